@@ -2,13 +2,18 @@ package commands
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -16,15 +21,14 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-idp/dns/cmd/dns/config"
 	"github.com/go-zoox/cli"
-	"github.com/go-zoox/dns"
-	"github.com/go-zoox/dns/client"
 	"github.com/go-zoox/fs/type/hosts"
 	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
 )
 
 // SystemHostsEntry represents an entry in the system hosts file
 type SystemHostsEntry struct {
-	IP          string
+	IPs         []string // IPv4 and IPv6 addresses, in file order
 	AliasTarget string
 	Domain      string
 	IsWildcard  bool
@@ -51,181 +55,190 @@ func isRegexPattern(pattern string) bool {
 }
 
 // parseSystemHostsFile parses a system hosts file with support for wildcard and regex patterns
-// Uses github.com/go-zoox/fs/type/hosts to parse the file, then enhances entries with pattern matching
-// Note: hostsParser.Mapping format is "domain:queryType" -> "IP" (e.g., "frontend:4" -> "10.1.0.169")
+// Each line is parsed with github.com/go-zoox/fs/type/hosts, then entries are merged per domain
+// (keeping every address, in file order) and enhanced with pattern matching
 func parseSystemHostsFile(filePath string) ([]SystemHostsEntry, error) {
-	hostsParser := hosts.New(filePath)
-	if err := hostsParser.Load(); err != nil {
+	file, err := os.Open(filePath)
+	if err != nil {
 		return nil, fmt.Errorf("failed to load hosts file: %w", err)
 	}
+	defer file.Close()
 
+	var domains []string                            // domains in order of first appearance
 	domainMap := make(map[string]*SystemHostsEntry) // Use map to merge entries for same domain
+	lines := 0
 
-	// Iterate through the hosts mapping
-	// Note: hostsParser.Mapping format is "domain:queryType" -> "IP" (e.g., "frontend:4" -> "10.1.0.169")
-	for key, ip := range hostsParser.Mapping {
-		// Parse the key format: "domain:queryType" or just "domain"
-		// Extract domain part (remove :4 or :6 suffix)
-		domain := key
-		if idx := strings.LastIndex(key, ":"); idx > 0 {
-			domain = key[:idx]
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
 		}
-		domain = strings.TrimSpace(domain)
-		if domain == "" {
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
+		host := &hosts.Host{}
+		if err := host.Parse(line); err != nil {
+			return nil, fmt.Errorf("failed to load hosts file: %w", err)
+		}
+		lines++
+
+		for _, domain := range host.Names {
+			domainLower := strings.ToLower(strings.TrimSpace(domain))
+
+			// Get or create entry for this domain
+			entry, exists := domainMap[domainLower]
+			if !exists {
+				// Try to determine if it's a regex pattern by attempting to compile it
+				isRegex := isRegexPattern(domain)
+				// Check if it contains wildcard (but not if it's already a regex)
+				isWildcard := !isRegex && strings.Contains(domain, "*")
+
+				entry = &SystemHostsEntry{
+					Domain:     domainLower,
+					IsWildcard: isWildcard,
+					IsRegex:    isRegex,
+				}
 
-		domainLower := strings.ToLower(domain)
-
-		// Get or create entry for this domain
-		entry, exists := domainMap[domainLower]
-		if !exists {
-			// Try to determine if it's a regex pattern by attempting to compile it
-			isRegex := isRegexPattern(domain)
-			// Check if it contains wildcard (but not if it's already a regex)
-			isWildcard := !isRegex && strings.Contains(domain, "*")
+				// Compile regex if it's a regex pattern
+				if isRegex {
+					compiled, err := regexp.Compile(domain)
+					if err != nil {
+						logger.Warn("Failed to compile regex pattern in hosts file: %s, error: %v", domain, err)
+						continue
+					}
+					entry.Regex = compiled
+				}
 
-			entry = &SystemHostsEntry{
-				Domain:     domainLower,
-				IsWildcard: isWildcard,
-				IsRegex:    isRegex,
+				domainMap[domainLower] = entry
+				domains = append(domains, domainLower)
 			}
 
 			// Support alias target in hosts file:
-			// if the value is not a valid IP, treat it as alias target domain.
-			if parsedIP := net.ParseIP(ip); parsedIP != nil {
-				entry.IP = ip
-			} else {
-				entry.AliasTarget = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(ip, ".")))
-			}
-
-			// Compile regex if it's a regex pattern
-			if isRegex {
-				compiled, err := regexp.Compile(domain)
-				if err != nil {
-					logger.Warn("Failed to compile regex pattern in hosts file: %s, error: %v", domain, err)
-					continue
+			// if the value is not a valid IP, treat it as alias target domain (the first one wins).
+			if parsedIP := net.ParseIP(host.IP); parsedIP != nil {
+				if !slices.Contains(entry.IPs, parsedIP.String()) {
+					entry.IPs = append(entry.IPs, parsedIP.String())
 				}
-				entry.Regex = compiled
+			} else if entry.AliasTarget == "" {
+				entry.AliasTarget = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(host.IP, ".")))
 			}
-
-			domainMap[domainLower] = entry
 		}
-		// If entry exists, we keep the first IP found (could be enhanced to support multiple IPs)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load hosts file: %w", err)
 	}
 
-	// Convert map to slice (deduplicated by domain)
-	uniqueEntries := make([]SystemHostsEntry, 0, len(domainMap))
-	for _, entry := range domainMap {
-		uniqueEntries = append(uniqueEntries, *entry)
+	uniqueEntries := make([]SystemHostsEntry, 0, len(domains))
+	for _, domain := range domains {
+		uniqueEntries = append(uniqueEntries, *domainMap[domain])
 	}
 
-	logger.Debugf("Parsed %d unique entries from hosts file %s (total mappings: %d)", len(uniqueEntries), filePath, len(hostsParser.Mapping))
+	logger.Debugf("Parsed %d unique entries from hosts file %s (total lines: %d)", len(uniqueEntries), filePath, lines)
 	return uniqueEntries, nil
 }
 
-// lookupSystemHosts looks up a domain in system hosts entries with wildcard and regex support
-func lookupSystemHosts(entries []SystemHostsEntry, domain string, queryType int) (string, error) {
-	domain = strings.ToLower(strings.TrimSpace(domain))
-	domainNoDot := strings.TrimSuffix(domain, ".")
+// HostPattern implements config.HostPattern so entries can be placed in a config.HostIndex.
+func (e *SystemHostsEntry) HostPattern() (string, bool, *regexp.Regexp) {
+	return e.Domain, e.IsWildcard, e.Regex
+}
 
-	logger.Debugf("Looking up domain: %s (no dot: %s), query type: %d, entries count: %d", domain, domainNoDot, queryType, len(entries))
+// HostAddresses implements config.HostAddresser so exact entries answer PTR queries.
+func (e *SystemHostsEntry) HostAddresses() []string {
+	return e.IPs
+}
 
-	// First try exact matches
-	for _, entry := range entries {
-		if !entry.IsWildcard && !entry.IsRegex {
-			logger.Debugf("Checking exact match: entry.Domain=%s, domain=%s, domainNoDot=%s", entry.Domain, domain, domainNoDot)
-			if entry.Domain == domain || entry.Domain == domainNoDot {
-				if entry.IP == "" {
-					continue
-				}
-				// Check if IP matches query type
-				if queryType == 4 && !config.IsIPv6(entry.IP) {
-					logger.Debugf("Found exact match: %s -> %s", entry.Domain, entry.IP)
-					return entry.IP, nil
-				} else if queryType == 6 && config.IsIPv6(entry.IP) {
-					logger.Debugf("Found exact match: %s -> %s", entry.Domain, entry.IP)
-					return entry.IP, nil
-				} else {
-					logger.Debugf("IP type mismatch: queryType=%d, isIPv6=%v, IP=%s", queryType, config.IsIPv6(entry.IP), entry.IP)
-				}
-			}
+// addresses returns the entry's addresses of one family (4 or 6).
+func (e *SystemHostsEntry) addresses(queryType int) []string {
+	var out []string
+	for _, ip := range e.IPs {
+		if (queryType == 6) == config.IsIPv6(ip) {
+			out = append(out, ip)
 		}
 	}
+	return out
+}
 
-	// Then try wildcard and regex patterns
-	for _, entry := range entries {
-		var matched bool
+// systemHosts is a parsed system hosts file together with its precompiled lookup index.
+type systemHosts struct {
+	entries []SystemHostsEntry
+	index   *config.HostIndex[*SystemHostsEntry]
+	// positions are the round-robin positions of entries with several addresses
+	// (systemHostsKey -> *atomic.Uint32); a reload starts them over.
+	positions sync.Map
+}
 
-		if entry.IsRegex && entry.Regex != nil {
-			matched = entry.Regex.MatchString(domain) || entry.Regex.MatchString(domainNoDot)
-			if matched {
-				logger.Debugf("Regex match: pattern=%s, domain=%s", entry.Domain, domain)
-			}
-		} else if entry.IsWildcard {
-			matched = config.MatchWildcard(domain, entry.Domain) || config.MatchWildcard(domainNoDot, entry.Domain)
-			if matched {
-				logger.Debugf("Wildcard match: pattern=%s, domain=%s", entry.Domain, domain)
-			}
-		}
+// systemHostsKey identifies the addresses of one family (4 or 6) of an entry.
+type systemHostsKey struct {
+	entry  *SystemHostsEntry
+	family int
+}
 
-		if matched {
-			if entry.IP == "" {
-				continue
-			}
-			// Check if IP matches query type
-			if queryType == 4 && !config.IsIPv6(entry.IP) {
-				return entry.IP, nil
-			} else if queryType == 6 && config.IsIPv6(entry.IP) {
-				return entry.IP, nil
-			}
-		}
+// newSystemHosts indexes entries for lookups.
+func newSystemHosts(entries []SystemHostsEntry) *systemHosts {
+	ptrs := make([]*SystemHostsEntry, len(entries))
+	for i := range entries {
+		ptrs[i] = &entries[i]
 	}
-
-	logger.Debugf("No match found for domain: %s", domain)
-	return "", fmt.Errorf("not found")
+	return &systemHosts{entries: entries, index: config.NewHostIndex(ptrs)}
 }
 
-// lookupSystemHostsAlias looks up alias target from system hosts entries.
-func lookupSystemHostsAlias(entries []SystemHostsEntry, domain string) (string, error) {
-	domain = strings.ToLower(strings.TrimSpace(domain))
-	domainNoDot := strings.TrimSuffix(domain, ".")
+// len returns the number of entries, safe on nil.
+func (s *systemHosts) len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.entries)
+}
 
-	// First try exact matches
-	for _, entry := range entries {
-		if !entry.IsWildcard && !entry.IsRegex {
-			if (entry.Domain == domain || entry.Domain == domainNoDot) && entry.AliasTarget != "" {
-				return entry.AliasTarget, nil
-			}
-		}
+// lookupSystemHosts looks up a domain in system hosts entries with wildcard and regex support.
+// It returns every address of the query's family (4 or 6) in file order.
+func lookupSystemHosts(hosts *systemHosts, domain string, queryType int) ([]string, error) {
+	entry, ok := lookupSystemHostsEntry(hosts, domain, queryType)
+	if !ok {
+		logger.Debugf("No match found for domain: %s", domain)
+		return nil, fmt.Errorf("not found")
 	}
 
-	// Then try wildcard and regex patterns
-	for _, entry := range entries {
-		var matched bool
+	ips := entry.addresses(queryType)
+	logger.Debugf("Found system hosts match: pattern=%s, domain=%s -> %v", entry.Domain, domain, ips)
+	return ips, nil
+}
 
-		if entry.IsRegex && entry.Regex != nil {
-			matched = entry.Regex.MatchString(domain) || entry.Regex.MatchString(domainNoDot)
-		} else if entry.IsWildcard {
-			matched = config.MatchWildcard(domain, entry.Domain) || config.MatchWildcard(domainNoDot, entry.Domain)
-		}
+// lookupSystemHostsEntry returns the entry answering domain with addresses of the
+// query's family (4 or 6).
+func lookupSystemHostsEntry(hosts *systemHosts, domain string, queryType int) (*SystemHostsEntry, bool) {
+	if hosts == nil {
+		return nil, false
+	}
+	return hosts.index.Find(domain, func(e *SystemHostsEntry) bool {
+		return len(e.addresses(queryType)) > 0
+	})
+}
 
-		if matched && entry.AliasTarget != "" {
-			return entry.AliasTarget, nil
-		}
+// lookupSystemHostsAlias looks up alias target from system hosts entries.
+func lookupSystemHostsAlias(hosts *systemHosts, domain string) (string, error) {
+	if hosts == nil {
+		return "", fmt.Errorf("not found")
 	}
 
-	return "", fmt.Errorf("not found")
+	entry, ok := hosts.index.Find(domain, func(e *SystemHostsEntry) bool { return e.AliasTarget != "" })
+	if !ok {
+		return "", fmt.Errorf("not found")
+	}
+	return entry.AliasTarget, nil
 }
 
-// isUpstreamNotFoundError checks if upstream returned DNS rcode 3 (Name Error/NXDOMAIN).
-// Some upstream clients expose this as an error string like "failed to query with code: 3".
-func isUpstreamNotFoundError(err error) bool {
-	if err == nil {
-		return false
+// lookupSystemHostsAddr returns the exact domains mapped to ip, sorted.
+func lookupSystemHostsAddr(hosts *systemHosts, ip net.IP) []string {
+	if hosts == nil {
+		return nil
 	}
-	message := strings.ToLower(err.Error())
-	return strings.Contains(message, "code: 3")
+	var domains []string
+	for _, entry := range hosts.index.Reverse(ip) {
+		domains = append(domains, entry.Domain)
+	}
+	return domains
 }
 
 // parseResolvConf parses /etc/resolv.conf and extracts nameserver entries
@@ -303,7 +316,7 @@ func parseResolvConf(resolvConfPath string, serverHost string) ([]string, error)
 }
 
 // reloadSystemHostsFile reloads the system hosts file and updates entries (lock-free read path via atomic.Value).
-func reloadSystemHostsFile(filePath string, hostsAtomic *atomic.Value) {
+func reloadSystemHostsFile(filePath string, hostsAtomic *atomic.Value, metrics *serverMetrics) error {
 	// Small delay to ensure file write is complete
 	time.Sleep(200 * time.Millisecond)
 
@@ -311,27 +324,41 @@ func reloadSystemHostsFile(filePath string, hostsAtomic *atomic.Value) {
 	newEntries, err := parseSystemHostsFile(filePath)
 	if err != nil {
 		logger.Warn("Failed to reload system hosts file %s: %v", filePath, err)
-		return
+		metrics.reloaded("system_hosts", false)
+		return fmt.Errorf("failed to reload system hosts file %s: %w", filePath, err)
 	}
+	metrics.reloaded("system_hosts", true)
 
 	oldAny := hostsAtomic.Load()
 	oldCount := 0
 	if oldAny != nil {
-		if old, ok := oldAny.([]SystemHostsEntry); ok {
-			oldCount = len(old)
+		if old, ok := oldAny.(*systemHosts); ok {
+			oldCount = old.len()
 		}
 	}
 	newCount := len(newEntries)
-	hostsAtomic.Store(newEntries)
+	hostsAtomic.Store(newSystemHosts(newEntries))
 
 	logger.Info("Successfully reloaded system hosts file: %s (entries: %d -> %d)", filePath, oldCount, newCount)
+	return nil
 }
 
 // watchSystemHostsFile watches for changes to the system hosts file and reloads it automatically
-func watchSystemHostsFile(filePath string, hostsAtomic *atomic.Value) {
+func watchSystemHostsFile(filePath string, hostsAtomic *atomic.Value, metrics *serverMetrics, done <-chan struct{}) {
+	watchFile(filePath, "system hosts file", done, func() {
+		_ = reloadSystemHostsFile(filePath, hostsAtomic, metrics)
+	}, func() {
+		hostsAtomic.Store(newSystemHosts(nil))
+		logger.Info("Cleared system hosts entries due to file removal")
+	})
+}
+
+// watchFile watches a file for changes and calls onChange when it is written or replaced,
+// or onRemove when it disappears, until done is closed. description is used in log messages.
+func watchFile(filePath, description string, done <-chan struct{}, onChange func(), onRemove func()) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		logger.Warn("Failed to create file watcher for hosts file: %v", err)
+		logger.Warn("Failed to create file watcher for %s: %v", description, err)
 		return
 	}
 	defer watcher.Close()
@@ -346,25 +373,27 @@ func watchSystemHostsFile(filePath string, hostsAtomic *atomic.Value) {
 		logger.Debugf("Cannot watch file directly, watching directory instead: %v", err)
 		// If direct file watch fails, watch the directory
 		if err := watcher.Add(dir); err != nil {
-			logger.Warn("Failed to watch directory %s for hosts file changes: %v", dir, err)
+			logger.Warn("Failed to watch directory %s for %s changes: %v", dir, description, err)
 			return
 		}
 	}
 
-	logger.Info("Watching system hosts file %s for changes (directory: %s)", filePath, dir)
+	logger.Info("Watching %s %s for changes (directory: %s)", description, filePath, dir)
 
 	for {
 		select {
+		case <-done:
+			return
 		case event, ok := <-watcher.Events:
 			if !ok {
-				logger.Warn("File watcher channel closed for hosts file")
+				logger.Warn("File watcher channel closed for %s", description)
 				return
 			}
 
 			// Log all events for debugging
 			logger.Debugf("File watcher event: %s, op: %v", event.Name, event.Op)
 
-			// Check if the event is for our hosts file
+			// Check if the event is for our file
 			// Compare both full path and filename (in case we're watching directory)
 			eventFileName := filepath.Base(event.Name)
 			isTargetFile := event.Name == filePath || eventFileName == fileName
@@ -374,26 +403,26 @@ func watchSystemHostsFile(filePath string, hostsAtomic *atomic.Value) {
 				// Note: On some systems, file updates (including vim) may trigger Rename events
 				// (when editors use atomic writes: create temp file, delete old, rename temp)
 				if event.Op&fsnotify.Write == fsnotify.Write {
-					logger.Info("Detected change in system hosts file: %s (write event)", filePath)
-					reloadSystemHostsFile(filePath, hostsAtomic)
+					logger.Info("Detected change in %s: %s (write event)", description, filePath)
+					onChange()
 				} else if event.Op&fsnotify.Create == fsnotify.Create {
-					logger.Info("Detected change in system hosts file: %s (create event)", filePath)
-					reloadSystemHostsFile(filePath, hostsAtomic)
+					logger.Info("Detected change in %s: %s (create event)", description, filePath)
+					onChange()
 				} else if event.Op&fsnotify.Rename == fsnotify.Rename {
 					// Rename event often occurs during file updates (atomic write pattern used by vim and other editors)
 					// Check if file still exists (file was likely renamed back to original name)
 					if _, err := os.Stat(filePath); err == nil {
-						logger.Info("Detected change in system hosts file: %s (file updated, reloading)", filePath)
-						reloadSystemHostsFile(filePath, hostsAtomic)
+						logger.Info("Detected change in %s: %s (file updated, reloading)", description, filePath)
+						// The watch followed the old inode; re-add it for the replacement file
+						_ = watcher.Add(filePath)
+						onChange()
 					} else {
-						logger.Warn("System hosts file %s was renamed and no longer exists", filePath)
-						hostsAtomic.Store([]SystemHostsEntry{})
-						logger.Info("Cleared system hosts entries due to file rename/removal")
+						logger.Warn("%s %s was renamed and no longer exists", description, filePath)
+						onRemove()
 					}
 				} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-					logger.Warn("System hosts file %s was removed", filePath)
-					hostsAtomic.Store([]SystemHostsEntry{})
-					logger.Info("Cleared system hosts entries due to file removal")
+					logger.Warn("%s %s was removed", description, filePath)
+					onRemove()
 				}
 			}
 		case err, ok := <-watcher.Errors:
@@ -401,7 +430,7 @@ func watchSystemHostsFile(filePath string, hostsAtomic *atomic.Value) {
 				logger.Warn("File watcher error channel closed")
 				return
 			}
-			logger.Warn("File watcher error for hosts file: %v", err)
+			logger.Warn("File watcher error for %s: %v", description, err)
 		}
 	}
 }
@@ -486,6 +515,18 @@ func NewServerCommand() *cli.Command {
 				Usage:   "Upstream DNS servers",
 				EnvVars: []string{"DNS_UPSTREAM"},
 			},
+			&cli.StringFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "How long to wait for in-flight queries on shutdown",
+				EnvVars: []string{"DNS_SHUTDOWN_TIMEOUT"},
+				Value:   "10s",
+			},
+			&cli.StringFlag{
+				Name:    "upstream-strategy",
+				Usage:   "Upstream selection strategy: failover, round_robin, random, fastest or parallel",
+				EnvVars: []string{"DNS_UPSTREAM_STRATEGY"},
+				Value:   "failover",
+			},
 			&cli.BoolFlag{
 				Name:    "disable-system-hosts",
 				Usage:   "Disable system hosts file lookup (enabled by default)",
@@ -497,6 +538,12 @@ func NewServerCommand() *cli.Command {
 				Value:   "/etc/hosts",
 				EnvVars: []string{"DNS_SYSTEM_HOSTS_FILE"},
 			},
+			&cli.StringFlag{
+				Name:    "system-hosts-order",
+				Usage:   "Order of the addresses of a system hosts name with several IPs: fixed, shuffle or round_robin",
+				Value:   config.HostsOrderFixed,
+				EnvVars: []string{"DNS_SYSTEM_HOSTS_ORDER"},
+			},
 			&cli.BoolFlag{
 				Name:    "disable-cache",
 				Usage:   "Disable in-memory response cache (enabled by default)",
@@ -505,13 +552,13 @@ func NewServerCommand() *cli.Command {
 			&cli.StringFlag{
 				Name:    "cache-ttl",
 				Value:   config.DNSCachePositiveTTLDefault,
-				Usage:   "TTL for cached answers that have IPs",
+				Usage:   "Maximum TTL for cached answers that have records (upstream TTLs are used below it)",
 				EnvVars: []string{"DNS_CACHE_POSITIVE_TTL"},
 			},
 			&cli.StringFlag{
 				Name:    "cache-negative-ttl",
 				Value:   config.DNSCacheNegativeTTLDefault,
-				Usage:   "TTL for cached empty / NXDOMAIN-style answers",
+				Usage:   "Maximum TTL for cached empty / NXDOMAIN-style answers",
 				EnvVars: []string{"DNS_CACHE_NEGATIVE_TTL"},
 			},
 			&cli.IntFlag{
@@ -520,6 +567,36 @@ func NewServerCommand() *cli.Command {
 				Usage:   "Maximum number of cache entries",
 				EnvVars: []string{"DNS_CACHE_MAX_ENTRIES"},
 			},
+			&cli.BoolFlag{
+				Name:    "dnssec",
+				Usage:   "Validate upstream answers with DNSSEC from the root trust anchors",
+				EnvVars: []string{"DNS_DNSSEC"},
+			},
+			&cli.BoolFlag{
+				Name:    "dns64",
+				Usage:   "Synthesize AAAA records from A records with the NAT64 prefix 64:ff9b::/96 (DNS64)",
+				EnvVars: []string{"DNS_DNS64"},
+			},
+			&cli.StringFlag{
+				Name:    "query-log",
+				Usage:   "Write a JSON line per query to this file, or to stdout with \"stdout\"",
+				EnvVars: []string{"DNS_QUERY_LOG"},
+			},
+			&cli.StringFlag{
+				Name:    "metrics-listen",
+				Usage:   "Expose Prometheus metrics on this address (e.g. 127.0.0.1:9153), disabled by default",
+				EnvVars: []string{"DNS_METRICS_LISTEN"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-listen",
+				Usage:   "Expose the admin HTTP API on this address (e.g. 127.0.0.1:9154), disabled by default",
+				EnvVars: []string{"DNS_ADMIN_LISTEN"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				Usage:   "Bearer token required by the admin HTTP API",
+				EnvVars: []string{"DNS_ADMIN_TOKEN"},
+			},
 		},
 		Action: func(ctx *cli.Context) error {
 			var cfg *config.Config
@@ -538,7 +615,6 @@ func NewServerCommand() *cli.Command {
 			// Get values from config file or command line flags (CLI flags override config)
 			port := ctx.Int("port")
 			host := ctx.String("host")
-			ttl := ctx.Uint("ttl")
 			enableDoT := ctx.Bool("dot")
 			dotPort := ctx.Int("dot-port")
 			enableDoH := ctx.Bool("doh")
@@ -547,7 +623,6 @@ func NewServerCommand() *cli.Command {
 			doqPort := ctx.Int("doq-port")
 			tlsCert := ctx.String("tls-cert")
 			tlsKey := ctx.String("tls-key")
-			upstreams := ctx.StringSlice("upstream")
 			disableSystemHosts := ctx.Bool("disable-system-hosts")
 			systemHostsFile := ctx.String("system-hosts-file")
 
@@ -559,9 +634,6 @@ func NewServerCommand() *cli.Command {
 				if host == "0.0.0.0" && cfg.Server.Host != "" {
 					host = cfg.Server.Host
 				}
-				if ttl == 500 && cfg.Server.TTL != 0 {
-					ttl = uint(cfg.Server.TTL)
-				}
 				if !enableDoT && cfg.DoT.Enabled {
 					enableDoT = cfg.DoT.Enabled
 				}
@@ -598,9 +670,6 @@ func NewServerCommand() *cli.Command {
 				if tlsKey == "" && cfg.DoQ.TLS.Key != "" {
 					tlsKey = cfg.DoQ.TLS.Key
 				}
-				if len(upstreams) == 0 && len(cfg.Upstream.Servers) > 0 {
-					upstreams = cfg.Upstream.Servers
-				}
 				// Merge system hosts config (CLI flags override config)
 				// System hosts is enabled by default, unless explicitly disabled
 				if !disableSystemHosts && cfg.SystemHosts.Disabled {
@@ -617,101 +686,86 @@ func NewServerCommand() *cli.Command {
 			} else if cfg != nil && !cfg.Cache.EffectiveCacheEnabled() {
 				cacheEnabled = false
 			}
-			cachePosTTL, err := time.ParseDuration(strings.TrimSpace(ctx.String("cache-ttl")))
-			if err != nil {
-				return fmt.Errorf("invalid --cache-ttl: %w", err)
-			}
-			cacheNegTTL, err := time.ParseDuration(strings.TrimSpace(ctx.String("cache-negative-ttl")))
-			if err != nil {
-				return fmt.Errorf("invalid --cache-negative-ttl: %w", err)
-			}
-			cacheMaxEntries := ctx.Int("cache-max-entries")
-			if cacheMaxEntries <= 0 {
-				cacheMaxEntries = config.DNSCacheMaxEntriesDefault
-			}
-			// Config overrides flag defaults unless the flag was set explicitly on the CLI.
-			if cfg != nil && cfg.Cache.EffectiveCacheEnabled() {
-				if !ctx.IsSet("cache-ttl") {
-					if d, err := time.ParseDuration(cfg.Cache.PositiveTTL); err == nil {
-						cachePosTTL = d
-					}
-				}
-				if !ctx.IsSet("cache-negative-ttl") {
-					if d, err := time.ParseDuration(cfg.Cache.NegativeTTL); err == nil {
-						cacheNegTTL = d
-					}
-				}
-				if !ctx.IsSet("cache-max-entries") && cfg.Cache.MaxEntries > 0 {
-					cacheMaxEntries = cfg.Cache.MaxEntries
-				}
-			}
 			var ansCache *dnsAnswerCache
 			if cacheEnabled {
+				cachePolicy, cacheServeStale, cacheMaxEntries, err := cacheSettings(ctx, cfg)
+				if err != nil {
+					return err
+				}
 				ansCache = newDNSAnswerCache(cacheMaxEntries)
-				logger.Info("DNS response cache enabled (positive_ttl=%v negative_ttl=%v max_entries=%d)", cachePosTTL, cacheNegTTL, cacheMaxEntries)
+				logger.Info("DNS response cache enabled (min_ttl=%v positive_ttl=%v negative_ttl=%v serve_stale=%v max_entries=%d)",
+					cachePolicy.minTTL, cachePolicy.maxTTL, cachePolicy.maxNegTTL, cacheServeStale, cacheMaxEntries)
 			}
 
-			// Default upstream: try to read from /etc/resolv.conf if still empty
-			if len(upstreams) == 0 {
-				resolvConfServers, err := parseResolvConf("/etc/resolv.conf", host)
-				if err != nil {
-					logger.Warn("Failed to read /etc/resolv.conf: %v, using default upstream", err)
-					upstreams = []string{"114.114.114.114:53"}
-				} else if len(resolvConfServers) > 0 {
-					upstreams = resolvConfServers
-					logger.Info("Loaded %d upstream DNS servers from /etc/resolv.conf: %v", len(upstreams), upstreams)
-				} else {
-					logger.Warn("No valid nameservers found in /etc/resolv.conf, using default upstream")
-					upstreams = []string{"114.114.114.114:53"}
+			// Prometheus metrics (CLI flag overrides config)
+			metricsListen := ctx.String("metrics-listen")
+			metricsPath := "/metrics"
+			if cfg != nil {
+				if metricsListen == "" && cfg.Metrics.Enabled {
+					metricsListen = cfg.Metrics.Listen
 				}
+				metricsPath = cfg.Metrics.Path
 			}
-
-			// Parse upstream timeout
-			upstreamTimeout := 5 * time.Second
-			if cfg != nil && cfg.Upstream.Timeout != "" {
-				if parsed, err := time.ParseDuration(cfg.Upstream.Timeout); err == nil {
-					upstreamTimeout = parsed
+			// The metrics and admin API listeners stop with the DNS server
+			var httpServers []*http.Server
+			defer func() {
+				for _, s := range httpServers {
+					s.Close()
 				}
+			}()
+
+			var metrics *serverMetrics
+			if metricsListen != "" {
+				metrics = newServerMetrics(ansCache)
+				metricsServer := metrics.httpServer(metricsListen, metricsPath)
+				httpServers = append(httpServers, metricsServer)
+				go serveHTTP(metricsServer, "metrics")
 			}
 
-			// Validate DoT, DoH, and DoQ configuration
-			if enableDoT || enableDoH || enableDoQ {
-				if tlsCert == "" || tlsKey == "" {
-					return fmt.Errorf("TLS certificate and key are required when DoT/DoH/DoQ is enabled (use --tls-cert and --tls-key or config file)")
+			// Admin API (CLI flags override config)
+			adminListen := ctx.String("admin-listen")
+			adminToken := ctx.String("admin-token")
+			if cfg != nil {
+				if adminListen == "" && cfg.Admin.Enabled {
+					adminListen = cfg.Admin.Listen
+				}
+				if adminToken == "" {
+					adminToken = cfg.Admin.Token
 				}
 			}
-
-			// Create upstream client
-			upstreamClient := dns.NewClient(&dns.ClientOptions{
-				Servers: upstreams,
-				Timeout: upstreamTimeout,
-			})
-
-			// Create server
-			serverOptions := &dns.ServerOptions{
-				Port:      port,
-				Host:      host,
-				TTL:       uint32(ttl),
-				EnableDoT: enableDoT,
-				EnableDoH: enableDoH,
-				EnableDoQ: enableDoQ,
+			if adminListen != "" && adminToken == "" {
+				return fmt.Errorf("an admin token is required when the admin API is enabled (use --admin-token or admin.token in the config file)")
 			}
 
-			if enableDoT {
-				serverOptions.DoTPort = dotPort
+			// Query log (CLI flag overrides config output)
+			queryLogCfg := config.QueryLogConfig{MaxSizeMB: 100, MaxBackups: 10}
+			if cfg != nil {
+				queryLogCfg = cfg.QueryLog
 			}
-			if enableDoH {
-				serverOptions.DoHPort = dohPort
+			if ctx.String("query-log") != "" {
+				queryLogCfg.Enabled = true
+				queryLogCfg.Output = ctx.String("query-log")
 			}
-			if enableDoQ {
-				serverOptions.DoQPort = doqPort
+			var queryLog *queryLogger
+			if queryLogCfg.Enabled {
+				queryLog, err = newQueryLogger(queryLogCfg)
+				if err != nil {
+					return fmt.Errorf("failed to open query log: %w", err)
+				}
+				defer queryLog.close()
+				logger.Info("Query log enabled (output: %s)", queryLogCfg.Output)
 			}
+
+			// Validate DoT, DoH, and DoQ configuration
 			if enableDoT || enableDoH || enableDoQ {
-				serverOptions.TLSCertFile = tlsCert
-				serverOptions.TLSKeyFile = tlsKey
+				if tlsCert == "" || tlsKey == "" {
+					return fmt.Errorf("TLS certificate and key are required when DoT/DoH/DoQ is enabled (use --tls-cert and --tls-key or config file)")
+				}
 			}
 
-			server := dns.NewServer(serverOptions)
+			// File watchers run until the server shuts down
+			stopWatchers := make(chan struct{})
+			defer close(stopWatchers)
 
 			// System hosts snapshot for lock-free reads on the query hot path (atomic.Value).
 			var systemHostsAtomic atomic.Value
@@ -719,165 +773,330 @@ func NewServerCommand() *cli.Command {
 				entries, err := parseSystemHostsFile(systemHostsFile)
 				if err != nil {
 					logger.Warn("Failed to load system hosts file %s: %v", systemHostsFile, err)
-					systemHostsAtomic.Store([]SystemHostsEntry{})
+					systemHostsAtomic.Store(newSystemHosts(nil))
 				} else {
-					systemHostsAtomic.Store(entries)
+					systemHostsAtomic.Store(newSystemHosts(entries))
 					logger.Info("Loaded system hosts file: %s (with wildcard/regex support, %d entries)", systemHostsFile, len(entries))
 					for i, entry := range entries {
 						if i < 5 {
-							logger.Debugf("System hosts entry %d: %s -> %s (wildcard: %v, regex: %v)", i, entry.Domain, entry.IP, entry.IsWildcard, entry.IsRegex)
+							logger.Debugf("System hosts entry %d: %s -> %v (wildcard: %v, regex: %v)", i, entry.Domain, entry.IPs, entry.IsWildcard, entry.IsRegex)
 						}
 					}
 				}
-				go watchSystemHostsFile(systemHostsFile, &systemHostsAtomic)
+				go watchSystemHostsFile(systemHostsFile, &systemHostsAtomic, metrics, stopWatchers)
 			} else {
-				systemHostsAtomic.Store([]SystemHostsEntry{})
+				systemHostsAtomic.Store(newSystemHosts(nil))
 			}
 
-			// Handler order:
-			// 1. Config hosts (static IP)
-			// 2. System hosts (static IP)
-			// 3. Response cache (upstream-derived answers only)
-			// 4. Config alias -> upstream
-			// 5. System hosts alias -> upstream
-			// 6. Upstream
-			server.Handle(func(hostname string, typ int) ([]string, error) {
-				queryType := "A"
-				if typ == 6 {
-					queryType = "AAAA"
+			// Current handler, swapped atomically when the config file or filter lists are reloaded.
+			var handlerAtomic atomic.Value
+			filterWatcher := newFilterListWatcher(&handlerAtomic, stopWatchers)
+
+			// Temporary host overrides added through the admin API survive reloads.
+			overrides := newHostOverrides()
+			// Upstream lookups in flight, shared by identical queries across reloads like the cache.
+			inflight := newLookupCoalescer()
+			// Health of the addresses of health-checked hosts, so that reloads keep down ones out.
+			hostHealthState := newHostHealthState()
+
+			// buildHandler derives the reloadable part of the server (hosts, alias, zones,
+			// filter, upstreams, cache TTLs) from a loaded config; CLI flags still take precedence.
+			// It leaves the running server untouched: the handler applies its shared
+			// settings when activated.
+			buildHandler := func(cfg *config.Config) (_ *queryHandler, err error) {
+				ttl := ctx.Uint("ttl")
+				if cfg != nil && ttl == 500 && cfg.Server.TTL != 0 {
+					ttl = uint(cfg.Server.TTL)
 				}
-				logger.Debugf("DNS query received: %s (type: %s, code: %d)", hostname, queryType, typ)
 
-				if cfg != nil {
-					ips, err := cfg.LookupHost(hostname, typ)
-					if err == nil && len(ips) > 0 {
-						logger.Debugf("[channel: config.hosts] Resolved %s (%s) from config hosts -> %v", hostname, queryType, ips)
-						return ips, nil
+				upstreams := ctx.StringSlice("upstream")
+				if cfg != nil && len(upstreams) == 0 && len(cfg.Upstream.Servers) > 0 {
+					upstreams = cfg.Upstream.Servers
+				}
+				// Default upstream: try to read from /etc/resolv.conf if still empty
+				if len(upstreams) == 0 {
+					resolvConfServers, err := parseResolvConf("/etc/resolv.conf", host)
+					if err != nil {
+						logger.Warn("Failed to read /etc/resolv.conf: %v, using default upstream", err)
+						upstreams = []string{"114.114.114.114:53"}
+					} else if len(resolvConfServers) > 0 {
+						upstreams = resolvConfServers
+						logger.Info("Loaded %d upstream DNS servers from /etc/resolv.conf: %v", len(upstreams), upstreams)
+					} else {
+						logger.Warn("No valid nameservers found in /etc/resolv.conf, using default upstream")
+						upstreams = []string{"114.114.114.114:53"}
 					}
-				} else {
-					logger.Debugf("Config hosts not available, skipping config static hosts")
 				}
 
-				var entries []SystemHostsEntry
-				if v := systemHostsAtomic.Load(); v != nil {
-					if s, ok := v.([]SystemHostsEntry); ok {
-						entries = s
+				// Parse upstream timeout
+				upstreamTimeout := 5 * time.Second
+				if cfg != nil && cfg.Upstream.Timeout != "" {
+					if parsed, err := time.ParseDuration(cfg.Upstream.Timeout); err == nil {
+						upstreamTimeout = parsed
+					}
+				}
+
+				cachePolicy, cacheServeStale, cacheMaxEntries, err := cacheSettings(ctx, cfg)
+				if err != nil {
+					return nil, err
+				}
+
+				systemHostsOrder := ctx.String("system-hosts-order")
+				if cfg != nil && !ctx.IsSet("system-hosts-order") {
+					systemHostsOrder = cfg.SystemHosts.Order
+				}
+				hostsOrder, err := newAddressOrder(systemHostsOrder)
+				if err != nil {
+					return nil, fmt.Errorf("invalid system hosts order: %w", err)
+				}
+
+				var queryACL, recursionACL *aclList
+				if cfg != nil {
+					if queryACL, err = newACLList(cfg.ACL.Query); err != nil {
+						return nil, fmt.Errorf("invalid acl.query: %w", err)
+					}
+					if recursionACL, err = newACLList(cfg.ACL.Recursion); err != nil {
+						return nil, fmt.Errorf("invalid acl.recursion: %w", err)
 					}
 				}
-				var sysHostsLookupErr error
-				if len(entries) > 0 {
-					logger.Debugf("Checking system hosts for %s (%s), total entries: %d", hostname, queryType, len(entries))
-					ip, err := lookupSystemHosts(entries, hostname, typ)
-					sysHostsLookupErr = err
-					if err == nil && ip != "" {
-						logger.Debugf("[channel: system.hosts] Resolved %s (%s) from system hosts -> %v", hostname, queryType, []string{ip})
-						return []string{ip}, nil
+				var rateLimit *rateLimiter
+				if cfg != nil {
+					if rateLimit, err = newRateLimiter(cfg.RateLimit); err != nil {
+						return nil, fmt.Errorf("invalid rate_limit: %w", err)
 					}
-				} else {
-					logger.Debugf("System hosts not enabled or empty, skipping system static hosts")
 				}
 
-				ck := dnsCacheKey(hostname, typ)
-				now := time.Now()
-				if ansCache != nil {
-					if ips, hit := ansCache.get(now, ck); hit {
-						logger.Debugf("[cache] hit for %s (%s)", hostname, queryType)
-						return ips, nil
+				var dnssecCfg config.DNSSECConfig
+				if cfg != nil {
+					dnssecCfg = cfg.DNSSEC
+				}
+				dnssecCfg.Validate = dnssecCfg.Validate || ctx.Bool("dnssec")
+				validator, err := newDNSSECValidator(dnssecCfg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid dnssec: %w", err)
+				}
+
+				var dns64Cfg config.DNS64Config
+				if cfg != nil {
+					dns64Cfg = cfg.DNS64
+				}
+				dns64Cfg.Enabled = dns64Cfg.Enabled || ctx.Bool("dns64")
+				dns64, err := newDNS64(dns64Cfg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid dns64: %w", err)
+				}
+
+				var zones *zoneSet
+				if cfg != nil && len(cfg.Zones) > 0 {
+					zones, err = loadZones(cfg.Zones)
+					if err != nil {
+						return nil, fmt.Errorf("failed to load zones: %w", err)
 					}
 				}
 
+				signer, err := newDNSSECSigner(dnssecCfg.Sign, zones, uint32(ttl))
+				if err != nil {
+					return nil, fmt.Errorf("failed to load dnssec keys: %w", err)
+				}
+
+				var filter *dnsFilter
 				if cfg != nil {
-					aliasTarget, aliasErr := cfg.LookupAlias(hostname)
-					if aliasErr == nil && aliasTarget != "" {
-						logger.Debugf("Config alias match for %s (%s): %s, querying upstream", hostname, queryType, aliasTarget)
-						aliasIPs, upstreamErr := upstreamClient.LookUp(aliasTarget, &client.LookUpOptions{
-							Typ: typ,
-						})
-						if upstreamErr == nil && len(aliasIPs) > 0 {
-							logger.Debugf("[channel: config.alias] Resolved %s (%s) via alias %s -> %v", hostname, queryType, aliasTarget, aliasIPs)
-							if ansCache != nil {
-								ansCache.set(time.Now(), ck, aliasIPs, false, cachePosTTL)
-							}
-							return aliasIPs, nil
-						}
-						if isUpstreamNotFoundError(upstreamErr) {
-							logger.Debugf("Alias target %s has no %s record, returning empty answer", aliasTarget, queryType)
-							if ansCache != nil {
-								ansCache.set(time.Now(), ck, nil, true, cacheNegTTL)
-							}
-							return []string{}, nil
-						}
-						logger.Warn("Failed to resolve alias target %s for %s (%s): %v", aliasTarget, hostname, queryType, upstreamErr)
+					filter, err = loadDNSFilter(cfg.Filter)
+					if err != nil {
+						return nil, fmt.Errorf("failed to load filter: %w", err)
 					}
-					logger.Debugf("No match found in config hosts/alias for %s (%s)", hostname, queryType)
-				}
-
-				if len(entries) > 0 {
-					aliasTarget, aliasErr := lookupSystemHostsAlias(entries, hostname)
-					if aliasErr == nil && aliasTarget != "" {
-						logger.Debugf("System hosts alias match for %s (%s): %s, querying upstream", hostname, queryType, aliasTarget)
-						aliasIPs, upstreamErr := upstreamClient.LookUp(aliasTarget, &client.LookUpOptions{
-							Typ: typ,
-						})
-						if upstreamErr == nil && len(aliasIPs) > 0 {
-							logger.Debugf("[channel: system.alias] Resolved %s (%s) via alias %s -> %v", hostname, queryType, aliasTarget, aliasIPs)
-							if ansCache != nil {
-								ansCache.set(time.Now(), ck, aliasIPs, false, cachePosTTL)
-							}
-							return aliasIPs, nil
-						}
-						if isUpstreamNotFoundError(upstreamErr) {
-							logger.Debugf("System alias target %s has no %s record, returning empty answer", aliasTarget, queryType)
-							if ansCache != nil {
-								ansCache.set(time.Now(), ck, nil, true, cacheNegTTL)
-							}
-							return []string{}, nil
+				}
+
+				// Create upstream resolvers, routed per domain, with their selection strategy
+				// and health checks
+				var routes []config.UpstreamRoute
+				upstreamOpts := upstreamOptions{
+					metrics:  metrics,
+					timeout:  upstreamTimeout,
+					strategy: ctx.String("upstream-strategy"),
+					health:   healthCheckOptions{interval: 10 * time.Second},
+					dnssec:   validator != nil,
+				}
+				if cfg != nil {
+					routes = cfg.Upstream.Routes
+					if !ctx.IsSet("upstream-strategy") {
+						upstreamOpts.strategy = cfg.Upstream.Strategy
+					}
+					hc := cfg.Upstream.HealthCheck
+					upstreamOpts.health = healthCheckOptions{domain: hc.Domain, failThreshold: hc.FailThreshold}
+					if hc.EffectiveEnabled() {
+						if upstreamOpts.health.interval, err = time.ParseDuration(hc.Interval); err != nil {
+							return nil, fmt.Errorf("invalid upstream.health_check.interval: %w", err)
 						}
-						logger.Warn("Failed to resolve system alias target %s for %s (%s): %v", aliasTarget, hostname, queryType, upstreamErr)
 					}
-					logger.Debugf("No match found in system hosts for %s (%s), error: %v", hostname, queryType, sysHostsLookupErr)
 				}
-
-				logger.Debugf("Querying upstream DNS servers for %s (%s)", hostname, queryType)
-				ips, err := upstreamClient.LookUp(hostname, &client.LookUpOptions{
-					Typ: typ,
-				})
+				upstreamRouter, err := newUpstreamRouter(upstreams, routes, upstreamOpts)
 				if err != nil {
-					if isUpstreamNotFoundError(err) {
-						logger.Debugf("Upstream returned not found for %s (%s), returning empty answer", hostname, queryType)
-						if ansCache != nil {
-							ansCache.set(time.Now(), ck, nil, true, cacheNegTTL)
-						}
-						return []string{}, nil
+					return nil, fmt.Errorf("failed to create upstream resolver: %w", err)
+				}
+				defer func() {
+					if err != nil {
+						upstreamRouter.close()
 					}
-					logger.Error("Failed to resolve %s (%s) from upstream: %v", hostname, queryType, err)
-					return nil, err
+				}()
+
+				var prefetch *cachePrefetcher
+				if cfg != nil && ansCache != nil {
+					prefetch = newCachePrefetcher(cfg.Cache.Prefetch)
 				}
 
-				if len(ips) > 0 {
-					logger.Debugf("[channel: upstream] Resolved %s (%s) from upstream -> %v", hostname, queryType, ips)
-					if ansCache != nil {
-						ansCache.set(time.Now(), ck, ips, false, cachePosTTL)
-					}
-				} else {
-					logger.Debugf("No results found for %s (%s) from upstream", hostname, queryType)
-					if ansCache != nil {
-						ansCache.set(time.Now(), ck, nil, true, cacheNegTTL)
+				// The effective config, as dumped by the admin API, is the config file
+				// with the values CLI flags override.
+				effectiveCfg := &config.Config{}
+				if cfg != nil {
+					if effectiveCfg, err = cfg.Clone(); err != nil {
+						return nil, err
 					}
 				}
-				return ips, nil
-			})
+				effectiveCfg.Server.Host, effectiveCfg.Server.Port, effectiveCfg.Server.TTL = host, port, uint32(ttl)
+				effectiveCfg.DoT.Enabled, effectiveCfg.DoT.Port = enableDoT, dotPort
+				effectiveCfg.DoH.Enabled, effectiveCfg.DoH.Port = enableDoH, dohPort
+				effectiveCfg.DoQ.Enabled, effectiveCfg.DoQ.Port = enableDoQ, doqPort
+				tls := config.TLSConfig{Cert: tlsCert, Key: tlsKey}
+				effectiveCfg.DoT.TLS, effectiveCfg.DoH.TLS, effectiveCfg.DoQ.TLS = tls, tls, tls
+				effectiveCfg.SystemHosts = config.SystemHostsConfig{Disabled: disableSystemHosts, FilePath: systemHostsFile, Order: systemHostsOrder}
+				effectiveCfg.Upstream.Servers = upstreams
+				effectiveCfg.Upstream.Strategy = upstreamOpts.strategy
+				effectiveCfg.Upstream.Timeout = upstreamTimeout.String()
+				effectiveCfg.Cache.Enabled = &cacheEnabled
+				if cacheEnabled {
+					effectiveCfg.Cache.PositiveTTL = cachePolicy.maxTTL.String()
+					effectiveCfg.Cache.NegativeTTL = cachePolicy.maxNegTTL.String()
+					effectiveCfg.Cache.MinTTL = cachePolicy.minTTL.String()
+					effectiveCfg.Cache.MaxEntries = cacheMaxEntries
+				}
+				effectiveCfg.Metrics.Enabled, effectiveCfg.Metrics.Listen = metricsListen != "", metricsListen
+				effectiveCfg.Admin = config.AdminConfig{Enabled: adminListen != "", Listen: adminListen, Token: adminToken}
+				effectiveCfg.QueryLog = queryLogCfg
+				effectiveCfg.DNSSEC.Validate = dnssecCfg.Validate
+				effectiveCfg.DNS64.Enabled = dns64Cfg.Enabled
+				if effectiveCfg.DNS64.Prefix == "" {
+					effectiveCfg.DNS64.Prefix = config.DNS64PrefixDefault
+				}
 
-			// Handle graceful shutdown
-			sigChan := make(chan os.Signal, 1)
-			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+				views, err := loadViews(cfg, upstreamOpts)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load views: %w", err)
+				}
 
-			go func() {
-				<-sigChan
-				logger.Info("Shutting down DNS server...")
-				os.Exit(0)
+				hostHealth, err := startHostHealthChecker(hostHealthState, append([]*config.Config{cfg}, views.hostsConfigs()...)...)
+				if err != nil {
+					views.close()
+					return nil, fmt.Errorf("failed to start host health checks: %w", err)
+				}
+
+				return &queryHandler{
+					cfg:              cfg,
+					zones:            zones,
+					systemHosts:      &systemHostsAtomic,
+					filter:           filter,
+					cache:            ansCache,
+					metrics:          metrics,
+					queryLog:         queryLog,
+					upstream:         upstreamRouter,
+					ttl:              uint32(ttl),
+					cachePolicy:      cachePolicy,
+					prefetch:         prefetch,
+					overrides:        overrides,
+					systemHostsOrder: hostsOrder,
+					hostHealth:       hostHealth,
+					hostHealthState:  hostHealthState,
+					views:            views,
+					queryACL:         queryACL,
+					recursionACL:     recursionACL,
+					rateLimit:        rateLimit,
+					inflight:         inflight,
+					dnssec:           validator,
+					signer:           signer,
+					dns64:            dns64,
+					cacheMaxEntries:  cacheMaxEntries,
+					cacheServeStale:  cacheServeStale,
+					filterWatcher:    filterWatcher,
+					effectiveCfg:     effectiveCfg,
+				}, nil
+			}
+
+			handler, err := buildHandler(cfg)
+			if err != nil {
+				return err
+			}
+
+			handlerAtomic.Store(handler)
+			handler.activate()
+			defer func() {
+				h := handlerAtomic.Load().(*queryHandler)
+				h.hostHealth.stop()
+				h.upstream.close()
+				h.views.close()
 			}()
 
+			// Warm the cache from the last snapshot and keep saving it
+			if ansCache != nil && cfg != nil && cfg.Cache.PersistFile != "" {
+				persistInterval, err := parseOptionalDuration(cfg.Cache.PersistInterval)
+				if err != nil {
+					return fmt.Errorf("invalid cache.persist_interval: %w", err)
+				}
+				if n, err := ansCache.load(cfg.Cache.PersistFile, time.Now()); err != nil {
+					logger.Warn("Starting with an empty DNS cache: %v", err)
+				} else {
+					logger.Info("Restored %d DNS cache entries from %s", n, cfg.Cache.PersistFile)
+				}
+				cachePersist := startCachePersister(ansCache, cfg.Cache.PersistFile, persistInterval)
+				defer cachePersist.stop()
+			}
+			if configPath != "" {
+				go watchConfigFile(configPath, buildHandler, &handlerAtomic, stopWatchers)
+			}
+
+			// reloadAll re-reads the config file, system hosts and filter lists, on SIGHUP
+			// or through the admin API.
+			reloadAll := func() error {
+				var errs []error
+				if configPath != "" {
+					errs = append(errs, reloadConfigFile(configPath, buildHandler, &handlerAtomic))
+				}
+				if !disableSystemHosts {
+					errs = append(errs, reloadSystemHostsFile(systemHostsFile, &systemHostsAtomic, metrics))
+				}
+				errs = append(errs, filterWatcher.reload())
+				return errors.Join(errs...)
+			}
+
+			if adminListen != "" {
+				admin := &adminServer{
+					token:         adminToken,
+					handlerAtomic: &handlerAtomic,
+					overrides:     overrides,
+					reload:        reloadAll,
+				}
+				adminServer := admin.httpServer(adminListen)
+				httpServers = append(httpServers, adminServer)
+				go serveHTTP(adminServer, "admin API")
+			}
+
+			server, err := newDNSServer(&dnsServerOptions{
+				Host:        host,
+				Port:        port,
+				EnableDoT:   enableDoT,
+				DoTPort:     dotPort,
+				EnableDoH:   enableDoH,
+				DoHPort:     dohPort,
+				EnableDoQ:   enableDoQ,
+				DoQPort:     doqPort,
+				TLSCertFile: tlsCert,
+				TLSKeyFile:  tlsKey,
+			}, func(req *dnsRequest) *mdns.Msg {
+				return handlerAtomic.Load().(*queryHandler).serveDNS(req)
+			})
+			if err != nil {
+				return err
+			}
+
 			// Start server
 			protocols := []string{"UDP/TCP"}
 			if enableDoT {
@@ -891,9 +1110,40 @@ func NewServerCommand() *cli.Command {
 			}
 			logger.Info("Starting DNS server on %s:%d (%s)", host, port, strings.Join(protocols, ", "))
 
-			server.Serve()
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- server.serve()
+			}()
+
+			// SIGHUP reloads config, hosts and filter lists; SIGINT/SIGTERM stop the listeners,
+			// drain in-flight queries and return so deferred cleanup (watchers, upstreams, cache
+			// snapshot, query log) runs.
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			defer signal.Stop(sigChan)
+			for {
+				select {
+				case err := <-serveErr:
+					return err
+				case sig := <-sigChan:
+					if sig == syscall.SIGHUP {
+						logger.Info("Received SIGHUP, reloading")
+						_ = reloadAll()
+						continue
+					}
 
-			return nil
+					timeout := shutdownTimeout(ctx, handlerAtomic.Load().(*queryHandler).cfg)
+					logger.Info("Received %s, shutting down DNS server (draining for up to %v)...", sig, timeout)
+					shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+					err := errors.Join(server.shutdown(shutdownCtx), shutdownHTTPServers(shutdownCtx, httpServers))
+					cancel()
+					if err != nil {
+						logger.Warn("DNS server did not shut down cleanly: %v", err)
+					}
+					logger.Info("DNS server stopped")
+					return nil
+				}
+			}
 		},
 	}
 }
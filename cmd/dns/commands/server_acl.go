@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// aclList decides the action for a query from the rules of a config ACL list. A nil
+// *aclList allows every query.
+type aclList struct {
+	def   string
+	rules []aclRule
+}
+
+type aclRule struct {
+	match   config.ClientMatch
+	clients []netip.Prefix
+	action  string
+}
+
+// newACLList compiles cfg, or returns nil when it allows every query.
+func newACLList(cfg config.ACLList) (*aclList, error) {
+	l := &aclList{def: cfg.Default}
+	if l.def == "" {
+		l.def = config.ACLAllow
+	}
+	for i, rule := range cfg.Rules {
+		clients, err := rule.ClientPrefixes()
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		l.rules = append(l.rules, aclRule{match: rule.ClientMatch, clients: clients, action: rule.Action})
+	}
+	if l.def == config.ACLAllow && len(l.rules) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// aclResult is the answer to a question denied with a config.ACLRefuse or ACLDrop
+// action; serveDNS sends no response for the "acl.drop" channel.
+func aclResult(action string) *dnsResult {
+	if action == config.ACLDrop {
+		return &dnsResult{rcode: mdns.RcodeRefused, channel: "acl.drop"}
+	}
+	return &dnsResult{rcode: mdns.RcodeRefused, channel: "acl"}
+}
+
+// action returns the config.ACL* action for a query from client over protocol.
+func (l *aclList) action(client net.IP, protocol string) string {
+	if l == nil {
+		return config.ACLAllow
+	}
+	for _, rule := range l.rules {
+		if rule.match.Matches(rule.clients, client, protocol) {
+			return rule.action
+		}
+	}
+	return l.def
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func TestQueryHandlerACL(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{
+		Hosts: config.HostsConfig{"git.example.com": "10.0.0.20"},
+		ACL: config.ACLConfig{
+			Query: config.ACLList{Default: config.ACLAllow, Rules: []config.ACLRule{
+				{ClientMatch: config.ClientMatch{Clients: []string{"198.51.100.0/24"}}, Action: config.ACLDrop},
+				{ClientMatch: config.ClientMatch{Clients: []string{"203.0.113.0/24"}, Protocols: []string{"udp"}}, Action: config.ACLRefuse},
+			}},
+			Recursion: config.ACLList{Default: config.ACLRefuse, Rules: []config.ACLRule{
+				{ClientMatch: config.ClientMatch{Clients: []string{"10.0.0.0/8"}}, Action: config.ACLAllow},
+			}},
+		},
+	}
+	h := newTestHandler(t, cfg, startAnsweringUpstream(t, "93.184.216.34"))
+	var err error
+	if h.queryACL, err = newACLList(cfg.ACL.Query); err != nil {
+		t.Fatal(err)
+	}
+	if h.recursionACL, err = newACLList(cfg.ACL.Recursion); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := h.serveDNS(viewQuery("git.example.com", mdns.TypeA, "198.51.100.1", "udp")); reply != nil {
+		t.Fatalf("dropped client got %v", reply)
+	}
+	if reply := h.serveDNS(viewQuery("git.example.com", mdns.TypeA, "203.0.113.1", "udp")); reply.Rcode != mdns.RcodeRefused {
+		t.Fatalf("refused client got rcode %s", mdns.RcodeToString[reply.Rcode])
+	}
+
+	// Over DoH the same client may query, but only local names
+	public := func(name string) *mdns.Msg { return h.serveDNS(viewQuery(name, mdns.TypeA, "203.0.113.1", "doh")) }
+	if reply := public("git.example.com"); firstA(t, reply) != "10.0.0.20" || reply.RecursionAvailable {
+		t.Fatalf("public client local answer = %v", reply)
+	}
+	if reply := public("www.example.com"); reply.Rcode != mdns.RcodeRefused || len(reply.Answer) != 0 {
+		t.Fatalf("public client got a recursive answer: %v", reply)
+	}
+
+	// Internal clients recurse; their cached answers are not served to others
+	if reply := h.serveDNS(viewQuery("www.example.com", mdns.TypeA, "10.1.2.3", "udp")); firstA(t, reply) != "93.184.216.34" || !reply.RecursionAvailable {
+		t.Fatalf("internal client answer = %v", reply)
+	}
+	if _, hit := h.cache.get(time.Now(), dnsCacheKey("www.example.com", mdns.TypeA)); !hit {
+		t.Fatal("expected the internal answer to be cached")
+	}
+	if reply := public("www.example.com"); reply.Rcode != mdns.RcodeRefused {
+		t.Fatalf("public client got a cached answer: %v", reply)
+	}
+}
+
+func TestDNSServerDropsNilReplies(t *testing.T) {
+	t.Parallel()
+	s, _ := startTestServer(t, func(req *dnsRequest) *mdns.Msg { return nil })
+	t.Cleanup(func() { s.shutdown(t.Context()) })
+
+	m := new(mdns.Msg)
+	m.SetQuestion("example.com.", mdns.TypeA)
+	for _, network := range []string{"udp", "tcp"} {
+		client := &mdns.Client{Net: network, Timeout: 300 * time.Millisecond}
+		if reply, _, err := client.Exchange(m, s.Addr()); err == nil {
+			t.Errorf("%s: expected no response, got %v", network, reply)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+)
+
+// addressOrder orders the addresses answered for a hosts entry with several IPs.
+// A nil *addressOrder keeps the listed order.
+type addressOrder struct {
+	order string // config.HostsOrder*
+}
+
+func newAddressOrder(order string) (*addressOrder, error) {
+	switch order {
+	case "", config.HostsOrderFixed:
+		return nil, nil
+	case config.HostsOrderShuffle, config.HostsOrderRoundRobin:
+		return &addressOrder{order: order}, nil
+	}
+	return nil, fmt.Errorf("unsupported hosts order %q", order)
+}
+
+// apply returns ips in the order of the next response for key, the entry and address
+// family they were found for. Round-robin positions are kept in positions (key ->
+// *atomic.Uint32), which holds at most one position per key. ips is not modified.
+func (o *addressOrder) apply(positions *sync.Map, key any, ips []string) []string {
+	if o == nil || len(ips) < 2 {
+		return ips
+	}
+	var next *atomic.Uint32
+	if o.order == config.HostsOrderRoundRobin {
+		v, ok := positions.Load(key)
+		if !ok {
+			v, _ = positions.LoadOrStore(key, new(atomic.Uint32))
+		}
+		next = v.(*atomic.Uint32)
+	}
+	return config.OrderAddresses(ips, o.order, next, nil)
+}
@@ -0,0 +1,57 @@
+package commands
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+)
+
+func TestAddressOrder(t *testing.T) {
+	t.Parallel()
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	var positions sync.Map
+
+	fixed, err := newAddressOrder(config.HostsOrderFixed)
+	if err != nil || !slices.Equal(fixed.apply(&positions, "a", ips), ips) {
+		t.Fatalf("fixed order changed the addresses: %v", err)
+	}
+
+	rr, err := newAddressOrder(config.HostsOrderRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		if got := rr.apply(&positions, "a", ips); got[0] != want || len(got) != 3 {
+			t.Fatalf("round robin = %v, want %s first", got, want)
+		}
+	}
+	if got := rr.apply(&positions, "b", ips); got[0] != "10.0.0.1" {
+		t.Fatalf("round robin positions must be per key, got %v", got)
+	}
+
+	shuffle, err := newAddressOrder(config.HostsOrderShuffle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		got := shuffle.apply(&positions, "a", ips)
+		sorted := slices.Sorted(slices.Values(got))
+		if !slices.Equal(sorted, ips) {
+			t.Fatalf("shuffle lost addresses: %v", got)
+		}
+		seen[got[0]] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("shuffle always answered %v first", seen)
+	}
+	if !slices.Equal(ips, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}) {
+		t.Fatalf("apply modified its input: %v", ips)
+	}
+
+	if _, err := newAddressOrder("weighted"); err == nil {
+		t.Fatal("expected an error for an unknown order")
+	}
+}
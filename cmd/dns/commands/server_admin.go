@@ -0,0 +1,413 @@
+package commands
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// hostOverrideTTL is the TTL of answers built from host overrides, kept short so
+// clients pick up removal of an override quickly.
+const hostOverrideTTL = 10
+
+// hostOverride is a temporary A/AAAA mapping added through the admin API.
+type hostOverride struct {
+	Domain  string     `json:"domain"`
+	IPs     []string   `json:"ips"`
+	Expires *time.Time `json:"expires,omitempty"` // nil = until removed or restart
+}
+
+// hostOverrides holds the temporary host mappings. They are kept in memory only and
+// take precedence over every other source. A nil *hostOverrides has no entries.
+type hostOverrides struct {
+	mu      sync.RWMutex
+	entries map[string]*hostOverride
+}
+
+func newHostOverrides() *hostOverrides {
+	return &hostOverrides{entries: make(map[string]*hostOverride)}
+}
+
+// lookup returns the override of hostname (lowercased, without trailing dot).
+func (o *hostOverrides) lookup(now time.Time, hostname string) (*hostOverride, bool) {
+	if o == nil {
+		return nil, false
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	e := o.entries[hostname]
+	if e == nil || (e.Expires != nil && now.After(*e.Expires)) {
+		return nil, false
+	}
+	return e, true
+}
+
+// result answers qtype from the override: the addresses of the query's family, or an
+// empty answer when the override has none of that family.
+func (e *hostOverride) result(hostname string, qtype uint16) *dnsResult {
+	res := &dnsResult{channel: "override"}
+	for _, ip := range e.IPs {
+		if (qtype == mdns.TypeAAAA) == strings.Contains(ip, ":") {
+			res.answer = append(res.answer, newAddressRR(hostname, ip, hostOverrideTTL))
+		}
+	}
+	return res
+}
+
+func (o *hostOverrides) set(e *hostOverride) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries[e.Domain] = e
+}
+
+func (o *hostOverrides) remove(domain string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.entries[domain]; !ok {
+		return false
+	}
+	delete(o.entries, domain)
+	return true
+}
+
+// list returns the overrides that have not expired, sorted by domain.
+func (o *hostOverrides) list(now time.Time) []*hostOverride {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	out := make([]*hostOverride, 0, len(o.entries))
+	for _, e := range o.entries {
+		if e.Expires == nil || !now.After(*e.Expires) {
+			out = append(out, e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Domain < out[j].Domain })
+	return out
+}
+
+// adminServer serves the admin HTTP API. Every request must carry the bearer token.
+type adminServer struct {
+	token         string
+	handlerAtomic *atomic.Value // *queryHandler
+	overrides     *hostOverrides
+	reload        func() error
+}
+
+// handler returns the admin API routes behind token authentication.
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /cache", a.listCache)
+	mux.HandleFunc("DELETE /cache", a.flushCache)
+	mux.HandleFunc("DELETE /cache/{name}", a.deleteCache)
+	mux.HandleFunc("GET /config", a.dumpConfig)
+	mux.HandleFunc("GET /hosts", a.listHosts)
+	mux.HandleFunc("GET /hosts/overrides", a.listOverrides)
+	mux.HandleFunc("PUT /hosts/overrides/{name}", a.putOverride)
+	mux.HandleFunc("DELETE /hosts/overrides/{name}", a.deleteOverride)
+	mux.HandleFunc("POST /reload", a.triggerReload)
+	mux.HandleFunc("GET /upstreams", a.listUpstreams)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dns admin"`)
+			writeAdminError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// httpServer returns the HTTP server exposing the admin API on listen.
+func (a *adminServer) httpServer(listen string) *http.Server {
+	return newHTTPServer(listen, a.handler())
+}
+
+func (a *adminServer) current() *queryHandler {
+	return a.handlerAtomic.Load().(*queryHandler)
+}
+
+// adminCacheEntry is a cache entry as listed by GET /cache.
+type adminCacheEntry struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	View     string   `json:"view,omitempty"`
+	Rcode    string   `json:"rcode"`
+	Answers  []string `json:"answers,omitempty"`
+	TTL      int64    `json:"ttl"` // seconds left, negative once expired
+	Stale    bool     `json:"stale,omitempty"`
+	Negative bool     `json:"negative,omitempty"`
+}
+
+// listCache lists cached answers, optionally only those of ?name=.
+func (a *adminServer) listCache(w http.ResponseWriter, r *http.Request) {
+	filter := strings.ToLower(strings.TrimSuffix(r.URL.Query().Get("name"), "."))
+	now := time.Now()
+	entries := []adminCacheEntry{}
+	for _, e := range a.current().cache.snapshot() {
+		name, qtype, _ := strings.Cut(e.key, "#")
+		qtype, view, _ := strings.Cut(qtype, "@")
+		if filter != "" && name != filter {
+			continue
+		}
+		entry := adminCacheEntry{
+			Name:     name,
+			Type:     qtype,
+			View:     view,
+			Rcode:    mdns.RcodeToString[e.rcode],
+			TTL:      int64(e.expires.Sub(now) / time.Second),
+			Stale:    now.After(e.expires),
+			Negative: e.negative,
+		}
+		if t, err := strconv.Atoi(qtype); err == nil {
+			if s, ok := mdns.TypeToString[uint16(t)]; ok {
+				entry.Type = s
+			}
+		}
+		for _, rr := range e.answer {
+			entry.Answers = append(entry.Answers, rr.String())
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	writeAdminJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+func (a *adminServer) flushCache(w http.ResponseWriter, r *http.Request) {
+	cache := a.current().cache
+	n := cache.len()
+	cache.flush()
+	logger.Info("Admin API flushed the DNS cache (%d entries)", n)
+	writeAdminJSON(w, http.StatusOK, map[string]int{"deleted": n})
+}
+
+// deleteCache drops the cached answers of a name, for every type or only ?type=.
+func (a *adminServer) deleteCache(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var qtype uint16
+	if t := r.URL.Query().Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = mdns.StringToType[strings.ToUpper(t)]; !ok {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("unknown record type %q", t))
+			return
+		}
+	}
+	n := a.current().cache.delete(name, qtype)
+	logger.Info("Admin API deleted %d cache entries of %s", n, name)
+	writeAdminJSON(w, http.StatusOK, map[string]int{"deleted": n})
+}
+
+// dumpConfig returns the effective config (file merged with CLI flags) as YAML.
+func (a *adminServer) dumpConfig(w http.ResponseWriter, r *http.Request) {
+	effective := a.current().effectiveCfg
+	if effective == nil {
+		writeAdminError(w, http.StatusNotFound, "no effective config")
+		return
+	}
+	out, err := effective.Clone()
+	if err == nil && out.Admin.Token != "" {
+		out.Admin.Token = "REDACTED"
+	}
+	var data []byte
+	if err == nil {
+		data, err = yaml.Marshal(out)
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
+
+// adminHost is a static host mapping as listed by GET /hosts.
+type adminHost struct {
+	Domain   string              `json:"domain"`
+	IPv4     []string            `json:"ipv4,omitempty"`
+	IPv6     []string            `json:"ipv6,omitempty"`
+	Alias    string              `json:"alias,omitempty"`
+	Records  map[string][]string `json:"records,omitempty"`
+	TTL      uint32              `json:"ttl,omitempty"`
+	Wildcard bool                `json:"wildcard,omitempty"`
+	Regex    bool                `json:"regex,omitempty"`
+	Down     []string            `json:"down,omitempty"` // addresses failing their health check
+}
+
+// listHosts lists the parsed config hosts, system hosts entries and overrides.
+func (a *adminServer) listHosts(w http.ResponseWriter, r *http.Request) {
+	h := a.current()
+	hosts := []adminHost{}
+	if h.cfg != nil {
+		idx, err := h.cfg.HostIndex()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, m := range idx.Entries() {
+			host := adminHost{
+				Domain:   m.Domain,
+				IPv4:     m.IPv4,
+				IPv6:     m.IPv6,
+				Alias:    m.AliasTarget,
+				TTL:      m.TTL,
+				Wildcard: m.IsWildcard,
+				Regex:    m.IsRegex,
+			}
+			for _, ip := range m.HostAddresses() {
+				if !m.Healthy(ip) {
+					host.Down = append(host.Down, ip)
+				}
+			}
+			for rrtype, rrs := range m.Records {
+				if host.Records == nil {
+					host.Records = make(map[string][]string)
+				}
+				for _, rr := range rrs {
+					value := strings.TrimPrefix(rr.String(), rr.Header().String())
+					host.Records[mdns.TypeToString[rrtype]] = append(host.Records[mdns.TypeToString[rrtype]], value)
+				}
+			}
+			hosts = append(hosts, host)
+		}
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].Domain < hosts[j].Domain })
+	}
+
+	systemHosts := []adminHost{}
+	if snapshot := h.systemHostsSnapshot(); snapshot != nil {
+		for _, e := range snapshot.entries {
+			host := adminHost{
+				Domain:   e.Domain,
+				IPv4:     e.addresses(4),
+				IPv6:     e.addresses(6),
+				Alias:    e.AliasTarget,
+				Wildcard: e.IsWildcard,
+				Regex:    e.IsRegex,
+			}
+			systemHosts = append(systemHosts, host)
+		}
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"hosts":        hosts,
+		"system_hosts": systemHosts,
+		"overrides":    a.overrides.list(time.Now()),
+	})
+}
+
+func (a *adminServer) listOverrides(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, map[string]any{"overrides": a.overrides.list(time.Now())})
+}
+
+// putOverride adds or replaces the override of a name. The body is
+// {"ips": ["10.0.0.1", "fd00::1"], "ttl": "30m"}; ttl is optional.
+func (a *adminServer) putOverride(w http.ResponseWriter, r *http.Request) {
+	domain, ok := filterDomain(r.PathValue("name"))
+	if !ok {
+		writeAdminError(w, http.StatusBadRequest, "invalid domain name")
+		return
+	}
+	var body struct {
+		IPs []string `json:"ips"`
+		TTL string   `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(body.IPs) == 0 {
+		writeAdminError(w, http.StatusBadRequest, "ips is required")
+		return
+	}
+	e := &hostOverride{Domain: domain}
+	for _, s := range body.IPs {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid IP %q", s))
+			return
+		}
+		e.IPs = append(e.IPs, ip.String())
+	}
+	if body.TTL != "" {
+		ttl, err := time.ParseDuration(body.TTL)
+		if err != nil || ttl <= 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid ttl %q", body.TTL))
+			return
+		}
+		expires := time.Now().Add(ttl)
+		e.Expires = &expires
+	}
+
+	a.overrides.set(e)
+	a.current().cache.delete(domain, 0)
+	logger.Info("Admin API set host override %s -> %v", domain, e.IPs)
+	writeAdminJSON(w, http.StatusOK, e)
+}
+
+func (a *adminServer) deleteOverride(w http.ResponseWriter, r *http.Request) {
+	domain, _ := filterDomain(r.PathValue("name"))
+	if !a.overrides.remove(domain) {
+		writeAdminError(w, http.StatusNotFound, "no override for "+r.PathValue("name"))
+		return
+	}
+	a.current().cache.delete(domain, 0)
+	logger.Info("Admin API removed host override %s", domain)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// triggerReload reloads the config file, system hosts and filter lists, like SIGHUP.
+func (a *adminServer) triggerReload(w http.ResponseWriter, r *http.Request) {
+	logger.Info("Admin API triggered a reload")
+	if err := a.reload(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (a *adminServer) listUpstreams(w http.ResponseWriter, r *http.Request) {
+	h := a.current()
+	resp := map[string]any{"groups": h.upstream.status()}
+	views := map[string]any{}
+	for _, v := range h.views {
+		if v.upstream != nil {
+			views[v.name()] = v.upstream.status()
+		}
+	}
+	if len(views) > 0 {
+		resp["views"] = views
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Debugf("Failed to write admin API response: %v", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,221 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func newTestAdmin(t *testing.T, h *queryHandler, reload func() error) *httptest.Server {
+	t.Helper()
+	if reload == nil {
+		reload = func() error { return nil }
+	}
+	var handlerAtomic atomic.Value
+	handlerAtomic.Store(h)
+	a := &adminServer{
+		token:         "secret",
+		handlerAtomic: &handlerAtomic,
+		overrides:     h.overrides,
+		reload:        reload,
+	}
+	srv := httptest.NewServer(a.handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler(t, nil, "127.0.0.1:1")
+	srv := newTestAdmin(t, h, nil)
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/cache", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("Authorization %q: status %d", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler(t, nil, "127.0.0.1:1")
+	srv := newTestAdmin(t, h, nil)
+	now := time.Now()
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		rr, _ := mdns.NewRR(name + ". 60 IN A 10.0.0.1")
+		h.cache.set(now, dnsCacheKey(name, mdns.TypeA), &dnsResult{answer: []mdns.RR{rr}}, false, time.Minute)
+		h.cache.set(now, dnsCacheKey(name, mdns.TypeAAAA), &dnsResult{}, true, time.Minute)
+	}
+
+	status, body := adminRequest(t, srv, http.MethodGet, "/cache?name=a.example.com", "")
+	var list struct {
+		Entries []adminCacheEntry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil || status != http.StatusOK {
+		t.Fatalf("status %d body %s", status, body)
+	}
+	if len(list.Entries) != 2 || list.Entries[0].Type != "A" || len(list.Entries[0].Answers) != 1 || !list.Entries[1].Negative {
+		t.Fatalf("unexpected entries %+v", list.Entries)
+	}
+
+	if status, body = adminRequest(t, srv, http.MethodDelete, "/cache/A.example.com.?type=aaaa", ""); status != http.StatusOK || !strings.Contains(body, `"deleted": 1`) {
+		t.Fatalf("delete by type: %d %s", status, body)
+	}
+	if status, body = adminRequest(t, srv, http.MethodDelete, "/cache/a.example.com", ""); status != http.StatusOK || !strings.Contains(body, `"deleted": 1`) {
+		t.Fatalf("delete by name: %d %s", status, body)
+	}
+	if status, _ = adminRequest(t, srv, http.MethodDelete, "/cache/a.example.com?type=BOGUS", ""); status != http.StatusBadRequest {
+		t.Fatalf("unknown type: status %d", status)
+	}
+	if status, body = adminRequest(t, srv, http.MethodDelete, "/cache", ""); status != http.StatusOK || !strings.Contains(body, `"deleted": 2`) {
+		t.Fatalf("flush: %d %s", status, body)
+	}
+	if h.cache.len() != 0 {
+		t.Fatalf("cache not flushed: %d entries", h.cache.len())
+	}
+}
+
+func TestAdminHostOverrides(t *testing.T) {
+	t.Parallel()
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		rr, _ := mdns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(t, nil, upstream)
+	h.overrides = newHostOverrides()
+	srv := newTestAdmin(t, h, nil)
+
+	// Cache the upstream answer first; setting the override must evict it.
+	if reply := h.serveDNS(testQuery("app.example.com", mdns.TypeA)); len(reply.Answer) != 1 {
+		t.Fatalf("upstream reply: %v", reply)
+	}
+
+	status, body := adminRequest(t, srv, http.MethodPut, "/hosts/overrides/App.example.com", `{"ips":["10.1.1.1","fd00::1"],"ttl":"1h"}`)
+	if status != http.StatusOK {
+		t.Fatalf("put override: %d %s", status, body)
+	}
+	reply := h.serveDNS(testQuery("app.example.com", mdns.TypeA))
+	if len(reply.Answer) != 1 || reply.Answer[0].(*mdns.A).A.String() != "10.1.1.1" || reply.Answer[0].Header().Ttl != hostOverrideTTL {
+		t.Fatalf("override A reply: %v", reply)
+	}
+	reply = h.serveDNS(testQuery("app.example.com", mdns.TypeAAAA))
+	if len(reply.Answer) != 1 || reply.Answer[0].(*mdns.AAAA).AAAA.String() != "fd00::1" {
+		t.Fatalf("override AAAA reply: %v", reply)
+	}
+
+	if status, body = adminRequest(t, srv, http.MethodGet, "/hosts/overrides", ""); !strings.Contains(body, `"app.example.com"`) {
+		t.Fatalf("list overrides: %d %s", status, body)
+	}
+	if status, _ = adminRequest(t, srv, http.MethodPut, "/hosts/overrides/app.example.com", `{"ips":["not-an-ip"]}`); status != http.StatusBadRequest {
+		t.Fatalf("invalid IP: status %d", status)
+	}
+
+	if status, _ = adminRequest(t, srv, http.MethodDelete, "/hosts/overrides/app.example.com", ""); status != http.StatusNoContent {
+		t.Fatalf("delete override: status %d", status)
+	}
+	if status, _ = adminRequest(t, srv, http.MethodDelete, "/hosts/overrides/app.example.com", ""); status != http.StatusNotFound {
+		t.Fatalf("delete missing override: status %d", status)
+	}
+	reply = h.serveDNS(testQuery("app.example.com", mdns.TypeA))
+	if len(reply.Answer) != 1 || reply.Answer[0].(*mdns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("reply after removing override: %v", reply)
+	}
+}
+
+func TestHostOverrideExpires(t *testing.T) {
+	t.Parallel()
+	o := newHostOverrides()
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	o.set(&hostOverride{Domain: "a.example.com", IPs: []string{"10.0.0.1"}, Expires: &expires})
+
+	if _, ok := o.lookup(now, "a.example.com"); !ok {
+		t.Fatal("override not found before expiry")
+	}
+	if _, ok := o.lookup(now.Add(2*time.Minute), "a.example.com"); ok {
+		t.Fatal("override found after expiry")
+	}
+	if got := o.list(now.Add(2 * time.Minute)); len(got) != 0 {
+		t.Fatalf("expired override listed: %v", got)
+	}
+}
+
+func TestAdminConfigRedactsToken(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler(t, nil, "127.0.0.1:1")
+	h.effectiveCfg = &config.Config{
+		Server: config.ServerConfig{Port: 5353},
+		Admin:  config.AdminConfig{Enabled: true, Listen: "127.0.0.1:9154", Token: "secret"},
+	}
+	srv := newTestAdmin(t, h, nil)
+
+	status, body := adminRequest(t, srv, http.MethodGet, "/config", "")
+	if status != http.StatusOK || !strings.Contains(body, "port: 5353") || strings.Contains(body, "secret") || !strings.Contains(body, "REDACTED") {
+		t.Fatalf("config dump: %d %s", status, body)
+	}
+	if h.effectiveCfg.Admin.Token != "secret" {
+		t.Fatal("dumping the config modified the effective config")
+	}
+}
+
+func TestAdminReloadAndUpstreams(t *testing.T) {
+	t.Parallel()
+	h := newTestHandler(t, nil, "127.0.0.1:1")
+	var failReload atomic.Bool
+	srv := newTestAdmin(t, h, func() error {
+		if failReload.Load() {
+			return errors.New("bad config")
+		}
+		return nil
+	})
+
+	status, body := adminRequest(t, srv, http.MethodGet, "/upstreams", "")
+	if status != http.StatusOK || !strings.Contains(body, `"127.0.0.1:1"`) || !strings.Contains(body, `"healthy": true`) {
+		t.Fatalf("upstreams: %d %s", status, body)
+	}
+
+	if status, _ = adminRequest(t, srv, http.MethodPost, "/reload", ""); status != http.StatusOK {
+		t.Fatalf("reload: status %d", status)
+	}
+	failReload.Store(true)
+	if status, body = adminRequest(t, srv, http.MethodPost, "/reload", ""); status != http.StatusInternalServerError || !strings.Contains(body, "bad config") {
+		t.Fatalf("failed reload: %d %s", status, body)
+	}
+}
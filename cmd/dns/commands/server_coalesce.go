@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"golang.org/x/sync/singleflight"
+)
+
+// lookupCoalescer runs one upstream lookup per cache key at a time: concurrent
+// identical questions (typically a burst of clients after a cache entry expires) wait
+// for the lookup in flight and share its result. A nil *lookupCoalescer runs every
+// lookup.
+type lookupCoalescer struct {
+	group singleflight.Group
+}
+
+func newLookupCoalescer() *lookupCoalescer {
+	return &lookupCoalescer{}
+}
+
+// do returns the result of lookup for key, running it unless a lookup for key is
+// already in flight. coalesced reports whether the result came from another caller's
+// lookup.
+func (c *lookupCoalescer) do(key string, lookup func() (*dnsResult, error)) (res *dnsResult, coalesced bool, err error) {
+	if c == nil {
+		res, err = lookup()
+		return res, false, err
+	}
+	ran := false
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		ran = true
+		return lookup()
+	})
+	res, _ = v.(*dnsResult)
+	return res, !ran, err
+}
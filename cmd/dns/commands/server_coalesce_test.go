@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// startSlowUpstream runs an upstream answering every A query with ip after delay and
+// counts the queries per name.
+func startSlowUpstream(t *testing.T, ip string, delay time.Duration) (string, func(name string) int64) {
+	t.Helper()
+	var mu sync.Mutex
+	counts := make(map[string]*atomic.Int64)
+	count := func(name string) *atomic.Int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		if counts[name] == nil {
+			counts[name] = new(atomic.Int64)
+		}
+		return counts[name]
+	}
+	addr := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		count(r.Question[0].Name).Add(1)
+		time.Sleep(delay)
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		rr, _ := mdns.NewRR(r.Question[0].Name + " 60 IN A " + ip)
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	return addr, func(name string) int64 { return count(mdns.Fqdn(name)).Load() }
+}
+
+// serveConcurrently sends n copies of req at once and returns the replies.
+func serveConcurrently(h *queryHandler, n int, req func() *dnsRequest) []*mdns.Msg {
+	replies := make([]*mdns.Msg, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range replies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			replies[i] = h.serveDNS(req())
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return replies
+}
+
+func TestQueryHandlerCoalescesUpstreamLookups(t *testing.T) {
+	t.Parallel()
+	upstream, queries := startSlowUpstream(t, "192.0.2.1", 200*time.Millisecond)
+	cfg := &config.Config{Hosts: config.HostsConfig{"db.internal": "db.cloud.example"}}
+	h := newTestHandler(t, cfg, upstream)
+	h.inflight = newLookupCoalescer()
+
+	for _, name := range []string{"www.example.com", "db.internal"} {
+		replies := serveConcurrently(h, 20, func() *dnsRequest { return testQuery(name, mdns.TypeA) })
+		for _, reply := range replies {
+			if len(reply.Answer) != 1 || reply.Answer[0].(*mdns.A).A.String() != "192.0.2.1" {
+				t.Fatalf("%s: unexpected answer %v", name, reply.Answer)
+			}
+			if got := reply.Answer[0].Header().Name; got != mdns.Fqdn(name) {
+				t.Fatalf("%s: answer for %s", name, got)
+			}
+		}
+	}
+	if got := queries("www.example.com"); got != 1 {
+		t.Errorf("www.example.com: %d upstream queries, want 1", got)
+	}
+	if got := queries("db.cloud.example"); got != 1 {
+		t.Errorf("alias target db.cloud.example: %d upstream queries, want 1", got)
+	}
+
+	// Different questions are not coalesced
+	serveConcurrently(h, 2, func() *dnsRequest { return testQuery("a.example.com", mdns.TypeA) })
+	serveConcurrently(h, 2, func() *dnsRequest { return testQuery("b.example.com", mdns.TypeA) })
+	if queries("a.example.com") != 1 || queries("b.example.com") != 1 {
+		t.Errorf("upstream queries: a=%d b=%d, want 1 each", queries("a.example.com"), queries("b.example.com"))
+	}
+}
+
+func TestLookupCoalescerNil(t *testing.T) {
+	t.Parallel()
+	var c *lookupCoalescer
+	calls := 0
+	res, coalesced, err := c.do("k", func() (*dnsResult, error) {
+		calls++
+		return &dnsResult{channel: "upstream"}, nil
+	})
+	if err != nil || coalesced || calls != 1 || res.channel != "upstream" {
+		t.Fatalf("nil coalescer: res=%v coalesced=%v err=%v calls=%d", res, coalesced, err, calls)
+	}
+}
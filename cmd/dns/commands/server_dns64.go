@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"math"
+	"net/netip"
+	"slices"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// ipv4MappedPrefix holds the IPv4-mapped IPv6 addresses, which clients behind NAT64
+// cannot reach: AAAA records of this range are ignored (RFC 6147 section 5.1.4).
+var ipv4MappedPrefix = netip.MustParsePrefix("::ffff:0:0/96")
+
+// dns64 synthesizes AAAA records from A records with a NAT64 prefix (RFC 6147). A nil
+// *dns64 synthesizes nothing.
+type dns64 struct {
+	prefix  netip.Prefix
+	exclude []netip.Prefix // IPv4 networks never synthesized
+}
+
+// newDNS64 returns the synthesizer of cfg, or nil when DNS64 is off.
+func newDNS64(cfg config.DNS64Config) (*dns64, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	prefix, err := cfg.ParsePrefix()
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := cfg.ParseExclude()
+	if err != nil {
+		return nil, err
+	}
+	return &dns64{prefix: prefix, exclude: exclude}, nil
+}
+
+// embed returns the IPv6 address of the IPv4 address ip in the prefix (RFC 6052
+// section 2.2).
+func (d *dns64) embed(ip netip.Addr) netip.Addr {
+	b := d.prefix.Addr().As16()
+	n := d.prefix.Bits() / 8
+	for _, octet := range ip.As4() {
+		// Bits 64 to 71 are reserved
+		if n == 8 {
+			n++
+		}
+		b[n] = octet
+		n++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// extract returns the IPv4 address embedded in ip, and whether ip is in the prefix.
+func (d *dns64) extract(ip netip.Addr) (netip.Addr, bool) {
+	if !d.prefix.Contains(ip) {
+		return netip.Addr{}, false
+	}
+	b := ip.As16()
+	var v4 [4]byte
+	n := d.prefix.Bits() / 8
+	for i := range v4 {
+		if n == 8 {
+			n++
+		}
+		v4[i] = b[n]
+		n++
+	}
+	return netip.AddrFrom4(v4), true
+}
+
+// hasAAAA reports whether res answers with AAAA records clients can use.
+func (d *dns64) hasAAAA(res *dnsResult) bool {
+	return slices.ContainsFunc(res.answer, func(rr mdns.RR) bool {
+		aaaa, ok := rr.(*mdns.AAAA)
+		if !ok {
+			return false
+		}
+		ip, ok := netip.AddrFromSlice(aaaa.AAAA)
+		return ok && !ipv4MappedPrefix.Contains(ip)
+	})
+}
+
+// synthesize returns the answer to an AAAA question built from a, the answer to the A
+// question of the same name, given aaaa, the answer without usable AAAA records. It
+// returns nil when a has no A record to synthesize from.
+func (d *dns64) synthesize(a, aaaa *dnsResult) *dnsResult {
+	// Synthesized records do not outlive the negative answer (RFC 6147 section 5.1.7)
+	maxTTL := uint32(math.MaxUint32)
+	for _, rr := range aaaa.ns {
+		if soa, ok := rr.(*mdns.SOA); ok {
+			maxTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	var answer []mdns.RR
+	synthesized := false
+	for _, rr := range a.answer {
+		switch rr := rr.(type) {
+		case *mdns.A:
+			ip, ok := netip.AddrFromSlice(rr.A.To4())
+			if !ok || slices.ContainsFunc(d.exclude, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+				continue
+			}
+			answer = append(answer, &mdns.AAAA{
+				Hdr:  mdns.RR_Header{Name: rr.Hdr.Name, Rrtype: mdns.TypeAAAA, Class: rr.Hdr.Class, Ttl: min(rr.Hdr.Ttl, maxTTL)},
+				AAAA: d.embed(ip).AsSlice(),
+			})
+			synthesized = true
+		case *mdns.CNAME, *mdns.DNAME:
+			// The chain leading to the A records
+			answer = append(answer, mdns.Copy(rr))
+		}
+	}
+	if !synthesized {
+		return nil
+	}
+	return &dnsResult{answer: answer, channel: "dns64"}
+}
+
+// ptrTarget returns the in-addr.arpa name of the IPv4 address embedded in the ip6.arpa
+// name, or "" when name is not the reverse name of an address in the prefix.
+func (d *dns64) ptrTarget(name string) string {
+	if d == nil {
+		return ""
+	}
+	ip, ok := netip.AddrFromSlice(ptrAddress(name))
+	if !ok || !ip.Is6() {
+		return ""
+	}
+	v4, ok := d.extract(ip)
+	if !ok {
+		return ""
+	}
+	target, err := mdns.ReverseAddr(v4.String())
+	if err != nil {
+		return ""
+	}
+	return target
+}
@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func TestDNS64Embed(t *testing.T) {
+	t.Parallel()
+	// RFC 6052 section 2.4
+	tests := []struct{ prefix, want string }{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	ip := netip.MustParseAddr("192.0.2.33")
+	for _, tt := range tests {
+		d, err := newDNS64(config.DNS64Config{Enabled: true, Prefix: tt.prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := d.embed(ip)
+		if got != netip.MustParseAddr(tt.want) {
+			t.Errorf("%s: embed = %s, want %s", tt.prefix, got, tt.want)
+		}
+		if v4, ok := d.extract(got); !ok || v4 != ip {
+			t.Errorf("%s: extract(%s) = %s, %v", tt.prefix, got, v4, ok)
+		}
+	}
+}
+
+func TestQueryHandlerDNS64(t *testing.T) {
+	t.Parallel()
+	soa := "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 30"
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Name == "nx.example.":
+			m.Rcode = mdns.RcodeNameError
+			m.Ns = append(m.Ns, newRR(t, soa))
+		case q.Name == "v4.example." && q.Qtype == mdns.TypeA:
+			m.Answer = append(m.Answer, newRR(t, "v4.example. 60 IN A 192.0.2.33"))
+		case q.Name == "www.example.":
+			m.Answer = append(m.Answer, newRR(t, "www.example. 600 IN CNAME v4.example."))
+			if q.Qtype == mdns.TypeA {
+				m.Answer = append(m.Answer, newRR(t, "v4.example. 600 IN A 192.0.2.34"))
+			} else {
+				m.Ns = append(m.Ns, newRR(t, soa))
+			}
+		case q.Name == "mapped.example." && q.Qtype == mdns.TypeA:
+			m.Answer = append(m.Answer, newRR(t, "mapped.example. 60 IN A 198.51.100.1"))
+		case q.Name == "mapped.example." && q.Qtype == mdns.TypeAAAA:
+			m.Answer = append(m.Answer, newRR(t, "mapped.example. 60 IN AAAA ::ffff:198.51.100.1"))
+		case q.Name == "private.example." && q.Qtype == mdns.TypeA:
+			m.Answer = append(m.Answer, newRR(t, "private.example. 60 IN A 10.0.0.1"))
+		default:
+			m.Ns = append(m.Ns, newRR(t, soa))
+		}
+		w.WriteMsg(m)
+	})
+	cfg := &config.Config{
+		Hosts: config.HostsConfig{
+			"v4only.lab": "192.0.2.33",
+			"dual.lab":   map[string]interface{}{"a": "192.0.2.40", "aaaa": "2001:db8::40"},
+		},
+		DNS64: config.DNS64Config{Enabled: true, Exclude: []string{"10.0.0.0/8"}},
+		Views: []config.ViewConfig{
+			{Name: "native", ClientMatch: config.ClientMatch{Clients: []string{"10.0.0.0/8"}}, DNS64: &config.DNS64Config{}},
+		},
+	}
+	h := newTestHandler(t, cfg, upstream)
+	var err error
+	if h.dns64, err = newDNS64(cfg.DNS64); err != nil {
+		t.Fatal(err)
+	}
+	if h.views, err = loadViews(cfg, upstreamOptions{timeout: h.upstream.timeout}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.views.close)
+
+	tests := []struct {
+		name  string
+		rcode int
+		want  []string // the AAAA addresses of the answer
+		ttl   uint32   // capped by the SOA minimum of the AAAA answer, if any
+	}{
+		{"v4only.lab", mdns.RcodeSuccess, []string{"64:ff9b::c000:221"}, 30},
+		{"dual.lab", mdns.RcodeSuccess, []string{"2001:db8::40"}, 500},
+		{"v4.example", mdns.RcodeSuccess, []string{"64:ff9b::c000:221"}, 30},
+		{"www.example", mdns.RcodeSuccess, []string{"64:ff9b::c000:222"}, 600},
+		{"mapped.example", mdns.RcodeSuccess, []string{"64:ff9b::c633:6401"}, 60},
+		{"private.example", mdns.RcodeSuccess, nil, 0},
+		{"nx.example", mdns.RcodeNameError, nil, 0},
+	}
+	for _, tt := range tests {
+		reply := h.serveDNS(testQuery(tt.name, mdns.TypeAAAA))
+		if reply.Rcode != tt.rcode {
+			t.Errorf("%s: rcode %s, want %s", tt.name, mdns.RcodeToString[reply.Rcode], mdns.RcodeToString[tt.rcode])
+			continue
+		}
+		var got []string
+		for _, rr := range reply.Answer {
+			if aaaa, ok := rr.(*mdns.AAAA); ok {
+				got = append(got, aaaa.AAAA.String())
+				if aaaa.Hdr.Ttl != tt.ttl {
+					t.Errorf("%s: TTL %d, want %d", tt.name, aaaa.Hdr.Ttl, tt.ttl)
+				}
+			}
+		}
+		if len(got) != len(tt.want) || len(got) > 0 && got[0] != tt.want[0] {
+			t.Errorf("%s: AAAA %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The CNAME chain leads to the synthesized records
+	if reply := h.serveDNS(testQuery("www.example", mdns.TypeAAAA)); countType(reply.Answer, mdns.TypeCNAME) != 1 {
+		t.Errorf("www.example: expected the CNAME, got %v", reply.Answer)
+	}
+
+	// Reverse names of the prefix are aliases of the IPv4 reverse names
+	name, _ := mdns.ReverseAddr("64:ff9b::c000:221")
+	reply := h.serveDNS(testQuery(name, mdns.TypePTR))
+	if len(reply.Answer) != 2 || reply.Answer[0].(*mdns.CNAME).Target != "33.2.0.192.in-addr.arpa." || reply.Answer[1].(*mdns.PTR).Ptr != "v4only.lab." {
+		t.Errorf("PTR %s: %v", name, reply.Answer)
+	}
+
+	// Neither clients validating themselves nor views without DNS64 get synthesized records
+	for _, req := range []*dnsRequest{dnssecQuery("v4only.lab", mdns.TypeAAAA, true, true), viewQuery("v4only.lab", mdns.TypeAAAA, "10.1.2.3", "udp")} {
+		if reply := h.serveDNS(req); len(reply.Answer) != 0 {
+			t.Errorf("unexpected synthesized answer %v", reply.Answer)
+		}
+	}
+}
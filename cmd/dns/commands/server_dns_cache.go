@@ -1,103 +1,516 @@
 package commands
 
 import (
+	"container/list"
+	"hash/maphash"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
 )
 
-// dnsAnswerCache stores final IP lists for queries that were resolved via upstream
+// dnsCacheShards is the number of independently locked LRU shards of the cache.
+const dnsCacheShards = 16
+
+// staleAnswerTTL is the TTL of answers served stale, as recommended by RFC 8767.
+const staleAnswerTTL = 30
+
+// dnsAnswerCache stores final answers for queries that were resolved via upstream
 // (including config/system alias chains). Keys are normalized name + query type.
+//
+// Keys are spread over shards, each an LRU list with its own lock, so inserts and
+// evictions are O(1) and concurrent queries rarely contend. Expired entries are kept
+// for the serve-stale window and otherwise dropped lazily or by LRU eviction.
 type dnsAnswerCache struct {
-	mu         sync.RWMutex
-	entries    map[string]*dnsCacheEntry
+	shards     []*dnsCacheShard
+	active     atomic.Int64 // keys are spread over the first active shards
+	seed       maphash.Seed
+	serveStale atomic.Int64  // time.Duration expired entries are kept for, 0 = disabled
+	generation atomic.Uint64 // incremented by flush
+
+	// Counters exported as metrics
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64 // entries dropped to stay within maxEntries
+}
+
+type dnsCacheShard struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element // values are *dnsCacheEntry
+	lru        *list.List               // most recently used at the front
 	maxEntries int
 }
 
 type dnsCacheEntry struct {
-	ips      []string // only used when negative == false
+	key      string
+	rcode    int
+	answer   []mdns.RR // only used when negative == false
+	ns       []mdns.RR // authority section (SOA) kept for negative answers
 	expires  time.Time
+	ttl      time.Duration
 	negative bool // NXDOMAIN / empty success
+	security dnssecStatus
+
+	hits          int       // times served from the cache
+	prefetching   bool      // a background refresh is running
+	prefetchRetry time.Time // no refresh starts before, after one failed
 }
 
-func dnsCacheKey(hostname string, typ int) string {
+func dnsCacheKey(hostname string, qtype uint16) string {
 	h := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
-	return h + "#" + strconv.Itoa(typ)
+	return h + "#" + strconv.Itoa(int(qtype))
 }
 
 func newDNSAnswerCache(maxEntries int) *dnsAnswerCache {
-	if maxEntries <= 0 {
-		maxEntries = config.DNSCacheMaxEntriesDefault
-	}
-	return &dnsAnswerCache{
-		entries:    make(map[string]*dnsCacheEntry),
-		maxEntries: maxEntries,
+	return newShardedDNSAnswerCache(maxEntries, dnsCacheShards)
+}
+
+func newShardedDNSAnswerCache(maxEntries, shards int) *dnsAnswerCache {
+	c := &dnsAnswerCache{seed: maphash.MakeSeed()}
+	for i := 0; i < shards; i++ {
+		c.shards = append(c.shards, &dnsCacheShard{
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+		})
 	}
+	c.resize(maxEntries)
+	return c
 }
 
-// get returns (ips, true) on hit. For negative cache, ips is empty slice.
-func (c *dnsAnswerCache) get(now time.Time, key string) ([]string, bool) {
+func (c *dnsAnswerCache) shard(key string) *dnsCacheShard {
+	return c.shards[maphash.String(c.seed, key)%uint64(c.active.Load())]
+}
+
+// get returns a copy of the cached result on hit, with record TTLs lowered to the time
+// left. For negative cache, the answer is empty.
+func (c *dnsAnswerCache) get(now time.Time, key string) (*dnsResult, bool) {
 	if c == nil {
 		return nil, false
 	}
-	c.mu.RLock()
-	e := c.entries[key]
-	c.mu.RUnlock()
-	if e == nil {
+	s := c.shard(key)
+	s.mu.Lock()
+	el := s.entries[key]
+	if el == nil {
+		s.mu.Unlock()
+		c.misses.Add(1)
 		return nil, false
 	}
+	e := el.Value.(*dnsCacheEntry)
 	if now.After(e.expires) {
-		c.mu.Lock()
-		if cur := c.entries[key]; cur == e && now.After(cur.expires) {
-			delete(c.entries, key)
+		if now.After(e.expires.Add(time.Duration(c.serveStale.Load()))) {
+			s.removeLocked(el)
 		}
-		c.mu.Unlock()
+		s.mu.Unlock()
+		c.misses.Add(1)
 		return nil, false
 	}
-	if e.negative {
-		return []string{}, true
+	e.hits++
+	s.lru.MoveToFront(el)
+	s.mu.Unlock()
+
+	c.hits.Add(1)
+	return e.result(uint32((e.expires.Sub(now)+time.Second-1)/time.Second), "cache"), true
+}
+
+// getStale returns an expired answer still within the serve-stale window, for use when
+// no upstream could be reached. Its records carry staleAnswerTTL.
+func (c *dnsAnswerCache) getStale(now time.Time, key string) (*dnsResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+	window := time.Duration(c.serveStale.Load())
+	if window <= 0 {
+		return nil, false
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	el := s.entries[key]
+	if el == nil {
+		s.mu.Unlock()
+		return nil, false
+	}
+	e := el.Value.(*dnsCacheEntry)
+	if !now.After(e.expires) || now.After(e.expires.Add(window)) {
+		s.mu.Unlock()
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	s.mu.Unlock()
+
+	return e.result(staleAnswerTTL, "stale"), true
+}
+
+// prefetchDue reports whether the entry for key should be refreshed: it was served at
+// least minHits times and less than threshold (a fraction) of its TTL is left. It returns
+// true once per cached answer so a single refresh runs for it, until prefetchDone reports
+// that refresh failed.
+func (c *dnsAnswerCache) prefetchDue(now time.Time, key string, threshold float64, minHits int) bool {
+	if c == nil {
+		return false
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el := s.entries[key]
+	if el == nil {
+		return false
+	}
+	e := el.Value.(*dnsCacheEntry)
+	left := e.expires.Sub(now)
+	if e.prefetching || now.Before(e.prefetchRetry) || e.hits < minHits || left <= 0 || float64(left) > threshold*float64(e.ttl) {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// prefetchDone ends the refresh of key started by prefetchDue. A refresh that cached a
+// new answer replaced the entry; otherwise it failed and the entry may be refreshed
+// again after cachePrefetchRetry.
+func (c *dnsAnswerCache) prefetchDone(now time.Time, key string) {
+	if c == nil {
+		return
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el := s.entries[key]; el != nil {
+		if e := el.Value.(*dnsCacheEntry); e.prefetching {
+			e.prefetching = false
+			e.prefetchRetry = now.Add(cachePrefetchRetry)
+		}
+	}
+}
+
+// result copies the entry into a dnsResult whose record TTLs are capped at ttl.
+func (e *dnsCacheEntry) result(ttl uint32, channel string) *dnsResult {
+	res := &dnsResult{rcode: e.rcode, ns: capTTLs(copyRRs(e.ns), ttl), security: e.security, channel: channel}
+	if !e.negative {
+		res.answer = capTTLs(copyRRs(e.answer), ttl)
+	}
+	return res
+}
+
+func (c *dnsAnswerCache) set(now time.Time, key string, res *dnsResult, negative bool, ttl time.Duration) {
+	c.setFrom(c.currentGeneration(), now, key, res, negative, ttl)
+}
+
+// currentGeneration returns the generation of the cache, to pass to setFrom.
+func (c *dnsAnswerCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
 	}
-	out := make([]string, len(e.ips))
-	copy(out, e.ips)
-	return out, true
+	return c.generation.Load()
 }
 
-func (c *dnsAnswerCache) set(now time.Time, key string, ips []string, negative bool, ttl time.Duration) {
+// setFrom stores res like set, unless the cache was flushed since generation gen: the
+// lookup of res started before the flush and may have used a replaced config.
+func (c *dnsAnswerCache) setFrom(gen uint64, now time.Time, key string, res *dnsResult, negative bool, ttl time.Duration) {
 	if c == nil || ttl <= 0 {
 		return
 	}
 	e := &dnsCacheEntry{
+		key:      key,
+		rcode:    res.rcode,
+		ns:       copyRRs(res.ns),
 		expires:  now.Add(ttl),
+		ttl:      ttl,
 		negative: negative,
+		security: res.security,
 	}
 	if !negative {
-		e.ips = make([]string, len(ips))
-		copy(e.ips, ips)
+		e.answer = copyRRs(res.answer)
+	}
+	c.insert(gen, e)
+}
+
+// insert stores e as the most recently used entry of its key, unless the cache was
+// flushed since generation gen.
+func (c *dnsAnswerCache) insert(gen uint64, e *dnsCacheEntry) {
+	s := c.shard(e.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// flush moves to the next generation before it clears the shards
+	if c.generation.Load() != gen {
+		return
+	}
+	if el := s.entries[e.key]; el != nil {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
 	}
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.entries[key] = e
-	c.evictIfNeededLocked(now)
+	s.entries[e.key] = s.lru.PushFront(e)
+	c.evictions.Add(uint64(s.evictLocked()))
 }
 
-func (c *dnsAnswerCache) evictIfNeededLocked(now time.Time) {
-	for k, e := range c.entries {
-		if now.After(e.expires) {
-			delete(c.entries, k)
+// snapshot returns the entries of every shard, least recently used first. Entries are
+// never modified after insert apart from their hit counters and prefetch state, so they
+// are safe to read.
+func (c *dnsAnswerCache) snapshot() []*dnsCacheEntry {
+	if c == nil {
+		return nil
+	}
+	var out []*dnsCacheEntry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for el := s.lru.Back(); el != nil; el = el.Prev() {
+			out = append(out, el.Value.(*dnsCacheEntry))
 		}
+		s.mu.Unlock()
 	}
-	if len(c.entries) <= c.maxEntries {
+	return out
+}
+
+// resize changes the maximum number of entries, evicting the least recently used
+// entries if the cache is now over it. The limit is split across shards so that they
+// add up to maxEntries exactly: the first shards hold one entry more than the others.
+// A limit below the number of shards spreads keys over that many shards only, so that
+// none of them is left without room.
+func (c *dnsAnswerCache) resize(maxEntries int) {
+	if c == nil {
 		return
 	}
-	over := len(c.entries) - c.maxEntries
-	for k := range c.entries {
-		if over <= 0 {
-			break
+	if maxEntries <= 0 {
+		maxEntries = config.DNSCacheMaxEntriesDefault
+	}
+	active := min(len(c.shards), maxEntries)
+	c.active.Store(int64(active))
+	perShard, rest := maxEntries/active, maxEntries%active
+	for i, s := range c.shards {
+		s.mu.Lock()
+		s.maxEntries = 0
+		if i < active {
+			s.maxEntries = perShard
+		}
+		if i < rest {
+			s.maxEntries++
 		}
-		delete(c.entries, k)
-		over--
+		// Entries of keys now spread over other shards are unreachable
+		for key, el := range s.entries {
+			if c.shard(key) != s {
+				s.removeLocked(el)
+			}
+		}
+		c.evictions.Add(uint64(s.evictLocked()))
+		s.mu.Unlock()
+	}
+}
+
+// setServeStale sets how long expired entries are kept to be served stale; 0 disables it.
+func (c *dnsAnswerCache) setServeStale(d time.Duration) {
+	if c == nil {
+		return
+	}
+	if d < 0 {
+		d = 0
+	}
+	c.serveStale.Store(int64(d))
+}
+
+// len returns the number of entries, including expired ones not yet removed.
+func (c *dnsAnswerCache) len() int {
+	if c == nil {
+		return 0
+	}
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.entries)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// hitCount, missCount and evictionCount return the cache counters, 0 on a nil cache.
+func (c *dnsAnswerCache) hitCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.hits.Load()
+}
+
+func (c *dnsAnswerCache) missCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.misses.Load()
+}
+
+func (c *dnsAnswerCache) evictionCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.evictions.Load()
+}
+
+// delete drops the entries of name for qtype, or for every type when qtype is 0, in
+// every view and returns how many were dropped.
+func (c *dnsAnswerCache) delete(name string, qtype uint16) int {
+	if c == nil {
+		return 0
+	}
+	want := dnsCacheKey(name, qtype)
+	matches := func(key string) bool { return key == want || strings.HasPrefix(key, want+"@") }
+	if qtype == 0 {
+		prefix := want[:len(want)-1] // keep "name#"
+		matches = func(key string) bool { return strings.HasPrefix(key, prefix) }
+	}
+
+	deleted := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, el := range s.entries {
+			if matches(key) {
+				s.removeLocked(el)
+				deleted++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return deleted
+}
+
+// flush drops every cached entry, and the answers of the lookups in flight (see setFrom).
+func (c *dnsAnswerCache) flush() {
+	if c == nil {
+		return
+	}
+	c.generation.Add(1)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.entries = make(map[string]*list.Element)
+		s.lru.Init()
+		s.mu.Unlock()
+	}
+}
+
+// evictLocked drops least recently used entries until the shard fits maxEntries and
+// returns how many were dropped.
+func (s *dnsCacheShard) evictLocked() int {
+	evicted := 0
+	for len(s.entries) > s.maxEntries {
+		s.removeLocked(s.lru.Back())
+		evicted++
+	}
+	return evicted
+}
+
+func (s *dnsCacheShard) removeLocked(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*dnsCacheEntry).key)
+}
+
+// cachePrefetchConcurrency bounds the background refreshes running at once.
+const cachePrefetchConcurrency = 16
+
+// cachePrefetchRetry is how long after a failed refresh an entry may be refreshed again.
+const cachePrefetchRetry = 5 * time.Second
+
+// cachePrefetcher refreshes popular cache entries from upstream shortly before they expire.
+// A nil *cachePrefetcher never prefetches.
+type cachePrefetcher struct {
+	threshold float64 // fraction of the TTL left below which a hit triggers a refresh
+	minHits   int
+	slots     chan struct{}
+}
+
+// newCachePrefetcher returns the prefetcher configured by cfg, nil when prefetch is off.
+func newCachePrefetcher(cfg config.CachePrefetchConfig) *cachePrefetcher {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &cachePrefetcher{
+		threshold: float64(cfg.Threshold) / 100,
+		minHits:   cfg.MinHits,
+		slots:     make(chan struct{}, cachePrefetchConcurrency),
+	}
+}
+
+// refresh runs resolve in the background when the hit on key makes it due for prefetch.
+// Refreshes beyond cachePrefetchConcurrency are skipped; the entry then expires normally.
+func (p *cachePrefetcher) refresh(cache *dnsAnswerCache, now time.Time, key string, resolve func()) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return
+	}
+	if !cache.prefetchDue(now, key, p.threshold, p.minHits) {
+		<-p.slots
+		return
+	}
+	go func() {
+		defer func() { <-p.slots }()
+		resolve()
+		cache.prefetchDone(time.Now(), key)
+	}()
+}
+
+// dnsCachePolicy decides how long answers are cached from the TTLs upstream returned.
+type dnsCachePolicy struct {
+	minTTL    time.Duration // lower bound for every answer
+	maxTTL    time.Duration // upper bound for positive answers
+	maxNegTTL time.Duration // upper bound for negative answers, and their TTL without a SOA
+}
+
+// ttl returns how long res may be cached: the lowest record TTL of a positive answer,
+// or for a negative answer the SOA TTL capped by its MINIMUM field (RFC 2308), clamped
+// to the policy bounds. 0 means the answer must not be cached.
+func (p dnsCachePolicy) ttl(res *dnsResult, negative bool) time.Duration {
+	var ttl time.Duration
+	upper := p.maxTTL
+	if negative {
+		upper = p.maxNegTTL
+		ttl = upper
+		for _, rr := range res.ns {
+			if soa, ok := rr.(*mdns.SOA); ok {
+				ttl = time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+				break
+			}
+		}
+	} else {
+		lowest := uint32(0)
+		for i, rr := range res.answer {
+			if i == 0 || rr.Header().Ttl < lowest {
+				lowest = rr.Header().Ttl
+			}
+		}
+		ttl = time.Duration(lowest) * time.Second
+	}
+
+	if ttl > upper {
+		ttl = upper
+	}
+	if ttl < p.minTTL {
+		ttl = p.minTTL
+	}
+	return ttl
+}
+
+// capTTLs lowers the TTL of every record to at most ttl.
+func capTTLs(rrs []mdns.RR, ttl uint32) []mdns.RR {
+	for _, rr := range rrs {
+		if rr.Header().Ttl > ttl {
+			rr.Header().Ttl = ttl
+		}
+	}
+	return rrs
+}
+
+// copyRRs deep-copies records so cached entries are never mutated by callers.
+func copyRRs(rrs []mdns.RR) []mdns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	out := make([]mdns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = mdns.Copy(rr)
 	}
+	return out
 }
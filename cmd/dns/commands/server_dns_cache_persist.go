@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+// dnsCacheSnapshotVersion is bumped when the snapshot format changes; snapshots of
+// other versions are ignored.
+const dnsCacheSnapshotVersion = 1
+
+// dnsCacheSnapshot is the on-disk form of the answer cache. Records are kept in zone
+// file presentation format.
+type dnsCacheSnapshot struct {
+	Version int                     `json:"version"`
+	SavedAt time.Time               `json:"saved_at"`
+	Entries []dnsCacheSnapshotEntry `json:"entries"`
+}
+
+type dnsCacheSnapshotEntry struct {
+	Key      string        `json:"key"`
+	Rcode    int           `json:"rcode"`
+	Answer   []string      `json:"answer,omitempty"`
+	Ns       []string      `json:"ns,omitempty"`
+	Expires  time.Time     `json:"expires"`
+	TTL      time.Duration `json:"ttl"`
+	Negative bool          `json:"negative,omitempty"`
+	Security dnssecStatus  `json:"dnssec,omitempty"`
+}
+
+// save writes the cache to path, replacing the file atomically, and returns the
+// number of entries written. Entries past the serve-stale window are skipped.
+func (c *dnsAnswerCache) save(path string, now time.Time) (int, error) {
+	snap := dnsCacheSnapshot{Version: dnsCacheSnapshotVersion, SavedAt: now}
+	stale := time.Duration(c.serveStale.Load())
+	for _, e := range c.snapshot() {
+		if now.After(e.expires.Add(stale)) {
+			continue
+		}
+		se := dnsCacheSnapshotEntry{
+			Key:      e.key,
+			Rcode:    e.rcode,
+			Expires:  e.expires,
+			TTL:      e.ttl,
+			Negative: e.negative,
+			Security: e.security,
+		}
+		for _, rr := range e.answer {
+			se.Answer = append(se.Answer, rr.String())
+		}
+		for _, rr := range e.ns {
+			se.Ns = append(se.Ns, rr.String())
+		}
+		snap.Entries = append(snap.Entries, se)
+	}
+
+	data, err := json.Marshal(&snap)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	return len(snap.Entries), nil
+}
+
+// load warms the cache from a snapshot written by save and returns the number of
+// entries restored. Entries keep their original expiry, so only the remaining TTL is
+// served; expired ones are restored only while within the serve-stale window.
+// A missing file is not an error.
+func (c *dnsAnswerCache) load(path string, now time.Time) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+	var snap dnsCacheSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("failed to parse cache snapshot %s: %w", path, err)
+	}
+	if snap.Version != dnsCacheSnapshotVersion {
+		return 0, fmt.Errorf("cache snapshot %s has unsupported version %d", path, snap.Version)
+	}
+
+	stale := time.Duration(c.serveStale.Load())
+	restored := 0
+	for _, se := range snap.Entries {
+		if se.Key == "" || now.After(se.Expires.Add(stale)) {
+			continue
+		}
+		e := &dnsCacheEntry{
+			key:      se.Key,
+			rcode:    se.Rcode,
+			expires:  se.Expires,
+			ttl:      se.TTL,
+			negative: se.Negative,
+			security: se.Security,
+		}
+		if e.answer, err = parseSnapshotRRs(se.Answer); err == nil {
+			e.ns, err = parseSnapshotRRs(se.Ns)
+		}
+		if err != nil {
+			logger.Debugf("Skipping cache snapshot entry %s: %v", se.Key, err)
+			continue
+		}
+		c.insert(c.currentGeneration(), e)
+		restored++
+	}
+	return restored, nil
+}
+
+func parseSnapshotRRs(records []string) ([]mdns.RR, error) {
+	var out []mdns.RR
+	for _, s := range records {
+		rr, err := mdns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		if rr != nil {
+			out = append(out, rr)
+		}
+	}
+	return out, nil
+}
+
+// cachePersister saves the answer cache to a file periodically and when stopped.
+type cachePersister struct {
+	cache    *dnsAnswerCache
+	path     string
+	stopCh   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startCachePersister saves cache to path every interval (0 = only on stop).
+func startCachePersister(cache *dnsAnswerCache, path string, interval time.Duration) *cachePersister {
+	p := &cachePersister{
+		cache:  cache,
+		path:   path,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go p.run(interval)
+	return p
+}
+
+func (p *cachePersister) run(interval time.Duration) {
+	defer close(p.done)
+	if interval <= 0 {
+		<-p.stopCh
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.persist()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *cachePersister) persist() {
+	n, err := p.cache.save(p.path, time.Now())
+	if err != nil {
+		logger.Warn("Failed to save DNS cache to %s: %v", p.path, err)
+		return
+	}
+	logger.Debugf("Saved %d DNS cache entries to %s", n, p.path)
+}
+
+// stop ends periodic saving and saves the cache a last time. It is safe to call more
+// than once and on a nil *cachePersister.
+func (p *cachePersister) stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+		<-p.done
+		p.persist()
+	})
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+func TestDNSAnswerCacheSaveLoad(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "cache", "snapshot.json")
+	now := time.Now()
+
+	c := newShardedDNSAnswerCache(10, 1)
+	c.set(now, "fresh#1", &dnsResult{answer: []mdns.RR{testA("fresh", "1.1.1.1")}}, false, time.Minute)
+	soa, _ := mdns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")
+	c.set(now, "missing#1", &dnsResult{rcode: mdns.RcodeNameError, ns: []mdns.RR{soa}}, true, 30*time.Second)
+	c.set(now.Add(-time.Hour), "expired#1", &dnsResult{answer: []mdns.RR{testA("expired", "2.2.2.2")}}, false, time.Minute)
+
+	n, err := c.save(path, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("saved %d entries, want 2", n)
+	}
+
+	restored := newShardedDNSAnswerCache(10, 1)
+	later := now.Add(20 * time.Second)
+	if n, err := restored.load(path, later); err != nil || n != 2 {
+		t.Fatalf("loaded %d entries, err %v", n, err)
+	}
+	got, hit := restored.get(later, "fresh#1")
+	if !hit || got.answer[0].(*mdns.A).A.String() != "1.1.1.1" || got.answer[0].Header().Ttl != 40 {
+		t.Fatalf("fresh entry: %v hit=%v", got, hit)
+	}
+	got, hit = restored.get(later, "missing#1")
+	if !hit || got.rcode != mdns.RcodeNameError || len(got.ns) != 1 || got.ns[0].Header().Ttl != 10 {
+		t.Fatalf("negative entry: %v hit=%v", got, hit)
+	}
+
+	if n, _ := newShardedDNSAnswerCache(10, 1).load(path, now.Add(time.Hour)); n != 0 {
+		t.Fatalf("restored %d expired entries", n)
+	}
+}
+
+func TestDNSAnswerCacheLoadMissingOrInvalid(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	c := newShardedDNSAnswerCache(10, 1)
+	if n, err := c.load(filepath.Join(dir, "none.json"), time.Now()); n != 0 || err != nil {
+		t.Fatalf("missing snapshot: n=%d err=%v", n, err)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.load(bad, time.Now()); err == nil {
+		t.Fatal("expected error for a corrupt snapshot")
+	}
+}
+
+func TestCachePersisterSavesOnStop(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	c := newShardedDNSAnswerCache(10, 1)
+	c.set(time.Now(), "x#1", &dnsResult{answer: []mdns.RR{testA("x", "3.3.3.3")}}, false, time.Minute)
+
+	p := startCachePersister(c, path, 0)
+	p.stop()
+	p.stop()
+
+	if n, err := newShardedDNSAnswerCache(10, 1).load(path, time.Now()); err != nil || n != 1 {
+		t.Fatalf("loaded %d entries, err %v", n, err)
+	}
+}
@@ -1,10 +1,21 @@
 package commands
 
 import (
+	"fmt"
+	"net"
 	"testing"
 	"time"
+
+	mdns "github.com/miekg/dns"
 )
 
+func testA(name, ip string) mdns.RR {
+	return &mdns.A{
+		Hdr: mdns.RR_Header{Name: mdns.Fqdn(name), Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip).To4(),
+	}
+}
+
 func TestDNSCacheKey(t *testing.T) {
 	t.Parallel()
 	if dnsCacheKey("Example.COM.", 4) != "example.com#4" {
@@ -13,6 +24,9 @@ func TestDNSCacheKey(t *testing.T) {
 	if dnsCacheKey("a.b", 6) != "a.b#6" {
 		t.Fatal(dnsCacheKey("a.b", 6))
 	}
+	if dnsCacheKey("mail.example.com", mdns.TypeMX) != "mail.example.com#15" {
+		t.Fatal(dnsCacheKey("mail.example.com", mdns.TypeMX))
+	}
 }
 
 func TestDNSAnswerCachePositiveNegative(t *testing.T) {
@@ -25,26 +39,208 @@ func TestDNSAnswerCachePositiveNegative(t *testing.T) {
 		t.Fatal("unexpected hit")
 	}
 
-	c.set(now, key, []string{"1.1.1.1", "2.2.2.2"}, false, time.Minute)
+	c.set(now, key, &dnsResult{answer: []mdns.RR{testA("x", "1.1.1.1"), testA("x", "2.2.2.2")}}, false, time.Minute)
 	got, hit := c.get(now, key)
-	if !hit || len(got) != 2 || got[0] != "1.1.1.1" {
+	if !hit || len(got.answer) != 2 || got.answer[0].(*mdns.A).A.String() != "1.1.1.1" {
 		t.Fatalf("got %v hit=%v", got, hit)
 	}
+	if got.channel != "cache" {
+		t.Fatalf("channel %q", got.channel)
+	}
 
-	c.set(now, key, nil, true, time.Minute)
+	c.set(now, key, &dnsResult{rcode: mdns.RcodeNameError}, true, time.Minute)
 	got2, hit2 := c.get(now, key)
-	if !hit2 || len(got2) != 0 {
+	if !hit2 || len(got2.answer) != 0 || got2.rcode != mdns.RcodeNameError {
 		t.Fatalf("negative got %v hit=%v", got2, hit2)
 	}
 }
 
+func TestDNSAnswerCacheReturnsCopies(t *testing.T) {
+	t.Parallel()
+	c := newDNSAnswerCache(10)
+	now := time.Now()
+	c.set(now, "z#1", &dnsResult{answer: []mdns.RR{testA("z", "3.3.3.3")}}, false, time.Minute)
+
+	got, _ := c.get(now, "z#1")
+	got.answer[0].Header().Ttl = 1
+	again, _ := c.get(now, "z#1")
+	if again.answer[0].Header().Ttl != 60 {
+		t.Fatalf("cached record was mutated: ttl=%d", again.answer[0].Header().Ttl)
+	}
+}
+
 func TestDNSAnswerCacheExpiry(t *testing.T) {
 	t.Parallel()
 	c := newDNSAnswerCache(10)
 	now := time.Now()
 	key := "y#4"
-	c.set(now, key, []string{"9.9.9.9"}, false, 50*time.Millisecond)
+	c.set(now, key, &dnsResult{answer: []mdns.RR{testA("y", "9.9.9.9")}}, false, 50*time.Millisecond)
 	if _, hit := c.get(now.Add(100*time.Millisecond), key); hit {
 		t.Fatal("expected miss after expiry")
 	}
 }
+
+func TestDNSAnswerCacheLowersTTLs(t *testing.T) {
+	t.Parallel()
+	c := newDNSAnswerCache(10)
+	now := time.Now()
+	c.set(now, "t#1", &dnsResult{answer: []mdns.RR{testA("t", "4.4.4.4")}}, false, 45*time.Second)
+
+	got, _ := c.get(now, "t#1")
+	if ttl := got.answer[0].Header().Ttl; ttl != 45 {
+		t.Fatalf("ttl=%d, want 45", ttl)
+	}
+	got, _ = c.get(now.Add(20*time.Second), "t#1")
+	if ttl := got.answer[0].Header().Ttl; ttl != 25 {
+		t.Fatalf("ttl=%d, want 25", ttl)
+	}
+}
+
+func TestDNSAnswerCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+	c := newShardedDNSAnswerCache(2, 1)
+	now := time.Now()
+	c.set(now, "a#1", &dnsResult{answer: []mdns.RR{testA("a", "1.1.1.1")}}, false, time.Minute)
+	c.set(now, "b#1", &dnsResult{answer: []mdns.RR{testA("b", "2.2.2.2")}}, false, time.Minute)
+	c.get(now, "a#1")
+	c.set(now, "c#1", &dnsResult{answer: []mdns.RR{testA("c", "3.3.3.3")}}, false, time.Minute)
+
+	if _, hit := c.get(now, "b#1"); hit {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	for _, key := range []string{"a#1", "c#1"} {
+		if _, hit := c.get(now, key); !hit {
+			t.Fatalf("%s was evicted", key)
+		}
+	}
+	if c.len() != 2 || c.evictionCount() != 1 {
+		t.Fatalf("len=%d evictions=%d", c.len(), c.evictionCount())
+	}
+
+	c.resize(1)
+	if c.len() != 1 || c.evictionCount() != 2 {
+		t.Fatalf("after resize len=%d evictions=%d", c.len(), c.evictionCount())
+	}
+}
+
+func TestDNSAnswerCacheHoldsMaxEntries(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	for _, maxEntries := range []int{5, 20, 100} {
+		c := newDNSAnswerCache(maxEntries)
+		for i := 0; i < 10*maxEntries; i++ {
+			name := fmt.Sprintf("host%d", i)
+			c.set(now, name+"#1", &dnsResult{answer: []mdns.RR{testA(name, "10.0.0.1")}}, false, time.Minute)
+		}
+		if n := c.len(); n > maxEntries || n < maxEntries/2 {
+			t.Errorf("max_entries %d: cache holds %d entries", maxEntries, n)
+		}
+		total := 0
+		for _, s := range c.shards {
+			total += s.maxEntries
+		}
+		if total != maxEntries {
+			t.Errorf("max_entries %d: shard limits add up to %d", maxEntries, total)
+		}
+	}
+}
+
+func TestDNSAnswerCacheServeStale(t *testing.T) {
+	t.Parallel()
+	c := newDNSAnswerCache(10)
+	now := time.Now()
+	key := "s#1"
+	c.set(now, key, &dnsResult{answer: []mdns.RR{testA("s", "5.5.5.5")}}, false, time.Minute)
+
+	if _, ok := c.getStale(now.Add(2*time.Minute), key); ok {
+		t.Fatal("stale answer served while serve-stale is disabled")
+	}
+
+	c.setServeStale(time.Hour)
+	if _, ok := c.getStale(now, key); ok {
+		t.Fatal("fresh entry returned as stale")
+	}
+	if _, hit := c.get(now.Add(2*time.Minute), key); hit {
+		t.Fatal("expired entry returned by get")
+	}
+	got, ok := c.getStale(now.Add(2*time.Minute), key)
+	if !ok || got.channel != "stale" || got.answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("got %v ok=%v", got, ok)
+	}
+	if _, ok := c.getStale(now.Add(2*time.Hour), key); ok {
+		t.Fatal("entry served past the serve-stale window")
+	}
+}
+
+func TestDNSCachePolicyTTL(t *testing.T) {
+	t.Parallel()
+	p := dnsCachePolicy{minTTL: 10 * time.Second, maxTTL: 5 * time.Minute, maxNegTTL: time.Minute}
+	withTTL := func(rr mdns.RR, ttl uint32) mdns.RR {
+		rr.Header().Ttl = ttl
+		return rr
+	}
+	soa := func(ttl, minttl uint32) *mdns.SOA {
+		return &mdns.SOA{Hdr: mdns.RR_Header{Name: "example.com.", Rrtype: mdns.TypeSOA, Class: mdns.ClassINET, Ttl: ttl}, Minttl: minttl}
+	}
+
+	tests := []struct {
+		name     string
+		res      *dnsResult
+		negative bool
+		want     time.Duration
+	}{
+		{"lowest record TTL", &dnsResult{answer: []mdns.RR{withTTL(testA("x", "1.1.1.1"), 120), withTTL(testA("x", "2.2.2.2"), 90)}}, false, 90 * time.Second},
+		{"clamped to max", &dnsResult{answer: []mdns.RR{withTTL(testA("x", "1.1.1.1"), 86400)}}, false, 5 * time.Minute},
+		{"clamped to min", &dnsResult{answer: []mdns.RR{withTTL(testA("x", "1.1.1.1"), 0)}}, false, 10 * time.Second},
+		{"SOA minimum", &dnsResult{rcode: mdns.RcodeNameError, ns: []mdns.RR{soa(3600, 30)}}, true, 30 * time.Second},
+		{"SOA TTL", &dnsResult{rcode: mdns.RcodeNameError, ns: []mdns.RR{soa(20, 900)}}, true, 20 * time.Second},
+		{"negative max", &dnsResult{rcode: mdns.RcodeNameError, ns: []mdns.RR{soa(3600, 3600)}}, true, time.Minute},
+		{"negative without SOA", &dnsResult{}, true, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := p.ttl(tt.res, tt.negative); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDNSAnswerCachePrefetchDue(t *testing.T) {
+	t.Parallel()
+	c := newDNSAnswerCache(10)
+	now := time.Now()
+	key := "p#1"
+	c.set(now, key, &dnsResult{answer: []mdns.RR{testA("p", "6.6.6.6")}}, false, 1000*time.Second)
+
+	c.get(now, key)
+	c.get(now, key)
+	if c.prefetchDue(now.Add(500*time.Second), key, 0.1, 2) {
+		t.Fatal("prefetch due with half of the TTL left")
+	}
+	if c.prefetchDue(now.Add(950*time.Second), key, 0.1, 3) {
+		t.Fatal("prefetch due below min hits")
+	}
+	if !c.prefetchDue(now.Add(950*time.Second), key, 0.1, 2) {
+		t.Fatal("prefetch not due in the last 10% of the TTL")
+	}
+	if c.prefetchDue(now.Add(960*time.Second), key, 0.1, 2) {
+		t.Fatal("prefetch due twice for the same answer")
+	}
+
+	// A failed refresh leaves the answer cached: it is retried after a while
+	c.prefetchDone(now.Add(960*time.Second), key)
+	if c.prefetchDue(now.Add(961*time.Second), key, 0.1, 2) {
+		t.Fatal("prefetch due right after a failed refresh")
+	}
+	if !c.prefetchDue(now.Add(960*time.Second+cachePrefetchRetry), key, 0.1, 2) {
+		t.Fatal("prefetch not retried after a failed refresh")
+	}
+
+	// A successful refresh replaced the answer
+	c.set(now.Add(970*time.Second), key, &dnsResult{answer: []mdns.RR{testA("p", "6.6.6.6")}}, false, 1000*time.Second)
+	c.prefetchDone(now.Add(970*time.Second), key)
+	c.get(now.Add(970*time.Second), key)
+	c.get(now.Add(970*time.Second), key)
+	if !c.prefetchDue(now.Add(1920*time.Second), key, 0.1, 2) {
+		t.Fatal("prefetch not due for the refreshed answer")
+	}
+}
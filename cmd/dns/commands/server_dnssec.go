@@ -0,0 +1,825 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// dnssecStatus is the DNSSEC security status of an answer (RFC 4035 section 4.3).
+type dnssecStatus uint8
+
+const (
+	dnssecUnchecked dnssecStatus = iota // not validated: local data, or validation is off
+	dnssecInsecure                      // no chain of trust covers the answer
+	dnssecSecure                        // the chain of trust from an anchor verifies
+	dnssecBogus                         // signatures or proofs are missing or do not verify
+)
+
+const (
+	dnssecCutLimit = 10000 // zone cut entries kept by a validator
+	dnssecMinTTL   = 5 * time.Second
+	dnssecMaxTTL   = time.Hour
+	// NSEC3 records with more iterations are treated as insecure (RFC 9276).
+	dnssecMaxNSEC3Iterations = 150
+)
+
+// dnssecExchange sends a query with the DO and CD flags to the upstreams.
+type dnssecExchange func(name string, qtype uint16) (*mdns.Msg, error)
+
+// dnssecValidator validates upstream answers against the chain of trust from its
+// anchors, looking up the DS and DNSKEY records of every zone on the way through the
+// upstreams and caching what they prove. A nil *dnssecValidator validates nothing.
+type dnssecValidator struct {
+	anchors  map[string][]mdns.RR // DS and DNSKEY records by zone
+	negative []string             // zones treated as unsigned
+
+	mu   sync.Mutex
+	cuts map[string]*dnssecCut // by name, what its parent zone proves about it
+}
+
+// dnssecTrust is the closest enclosing zone of a name with its validated keys.
+type dnssecTrust struct {
+	zone string
+	keys []*mdns.DNSKEY // nil = the zone is insecure
+}
+
+type dnssecCutKind uint8
+
+const (
+	cutNone     dnssecCutKind = iota // not a zone cut, the name is in its parent's zone
+	cutSecure                        // a signed zone, keys verified from the parent's DS
+	cutInsecure                      // a delegation proven to have no DS
+	cutMissing                       // the name does not exist
+)
+
+type dnssecCut struct {
+	kind    dnssecCutKind
+	keys    []*mdns.DNSKEY
+	expires time.Time
+}
+
+// newDNSSECValidator returns the validator of cfg, or nil when validation is off.
+func newDNSSECValidator(cfg config.DNSSECConfig) (*dnssecValidator, error) {
+	if !cfg.Validate {
+		return nil, nil
+	}
+	anchors, err := cfg.ParseTrustAnchors()
+	if err != nil {
+		return nil, err
+	}
+	v := &dnssecValidator{anchors: make(map[string][]mdns.RR), cuts: make(map[string]*dnssecCut)}
+	for _, rr := range anchors {
+		zone := mdns.CanonicalName(rr.Header().Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	for _, domain := range cfg.NegativeTrustAnchors {
+		v.negative = append(v.negative, mdns.CanonicalName(domain))
+	}
+	return v, nil
+}
+
+// validate returns the security status of an upstream reply to qname/qtype: every
+// RRset of the answer must be signed by the keys of its zone, and the denial of
+// existence of a negative answer must be proven by signed NSEC or NSEC3 records.
+// The error tells why an answer is bogus.
+func (v *dnssecValidator) validate(reply *mdns.Msg, qname string, qtype uint16, exchange dnssecExchange) (dnssecStatus, error) {
+	if v == nil {
+		return dnssecUnchecked, nil
+	}
+	now := time.Now()
+	qname = mdns.CanonicalName(qname)
+	status := dnssecSecure
+
+	sets, sigs := rrsets(reply.Answer)
+	for _, set := range sets {
+		h := set[0].Header()
+		owner := mdns.CanonicalName(h.Name)
+		if h.Rrtype == mdns.TypeCNAME && synthesizedCNAME(set[0].(*mdns.CNAME), sets) {
+			continue // proven by its signed DNAME
+		}
+		trust, err := v.trustFor(owner, h.Rrtype, exchange, now)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if trust.keys == nil {
+			status = dnssecInsecure
+			continue
+		}
+		sig, err := verifyRRset(set, sigs[rrsetKey{owner, h.Rrtype}], trust, now)
+		if err != nil {
+			return dnssecBogus, fmt.Errorf("%s %s: %w", owner, mdns.TypeToString[h.Rrtype], err)
+		}
+		// Fewer labels than the owner: expanded from a wildcard, the name itself must not exist
+		if labels := mdns.CountLabel(owner); int(sig.Labels) < labels {
+			if err := verifyDenialRecords(reply.Ns, trust, now); err != nil {
+				return dnssecBogus, err
+			}
+			if s, err := proveWildcardExpansion(reply.Ns, owner, int(sig.Labels)); err != nil {
+				return dnssecBogus, fmt.Errorf("%s: %w", owner, err)
+			} else if s == dnssecInsecure {
+				status = dnssecInsecure
+			}
+		}
+	}
+
+	name := chainTarget(reply.Answer, qname, qtype)
+	for _, rr := range reply.Answer {
+		h := rr.Header()
+		if h.Rrtype != mdns.TypeRRSIG && mdns.CanonicalName(h.Name) == name && (h.Rrtype == qtype || qtype == mdns.TypeANY) {
+			return status, nil
+		}
+	}
+
+	// Negative answer for the last name of the chain
+	trust, err := v.trustFor(name, qtype, exchange, now)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if trust.keys == nil {
+		return dnssecInsecure, nil
+	}
+	if err := verifyDenialRecords(reply.Ns, trust, now); err != nil {
+		return dnssecBogus, err
+	}
+	var proof dnssecStatus
+	if reply.Rcode == mdns.RcodeNameError {
+		proof, err = proveNameError(reply.Ns, name)
+	} else {
+		proof, err = proveNoData(reply.Ns, name, qtype)
+	}
+	if err != nil {
+		return dnssecBogus, fmt.Errorf("%s %s: %w", name, mdns.TypeToString[qtype], err)
+	}
+	return min(status, proof), nil
+}
+
+// trustFor returns the keys that sign the rrtype records of name: those of the zone
+// of name, or of its parent zone for DS records.
+func (v *dnssecValidator) trustFor(name string, rrtype uint16, exchange dnssecExchange, now time.Time) (*dnssecTrust, error) {
+	if rrtype == mdns.TypeDS && name != "." {
+		i, _ := mdns.NextLabel(name, 0)
+		return v.trust(mdns.Fqdn(name[i:]), exchange, now)
+	}
+	return v.trust(name, exchange, now)
+}
+
+// trust walks down from the closest trust anchor of name, one label at a time, and
+// returns the closest enclosing zone of name with its keys.
+func (v *dnssecValidator) trust(name string, exchange dnssecExchange, now time.Time) (*dnssecTrust, error) {
+	for _, domain := range v.negative {
+		if mdns.IsSubDomain(domain, name) {
+			return &dnssecTrust{zone: domain}, nil
+		}
+	}
+
+	labels := mdns.SplitDomainName(name)
+	anchor := -1
+	for i := 0; i <= len(labels); i++ {
+		if _, ok := v.anchors[mdns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			anchor = i
+			break
+		}
+	}
+	if anchor < 0 {
+		return &dnssecTrust{zone: "."}, nil
+	}
+
+	zone := mdns.Fqdn(strings.Join(labels[anchor:], "."))
+	cut, err := v.cut(zone, now, func() (*dnssecCut, error) {
+		keys, ttl, err := zoneKeys(zone, v.anchors[zone], exchange, now)
+		if err != nil {
+			return nil, err
+		}
+		if keys == nil {
+			return &dnssecCut{kind: cutInsecure, expires: now.Add(ttl)}, nil
+		}
+		return &dnssecCut{kind: cutSecure, keys: keys, expires: now.Add(ttl)}, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("trust anchor %s: %w", zone, err)
+	}
+	if cut.kind == cutInsecure {
+		return &dnssecTrust{zone: zone}, nil
+	}
+
+	trust := &dnssecTrust{zone: zone, keys: cut.keys}
+	for i := anchor - 1; i >= 0; i-- {
+		child := mdns.Fqdn(strings.Join(labels[i:], "."))
+		parent := trust
+		cut, err := v.cut(child, now, func() (*dnssecCut, error) {
+			return lookupCut(parent, child, exchange, now)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", child, err)
+		}
+		switch cut.kind {
+		case cutSecure:
+			trust = &dnssecTrust{zone: child, keys: cut.keys}
+		case cutInsecure:
+			return &dnssecTrust{zone: child}, nil
+		case cutMissing:
+			return trust, nil
+		}
+	}
+	return trust, nil
+}
+
+// cut returns the cached cut of name, or looks it up and caches it.
+func (v *dnssecValidator) cut(name string, now time.Time, lookup func() (*dnssecCut, error)) (*dnssecCut, error) {
+	v.mu.Lock()
+	cut := v.cuts[name]
+	v.mu.Unlock()
+	if cut != nil && now.Before(cut.expires) {
+		return cut, nil
+	}
+
+	cut, err := lookup()
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cuts) >= dnssecCutLimit {
+		for key, c := range v.cuts {
+			if !now.Before(c.expires) {
+				delete(v.cuts, key)
+			}
+		}
+		if len(v.cuts) >= dnssecCutLimit {
+			clear(v.cuts)
+		}
+	}
+	v.cuts[name] = cut
+	return cut, nil
+}
+
+// lookupCut asks for the DS records of child, in the zone of parent, to find whether
+// child is a signed zone, an unsigned delegation or no zone cut at all.
+func lookupCut(parent *dnssecTrust, child string, exchange dnssecExchange, now time.Time) (*dnssecCut, error) {
+	reply, err := exchange(child, mdns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	sets, sigs := rrsets(reply.Answer)
+	for _, set := range sets {
+		h := set[0].Header()
+		if mdns.CanonicalName(h.Name) != child {
+			continue
+		}
+		switch h.Rrtype {
+		case mdns.TypeDS:
+			if _, err := verifyRRset(set, sigs[rrsetKey{child, mdns.TypeDS}], parent, now); err != nil {
+				return nil, fmt.Errorf("DS: %w", err)
+			}
+			keys, ttl, err := zoneKeys(child, set, exchange, now)
+			if err != nil {
+				return nil, err
+			}
+			ttl = min(ttl, cutTTL(set))
+			if keys == nil {
+				return &dnssecCut{kind: cutInsecure, expires: now.Add(ttl)}, nil
+			}
+			return &dnssecCut{kind: cutSecure, keys: keys, expires: now.Add(ttl)}, nil
+		case mdns.TypeCNAME:
+			// An alias is never a zone cut
+			return &dnssecCut{kind: cutNone, expires: now.Add(cutTTL(set))}, nil
+		}
+	}
+
+	if err := verifyDenialRecords(reply.Ns, parent, now); err != nil {
+		return nil, err
+	}
+	kind, err := proveNoDS(reply, child)
+	if err != nil {
+		return nil, fmt.Errorf("DS: %w", err)
+	}
+	return &dnssecCut{kind: kind, expires: now.Add(cutTTL(reply.Ns))}, nil
+}
+
+// proveNoDS tells from the NSEC or NSEC3 records of a reply without DS records for
+// name whether name is an unsigned delegation, no zone cut or does not exist.
+func proveNoDS(reply *mdns.Msg, name string) (dnssecCutKind, error) {
+	nsecs, nsec3s := denialRecords(reply.Ns)
+	switch {
+	case len(nsecs) > 0:
+		for _, nsec := range nsecs {
+			if mdns.CanonicalName(nsec.Hdr.Name) == name {
+				return cutKindOf(nsec.TypeBitMap, name)
+			}
+		}
+		for _, nsec := range nsecs {
+			if !nsecCovers(nsec, name) {
+				continue
+			}
+			if reply.Rcode == mdns.RcodeNameError {
+				return cutMissing, nil
+			}
+			if next := mdns.CanonicalName(nsec.NextDomain); next != name && mdns.IsSubDomain(name, next) {
+				return cutNone, nil // empty non-terminal
+			}
+		}
+		return 0, errors.New("no NSEC proves the absence of DS records")
+	case len(nsec3s) > 0:
+		if nsec3Unsupported(nsec3s) {
+			return cutInsecure, nil
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				return cutKindOf(nsec3.TypeBitMap, name)
+			}
+		}
+		if _, cover, ok := closestEncloser(nsec3s, name); ok {
+			if cover.Flags&1 != 0 { // opt-out: unsigned delegations may exist in the span
+				return cutInsecure, nil
+			}
+			if reply.Rcode == mdns.RcodeNameError {
+				return cutMissing, nil
+			}
+		}
+		return 0, errors.New("no NSEC3 proves the absence of DS records")
+	}
+	return 0, errors.New("missing NSEC or NSEC3 records")
+}
+
+// cutKindOf tells from the types an NSEC or NSEC3 record lists for name, known to have
+// no DS records, whether it is an unsigned delegation.
+func cutKindOf(types []uint16, name string) (dnssecCutKind, error) {
+	switch {
+	case hasType(types, mdns.TypeDS):
+		return 0, fmt.Errorf("denial of existence lists DS records for %s", name)
+	case hasType(types, mdns.TypeNS) && !hasType(types, mdns.TypeSOA):
+		return cutInsecure, nil
+	}
+	return cutNone, nil
+}
+
+// zoneKeys fetches the DNSKEY records of zone and returns them if one of the keys
+// trusted by anchors (DS or DNSKEY records) signs them. It returns no keys and no
+// error when no anchor uses a supported algorithm, making the zone insecure.
+func zoneKeys(zone string, anchors []mdns.RR, exchange dnssecExchange, now time.Time) ([]*mdns.DNSKEY, time.Duration, error) {
+	var trusted []mdns.RR
+	for _, rr := range anchors {
+		switch rr := rr.(type) {
+		case *mdns.DS:
+			if supportedAlgorithm(rr.Algorithm) && supportedDigest(rr.DigestType) {
+				trusted = append(trusted, rr)
+			}
+		case *mdns.DNSKEY:
+			if supportedAlgorithm(rr.Algorithm) {
+				trusted = append(trusted, rr)
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, dnssecMaxTTL, nil
+	}
+
+	reply, err := exchange(zone, mdns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	sets, sigs := rrsets(reply.Answer)
+	var set []mdns.RR
+	for _, s := range sets {
+		if h := s[0].Header(); h.Rrtype == mdns.TypeDNSKEY && mdns.CanonicalName(h.Name) == zone {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, 0, fmt.Errorf("no DNSKEY records for %s", zone)
+	}
+
+	for _, sig := range sigs[rrsetKey{zone, mdns.TypeDNSKEY}] {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, rr := range set {
+			key := rr.(*mdns.DNSKEY)
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && trustedKey(key, trusted) && sig.Verify(key, set) == nil {
+				keys := make([]*mdns.DNSKEY, 0, len(set))
+				for _, rr := range set {
+					keys = append(keys, rr.(*mdns.DNSKEY))
+				}
+				return keys, cutTTL(set), nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("no DNSKEY record of %s is signed by a trusted key", zone)
+}
+
+// trustedKey reports whether key matches one of the DS or DNSKEY records of trusted.
+func trustedKey(key *mdns.DNSKEY, trusted []mdns.RR) bool {
+	for _, rr := range trusted {
+		switch rr := rr.(type) {
+		case *mdns.DS:
+			if rr.KeyTag != key.KeyTag() || rr.Algorithm != key.Algorithm {
+				continue
+			}
+			if ds := key.ToDS(rr.DigestType); ds != nil && strings.EqualFold(ds.Digest, rr.Digest) {
+				return true
+			}
+		case *mdns.DNSKEY:
+			if rr.Algorithm == key.Algorithm && rr.Flags == key.Flags && rr.PublicKey == key.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case mdns.RSASHA1, mdns.RSASHA1NSEC3SHA1, mdns.RSASHA256, mdns.RSASHA512,
+		mdns.ECDSAP256SHA256, mdns.ECDSAP384SHA384, mdns.ED25519:
+		return true
+	}
+	return false
+}
+
+func supportedDigest(digest uint8) bool {
+	return digest == mdns.SHA1 || digest == mdns.SHA256 || digest == mdns.SHA384
+}
+
+// verifyRRset checks that one of sigs is a valid signature of set by the keys of trust
+// and returns it.
+func verifyRRset(set []mdns.RR, sigs []*mdns.RRSIG, trust *dnssecTrust, now time.Time) (*mdns.RRSIG, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("missing signature")
+	}
+	err := errors.New("no signature by a key of " + trust.zone)
+	for _, sig := range sigs {
+		if mdns.CanonicalName(sig.SignerName) != trust.zone {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			err = errors.New("signature expired or not yet valid")
+			continue
+		}
+		for _, key := range trust.keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if verr := sig.Verify(key, set); verr != nil {
+				err = verr
+				continue
+			}
+			return sig, nil
+		}
+	}
+	return nil, err
+}
+
+// verifyDenialRecords checks the signatures of the SOA, NSEC and NSEC3 records of the
+// authority section of a reply.
+func verifyDenialRecords(ns []mdns.RR, trust *dnssecTrust, now time.Time) error {
+	sets, sigs := rrsets(ns)
+	for _, set := range sets {
+		h := set[0].Header()
+		switch h.Rrtype {
+		case mdns.TypeSOA, mdns.TypeNSEC, mdns.TypeNSEC3:
+			owner := mdns.CanonicalName(h.Name)
+			if _, err := verifyRRset(set, sigs[rrsetKey{owner, h.Rrtype}], trust, now); err != nil {
+				return fmt.Errorf("%s %s: %w", owner, mdns.TypeToString[h.Rrtype], err)
+			}
+		}
+	}
+	return nil
+}
+
+// proveNameError checks that the NSEC or NSEC3 records of ns prove that name does
+// not exist and that no wildcard could have answered for it.
+func proveNameError(ns []mdns.RR, name string) (dnssecStatus, error) {
+	nsecs, nsec3s := denialRecords(ns)
+	switch {
+	case len(nsecs) > 0:
+		for _, nsec := range nsecs {
+			if !nsecCovers(nsec, name) {
+				continue
+			}
+			ce := nsecClosestEncloser(nsec, name)
+			for _, w := range nsecs {
+				if nsecCovers(w, "*."+ce) {
+					return dnssecSecure, nil
+				}
+			}
+			return 0, errors.New("no NSEC proves the absence of a wildcard")
+		}
+		return 0, errors.New("no NSEC proves the name does not exist")
+	case len(nsec3s) > 0:
+		if nsec3Unsupported(nsec3s) {
+			return dnssecInsecure, nil
+		}
+		ce, cover, ok := closestEncloser(nsec3s, name)
+		if !ok {
+			return 0, errors.New("no NSEC3 closest encloser proof")
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover("*." + ce) {
+				if cover.Flags&1 != 0 {
+					return dnssecInsecure, nil
+				}
+				return dnssecSecure, nil
+			}
+		}
+		return 0, errors.New("no NSEC3 proves the absence of a wildcard")
+	}
+	return 0, errors.New("missing NSEC or NSEC3 records")
+}
+
+// proveNoData checks that the NSEC or NSEC3 records of ns prove that name has no
+// qtype records, directly or through a wildcard.
+func proveNoData(ns []mdns.RR, name string, qtype uint16) (dnssecStatus, error) {
+	nsecs, nsec3s := denialRecords(ns)
+	switch {
+	case len(nsecs) > 0:
+		for _, nsec := range nsecs {
+			if mdns.CanonicalName(nsec.Hdr.Name) == name {
+				return noDataStatus(nsec.TypeBitMap, qtype)
+			}
+		}
+		for _, nsec := range nsecs {
+			if !nsecCovers(nsec, name) {
+				continue
+			}
+			if next := mdns.CanonicalName(nsec.NextDomain); next != name && mdns.IsSubDomain(name, next) {
+				return dnssecSecure, nil // empty non-terminal
+			}
+			wildcard := "*." + nsecClosestEncloser(nsec, name)
+			for _, w := range nsecs {
+				if mdns.CanonicalName(w.Hdr.Name) == wildcard {
+					return noDataStatus(w.TypeBitMap, qtype)
+				}
+			}
+		}
+		return 0, errors.New("no NSEC proves the absence of the type")
+	case len(nsec3s) > 0:
+		if nsec3Unsupported(nsec3s) {
+			return dnssecInsecure, nil
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				return noDataStatus(nsec3.TypeBitMap, qtype)
+			}
+		}
+		if ce, cover, ok := closestEncloser(nsec3s, name); ok {
+			if qtype == mdns.TypeDS && cover.Flags&1 != 0 {
+				return dnssecInsecure, nil
+			}
+			for _, nsec3 := range nsec3s {
+				if nsec3.Match("*." + ce) {
+					return noDataStatus(nsec3.TypeBitMap, qtype)
+				}
+			}
+		}
+		return 0, errors.New("no NSEC3 proves the absence of the type")
+	}
+	return 0, errors.New("missing NSEC or NSEC3 records")
+}
+
+func noDataStatus(types []uint16, qtype uint16) (dnssecStatus, error) {
+	if hasType(types, qtype) || hasType(types, mdns.TypeCNAME) {
+		return 0, fmt.Errorf("denial of existence lists %s records", mdns.TypeToString[qtype])
+	}
+	return dnssecSecure, nil
+}
+
+// proveWildcardExpansion checks that the NSEC or NSEC3 records of ns prove that name,
+// answered from a wildcard with labels labels, does not exist itself.
+func proveWildcardExpansion(ns []mdns.RR, name string, labels int) (dnssecStatus, error) {
+	nsecs, nsec3s := denialRecords(ns)
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return dnssecSecure, nil
+		}
+	}
+	if len(nsec3s) > 0 {
+		if nsec3Unsupported(nsec3s) {
+			return dnssecInsecure, nil
+		}
+		split := mdns.SplitDomainName(name)
+		nextCloser := mdns.Fqdn(strings.Join(split[len(split)-labels-1:], "."))
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(nextCloser) {
+				return dnssecSecure, nil
+			}
+		}
+	}
+	return 0, errors.New("no proof that the wildcard-expanded name does not exist")
+}
+
+// closestEncloser finds the closest encloser of name proven by nsec3s: the longest
+// existing ancestor, matched by an NSEC3, whose child towards name (the next closer
+// name) is covered by another one, returned as cover.
+func closestEncloser(nsec3s []*mdns.NSEC3, name string) (ce string, cover *mdns.NSEC3, ok bool) {
+	labels := mdns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		candidate := mdns.Fqdn(strings.Join(labels[i:], "."))
+		matched := false
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(candidate) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		nextCloser := mdns.Fqdn(strings.Join(labels[i-1:], "."))
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(nextCloser) {
+				return candidate, nsec3, true
+			}
+		}
+		return "", nil, false
+	}
+	return "", nil, false
+}
+
+// nsec3Unsupported reports whether the NSEC3 records use a hash or a number of
+// iterations that validators treat as insecure.
+func nsec3Unsupported(nsec3s []*mdns.NSEC3) bool {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash != mdns.SHA1 || nsec3.Iterations > dnssecMaxNSEC3Iterations {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name sorts strictly between the owner and the next name
+// of nsec, the last NSEC of a zone wrapping around to its apex.
+func nsecCovers(nsec *mdns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// nsecClosestEncloser returns the longest ancestor of name known to exist from an
+// NSEC covering it: the longest common ancestor with its owner or next name.
+func nsecClosestEncloser(nsec *mdns.NSEC, name string) string {
+	n := max(mdns.CompareDomainName(name, nsec.Hdr.Name), mdns.CompareDomainName(name, nsec.NextDomain))
+	labels := mdns.SplitDomainName(mdns.CanonicalName(name))
+	return mdns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// canonicalCompare orders names as in RFC 4034 section 6.1: label by label from the
+// root, case-insensitively.
+func canonicalCompare(a, b string) int {
+	la, lb := canonicalLabels(a), canonicalLabels(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// canonicalLabels returns the labels of name as lowercased octets, with escapes such as
+// "\000" decoded so that they sort by value.
+func canonicalLabels(name string) []string {
+	buf := make([]byte, 256)
+	end, err := mdns.PackDomainName(mdns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return mdns.SplitDomainName(strings.ToLower(name))
+	}
+	var labels []string
+	for off := 0; off < end && buf[off] != 0; off += int(buf[off]) + 1 {
+		label := buf[off+1 : off+1+int(buf[off])]
+		for i, c := range label {
+			if 'A' <= c && c <= 'Z' {
+				label[i] = c + 'a' - 'A'
+			}
+		}
+		labels = append(labels, string(label))
+	}
+	return labels
+}
+
+func denialRecords(ns []mdns.RR) (nsecs []*mdns.NSEC, nsec3s []*mdns.NSEC3) {
+	for _, rr := range ns {
+		switch rr := rr.(type) {
+		case *mdns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *mdns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// rrsets groups rrs into RRsets in order of appearance, with the signatures covering
+// each of them.
+func rrsets(rrs []mdns.RR) ([][]mdns.RR, map[rrsetKey][]*mdns.RRSIG) {
+	var sets [][]mdns.RR
+	index := make(map[rrsetKey]int)
+	sigs := make(map[rrsetKey][]*mdns.RRSIG)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*mdns.RRSIG); ok {
+			key := rrsetKey{mdns.CanonicalName(h.Name), sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey{mdns.CanonicalName(h.Name), h.Rrtype}
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []mdns.RR{rr})
+	}
+	return sets, sigs
+}
+
+// chainTarget follows the CNAME records of answer from qname and returns the last name.
+func chainTarget(answer []mdns.RR, qname string, qtype uint16) string {
+	if qtype == mdns.TypeCNAME {
+		return qname
+	}
+	for range answer {
+		next := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*mdns.CNAME); ok && mdns.CanonicalName(cname.Hdr.Name) == qname {
+				next = mdns.CanonicalName(cname.Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		qname = next
+	}
+	return qname
+}
+
+// synthesizedCNAME reports whether cname is the one a DNAME of sets synthesizes
+// (RFC 6672); such CNAME records are not signed.
+func synthesizedCNAME(cname *mdns.CNAME, sets [][]mdns.RR) bool {
+	owner := mdns.CanonicalName(cname.Hdr.Name)
+	for _, set := range sets {
+		dname, ok := set[0].(*mdns.DNAME)
+		if !ok {
+			continue
+		}
+		from := mdns.CanonicalName(dname.Hdr.Name)
+		if owner != from && mdns.IsSubDomain(from, owner) &&
+			mdns.CanonicalName(cname.Target) == strings.TrimSuffix(owner, from)+mdns.CanonicalName(dname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// cutTTL returns how long what rrs prove can be cached: their lowest TTL, within
+// dnssecMinTTL and dnssecMaxTTL.
+func cutTTL(rrs []mdns.RR) time.Duration {
+	ttl := dnssecMaxTTL
+	for _, rr := range rrs {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	return max(ttl, dnssecMinTTL)
+}
+
+// withoutDNSSEC returns rrs without the DNSSEC records of answers to clients that did
+// not set the DO flag (RFC 3225), unless qtype asks for them.
+func withoutDNSSEC(rrs []mdns.RR, qtype uint16) []mdns.RR {
+	dnssec := func(rr mdns.RR) bool {
+		switch t := rr.Header().Rrtype; t {
+		case mdns.TypeRRSIG, mdns.TypeNSEC, mdns.TypeNSEC3:
+			return t != qtype
+		}
+		return false
+	}
+	if !slices.ContainsFunc(rrs, dnssec) {
+		return rrs
+	}
+	out := make([]mdns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if !dnssec(rr) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,443 @@
+package commands
+
+import (
+	"crypto"
+	"encoding/base32"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+const (
+	// dnssecSignatureValidity is how long signatures are valid; they are made again once
+	// half of it has passed.
+	dnssecSignatureValidity = 7 * 24 * time.Hour
+	dnssecSignatureLimit    = 10000 // signed RRsets kept per zone
+	dnssecDNSKEYTTL         = 3600  // when the key file has none
+)
+
+// nsec3Hex encodes NSEC3 hashed owner names (RFC 5155 section 3.3).
+var nsec3Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// dnssecSigner signs the answers of its zones on the fly (RFC 4470). A nil
+// *dnssecSigner signs nothing.
+type dnssecSigner struct {
+	zones []*signedZone // most specific first
+}
+
+// signedZone is a zone whose local answers are signed with its keys. Existence is
+// denied with "white lies": NSEC or NSEC3 records covering just the names to deny,
+// since names matched by hosts patterns cannot be listed in a chain.
+type signedZone struct {
+	origin string        // lowercased FQDN
+	zone   *authZone     // the local zone of the same origin, nil when answered from hosts
+	soa    *mdns.SOA     // of zone, or made up for hosts
+	ksks   []*signingKey // sign the DNSKEY RRset
+	zsks   []*signingKey // sign the other RRsets
+	dnskey []mdns.RR
+	nsec3  bool
+
+	mu   sync.Mutex
+	sigs map[string]*signedRRset // by rrsetID
+}
+
+type signingKey struct {
+	dnskey *mdns.DNSKEY
+	signer crypto.Signer
+}
+
+type signedRRset struct {
+	sigs    []*mdns.RRSIG
+	refresh time.Time
+}
+
+// newDNSSECSigner reads the keys of the signed zones, or returns nil when none is
+// configured. Zones with a local zone of the same origin are signed from it, the
+// others are answered from hosts with an SOA made up from ttl.
+func newDNSSECSigner(signs []config.DNSSECSignConfig, zones *zoneSet, ttl uint32) (*dnssecSigner, error) {
+	if len(signs) == 0 {
+		return nil, nil
+	}
+	s := &dnssecSigner{}
+	for _, sc := range signs {
+		z := &signedZone{origin: mdns.Fqdn(sc.Zone), nsec3: sc.NSEC3, sigs: make(map[string]*signedRRset)}
+		for _, path := range sc.Keys {
+			key, err := readSigningKey(path, z.origin)
+			if err != nil {
+				return nil, err
+			}
+			if key.dnskey.Flags&mdns.SEP != 0 {
+				z.ksks = append(z.ksks, key)
+			} else {
+				z.zsks = append(z.zsks, key)
+			}
+			z.dnskey = append(z.dnskey, key.dnskey)
+		}
+		// A single kind of key signs everything (combined signing keys)
+		if len(z.ksks) == 0 {
+			z.ksks = z.zsks
+		}
+		if len(z.zsks) == 0 {
+			z.zsks = z.ksks
+		}
+
+		if zone := zones.find(z.origin); zone != nil && zone.origin == z.origin {
+			z.zone, z.soa = zone, zone.soa
+		} else {
+			z.soa = &mdns.SOA{
+				Hdr:     mdns.RR_Header{Name: z.origin, Rrtype: mdns.TypeSOA, Class: mdns.ClassINET, Ttl: ttl},
+				Ns:      z.origin,
+				Mbox:    "hostmaster." + z.origin,
+				Serial:  uint32(time.Now().Unix()),
+				Refresh: 3600,
+				Retry:   600,
+				Expire:  86400,
+				Minttl:  ttl,
+			}
+		}
+
+		for _, key := range z.ksks {
+			logger.Info("Signing zone %s with key %d, publish in the parent zone: %s", z.origin, key.dnskey.KeyTag(), key.dnskey.ToDS(mdns.SHA256))
+		}
+		s.zones = append(s.zones, z)
+	}
+	sort.Slice(s.zones, func(i, j int) bool {
+		return mdns.CountLabel(s.zones[i].origin) > mdns.CountLabel(s.zones[j].origin)
+	})
+	return s, nil
+}
+
+// readSigningKey reads a BIND key pair: path.key has the DNSKEY record and
+// path.private the private key.
+func readSigningKey(path, origin string) (*signingKey, error) {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".key"), ".private")
+	pub, err := os.ReadFile(path + ".key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	rr, err := mdns.NewRR(string(pub))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %s.key: %w", path, err)
+	}
+	dnskey, ok := rr.(*mdns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("key %s.key: want a DNSKEY record", path)
+	}
+	dnskey.Hdr.Name = mdns.CanonicalName(dnskey.Hdr.Name)
+	if dnskey.Hdr.Name != origin {
+		return nil, fmt.Errorf("key %s.key is for zone %s, not %s", path, dnskey.Hdr.Name, origin)
+	}
+	if dnskey.Flags&mdns.ZONE == 0 || dnskey.Protocol != 3 || !supportedAlgorithm(dnskey.Algorithm) {
+		return nil, fmt.Errorf("key %s.key is not a zone signing key of a supported algorithm", path)
+	}
+	if dnskey.Hdr.Ttl == 0 {
+		dnskey.Hdr.Ttl = dnssecDNSKEYTTL
+	}
+
+	f, err := os.Open(path + ".private")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	defer f.Close()
+	private, err := dnskey.ReadPrivateKey(f, path+".private")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %s.private: %w", path, err)
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key %s.private cannot sign", path)
+	}
+	return &signingKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// find returns the most specific signed zone containing name, or nil.
+func (s *dnssecSigner) find(name string) *signedZone {
+	if s == nil {
+		return nil
+	}
+	for _, z := range s.zones {
+		if mdns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// apex answers the DNSKEY question of the zone, and its SOA question when it is answered
+// from hosts, or returns nil.
+func (z *signedZone) apex(name string, qtype uint16) *dnsResult {
+	if z == nil || name != z.origin {
+		return nil
+	}
+	switch {
+	case qtype == mdns.TypeDNSKEY:
+		return &dnsResult{answer: copyRRs(z.dnskey), authoritative: true, channel: "zone"}
+	case qtype == mdns.TypeSOA && z.zone == nil:
+		return &dnsResult{answer: []mdns.RR{mdns.Copy(z.soa)}, authoritative: true, channel: "zone"}
+	}
+	return nil
+}
+
+// negativeSOA returns the SOA for the authority section of negative answers.
+func (z *signedZone) negativeSOA() []mdns.RR {
+	soa := mdns.Copy(z.soa).(*mdns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return []mdns.RR{soa}
+}
+
+// sign returns rrs followed by the signatures of its RRsets in the zone.
+func (z *signedZone) sign(rrs []mdns.RR, now time.Time) []mdns.RR {
+	// rrs may be a cached answer, never append to it in place
+	rrs = slices.Clip(rrs)
+	sets, _ := rrsets(rrs)
+	for _, set := range sets {
+		if mdns.IsSubDomain(z.origin, set[0].Header().Name) {
+			rrs = append(rrs, z.signatures(set, now)...)
+		}
+	}
+	return rrs
+}
+
+// signatures returns the RRSIGs of set, made once per dnssecSignatureValidity/2 and
+// then with the TTL of set.
+func (z *signedZone) signatures(set []mdns.RR, now time.Time) []mdns.RR {
+	id := rrsetID(set)
+	z.mu.Lock()
+	signed := z.sigs[id]
+	z.mu.Unlock()
+
+	if signed == nil || !now.Before(signed.refresh) {
+		keys := z.zsks
+		if set[0].Header().Rrtype == mdns.TypeDNSKEY {
+			keys = z.ksks
+		}
+		signed = &signedRRset{refresh: now.Add(dnssecSignatureValidity / 2)}
+		for _, key := range keys {
+			sig := &mdns.RRSIG{
+				Algorithm:  key.dnskey.Algorithm,
+				KeyTag:     key.dnskey.KeyTag(),
+				SignerName: z.origin,
+				Inception:  uint32(now.Add(-time.Hour).Unix()),
+				Expiration: uint32(now.Add(dnssecSignatureValidity).Unix()),
+			}
+			if err := sig.Sign(key.signer, set); err != nil {
+				logger.Warn("[dnssec] Failed to sign %s %s with key %d: %v", set[0].Header().Name, mdns.TypeToString[set[0].Header().Rrtype], sig.KeyTag, err)
+				continue
+			}
+			signed.sigs = append(signed.sigs, sig)
+		}
+
+		z.mu.Lock()
+		if len(z.sigs) >= dnssecSignatureLimit {
+			for key, s := range z.sigs {
+				if !now.Before(s.refresh) {
+					delete(z.sigs, key)
+				}
+			}
+			if len(z.sigs) >= dnssecSignatureLimit {
+				clear(z.sigs)
+			}
+		}
+		z.sigs[id] = signed
+		z.mu.Unlock()
+	}
+
+	out := make([]mdns.RR, 0, len(signed.sigs))
+	for _, sig := range signed.sigs {
+		cp := mdns.Copy(sig).(*mdns.RRSIG)
+		cp.Hdr.Ttl = min(set[0].Header().Ttl, sig.OrigTtl)
+		out = append(out, cp)
+	}
+	return out
+}
+
+// rrsetID identifies an RRset by its records, whatever their TTL and order.
+func rrsetID(set []mdns.RR) string {
+	lines := make([]string, len(set))
+	for i, rr := range set {
+		cp := mdns.Copy(rr)
+		cp.Header().Ttl = 0
+		lines[i] = cp.String()
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// dnssecTypes returns the types of the local data at a name, and whether it exists.
+type dnssecTypes func(name string) ([]uint16, bool)
+
+// dnssecAliasTypes are listed by the NSEC records of names aliased in hosts: they have
+// the types of their target, unknown without querying it.
+var dnssecAliasTypes = []uint16{
+	mdns.TypeA, mdns.TypeAAAA, mdns.TypeMX, mdns.TypeTXT, mdns.TypeSRV, mdns.TypeCAA, mdns.TypeSVCB, mdns.TypeHTTPS,
+}
+
+// deny returns the signed NSEC or NSEC3 records proving that name has no qtype records
+// (RFC 4035 section 3.1.3) or does not exist, as told by lookup.
+func (z *signedZone) deny(name string, qtype uint16, lookup dnssecTypes, now time.Time) []mdns.RR {
+	types, exists := lookup(name)
+	types = slices.DeleteFunc(slices.Clone(types), func(t uint16) bool { return t == qtype })
+	var proof []mdns.RR
+	switch {
+	case exists && z.nsec3:
+		proof = []mdns.RR{z.nsec3Match(name, types)}
+	case exists:
+		proof = []mdns.RR{z.newNSEC(name, `\000.`+name, z.bitmap(name, types))}
+	default:
+		// The closest encloser exists, its child towards name and the wildcard below it do not
+		ce, nextCloser := z.origin, name
+		for n := name; n != z.origin; {
+			i, _ := mdns.NextLabel(n, 0)
+			parent := n[i:]
+			if _, ok := lookup(parent); ok || parent == z.origin {
+				ce, nextCloser = parent, n
+				break
+			}
+			n = parent
+		}
+		wildcard := "*." + ce
+		if z.nsec3 {
+			ceTypes, _ := lookup(ce)
+			proof = []mdns.RR{z.nsec3Match(ce, ceTypes), z.nsec3Cover(nextCloser), z.nsec3Cover(wildcard)}
+		} else {
+			proof = []mdns.RR{z.nsecCover(nextCloser, lookup), z.nsecCover(wildcard, lookup)}
+		}
+	}
+
+	var ns []mdns.RR
+	seen := make(map[string]bool)
+	for _, rr := range proof {
+		if !seen[rr.Header().Name] {
+			seen[rr.Header().Name] = true
+			ns = append(ns, rr)
+			ns = append(ns, z.signatures([]mdns.RR{rr}, now)...)
+		}
+	}
+	return ns
+}
+
+// bitmap returns the types listed by the NSEC or NSEC3 record of name.
+func (z *signedZone) bitmap(name string, types []uint16) []uint16 {
+	types = slices.Clone(types)
+	if name == z.origin {
+		types = append(types, mdns.TypeSOA, mdns.TypeDNSKEY)
+	}
+	if !z.nsec3 {
+		types = append(types, mdns.TypeNSEC)
+	}
+	// An NSEC3 record of an empty non-terminal has an empty bitmap
+	if len(types) > 0 {
+		types = append(types, mdns.TypeRRSIG)
+	}
+	slices.Sort(types)
+	return slices.Compact(types)
+}
+
+func (z *signedZone) newNSEC(owner, next string, types []uint16) *mdns.NSEC {
+	return &mdns.NSEC{
+		Hdr:        mdns.RR_Header{Name: owner, Rrtype: mdns.TypeNSEC, Class: mdns.ClassINET, Ttl: z.negativeSOA()[0].Header().Ttl},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// nsecCover returns an NSEC record whose owner and next names are the closest names
+// before and after name (RFC 4471), so that it denies name and its subdomains only.
+func (z *signedZone) nsecCover(name string, lookup dnssecTypes) *mdns.NSEC {
+	i, _ := mdns.NextLabel(name, 0)
+	parent := name[i:]
+	label := []byte(canonicalLabels(name)[0])
+
+	// The next name appends a zero octet to the first label (or increments its last
+	// octet when the label is full). The owner decrements the last octet and fills the
+	// label with 0xff octets, or when it is a zero octet, is the last subdomain of the
+	// label without it.
+	next := append(slices.Clone(label), 0)
+	if len(label) == 63 {
+		next = slices.Clone(label)
+		next[62]++
+	}
+	fill := func(label []byte, room int) []byte {
+		for len(label) < 63 && len(label) < room {
+			label = append(label, 0xff)
+		}
+		return label
+	}
+	owner := parent
+	switch last := label[len(label)-1]; {
+	case last > 0:
+		prev := append(slices.Clone(label[:len(label)-1]), last-1)
+		if 'A' <= last-1 && last-1 <= 'Z' {
+			// Uppercase octets sort as lowercase, skip them
+			prev[len(prev)-1] = 'A' - 1
+		}
+		owner = escapeLabel(fill(prev, 252-len(parent))) + "." + parent
+	case len(label) > 1:
+		prev := label[:len(label)-1]
+		owner = escapeLabel(fill(nil, 251-len(prev)-len(parent))) + "." + escapeLabel(prev) + "." + parent
+	}
+
+	types, _ := lookup(owner)
+	return z.newNSEC(owner, escapeLabel(next)+"."+parent, z.bitmap(owner, types))
+}
+
+// escapeLabel returns the presentation format of a label of any octets.
+func escapeLabel(label []byte) string {
+	var b strings.Builder
+	for _, c := range label {
+		if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "\\%03d", c)
+		}
+	}
+	return b.String()
+}
+
+func (z *signedZone) newNSEC3(hash []byte, next []byte, types []uint16) *mdns.NSEC3 {
+	return &mdns.NSEC3{
+		Hdr:        mdns.RR_Header{Name: strings.ToLower(nsec3Hex.EncodeToString(hash)) + "." + z.origin, Rrtype: mdns.TypeNSEC3, Class: mdns.ClassINET, Ttl: z.negativeSOA()[0].Header().Ttl},
+		Hash:       mdns.SHA1,
+		HashLength: uint8(len(next)),
+		NextDomain: nsec3Hex.EncodeToString(next),
+		TypeBitMap: types,
+	}
+}
+
+// nsec3Match returns the NSEC3 record matching name with its types. Hashes are made
+// without salt nor extra iterations (RFC 9276).
+func (z *signedZone) nsec3Match(name string, types []uint16) *mdns.NSEC3 {
+	hash := nsec3Hash(name)
+	return z.newNSEC3(hash, nsec3Step(hash, 1), z.bitmap(name, types))
+}
+
+// nsec3Cover returns an NSEC3 record covering the hash of name only.
+func (z *signedZone) nsec3Cover(name string) *mdns.NSEC3 {
+	hash := nsec3Hash(name)
+	return z.newNSEC3(nsec3Step(hash, -1), nsec3Step(hash, 1), nil)
+}
+
+func nsec3Hash(name string) []byte {
+	hash, _ := nsec3Hex.DecodeString(mdns.HashName(name, mdns.SHA1, 0, ""))
+	return hash
+}
+
+// nsec3Step returns hash plus delta (1 or -1), wrapping around.
+func nsec3Step(hash []byte, delta int) []byte {
+	out := slices.Clone(hash)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] += byte(delta)
+		if (delta > 0 && out[i] != 0) || (delta < 0 && out[i] != 0xff) {
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,197 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// writeSigningKey generates an ECDSA key of zone as BIND key files in dir and returns
+// their path without extension.
+func writeSigningKey(t *testing.T, dir, zone string, flags uint16) (string, *mdns.DNSKEY) {
+	t.Helper()
+	key := &mdns.DNSKEY{
+		Hdr:       mdns.RR_Header{Name: mdns.Fqdn(zone), Rrtype: mdns.TypeDNSKEY, Class: mdns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: mdns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "K"+mdns.Fqdn(zone)+"+013+"+strings.TrimSpace(string(rune('0'+flags%10))))
+	if err := os.WriteFile(path+".key", []byte("; generated for tests\n"+key.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".private", []byte(key.PrivateKeyString(private)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+// newSigningTestHandler returns a handler signing corp.example. from hosts and the test
+// zone corp.internal., and a validator anchored at their key signing keys. Only the
+// target of the db.corp.example. alias may be asked upstream.
+func newSigningTestHandler(t *testing.T, nsec3 bool) (*queryHandler, *dnssecValidator) {
+	t.Helper()
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		if q := r.Question[0]; q.Name != "db.cloud.test." {
+			t.Errorf("unexpected upstream query for %s", q.Name)
+		} else if q.Qtype == mdns.TypeA {
+			m.Answer = append(m.Answer, newRR(t, "db.cloud.test. 60 IN A 192.0.2.50"))
+		}
+		w.WriteMsg(m)
+	})
+	cfg := &config.Config{Hosts: config.HostsConfig{
+		"corp.example":        "192.0.2.1",
+		"www.corp.example":    "192.0.2.10",
+		"mail.corp.example":   map[string]interface{}{"a": "192.0.2.25", "txt": []interface{}{"v=spf1 -all"}},
+		"*.apps.corp.example": "192.0.2.30",
+		"a.b.corp.example":    "192.0.2.40",
+		"db.corp.example":     "db.cloud.test",
+		"other.example":       "192.0.2.99",
+	}}
+	h := newTestHandler(t, cfg, upstream)
+
+	zones, err := loadZones([]config.ZoneConfig{{File: writeTestZone(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.zones = zones
+
+	dir := t.TempDir()
+	var signs []config.DNSSECSignConfig
+	var anchors []string
+	for _, zone := range []string{"corp.example", "corp.internal"} {
+		ksk, key := writeSigningKey(t, dir, zone, mdns.ZONE|mdns.SEP)
+		zsk, _ := writeSigningKey(t, dir, zone, mdns.ZONE)
+		signs = append(signs, config.DNSSECSignConfig{Zone: zone, Keys: []string{ksk + ".key", zsk}, NSEC3: nsec3})
+		anchors = append(anchors, key.ToDS(mdns.SHA256).String())
+	}
+	if h.signer, err = newDNSSECSigner(signs, zones, uint32(h.ttl)); err != nil {
+		t.Fatal(err)
+	}
+	validator, err := newDNSSECValidator(config.DNSSECConfig{Validate: true, TrustAnchors: anchors})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, validator
+}
+
+func TestQueryHandlerSignsLocalAnswers(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer uint16 // type of the answer, 0 for none
+	}{
+		{"corp.example", mdns.TypeDNSKEY, mdns.RcodeSuccess, mdns.TypeDNSKEY},
+		{"corp.example", mdns.TypeSOA, mdns.RcodeSuccess, mdns.TypeSOA},
+		{"corp.example", mdns.TypeA, mdns.RcodeSuccess, mdns.TypeA},
+		{"corp.example", mdns.TypeMX, mdns.RcodeSuccess, 0},
+		{"www.corp.example", mdns.TypeA, mdns.RcodeSuccess, mdns.TypeA},
+		{"WWW.Corp.Example", mdns.TypeAAAA, mdns.RcodeSuccess, 0},
+		{"mail.corp.example", mdns.TypeTXT, mdns.RcodeSuccess, mdns.TypeTXT},
+		{"mail.corp.example", mdns.TypeMX, mdns.RcodeSuccess, 0},
+		{"x.apps.corp.example", mdns.TypeA, mdns.RcodeSuccess, mdns.TypeA},
+		{"b.corp.example", mdns.TypeA, mdns.RcodeSuccess, 0},
+		{"db.corp.example", mdns.TypeA, mdns.RcodeSuccess, mdns.TypeA},
+		{"db.corp.example", mdns.TypeTXT, mdns.RcodeSuccess, 0},
+		{"missing.corp.example", mdns.TypeA, mdns.RcodeNameError, 0},
+		{"a.missing.corp.example", mdns.TypeTXT, mdns.RcodeNameError, 0},
+		{"c.b.corp.example", mdns.TypeA, mdns.RcodeNameError, 0},
+		{"corp.internal", mdns.TypeDNSKEY, mdns.RcodeSuccess, mdns.TypeDNSKEY},
+		{"www.corp.internal", mdns.TypeAAAA, mdns.RcodeSuccess, mdns.TypeAAAA},
+		{"mail.corp.internal", mdns.TypeAAAA, mdns.RcodeSuccess, 0},
+		{"web.corp.internal", mdns.TypeA, mdns.RcodeSuccess, mdns.TypeCNAME},
+		{"web.corp.internal", mdns.TypeMX, mdns.RcodeSuccess, mdns.TypeCNAME},
+		{"old.corp.internal", mdns.TypeA, mdns.RcodeNameError, mdns.TypeCNAME},
+		{"x.apps.corp.internal", mdns.TypeA, mdns.RcodeSuccess, mdns.TypeA},
+		{"b.c.corp.internal", mdns.TypeA, mdns.RcodeSuccess, 0},
+		{"sub.corp.internal", mdns.TypeDS, mdns.RcodeSuccess, 0},
+		{"missing.corp.internal", mdns.TypeA, mdns.RcodeNameError, 0},
+	}
+	for _, nsec3 := range []bool{false, true} {
+		h, validator := newSigningTestHandler(t, nsec3)
+		exchange := func(name string, qtype uint16) (*mdns.Msg, error) {
+			return h.serveDNS(dnssecQuery(name, qtype, true, true)), nil
+		}
+		for _, tt := range tests {
+			reply := h.serveDNS(dnssecQuery(tt.name, tt.qtype, true, false))
+			if reply.Rcode != tt.rcode {
+				t.Errorf("nsec3=%v %s %s: rcode %s, want %s", nsec3, tt.name, mdns.TypeToString[tt.qtype], mdns.RcodeToString[reply.Rcode], mdns.RcodeToString[tt.rcode])
+				continue
+			}
+			if tt.answer != 0 && countType(reply.Answer, tt.answer) == 0 || tt.answer == 0 && len(reply.Answer) > 0 {
+				t.Errorf("nsec3=%v %s %s: answer %v", nsec3, tt.name, mdns.TypeToString[tt.qtype], reply.Answer)
+				continue
+			}
+			status, err := validator.validate(reply, mdns.Fqdn(strings.ToLower(tt.name)), tt.qtype, exchange)
+			if status != dnssecSecure {
+				t.Errorf("nsec3=%v %s %s: %v (%v), reply:\n%v", nsec3, tt.name, mdns.TypeToString[tt.qtype], status, err, reply)
+			}
+		}
+
+		// Referrals prove that the delegation is not signed
+		reply := h.serveDNS(dnssecQuery("ns.sub.corp.internal", mdns.TypeA, true, false))
+		if countType(reply.Ns, mdns.TypeNS) == 0 || countType(reply.Ns, mdns.TypeNSEC)+countType(reply.Ns, mdns.TypeNSEC3) == 0 || countType(reply.Ns, mdns.TypeRRSIG) == 0 {
+			t.Errorf("nsec3=%v: referral without a signed proof of no DS: %v", nsec3, reply.Ns)
+		}
+
+		// Without DO, nor for names out of the signed zones, nothing is signed
+		for _, req := range []*dnsRequest{dnssecQuery("www.corp.example", mdns.TypeA, false, false), dnssecQuery("other.example", mdns.TypeA, true, false)} {
+			reply := h.serveDNS(req)
+			if len(reply.Answer) != 1 || countType(reply.Ns, mdns.TypeRRSIG) > 0 {
+				t.Errorf("nsec3=%v %s: unexpected signed answer %v", nsec3, req.msg.Question[0].Name, reply)
+			}
+		}
+	}
+}
+
+func TestNewDNSSECSignerKeyErrors(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	other, _ := writeSigningKey(t, dir, "other.example", mdns.ZONE|mdns.SEP)
+	for _, keys := range [][]string{{other}, {filepath.Join(dir, "missing")}} {
+		if _, err := newDNSSECSigner([]config.DNSSECSignConfig{{Zone: "corp.example", Keys: keys}}, nil, 500); err == nil {
+			t.Errorf("keys %v: expected an error", keys)
+		}
+	}
+}
+
+func TestNSECCoverDeniesOnlyName(t *testing.T) {
+	t.Parallel()
+	z := &signedZone{origin: "corp.example.", soa: &mdns.SOA{Hdr: mdns.RR_Header{Name: "corp.example.", Ttl: 300}, Minttl: 60}}
+	none := func(string) ([]uint16, bool) { return nil, false }
+	tests := []struct {
+		name     string
+		notCover []string
+	}{
+		{"b.corp.example.", []string{"a.corp.example.", "az.corp.example.", "b0.corp.example.", "c.corp.example.", "corp.example."}},
+		{`a\[.corp.example.`, []string{"a.corp.example.", "a0.corp.example.", `a\[0.corp.example.`}},
+		{`b\000.corp.example.`, []string{"b.corp.example.", "a.b.corp.example.", `b\000\000.corp.example.`}},
+		{"*.corp.example.", []string{"corp.example.", "-.corp.example.", "a.corp.example."}},
+	}
+	for _, tt := range tests {
+		nsec := z.nsecCover(tt.name, none)
+		if !nsecCovers(nsec, tt.name) || !nsecCovers(nsec, "x."+tt.name) {
+			t.Errorf("%v does not cover %s and its subdomains", nsec, tt.name)
+		}
+		for _, name := range tt.notCover {
+			if nsecCovers(nsec, name) {
+				t.Errorf("%v covers %s", nsec, name)
+			}
+		}
+		if _, err := mdns.NewRR(nsec.String()); err != nil {
+			t.Errorf("%v: %v", nsec, err)
+		}
+	}
+}
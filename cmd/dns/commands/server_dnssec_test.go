@@ -0,0 +1,336 @@
+package commands
+
+import (
+	"crypto"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// testSigner signs the records of a test zone with a single ECDSA key.
+type testSigner struct {
+	key  *mdns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSigner(t *testing.T, zone string) *testSigner {
+	t.Helper()
+	key := &mdns.DNSKEY{
+		Hdr:       mdns.RR_Header{Name: zone, Rrtype: mdns.TypeDNSKEY, Class: mdns.ClassINET, Ttl: 3600},
+		Flags:     mdns.ZONE | mdns.SEP,
+		Protocol:  3,
+		Algorithm: mdns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the RRset rrs followed by its signature.
+func (s *testSigner) sign(t *testing.T, rrs ...mdns.RR) []mdns.RR {
+	t.Helper()
+	sig := &mdns.RRSIG{
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.key.Hdr.Name,
+		Algorithm:  s.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(24 * time.Hour).Unix()),
+	}
+	if err := sig.Sign(s.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func newRR(t *testing.T, s string) mdns.RR {
+	t.Helper()
+	rr, err := mdns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// startSignedUpstream serves a signed root zone delegating to the signed zone example.
+// and the unsigned zone insecure., and returns its address with the root trust anchor.
+func startSignedUpstream(t *testing.T) (addr, anchor string) {
+	t.Helper()
+	root, example := newTestSigner(t, "."), newTestSigner(t, "example.")
+	rootSOA := newRR(t, ". 300 IN SOA ns. host. 1 7200 3600 1209600 300")
+	exampleSOA := newRR(t, "example. 300 IN SOA ns.example. host.example. 1 7200 3600 1209600 300")
+	nsec := func(s string) mdns.RR { return newRR(t, s+" RRSIG NSEC") }
+
+	// Root NSEC chain: . -> example. -> insecure. -> .
+	rootInsecure := root.sign(t, nsec("insecure. 300 IN NSEC . NS"))
+	// example. NSEC chain: example. -> bogus.example. -> www.example. -> example.
+	exampleApex := example.sign(t, newRR(t, "example. 300 IN NSEC bogus.example. NS SOA RRSIG NSEC DNSKEY"))
+	exampleBogus := example.sign(t, nsec("bogus.example. 300 IN NSEC www.example. A"))
+	exampleWWW := example.sign(t, nsec("www.example. 300 IN NSEC example. A"))
+
+	tampered := example.sign(t, newRR(t, "bogus.example. 300 IN A 192.0.2.66"))
+	tampered[0] = newRR(t, "bogus.example. 300 IN A 192.0.2.99")
+
+	type response struct {
+		rcode      int
+		answer, ns []mdns.RR
+	}
+	concat := func(sets ...[]mdns.RR) []mdns.RR {
+		var out []mdns.RR
+		for _, set := range sets {
+			out = append(out, set...)
+		}
+		return out
+	}
+	exampleNXDomain := response{mdns.RcodeNameError, nil, concat(example.sign(t, exampleSOA), exampleBogus, exampleApex)}
+	responses := map[string]response{
+		". DNSKEY":            {answer: root.sign(t, root.key)},
+		"example. DNSKEY":     {answer: example.sign(t, example.key)},
+		"example. DS":         {answer: root.sign(t, example.key.ToDS(mdns.SHA256))},
+		"insecure. DS":        {ns: concat(root.sign(t, rootSOA), rootInsecure)},
+		"www.example. DS":     {ns: concat(example.sign(t, exampleSOA), exampleWWW)},
+		"bogus.example. DS":   {ns: concat(example.sign(t, exampleSOA), exampleBogus)},
+		"missing.example. DS": exampleNXDomain,
+		"www.example. A":      {answer: example.sign(t, newRR(t, "www.example. 300 IN A 192.0.2.1"))},
+		"www.example. AAAA":   {ns: concat(example.sign(t, exampleSOA), exampleWWW)},
+		"www.example. TXT":    {answer: []mdns.RR{newRR(t, `www.example. 300 IN TXT "unsigned"`)}},
+		"missing.example. A":  exampleNXDomain,
+		"bogus.example. A":    {answer: tampered},
+		"host.insecure. A":    {answer: []mdns.RR{newRR(t, "host.insecure. 300 IN A 192.0.2.9")}},
+	}
+
+	addr = startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		q := r.Question[0]
+		if opt := r.IsEdns0(); opt == nil || !opt.Do() || !r.CheckingDisabled {
+			t.Errorf("%s %s: query without the DO and CD flags", q.Name, mdns.TypeToString[q.Qtype])
+		}
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		res, ok := responses[strings.ToLower(q.Name)+" "+mdns.TypeToString[q.Qtype]]
+		if !ok {
+			t.Errorf("unexpected upstream query %s %s", q.Name, mdns.TypeToString[q.Qtype])
+			m.Rcode = mdns.RcodeServerFailure
+		}
+		m.Rcode, m.Answer, m.Ns = res.rcode, res.answer, res.ns
+		w.WriteMsg(m)
+	})
+	return addr, root.key.ToDS(mdns.SHA256).String()
+}
+
+func newDNSSECTestHandler(t *testing.T, cfg config.DNSSECConfig) *queryHandler {
+	t.Helper()
+	addr, anchor := startSignedUpstream(t)
+	cfg.Validate = true
+	cfg.TrustAnchors = []string{anchor}
+	validator, err := newDNSSECValidator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := newUpstreamRouter([]string{addr}, nil, upstreamOptions{timeout: 2 * time.Second, dnssec: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(up.close)
+	return &queryHandler{
+		cache:       newDNSAnswerCache(100),
+		upstream:    up,
+		ttl:         500,
+		cachePolicy: dnsCachePolicy{maxTTL: time.Minute, maxNegTTL: time.Minute},
+		dnssec:      validator,
+	}
+}
+
+// dnssecQuery is a query with the DO (EDNS0) and CD flags set as given.
+func dnssecQuery(name string, qtype uint16, do, cd bool) *dnsRequest {
+	req := testQuery(name, qtype)
+	if do {
+		req.msg.SetEdns0(4096, true)
+	}
+	req.msg.CheckingDisabled = cd
+	return req
+}
+
+func countType(rrs []mdns.RR, rrtype uint16) int {
+	n := 0
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			n++
+		}
+	}
+	return n
+}
+
+func TestQueryHandlerDNSSECValidation(t *testing.T) {
+	t.Parallel()
+	h := newDNSSECTestHandler(t, config.DNSSECConfig{})
+
+	tests := []struct {
+		name       string
+		qtype      uint16
+		do, cd     bool
+		rcode      int
+		ad         bool
+		answers    int // records of qtype
+		signatures int // RRSIG records in the answer
+	}{
+		{"www.example", mdns.TypeA, true, false, mdns.RcodeSuccess, true, 1, 1},
+		{"www.example", mdns.TypeA, true, false, mdns.RcodeSuccess, true, 1, 1}, // from the cache
+		{"www.example", mdns.TypeA, false, false, mdns.RcodeSuccess, false, 1, 0},
+		{"www.example", mdns.TypeAAAA, true, false, mdns.RcodeSuccess, true, 0, 0},
+		{"missing.example", mdns.TypeA, true, false, mdns.RcodeNameError, true, 0, 0},
+		{"host.insecure", mdns.TypeA, true, false, mdns.RcodeSuccess, false, 1, 0},
+		{"bogus.example", mdns.TypeA, true, false, mdns.RcodeServerFailure, false, 0, 0},
+		{"bogus.example", mdns.TypeA, true, true, mdns.RcodeSuccess, false, 1, 1},
+		{"www.example", mdns.TypeTXT, false, false, mdns.RcodeServerFailure, false, 0, 0},
+	}
+	for _, tt := range tests {
+		reply := h.serveDNS(dnssecQuery(tt.name, tt.qtype, tt.do, tt.cd))
+		desc := tt.name + " " + mdns.TypeToString[tt.qtype]
+		if reply.Rcode != tt.rcode || reply.AuthenticatedData != tt.ad {
+			t.Errorf("%s (do=%v cd=%v): rcode %s, AD %v; want %s, %v", desc, tt.do, tt.cd,
+				mdns.RcodeToString[reply.Rcode], reply.AuthenticatedData, mdns.RcodeToString[tt.rcode], tt.ad)
+		}
+		if got := countType(reply.Answer, tt.qtype); got != tt.answers {
+			t.Errorf("%s: %d %s records, want %d", desc, got, mdns.TypeToString[tt.qtype], tt.answers)
+		}
+		if got := countType(reply.Answer, mdns.TypeRRSIG); got != tt.signatures {
+			t.Errorf("%s: %d signatures, want %d", desc, got, tt.signatures)
+		}
+	}
+
+	// The AD flag of the query asks for the AD flag without DNSSEC records (RFC 6840)
+	req := dnssecQuery("www.example", mdns.TypeA, false, false)
+	req.msg.AuthenticatedData = true
+	if reply := h.serveDNS(req); !reply.AuthenticatedData || countType(reply.Answer, mdns.TypeRRSIG) != 0 {
+		t.Errorf("AD query: AD %v, answer %v", reply.AuthenticatedData, reply.Answer)
+	}
+
+	// NSEC records prove negative answers to DO clients only
+	if reply := h.serveDNS(dnssecQuery("missing.example", mdns.TypeA, true, false)); countType(reply.Ns, mdns.TypeNSEC) != 2 {
+		t.Errorf("NXDOMAIN authority with DO: %v", reply.Ns)
+	}
+	if reply := h.serveDNS(dnssecQuery("missing.example", mdns.TypeA, false, false)); countType(reply.Ns, mdns.TypeNSEC) != 0 || countType(reply.Ns, mdns.TypeSOA) != 1 {
+		t.Errorf("NXDOMAIN authority without DO: %v", reply.Ns)
+	}
+}
+
+func TestQueryHandlerDNSSECNegativeTrustAnchor(t *testing.T) {
+	t.Parallel()
+	h := newDNSSECTestHandler(t, config.DNSSECConfig{NegativeTrustAnchors: []string{"example"}})
+
+	reply := h.serveDNS(dnssecQuery("bogus.example", mdns.TypeA, true, false))
+	if reply.Rcode != mdns.RcodeSuccess || reply.AuthenticatedData || countType(reply.Answer, mdns.TypeA) != 1 {
+		t.Fatalf("negative trust anchor: %v", reply)
+	}
+}
+
+// testNSEC3Chain returns the NSEC3 records of a zone holding names, with the types
+// of each name.
+func testNSEC3Chain(t *testing.T, zone string, names map[string][]uint16, optOut bool) []mdns.RR {
+	t.Helper()
+	type entry struct {
+		hash  string
+		types []uint16
+	}
+	var entries []entry
+	for name, types := range names {
+		entries = append(entries, entry{mdns.HashName(name, mdns.SHA1, 0, ""), types})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	var out []mdns.RR
+	for i, e := range entries {
+		out = append(out, &mdns.NSEC3{
+			Hdr:        mdns.RR_Header{Name: strings.ToLower(e.hash) + "." + zone, Rrtype: mdns.TypeNSEC3, Class: mdns.ClassINET, Ttl: 300},
+			Hash:       mdns.SHA1,
+			Flags:      flags,
+			NextDomain: entries[(i+1)%len(entries)].hash,
+			HashLength: 20,
+			TypeBitMap: e.types,
+		})
+	}
+	return out
+}
+
+func TestNSECProofs(t *testing.T) {
+	t.Parallel()
+	apex := newRR(t, "example. 300 IN NSEC bogus.example. NS SOA RRSIG NSEC DNSKEY")
+	bogus := newRR(t, "bogus.example. 300 IN NSEC www.example. A RRSIG NSEC")
+	ent := newRR(t, "www.example. 300 IN NSEC a.b.example. A RRSIG NSEC")
+
+	if s, err := proveNameError([]mdns.RR{bogus, apex}, "missing.example."); err != nil || s != dnssecSecure {
+		t.Errorf("NXDOMAIN proof: %v %v", s, err)
+	}
+	// Without the apex NSEC nothing proves *.example. does not exist
+	if _, err := proveNameError([]mdns.RR{bogus}, "missing.example."); err == nil {
+		t.Error("NXDOMAIN proof accepted without a wildcard proof")
+	}
+	if _, err := proveNoData([]mdns.RR{bogus}, "bogus.example.", mdns.TypeA); err == nil {
+		t.Error("NODATA proof accepted for an existing type")
+	}
+	if s, err := proveNoData([]mdns.RR{ent}, "b.example.", mdns.TypeA); err != nil || s != dnssecSecure {
+		t.Errorf("empty non-terminal NODATA proof: %v %v", s, err)
+	}
+
+	// Escaped octets sort by value, not by their presentation
+	lies := newRR(t, `a\255.example. 300 IN NSEC b\000.example. RRSIG NSEC`)
+	if !nsecCovers(lies.(*mdns.NSEC), "b.example.") || nsecCovers(lies.(*mdns.NSEC), "b0.example.") {
+		t.Errorf("%v covers the wrong names", lies)
+	}
+}
+
+func TestNSEC3Proofs(t *testing.T) {
+	t.Parallel()
+	names := map[string][]uint16{
+		"example.":     {mdns.TypeNS, mdns.TypeSOA, mdns.TypeDNSKEY, mdns.TypeNSEC3PARAM},
+		"www.example.": {mdns.TypeA},
+	}
+	chain := testNSEC3Chain(t, "example.", names, false)
+
+	if s, err := proveNameError(chain, "missing.example."); err != nil || s != dnssecSecure {
+		t.Errorf("NXDOMAIN proof: %v %v", s, err)
+	}
+	if s, err := proveNoData(chain, "www.example.", mdns.TypeAAAA); err != nil || s != dnssecSecure {
+		t.Errorf("NODATA proof: %v %v", s, err)
+	}
+	if _, err := proveNoData(chain, "www.example.", mdns.TypeA); err == nil {
+		t.Error("NODATA proof accepted for an existing type")
+	}
+	if _, err := proveNoData(chain, "missing.example.", mdns.TypeA); err == nil {
+		t.Error("NODATA proof accepted for a missing name")
+	}
+
+	// Opt-out spans may hide unsigned delegations
+	optOut := testNSEC3Chain(t, "example.", names, true)
+	if s, err := proveNoData(optOut, "sub.example.", mdns.TypeDS); err != nil || s != dnssecInsecure {
+		t.Errorf("opt-out DS proof: %v %v", s, err)
+	}
+	reply := &mdns.Msg{Ns: optOut}
+	if kind, err := proveNoDS(reply, "sub.example."); err != nil || kind != cutInsecure {
+		t.Errorf("opt-out cut: %v %v", kind, err)
+	}
+	if kind, err := proveNoDS(reply, "www.example."); err != nil || kind != cutNone {
+		t.Errorf("www.example. cut: %v %v", kind, err)
+	}
+}
+
+func TestWithoutDNSSEC(t *testing.T) {
+	t.Parallel()
+	a := newRR(t, "www.example. 300 IN A 192.0.2.1")
+	sig := newRR(t, "www.example. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 1234 example. AAAA")
+	rrs := []mdns.RR{a, sig}
+	if got := withoutDNSSEC(rrs, mdns.TypeA); len(got) != 1 || got[0] != a || len(rrs) != 2 {
+		t.Errorf("withoutDNSSEC(A) = %v", got)
+	}
+	if got := withoutDNSSEC(rrs, mdns.TypeRRSIG); len(got) != 2 {
+		t.Errorf("withoutDNSSEC(RRSIG) = %v", got)
+	}
+}
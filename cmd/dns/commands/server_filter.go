@@ -0,0 +1,322 @@
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+// domainSet matches names against blocklist or allowlist rules.
+type domainSet struct {
+	exact      map[string]struct{} // the name only
+	suffix     map[string]struct{} // the name and its subdomains (||name^)
+	subdomains map[string]struct{} // subdomains only (*.name)
+}
+
+func newDomainSet() *domainSet {
+	return &domainSet{
+		exact:      make(map[string]struct{}),
+		suffix:     make(map[string]struct{}),
+		subdomains: make(map[string]struct{}),
+	}
+}
+
+func (s *domainSet) len() int {
+	return len(s.exact) + len(s.suffix) + len(s.subdomains)
+}
+
+// match reports whether name (lowercased, without trailing dot) is covered by a rule.
+func (s *domainSet) match(name string) bool {
+	if _, ok := s.exact[name]; ok {
+		return true
+	}
+	if _, ok := s.suffix[name]; ok {
+		return true
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; {
+		parent := name[i+1:]
+		if _, ok := s.suffix[parent]; ok {
+			return true
+		}
+		if _, ok := s.subdomains[parent]; ok {
+			return true
+		}
+		next := strings.IndexByte(parent, '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
+
+// dnsFilter answers names matched by the configured blocklists, unless an allowlist
+// rule makes an exception for them.
+type dnsFilter struct {
+	block    *domainSet
+	allow    *domainSet
+	response string
+	ttl      uint32
+}
+
+// loadDNSFilter reads the blocklists and allowlists of cfg. It returns nil when no
+// blocklist is configured.
+func loadDNSFilter(cfg config.FilterConfig) (*dnsFilter, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	f := &dnsFilter{
+		block:    newDomainSet(),
+		allow:    newDomainSet(),
+		response: cfg.BlockResponse,
+		ttl:      cfg.TTL,
+	}
+	if f.response == "" {
+		f.response = config.BlockResponseNXDomain
+	}
+
+	for _, path := range cfg.Blocklists {
+		if err := f.loadList(path, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range cfg.Allowlists {
+		if err := f.loadList(path, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, line := range cfg.Allow {
+		f.addRule(line, true)
+	}
+
+	logger.Info("Loaded DNS filter: %d block rules, %d allow rules (block_response: %s)", f.block.len(), f.allow.len(), f.response)
+	return f, nil
+}
+
+// loadList reads one list file. Every rule of an allowlist file is an exception.
+func (f *dnsFilter) loadList(path string, allowlist bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open filter list: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	rules := 0
+	for scanner.Scan() {
+		if f.addRule(scanner.Text(), allowlist) {
+			rules++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read filter list %s: %w", path, err)
+	}
+
+	logger.Debugf("Loaded %d rules from filter list %s", rules, path)
+	return nil
+}
+
+// addRule parses one list line and reports whether it held a rule. Supported syntax:
+//   - hosts format: "0.0.0.0 ads.example.com tracker.example.com"
+//   - domain lists: "ads.example.com" (the name only), "*.example.com" (subdomains only)
+//   - Adblock: "||example.com^" (the name and subdomains), "@@||example.com^" (exception)
+func (f *dnsFilter) addRule(line string, allowlist bool) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return false
+	}
+
+	target := f.block
+	if allowlist {
+		target = f.allow
+	}
+
+	// Adblock-style rules
+	if strings.HasPrefix(line, "@@") {
+		target = f.allow
+		line = line[2:]
+	}
+	if strings.HasPrefix(line, "||") {
+		rule := strings.TrimPrefix(line, "||")
+		if i := strings.IndexByte(rule, '$'); i >= 0 {
+			// Modifiers restrict rules to clients, types, ...; only $important applies to all queries
+			if rule[i+1:] != "important" {
+				return false
+			}
+			rule = rule[:i]
+		}
+		rule = strings.TrimSuffix(rule, "^")
+		if name, ok := filterDomain(rule); ok {
+			target.suffix[name] = struct{}{}
+			return true
+		}
+		return false
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	// Hosts format: every name after the IP is blocked
+	if net.ParseIP(fields[0]) != nil {
+		added := false
+		for _, field := range fields[1:] {
+			if name, ok := filterDomain(field); ok && !isLocalHostsName(name) {
+				target.exact[name] = struct{}{}
+				added = true
+			}
+		}
+		return added
+	}
+
+	if len(fields) != 1 {
+		return false
+	}
+	if rest, ok := strings.CutPrefix(fields[0], "*."); ok {
+		if name, ok := filterDomain(rest); ok {
+			target.subdomains[name] = struct{}{}
+			return true
+		}
+		return false
+	}
+	if name, ok := filterDomain(fields[0]); ok {
+		target.exact[name] = struct{}{}
+		return true
+	}
+	return false
+}
+
+// filterDomain normalizes a domain from a list, rejecting anything that is not a name.
+func filterDomain(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+	if s == "" || strings.ContainsAny(s, "*/:|^$") {
+		return "", false
+	}
+	if _, ok := mdns.IsDomainName(s); !ok {
+		return "", false
+	}
+	return s, true
+}
+
+// isLocalHostsName reports names found in the header of most hosts-format blocklists.
+func isLocalHostsName(name string) bool {
+	switch name {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+		return true
+	}
+	return false
+}
+
+// blocked reports whether hostname (lowercased, without trailing dot) is blocked.
+func (f *dnsFilter) blocked(hostname string) bool {
+	if f == nil {
+		return false
+	}
+	return f.block.match(hostname) && !f.allow.match(hostname)
+}
+
+// blockedResult builds the answer for a blocked name according to block_response.
+func (f *dnsFilter) blockedResult(hostname string, qtype uint16) *dnsResult {
+	res := &dnsResult{channel: "filter"}
+	switch f.response {
+	case config.BlockResponseRefused:
+		res.rcode = mdns.RcodeRefused
+	case config.BlockResponseNullIP:
+		// A/AAAA get the unspecified address, other types an empty answer
+		hdr := mdns.RR_Header{Name: mdns.Fqdn(hostname), Rrtype: qtype, Class: mdns.ClassINET, Ttl: f.ttl}
+		switch qtype {
+		case mdns.TypeA:
+			res.answer = []mdns.RR{&mdns.A{Hdr: hdr, A: net.IPv4zero.To4()}}
+		case mdns.TypeAAAA:
+			res.answer = []mdns.RR{&mdns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+	default:
+		res.rcode = mdns.RcodeNameError
+	}
+	return res
+}
+
+// filterListWatcher reloads the filter of the current handler when a list file changes.
+type filterListWatcher struct {
+	handlerAtomic *atomic.Value // *queryHandler
+	done          <-chan struct{}
+	mu            sync.Mutex
+	watched       map[string]bool
+}
+
+// newFilterListWatcher creates a watcher whose file watches end when done is closed.
+func newFilterListWatcher(handlerAtomic *atomic.Value, done <-chan struct{}) *filterListWatcher {
+	return &filterListWatcher{handlerAtomic: handlerAtomic, done: done, watched: make(map[string]bool)}
+}
+
+// watch starts watching the list files of cfg that are not watched yet. A nil
+// *filterListWatcher watches nothing.
+func (w *filterListWatcher) watch(cfg config.FilterConfig) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, path := range append(append([]string{}, cfg.Blocklists...), cfg.Allowlists...) {
+		if w.watched[path] {
+			continue
+		}
+		w.watched[path] = true
+		go watchFile(path, "filter list", w.done, func() { _ = w.reload() }, func() {
+			logger.Warn("Keeping the current filter until filter list %s is restored", path)
+		})
+	}
+}
+
+// reload rebuilds the filters of the current handler and its views from their config
+// and swaps in a copy of the handler using them. Lists that fail to load keep the
+// previous filter.
+func (w *filterListWatcher) reload() error {
+	// Small delay to ensure file write is complete
+	time.Sleep(200 * time.Millisecond)
+
+	for {
+		cur, _ := w.handlerAtomic.Load().(*queryHandler)
+		if cur == nil || cur.cfg == nil || !cur.cfg.Filter.Enabled() && !cur.views.hasFilterLists() {
+			return nil
+		}
+		next := *cur
+		var err error
+		if cur.cfg.Filter.Enabled() {
+			next.filter, err = loadDNSFilter(cur.cfg.Filter)
+			if err != nil {
+				next.filter = cur.filter
+			}
+		}
+		var viewsErr error
+		next.views, viewsErr = cur.views.reloadFilters()
+		if err = errors.Join(err, viewsErr); err != nil {
+			logger.Error("Failed to reload filter lists, keeping previous filter: %v", err)
+			cur.metrics.reloaded("filter", false)
+			return fmt.Errorf("failed to reload filter lists: %w", err)
+		}
+
+		// A config reload may have swapped the handler meanwhile; rebuild from the new one
+		if w.handlerAtomic.CompareAndSwap(cur, &next) {
+			cur.metrics.reloaded("filter", true)
+			logger.Info("Successfully reloaded filter lists")
+			return nil
+		}
+	}
+}
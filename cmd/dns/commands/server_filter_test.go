@@ -0,0 +1,150 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func writeFilterList(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDNSFilterListFormats(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	block := writeFilterList(t, dir, "block.txt", `# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+! adblock comment
+[Adblock Plus 2.0]
+||doubleclick.net^
+||client-only.net^$client=10.0.0.1
+@@||ok.doubleclick.net^
+plain.example.org
+*.wild.example.org
+`)
+	allow := writeFilterList(t, dir, "allow.txt", "tracker.example.com\n")
+
+	f, err := loadDNSFilter(config.FilterConfig{
+		Blocklists: []string{block},
+		Allowlists: []string{allow},
+		Allow:      []string{"||fine.doubleclick.net^"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{
+		"ads.example.com":         true,
+		"sub.ads.example.com":     false, // hosts entries block the name only
+		"tracker.example.com":     false, // allowlist file
+		"localhost":               false,
+		"doubleclick.net":         true,
+		"x.y.doubleclick.net":     true,
+		"ok.doubleclick.net":      false, // @@ exception
+		"a.ok.doubleclick.net":    false,
+		"fine.doubleclick.net":    false, // inline allow
+		"client-only.net":         false, // rules with modifiers are skipped
+		"plain.example.org":       true,
+		"www.plain.example.org":   false,
+		"wild.example.org":        false,
+		"a.wild.example.org":      true,
+		"unrelated.example.com":   false,
+		"example.com":             false,
+		"doubleclick.net.example": false,
+	} {
+		if got := f.blocked(name); got != want {
+			t.Errorf("blocked(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestQueryHandlerBlockResponses(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	block := writeFilterList(t, dir, "block.txt", "||ads.example.com^\n")
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetRcode(r, mdns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+
+	for _, tc := range []struct {
+		response string
+		qtype    uint16
+		rcode    int
+		answer   string
+	}{
+		{config.BlockResponseNXDomain, mdns.TypeA, mdns.RcodeNameError, ""},
+		{config.BlockResponseRefused, mdns.TypeA, mdns.RcodeRefused, ""},
+		{config.BlockResponseNullIP, mdns.TypeA, mdns.RcodeSuccess, "0.0.0.0"},
+		{config.BlockResponseNullIP, mdns.TypeAAAA, mdns.RcodeSuccess, "::"},
+		{config.BlockResponseNullIP, mdns.TypeMX, mdns.RcodeSuccess, ""},
+	} {
+		f, err := loadDNSFilter(config.FilterConfig{Blocklists: []string{block}, BlockResponse: tc.response, TTL: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newTestHandler(t, &config.Config{}, upstream)
+		h.filter = f
+
+		reply := h.serveDNS(testQuery("www.ads.example.com", tc.qtype))
+		if reply.Rcode != tc.rcode {
+			t.Errorf("%s/%s: rcode %s, want %s", tc.response, mdns.TypeToString[tc.qtype], mdns.RcodeToString[reply.Rcode], mdns.RcodeToString[tc.rcode])
+		}
+		got := ""
+		if len(reply.Answer) == 1 {
+			switch rr := reply.Answer[0].(type) {
+			case *mdns.A:
+				got = rr.A.String()
+			case *mdns.AAAA:
+				got = rr.AAAA.String()
+			}
+			if reply.Answer[0].Header().Ttl != 10 {
+				t.Errorf("%s: ttl %d, want 10", tc.response, reply.Answer[0].Header().Ttl)
+			}
+		}
+		if got != tc.answer || len(reply.Answer) > 1 {
+			t.Errorf("%s/%s: answer %v, want %q", tc.response, mdns.TypeToString[tc.qtype], reply.Answer, tc.answer)
+		}
+	}
+}
+
+func TestFilterListWatcherReload(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	block := writeFilterList(t, dir, "block.txt", "ads.example.com\n")
+	cfg := &config.Config{Filter: config.FilterConfig{Blocklists: []string{block}, BlockResponse: config.BlockResponseNXDomain}}
+
+	f, err := loadDNSFilter(cfg.Filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handlerAtomic atomic.Value
+	handlerAtomic.Store(&queryHandler{cfg: cfg, filter: f})
+	w := newFilterListWatcher(&handlerAtomic, nil)
+
+	writeFilterList(t, dir, "block.txt", "tracker.example.com\n")
+	w.reload()
+	cur := handlerAtomic.Load().(*queryHandler)
+	if cur.filter.blocked("ads.example.com") || !cur.filter.blocked("tracker.example.com") {
+		t.Fatal("expected the reloaded list to replace the previous one")
+	}
+
+	// A missing list keeps the previous filter
+	os.Remove(block)
+	w.reload()
+	if !handlerAtomic.Load().(*queryHandler).filter.blocked("tracker.example.com") {
+		t.Fatal("expected the previous filter to be kept")
+	}
+}
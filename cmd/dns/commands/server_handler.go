@@ -0,0 +1,699 @@
+package commands
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+// dnsResult is the outcome of resolving one question.
+type dnsResult struct {
+	rcode         int
+	answer        []mdns.RR
+	ns            []mdns.RR
+	extra         []mdns.RR
+	authoritative bool
+	security      dnssecStatus // of upstream answers when validating
+	channel       string       // acl, acl.drop, ratelimit, rrl, zone, view.hosts, config.hosts, system.hosts, filter, cache, view.alias, config.alias, system.alias, upstream, dnssec, dns64
+}
+
+// queryHandler answers DNS requests for dnsServer.
+//
+// Handler order:
+//  0. Authoritative zones (names under a zone origin never fall through)
+//  1. View hosts, then config hosts (static records of any type)
+//  2. System hosts (static IP)
+//  3. Blocklists (answered per filter.block_response, or the view's filter)
+//  4. Response cache (upstream-derived answers only, per view)
+//  5. View alias, then config alias -> upstream
+//  6. System hosts alias -> upstream
+//  7. Upstream (the view's, if it has its own)
+//
+// The view is the first of views matching the client address and protocol, if any.
+// Clients denied by queryACL get no answer; clients denied by recursionACL are only
+// answered up to step 3. rateLimit applies before step 0 and to the reply. With dnssec,
+// upstream answers of steps 5-7 are validated: bogus ones are answered SERVFAIL unless
+// the client sets CD, secure ones get the AD flag. Names of a zone signed by signer
+// never reach step 7 but are denied after step 2 unless an alias matches, and answers
+// for them are signed for clients setting DO. With dns64 (or the view's), AAAA questions
+// answered without AAAA records are answered from the A records of the name, and PTR
+// questions for NAT64 addresses from the PTR records of their IPv4 address.
+type queryHandler struct {
+	cfg         *config.Config
+	zones       *zoneSet
+	systemHosts *atomic.Value // *systemHosts
+	filter      *dnsFilter
+	metrics     *serverMetrics
+	queryLog    *queryLogger
+	cache       *dnsAnswerCache
+	upstream    *upstreamRouter
+	ttl         uint32 // TTL of answers built from static hosts
+	cachePolicy dnsCachePolicy
+	prefetch    *cachePrefetcher // nil disables prefetching
+	overrides   *hostOverrides   // temporary hosts added through the admin API
+	// systemHostsOrder orders the addresses of system hosts names with several IPs.
+	systemHostsOrder *addressOrder
+	hostHealth       *hostHealthChecker // probes health-checked config hosts, nil when none
+	hostHealthState  *hostHealthState   // health of the checked addresses, shared across reloads
+	views            dnsViews
+	queryACL         *aclList // who may query, nil allows everyone
+	recursionACL     *aclList // who may get answers needing upstreams, nil allows everyone
+	rateLimit        *rateLimiter
+	inflight         *lookupCoalescer // shares upstream lookups of the same question
+	dnssec           *dnssecValidator // validates upstream answers, nil when off
+	signer           *dnssecSigner    // signs the answers of local zones, nil when off
+	dns64            *dns64           // synthesizes AAAA records, nil when off
+	// cacheMaxEntries and cacheServeStale configure the cache shared across reloads,
+	// and filterWatcher watches the filter lists, once the handler is activated.
+	cacheMaxEntries int
+	cacheServeStale time.Duration
+	filterWatcher   *filterListWatcher
+	// effectiveCfg is cfg merged with the CLI flags, as shown by the admin API.
+	effectiveCfg *config.Config
+}
+
+// serveDNS builds the reply for a request received by dnsServer, or returns nil when
+// no response must be sent.
+func (h *queryHandler) serveDNS(req *dnsRequest) (reply *mdns.Msg) {
+	startAt := time.Now()
+	var channel string
+	var dropped bool
+	view := h.views.match(req.clientIP, req.protocol)
+	defer func() {
+		// Response rate limiting protects third parties from spoofed UDP queries
+		if req.protocol == "udp" && !dropped && channel != "ratelimit" {
+			if action := h.rateLimit.response(req.clientIP, reply, startAt); action != "" {
+				logger.Debugf("[channel: rrl] Limited response to %s (%s)", req.clientIP, action)
+				channel = "rrl"
+				dropped = limitReply(reply, action, req.protocol)
+			}
+		}
+
+		var qtype uint16
+		if len(req.msg.Question) > 0 {
+			qtype = req.msg.Question[0].Qtype
+		}
+		h.metrics.observeQuery(qtype, req.protocol, channel, reply.Rcode, time.Since(startAt))
+		h.queryLog.log(req, reply, channel, view.name(), startAt)
+		if dropped {
+			reply = nil
+		}
+	}()
+
+	reply = new(mdns.Msg)
+	reply.SetReply(req.msg)
+	recursion := h.recursionACL.action(req.clientIP, req.protocol)
+	reply.RecursionAvailable = recursion == config.ACLAllow
+
+	if action := h.queryACL.action(req.clientIP, req.protocol); action != config.ACLAllow {
+		logger.Debugf("[channel: acl] Denied query from %s over %s (%s)", req.clientIP, req.protocol, action)
+		res := aclResult(action)
+		channel, dropped = res.channel, action == config.ACLDrop
+		reply.Rcode = res.rcode
+		return reply
+	}
+
+	if action := h.rateLimit.query(req.clientIP, startAt); action != "" {
+		logger.Debugf("[channel: ratelimit] Limited query from %s (%s)", req.clientIP, action)
+		channel = "ratelimit"
+		dropped = limitReply(reply, action, req.protocol)
+		return reply
+	}
+
+	if req.msg.Opcode != mdns.OpcodeQuery {
+		reply.Rcode = mdns.RcodeNotImplemented
+		return reply
+	}
+	if len(req.msg.Question) != 1 {
+		reply.Rcode = mdns.RcodeFormatError
+		return reply
+	}
+	q := req.msg.Question[0]
+	if q.Qclass != mdns.ClassINET {
+		reply.Rcode = mdns.RcodeNotImplemented
+		return reply
+	}
+
+	question := strings.TrimSuffix(q.Name, ".") + " " + mdns.ClassToString[q.Qclass] + " " + mdns.TypeToString[q.Qtype]
+	do := false
+	if opt := req.msg.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	dns64 := h.dns64For(view)
+	if do && req.msg.CheckingDisabled {
+		// Validating clients get the records as signed (RFC 6147 section 5.5)
+		dns64 = nil
+	}
+	res, err := h.resolveDNS64(view, recursion, dns64, q.Name, q.Qtype)
+	if err != nil {
+		channel = "upstream"
+		logger.Error("[%s] lookup %s error(%s) +%dms", req.clientIP, question, err, time.Since(startAt).Milliseconds())
+		reply.Rcode = mdns.RcodeServerFailure
+		return reply
+	}
+	logger.Info("[%s] lookup %s +%dms", req.clientIP, question, time.Since(startAt).Milliseconds())
+
+	if res.security == dnssecBogus && !req.msg.CheckingDisabled {
+		channel = "dnssec"
+		reply.Rcode = mdns.RcodeServerFailure
+		return reply
+	}
+
+	channel, dropped = res.channel, res.channel == "acl.drop"
+	reply.Rcode = res.rcode
+	reply.Authoritative = res.authoritative
+	reply.Answer = res.answer
+	reply.Ns = res.ns
+	reply.Extra = res.extra
+	if h.dnssec != nil {
+		reply.AuthenticatedData = res.security == dnssecSecure && (do || req.msg.AuthenticatedData)
+		if !do {
+			reply.Answer = withoutDNSSEC(res.answer, q.Qtype)
+			reply.Ns = withoutDNSSEC(res.ns, q.Qtype)
+		}
+	}
+	if do {
+		h.signReply(view, reply, res, mdns.Fqdn(strings.ToLower(q.Name)), q.Qtype)
+	}
+	return reply
+}
+
+// signReply adds the signatures and the proofs of non-existence to the reply for a name
+// of a signed zone answered from its local data.
+func (h *queryHandler) signReply(view *dnsView, reply *mdns.Msg, res *dnsResult, name string, qtype uint16) {
+	z := h.signer.find(name)
+	// Names of a more specific local zone are not signed
+	if z == nil || h.zones.find(name) != z.zone || res.channel == "dns64" || (reply.Rcode != mdns.RcodeSuccess && reply.Rcode != mdns.RcodeNameError) {
+		return
+	}
+	now := time.Now()
+	lookup := func(name string) ([]uint16, bool) { return h.localTypes(view, z, name) }
+	switch {
+	case res.channel == "zone" && !res.authoritative && len(res.ns) > 0:
+		// A referral: the DS records of the delegation, or the proof that it has none
+		cut := res.ns[0].Header().Name
+		if ds := z.zone.records[cut][mdns.TypeDS]; len(ds) > 0 {
+			reply.Ns = append(slices.Clip(reply.Ns), z.sign(copyRRs(ds), now)...)
+		} else {
+			reply.Ns = append(slices.Clip(reply.Ns), z.deny(cut, mdns.TypeDS, lookup, now)...)
+		}
+	case len(res.answer) == 0:
+		reply.Ns = append(z.sign(z.negativeSOA(), now), z.deny(name, qtype, lookup, now)...)
+	default:
+		reply.Answer = z.sign(reply.Answer, now)
+		if res.channel == "zone" && len(res.ns) > 0 {
+			// A CNAME chain ending in NXDOMAIN or NODATA: the proof for its last target
+			if target := lastCNAMETarget(res.answer); target != "" {
+				reply.Ns = append(z.sign(z.negativeSOA(), now), z.deny(target, qtype, lookup, now)...)
+			}
+		}
+	}
+}
+
+// lastCNAMETarget returns the target of the last CNAME record of answer, or "".
+func lastCNAMETarget(answer []mdns.RR) string {
+	for i := len(answer) - 1; i >= 0; i-- {
+		if cname, ok := answer[i].(*mdns.CNAME); ok {
+			return strings.ToLower(cname.Target)
+		}
+	}
+	return ""
+}
+
+// localTypes returns the types of the local data at name in the signed zone z, and
+// whether name exists there.
+func (h *queryHandler) localTypes(view *dnsView, z *signedZone, name string) ([]uint16, bool) {
+	if z.zone != nil {
+		return z.zone.types(name)
+	}
+
+	hostname := strings.TrimSuffix(name, ".")
+	var types []uint16
+	if e, ok := h.overrides.lookup(time.Now(), hostname); ok {
+		for _, ip := range e.IPs {
+			types = append(types, addressType(ip))
+		}
+	}
+	subdomains := false
+	for _, cfg := range []*config.Config{view.hostsConfig(), h.cfg} {
+		if cfg != nil {
+			types = append(types, cfg.LookupTypes(hostname)...)
+			subdomains = subdomains || cfg.HasSubdomains(hostname)
+		}
+	}
+	entries := h.systemHostsSnapshot()
+	for _, qtype := range []uint16{mdns.TypeA, mdns.TypeAAAA} {
+		if ips, err := lookupSystemHosts(entries, hostname, addressQueryType(qtype)); err == nil && len(ips) > 0 {
+			types = append(types, qtype)
+		}
+	}
+	if h.hasAlias(view, hostname, entries) {
+		types = append(types, dnssecAliasTypes...)
+	}
+	slices.Sort(types)
+	types = slices.Compact(types)
+	return types, len(types) > 0 || subdomains || name == z.origin
+}
+
+// hasAlias reports whether a view, config or system hosts alias matches hostname.
+func (h *queryHandler) hasAlias(view *dnsView, hostname string, entries *systemHosts) bool {
+	for _, cfg := range []*config.Config{view.hostsConfig(), h.cfg} {
+		if cfg != nil {
+			if target, err := cfg.LookupAlias(hostname); err == nil && target != "" {
+				return true
+			}
+		}
+	}
+	if entries.len() > 0 {
+		if target, err := lookupSystemHostsAlias(entries, hostname); err == nil && target != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// systemHostsSnapshot returns the current system hosts snapshot.
+func (h *queryHandler) systemHostsSnapshot() *systemHosts {
+	if h.systemHosts == nil {
+		return nil
+	}
+	if v := h.systemHosts.Load(); v != nil {
+		if s, ok := v.(*systemHosts); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// upstreamFor returns the upstreams answering for view.
+func (h *queryHandler) upstreamFor(view *dnsView) *upstreamRouter {
+	if view != nil && view.upstream != nil {
+		return view.upstream
+	}
+	return h.upstream
+}
+
+// filterFor returns the filter applied in view.
+func (h *queryHandler) filterFor(view *dnsView) *dnsFilter {
+	if view != nil && view.ownFilter {
+		return view.filter
+	}
+	return h.filter
+}
+
+// dns64For returns the DNS64 synthesizer of view.
+func (h *queryHandler) dns64For(view *dnsView) *dns64 {
+	if view != nil && view.ownDNS64 {
+		return view.dns64
+	}
+	return h.dns64
+}
+
+// lookupHosts answers a question from the hosts of cfg, including PTR questions for
+// one of their addresses (ptrIP), or returns nil.
+func (h *queryHandler) lookupHosts(cfg *config.Config, hostname string, qtype uint16, ptrIP net.IP, channel string) *dnsResult {
+	rrs, err := cfg.LookupRecords(hostname, qtype, h.ttl)
+	if err == nil && len(rrs) > 0 {
+		logger.Debugf("[channel: %s] Resolved %s (%s) from hosts -> %v", channel, hostname, mdns.TypeToString[qtype], rrs)
+		return &dnsResult{answer: rrs, channel: channel}
+	}
+	if ptrIP != nil {
+		if rrs, err := cfg.LookupAddr(ptrIP, h.ttl); err == nil {
+			logger.Debugf("[channel: %s] Resolved %s (%s) from hosts -> %v", channel, hostname, mdns.TypeToString[qtype], rrs)
+			return &dnsResult{answer: rrs, channel: channel}
+		}
+	}
+	return nil
+}
+
+// resolveDNS64 answers a question like resolve, synthesizing the answers to AAAA and
+// PTR questions with d (RFC 6147) unless it is nil.
+func (h *queryHandler) resolveDNS64(view *dnsView, recursion string, d *dns64, hostname string, qtype uint16) (*dnsResult, error) {
+	if target := d.ptrTarget(hostname); target != "" && qtype == mdns.TypePTR {
+		// The reverse name of a NAT64 address is an alias of the IPv4 one
+		ptr, err := h.resolve(view, recursion, target, mdns.TypePTR)
+		if err != nil || ptr.rcode != mdns.RcodeSuccess && ptr.rcode != mdns.RcodeNameError {
+			return ptr, err
+		}
+		cname := &mdns.CNAME{
+			Hdr:    mdns.RR_Header{Name: mdns.Fqdn(hostname), Rrtype: mdns.TypeCNAME, Class: mdns.ClassINET, Ttl: h.ttl},
+			Target: target,
+		}
+		logger.Debugf("[channel: dns64] Resolved %s (PTR) as %s", hostname, target)
+		res := &dnsResult{rcode: ptr.rcode, answer: append([]mdns.RR{cname}, ptr.answer...), ns: ptr.ns, channel: "dns64"}
+		if ptr.security == dnssecBogus {
+			res.security = dnssecBogus
+		}
+		return res, nil
+	}
+
+	res, err := h.resolve(view, recursion, hostname, qtype)
+	if err != nil || d == nil || qtype != mdns.TypeAAAA || res.security == dnssecBogus || d.hasAAAA(res) {
+		return res, err
+	}
+	if res.rcode != mdns.RcodeSuccess && res.rcode != mdns.RcodeNameError {
+		return res, nil
+	}
+	a, err := h.resolve(view, recursion, hostname, mdns.TypeA)
+	if err != nil || a.rcode != mdns.RcodeSuccess || a.security == dnssecBogus {
+		return res, nil
+	}
+	if synthesized := d.synthesize(a, res); synthesized != nil {
+		logger.Debugf("[channel: dns64] Synthesized %s (AAAA) -> %v", hostname, synthesized.answer)
+		return synthesized, nil
+	}
+	return res, nil
+}
+
+// resolve answers a single question of any type, in view (nil for the top-level settings).
+// Questions needing upstreams are answered per the recursion config.ACL* action.
+func (h *queryHandler) resolve(view *dnsView, recursion, hostname string, qtype uint16) (*dnsResult, error) {
+	hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+	queryType := mdns.TypeToString[qtype]
+	logger.Debugf("DNS query received: %s (type: %s, code: %d)", hostname, queryType, qtype)
+
+	if qtype == mdns.TypeA || qtype == mdns.TypeAAAA {
+		if e, ok := h.overrides.lookup(time.Now(), hostname); ok {
+			logger.Debugf("[channel: override] Resolved %s (%s) from host override -> %v", hostname, queryType, e.IPs)
+			return e.result(hostname, qtype), nil
+		}
+	}
+
+	// Reverse lookups of addresses defined in hosts are answered from them
+	var ptrIP net.IP
+	if qtype == mdns.TypePTR {
+		ptrIP = ptrAddress(hostname)
+	}
+
+	signed := h.signer.find(mdns.Fqdn(hostname))
+	if res := signed.apex(mdns.Fqdn(hostname), qtype); res != nil {
+		logger.Debugf("[channel: zone] Answered %s (%s) from the keys of signed zone %s", hostname, queryType, signed.origin)
+		return res, nil
+	}
+
+	if zone := h.zones.find(mdns.Fqdn(hostname)); zone != nil {
+		res := zone.lookup(mdns.Fqdn(hostname), qtype)
+		logger.Debugf("[channel: zone] Answered %s (%s) from zone %s (rcode: %s)", hostname, queryType, zone.origin, mdns.RcodeToString[res.rcode])
+		return res, nil
+	}
+
+	if view != nil && view.hosts != nil {
+		if res := h.lookupHosts(view.hosts, hostname, qtype, ptrIP, "view.hosts"); res != nil {
+			return res, nil
+		}
+	}
+	if h.cfg != nil {
+		if res := h.lookupHosts(h.cfg, hostname, qtype, ptrIP, "config.hosts"); res != nil {
+			return res, nil
+		}
+	} else {
+		logger.Debugf("Config hosts not available, skipping config static hosts")
+	}
+
+	entries := h.systemHostsSnapshot()
+	if entries.len() > 0 && (qtype == mdns.TypeA || qtype == mdns.TypeAAAA) {
+		logger.Debugf("Checking system hosts for %s (%s), total entries: %d", hostname, queryType, entries.len())
+		if entry, ok := lookupSystemHostsEntry(entries, hostname, addressQueryType(qtype)); ok {
+			// Positions are kept per entry: names matched by a pattern share one
+			key := systemHostsKey{entry: entry, family: addressQueryType(qtype)}
+			ips := h.systemHostsOrder.apply(&entries.positions, key, entry.addresses(key.family))
+			logger.Debugf("[channel: system.hosts] Resolved %s (%s) from system hosts -> %v", hostname, queryType, ips)
+			res := &dnsResult{channel: "system.hosts"}
+			for _, ip := range ips {
+				res.answer = append(res.answer, newAddressRR(hostname, ip, h.ttl))
+			}
+			return res, nil
+		}
+	} else if entries.len() > 0 && ptrIP != nil {
+		if domains := lookupSystemHostsAddr(entries, ptrIP); len(domains) > 0 {
+			logger.Debugf("[channel: system.hosts] Resolved %s (%s) from system hosts -> %v", hostname, queryType, domains)
+			res := &dnsResult{channel: "system.hosts"}
+			for _, domain := range domains {
+				res.answer = append(res.answer, newPTRRR(hostname, domain, h.ttl))
+			}
+			return res, nil
+		}
+	} else {
+		logger.Debugf("System hosts not enabled, empty or not applicable to %s, skipping system static hosts", queryType)
+	}
+
+	// A zone signed from hosts has no other data: upstream answers could not be signed
+	if signed != nil && !h.hasAlias(view, hostname, entries) {
+		res := &dnsResult{authoritative: true, channel: "zone", ns: signed.negativeSOA()}
+		if _, exists := h.localTypes(view, signed, mdns.Fqdn(hostname)); !exists {
+			res.rcode = mdns.RcodeNameError
+		}
+		logger.Debugf("[channel: zone] Answered %s (%s) from signed zone %s (rcode: %s)", hostname, queryType, signed.origin, mdns.RcodeToString[res.rcode])
+		return res, nil
+	}
+
+	if filter := h.filterFor(view); filter.blocked(hostname) {
+		logger.Debugf("[channel: filter] Blocked %s (%s)", hostname, queryType)
+		return filter.blockedResult(hostname, qtype), nil
+	}
+
+	if recursion != config.ACLAllow {
+		logger.Debugf("[channel: acl] Denied recursion for %s (%s)", hostname, queryType)
+		return aclResult(recursion), nil
+	}
+
+	ck := view.cacheKey(hostname, qtype)
+	if h.cache != nil {
+		now := time.Now()
+		// Answers cached without validation (restored from a snapshot) are not trusted
+		if res, hit := h.cache.get(now, ck); hit && (h.dnssec == nil || res.security != dnssecUnchecked) {
+			logger.Debugf("[cache] hit for %s (%s)", hostname, queryType)
+			h.prefetch.refresh(h.cache, now, ck, func() {
+				logger.Debugf("[cache] prefetching %s (%s)", hostname, queryType)
+				h.resolveForward(view, ck, hostname, qtype, entries)
+			})
+			return res, nil
+		}
+	}
+
+	return h.resolveForward(view, ck, hostname, qtype, entries)
+}
+
+// resolveForward answers a question that needs upstream: through a config or system hosts
+// alias if one matches, otherwise by forwarding it. The result is cached under ck.
+// Concurrent calls for the same ck share a single lookup.
+func (h *queryHandler) resolveForward(view *dnsView, ck, hostname string, qtype uint16, entries *systemHosts) (*dnsResult, error) {
+	res, coalesced, err := h.inflight.do(ck, func() (*dnsResult, error) {
+		return h.lookupForward(view, ck, hostname, qtype, entries)
+	})
+	if coalesced {
+		logger.Debugf("Shared the upstream lookup in flight for %s (%s)", hostname, mdns.TypeToString[qtype])
+		h.metrics.observeCoalesced()
+	}
+	return res, err
+}
+
+// lookupForward resolves a question for resolveForward.
+func (h *queryHandler) lookupForward(view *dnsView, ck, hostname string, qtype uint16, entries *systemHosts) (*dnsResult, error) {
+	// Answers are not cached if a reload flushes the cache meanwhile
+	gen := h.cache.currentGeneration()
+	queryType := mdns.TypeToString[qtype]
+	if view != nil && view.hosts != nil {
+		aliasTarget, aliasErr := view.hosts.LookupAlias(hostname)
+		if aliasErr == nil && aliasTarget != "" {
+			logger.Debugf("View %s alias match for %s (%s): %s, querying upstream", view.name(), hostname, queryType, aliasTarget)
+			res, err := h.resolveAlias(view, gen, ck, hostname, qtype, aliasTarget, "view.alias")
+			if err == nil {
+				return res, nil
+			}
+			logger.Warn("Failed to resolve alias target %s for %s (%s) in view %s: %v", aliasTarget, hostname, queryType, view.name(), err)
+		}
+	}
+	if h.cfg != nil {
+		aliasTarget, aliasErr := h.cfg.LookupAlias(hostname)
+		if aliasErr == nil && aliasTarget != "" {
+			logger.Debugf("Config alias match for %s (%s): %s, querying upstream", hostname, queryType, aliasTarget)
+			res, err := h.resolveAlias(view, gen, ck, hostname, qtype, aliasTarget, "config.alias")
+			if err == nil {
+				return res, nil
+			}
+			logger.Warn("Failed to resolve alias target %s for %s (%s): %v", aliasTarget, hostname, queryType, err)
+		}
+		logger.Debugf("No match found in config hosts/alias for %s (%s)", hostname, queryType)
+	}
+
+	if entries.len() > 0 {
+		aliasTarget, aliasErr := lookupSystemHostsAlias(entries, hostname)
+		if aliasErr == nil && aliasTarget != "" {
+			logger.Debugf("System hosts alias match for %s (%s): %s, querying upstream", hostname, queryType, aliasTarget)
+			res, err := h.resolveAlias(view, gen, ck, hostname, qtype, aliasTarget, "system.alias")
+			if err == nil {
+				return res, nil
+			}
+			logger.Warn("Failed to resolve system alias target %s for %s (%s): %v", aliasTarget, hostname, queryType, err)
+		}
+		logger.Debugf("No alias found in system hosts for %s (%s)", hostname, queryType)
+	}
+
+	logger.Debugf("Querying upstream DNS servers for %s (%s)", hostname, queryType)
+	reply, err := h.upstreamFor(view).exchange(hostname, qtype)
+	if err != nil {
+		if res, ok := h.cache.getStale(time.Now(), ck); ok {
+			logger.Warn("Failed to resolve %s (%s) from upstream, serving stale answer: %v", hostname, queryType, err)
+			return res, nil
+		}
+		logger.Error("Failed to resolve %s (%s) from upstream: %v", hostname, queryType, err)
+		return nil, err
+	}
+
+	res := &dnsResult{rcode: reply.Rcode, answer: reply.Answer, channel: "upstream"}
+	var bogus error
+	if res.security, bogus = h.dnssec.validate(reply, hostname, qtype, h.upstreamFor(view).exchange); res.security == dnssecBogus {
+		// Not cached: clients setting CD get it, others SERVFAIL
+		logger.Warn("[dnssec] Bogus answer for %s (%s): %v", hostname, queryType, bogus)
+		res.ns = reply.Ns
+		return res, nil
+	}
+	if len(res.answer) > 0 {
+		logger.Debugf("[channel: upstream] Resolved %s (%s) from upstream -> %v", hostname, queryType, res.answer)
+		h.cache.setFrom(gen, time.Now(), ck, res, false, h.cachePolicy.ttl(res, false))
+	} else {
+		logger.Debugf("No results found for %s (%s) from upstream (rcode: %s)", hostname, queryType, mdns.RcodeToString[reply.Rcode])
+		// Keep the SOA so clients can negatively cache NXDOMAIN / NODATA
+		res.ns = reply.Ns
+		h.cache.setFrom(gen, time.Now(), ck, res, true, h.cachePolicy.ttl(res, true))
+	}
+	return res, nil
+}
+
+// resolveAlias resolves an alias target upstream and returns its records renamed to
+// hostname (CNAME-like flattening). A CNAME query is answered with the alias itself.
+// The result is cached under ck unless the cache was flushed since generation gen.
+func (h *queryHandler) resolveAlias(view *dnsView, gen uint64, ck, hostname string, qtype uint16, target, channel string) (*dnsResult, error) {
+	queryType := mdns.TypeToString[qtype]
+	if qtype == mdns.TypeCNAME {
+		cname := &mdns.CNAME{
+			Hdr:    mdns.RR_Header{Name: mdns.Fqdn(hostname), Rrtype: mdns.TypeCNAME, Class: mdns.ClassINET, Ttl: h.ttl},
+			Target: mdns.Fqdn(target),
+		}
+		return &dnsResult{answer: []mdns.RR{cname}, channel: channel}, nil
+	}
+
+	reply, err := h.upstreamFor(view).exchange(target, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &dnsResult{answer: flattenAlias(hostname, qtype, reply.Answer), channel: channel}
+	if h.dnssec != nil {
+		// The renamed records are never authenticated, but a bogus target is not served
+		security, bogus := h.dnssec.validate(reply, target, qtype, h.upstreamFor(view).exchange)
+		if security == dnssecBogus {
+			logger.Warn("[dnssec] Bogus answer for alias target %s of %s (%s): %v", target, hostname, queryType, bogus)
+			res.security = dnssecBogus
+			return res, nil
+		}
+		res.security = dnssecInsecure
+	}
+	if len(res.answer) > 0 {
+		logger.Debugf("[channel: %s] Resolved %s (%s) via alias %s -> %v", channel, hostname, queryType, target, res.answer)
+		h.cache.setFrom(gen, time.Now(), ck, res, false, h.cachePolicy.ttl(res, false))
+		return res, nil
+	}
+
+	logger.Debugf("Alias target %s has no %s record, returning empty answer", target, queryType)
+	h.cache.setFrom(gen, time.Now(), ck, res, true, h.cachePolicy.ttl(res, true))
+	return res, nil
+}
+
+// flattenAlias keeps the qtype records of an alias target's answer (skipping its CNAME
+// chain) and renames them to hostname.
+func flattenAlias(hostname string, qtype uint16, answer []mdns.RR) []mdns.RR {
+	var out []mdns.RR
+	for _, rr := range answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		cp := mdns.Copy(rr)
+		cp.Header().Name = mdns.Fqdn(hostname)
+		out = append(out, cp)
+	}
+	return out
+}
+
+// addressQueryType converts an A/AAAA RR type to the 4/6 query type used by hosts lookups.
+func addressQueryType(qtype uint16) int {
+	if qtype == mdns.TypeAAAA {
+		return 6
+	}
+	return 4
+}
+
+// addressType returns the RR type, A or AAAA, of the records of an address.
+func addressType(ip string) uint16 {
+	if strings.Contains(ip, ":") {
+		return mdns.TypeAAAA
+	}
+	return mdns.TypeA
+}
+
+// ptrAddress returns the address of a reverse lookup name under in-addr.arpa or
+// ip6.arpa, or nil when name does not name a complete address.
+func ptrAddress(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		slices.Reverse(labels)
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			if len(label) != 1 {
+				return nil
+			}
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil {
+				return nil
+			}
+			// Labels run from the lowest nibble of the address to the highest
+			n := len(labels) - 1 - i
+			ip[n/2] |= byte(nibble) << (4 * (1 - n%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// newPTRRR builds a PTR record owned by name pointing at target.
+func newPTRRR(name, target string, ttl uint32) mdns.RR {
+	return &mdns.PTR{
+		Hdr: mdns.RR_Header{Name: mdns.Fqdn(name), Rrtype: mdns.TypePTR, Class: mdns.ClassINET, Ttl: ttl},
+		Ptr: mdns.Fqdn(target),
+	}
+}
+
+// newAddressRR builds an A or AAAA record for ip owned by hostname.
+func newAddressRR(hostname, ip string, ttl uint32) mdns.RR {
+	parsed := net.ParseIP(ip)
+	if parsed.To4() != nil {
+		return &mdns.A{
+			Hdr: mdns.RR_Header{Name: mdns.Fqdn(hostname), Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: ttl},
+			A:   parsed.To4(),
+		}
+	}
+	return &mdns.AAAA{
+		Hdr:  mdns.RR_Header{Name: mdns.Fqdn(hostname), Rrtype: mdns.TypeAAAA, Class: mdns.ClassINET, Ttl: ttl},
+		AAAA: parsed.To16(),
+	}
+}
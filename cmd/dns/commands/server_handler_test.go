@@ -0,0 +1,414 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// startTestUpstream runs a plain UDP DNS server on localhost answering with handler.
+func startTestUpstream(t *testing.T, handler mdns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &mdns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func newTestHandler(t *testing.T, cfg *config.Config, upstreamAddr string) *queryHandler {
+	t.Helper()
+	up, err := newUpstreamRouter([]string{upstreamAddr}, nil, upstreamOptions{timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(up.close)
+	return &queryHandler{
+		cfg:         cfg,
+		cache:       newDNSAnswerCache(100),
+		upstream:    up,
+		ttl:         500,
+		cachePolicy: dnsCachePolicy{maxTTL: time.Minute, maxNegTTL: time.Minute},
+	}
+}
+
+func testQuery(name string, qtype uint16) *dnsRequest {
+	m := new(mdns.Msg)
+	m.SetQuestion(mdns.Fqdn(name), qtype)
+	return &dnsRequest{msg: m, clientIP: net.ParseIP("127.0.0.1"), protocol: "udp"}
+}
+
+func TestQueryHandlerConfigHostsRecordTypes(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{Hosts: config.HostsConfig{
+		"example.com": map[string]interface{}{
+			"a":   "1.2.3.4",
+			"mx":  []interface{}{"10 mail.example.com"},
+			"txt": []interface{}{map[string]interface{}{"value": "v=spf1 -all", "ttl": 30}},
+			"ttl": 120,
+		},
+	}}
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		t.Errorf("unexpected upstream query %v", r.Question[0])
+		m := new(mdns.Msg)
+		w.WriteMsg(m.SetRcode(r, mdns.RcodeServerFailure))
+	})
+	h := newTestHandler(t, cfg, upstream)
+
+	reply := h.serveDNS(testQuery("example.com", mdns.TypeMX))
+	if reply.Rcode != mdns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Fatalf("MX reply: %v", reply)
+	}
+	mx, ok := reply.Answer[0].(*mdns.MX)
+	if !ok || mx.Mx != "mail.example.com." || mx.Preference != 10 || mx.Hdr.Ttl != 120 || mx.Hdr.Name != "example.com." {
+		t.Fatalf("unexpected MX %v", reply.Answer[0])
+	}
+
+	reply = h.serveDNS(testQuery("example.com", mdns.TypeTXT))
+	txt, ok := reply.Answer[0].(*mdns.TXT)
+	if !ok || len(txt.Txt) != 1 || txt.Txt[0] != "v=spf1 -all" || txt.Hdr.Ttl != 30 {
+		t.Fatalf("unexpected TXT %v", reply.Answer)
+	}
+
+	reply = h.serveDNS(testQuery("example.com", mdns.TypeA))
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Ttl != 120 {
+		t.Fatalf("unexpected A %v", reply.Answer)
+	}
+}
+
+func TestQueryHandlerUpstreamForwardsAnyType(t *testing.T) {
+	t.Parallel()
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Qtype == mdns.TypeSRV && q.Name == "_sip._tcp.example.com.":
+			rr, _ := mdns.NewRR("_sip._tcp.example.com. 42 IN SRV 10 5 5060 sip.example.com.")
+			m.Answer = append(m.Answer, rr)
+		default:
+			m.Rcode = mdns.RcodeNameError
+			soa, _ := mdns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(t, nil, upstream)
+
+	reply := h.serveDNS(testQuery("_sip._tcp.example.com", mdns.TypeSRV))
+	if reply.Rcode != mdns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Fatalf("SRV reply: %v", reply)
+	}
+	srv := reply.Answer[0].(*mdns.SRV)
+	if srv.Port != 5060 || srv.Target != "sip.example.com." || srv.Hdr.Ttl != 42 {
+		t.Fatalf("unexpected SRV %v", srv)
+	}
+
+	reply = h.serveDNS(testQuery("missing.example.com", mdns.TypeMX))
+	if reply.Rcode != mdns.RcodeNameError || len(reply.Ns) != 1 {
+		t.Fatalf("NXDOMAIN reply: %v", reply)
+	}
+	if res, hit := h.cache.get(time.Now(), dnsCacheKey("missing.example.com", mdns.TypeMX)); !hit || res.rcode != mdns.RcodeNameError {
+		t.Fatalf("expected negative cache entry, got %v hit=%v", res, hit)
+	}
+}
+
+func TestQueryHandlerAliasFlattening(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{Hosts: config.HostsConfig{
+		"db.internal": "db.cloud.example",
+	}}
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		cname, _ := mdns.NewRR("db.cloud.example. 60 IN CNAME lb.cloud.example.")
+		a, _ := mdns.NewRR("lb.cloud.example. 60 IN A 10.1.1.1")
+		m.Answer = append(m.Answer, cname, a)
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(t, cfg, upstream)
+
+	reply := h.serveDNS(testQuery("db.internal", mdns.TypeA))
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Name != "db.internal." || reply.Answer[0].(*mdns.A).A.String() != "10.1.1.1" {
+		t.Fatalf("unexpected alias answer %v", reply.Answer)
+	}
+
+	reply = h.serveDNS(testQuery("db.internal", mdns.TypeCNAME))
+	if len(reply.Answer) != 1 || reply.Answer[0].(*mdns.CNAME).Target != "db.cloud.example." {
+		t.Fatalf("unexpected CNAME answer %v", reply.Answer)
+	}
+}
+
+func TestQueryHandlerUpstreamFailureIsServfail(t *testing.T) {
+	t.Parallel()
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		w.WriteMsg(m.SetRcode(r, mdns.RcodeRefused))
+	})
+	h := newTestHandler(t, nil, upstream)
+
+	reply := h.serveDNS(testQuery("example.org", mdns.TypeA))
+	if reply.Rcode != mdns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL, got %s", mdns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestQueryHandlerServesStaleWhenUpstreamFails(t *testing.T) {
+	t.Parallel()
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		w.WriteMsg(m.SetRcode(r, mdns.RcodeServerFailure))
+	})
+	h := newTestHandler(t, nil, upstream)
+	expired := func() {
+		h.cache.set(time.Now().Add(-2*time.Minute), dnsCacheKey("example.org", mdns.TypeA),
+			&dnsResult{answer: []mdns.RR{testA("example.org", "7.7.7.7")}}, false, time.Minute)
+	}
+
+	expired()
+	reply := h.serveDNS(testQuery("example.org", mdns.TypeA))
+	if reply.Rcode != mdns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL without serve-stale, got %s", mdns.RcodeToString[reply.Rcode])
+	}
+
+	h.cache.setServeStale(time.Hour)
+	expired()
+	reply = h.serveDNS(testQuery("example.org", mdns.TypeA))
+	if reply.Rcode != mdns.RcodeSuccess || len(reply.Answer) != 1 || reply.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("expected stale answer, got %v", reply)
+	}
+}
+
+func TestQueryHandlerPrefetchesPopularAnswers(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		queries.Add(1)
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, testA("popular.example.com", "8.8.4.4"))
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(t, nil, upstream)
+	h.prefetch = newCachePrefetcher(config.CachePrefetchConfig{Enabled: true, Threshold: 50, MinHits: 1})
+	ck := dnsCacheKey("popular.example.com", mdns.TypeA)
+	h.cache.set(time.Now().Add(-50*time.Second), ck, &dnsResult{answer: []mdns.RR{testA("popular.example.com", "8.8.4.4")}}, false, time.Minute)
+
+	reply := h.serveDNS(testQuery("popular.example.com", mdns.TypeA))
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Ttl > 10 {
+		t.Fatalf("expected cached answer, got %v", reply)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if res, hit := h.cache.get(time.Now(), ck); hit && res.answer[0].Header().Ttl > 50 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cached answer was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("expected one upstream query, got %d", n)
+	}
+}
+
+func TestQueryHandlerReverseLookupFromHosts(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{Hosts: config.HostsConfig{
+		"app.corp.internal": map[string]interface{}{"a": "10.0.0.2", "aaaa": "fd00::2", "ttl": 60},
+		"*.corp.internal":   "10.0.0.3",
+	}}
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("10.0.0.9 nas.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseSystemHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstreamQueries atomic.Int32
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		upstreamQueries.Add(1)
+		m := new(mdns.Msg)
+		w.WriteMsg(m.SetRcode(r, mdns.RcodeNameError))
+	})
+	h := newTestHandler(t, cfg, upstream)
+	h.systemHosts = &atomic.Value{}
+	h.systemHosts.Store(newSystemHosts(entries))
+
+	for name, want := range map[string]string{
+		"2.0.0.10.in-addr.arpa": "app.corp.internal.",
+		"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa": "app.corp.internal.",
+		"9.0.0.10.in-addr.arpa.": "nas.lan.",
+	} {
+		reply := h.serveDNS(testQuery(name, mdns.TypePTR))
+		if len(reply.Answer) != 1 {
+			t.Fatalf("PTR %s: %v", name, reply)
+		}
+		if ptr, ok := reply.Answer[0].(*mdns.PTR); !ok || ptr.Ptr != want || ptr.Hdr.Name != mdns.Fqdn(name) {
+			t.Errorf("PTR %s = %v, want %s", name, reply.Answer[0], want)
+		}
+	}
+	if upstreamQueries.Load() != 0 {
+		t.Fatalf("hosts PTR answers went upstream %d times", upstreamQueries.Load())
+	}
+
+	// Wildcard entries and unknown addresses are forwarded
+	for _, name := range []string{"3.0.0.10.in-addr.arpa", "1.2.0.192.in-addr.arpa"} {
+		if reply := h.serveDNS(testQuery(name, mdns.TypePTR)); reply.Rcode != mdns.RcodeNameError {
+			t.Errorf("PTR %s: expected upstream NXDOMAIN, got %v", name, reply)
+		}
+	}
+	if upstreamQueries.Load() != 2 {
+		t.Fatalf("expected 2 upstream queries, got %d", upstreamQueries.Load())
+	}
+}
+
+func TestPTRAddress(t *testing.T) {
+	t.Parallel()
+	for name, want := range map[string]string{
+		"4.3.2.1.in-addr.arpa.": "1.2.3.4",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.IP6.ARPA": "2001:db8::1",
+		"3.2.1.in-addr.arpa":   "",
+		"x.3.2.1.in-addr.arpa": "",
+		"1.0.ip6.arpa":         "",
+		"example.com":          "",
+	} {
+		got := ptrAddress(name)
+		if (want == "" && got != nil) || (want != "" && !got.Equal(net.ParseIP(want))) {
+			t.Errorf("ptrAddress(%q) = %v, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLookupSystemHostsIndex(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := "10.0.0.1 app.local\n10.0.0.2 *.local\n10.0.0.3 *.svc.local\nbackend.example.com web.local\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseSystemHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := newSystemHosts(entries)
+
+	for name, want := range map[string]string{
+		"app.local":     "10.0.0.1",
+		"other.local.":  "10.0.0.2",
+		"api.svc.local": "10.0.0.3",
+		"nothing.test":  "",
+	} {
+		got, _ := lookupSystemHosts(hosts, name, 4)
+		if strings.Join(got, ",") != want {
+			t.Errorf("lookupSystemHosts(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	if target, err := lookupSystemHostsAlias(hosts, "web.local"); err != nil || target != "backend.example.com" {
+		t.Errorf("lookupSystemHostsAlias(web.local) = %q, %v", target, err)
+	}
+	if _, err := lookupSystemHosts(nil, "app.local", 4); err == nil {
+		t.Error("expected nil system hosts to miss")
+	}
+}
+
+func TestParseSystemHostsFileMultipleAddresses(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := "# replicas\n10.0.0.1 web.local web\n10.0.0.2   web.local # second replica\nfd00::1 web.local\n10.0.0.1 web.local\n10.0.0.9 db.local\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseSystemHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Domain != "web.local" || entries[1].Domain != "web" || entries[2].Domain != "db.local" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	hosts := newSystemHosts(entries)
+
+	if got, _ := lookupSystemHosts(hosts, "web.local", 4); strings.Join(got, ",") != "10.0.0.1,10.0.0.2" {
+		t.Errorf("web.local A = %v", got)
+	}
+	if got, _ := lookupSystemHosts(hosts, "web.local", 6); strings.Join(got, ",") != "fd00::1" {
+		t.Errorf("web.local AAAA = %v", got)
+	}
+	if got, _ := lookupSystemHosts(hosts, "web", 6); len(got) != 0 {
+		t.Errorf("web AAAA = %v", got)
+	}
+}
+
+func TestQueryHandlerSystemHostsOrder(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("10.0.0.1 web.local\n10.0.0.2 web.local\n10.0.0.3 web.local\n10.0.1.1 *.lb.local\n10.0.1.2 *.lb.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseSystemHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, nil, "127.0.0.1:1")
+	h.systemHosts = &atomic.Value{}
+	h.systemHosts.Store(newSystemHosts(entries))
+
+	first := func() string {
+		reply := h.serveDNS(testQuery("web.local", mdns.TypeA))
+		if len(reply.Answer) != 3 {
+			t.Fatalf("expected 3 answers, got %v", reply)
+		}
+		return reply.Answer[0].(*mdns.A).A.String()
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := first(); got != "10.0.0.1" {
+			t.Fatalf("fixed order: first answer %s", got)
+		}
+	}
+
+	if h.systemHostsOrder, err = newAddressOrder(config.HostsOrderRoundRobin); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		if got := first(); got != want {
+			t.Fatalf("round robin: first answer %s, want %s", got, want)
+		}
+	}
+
+	// Names matched by a pattern share the position of their entry
+	for i, want := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.1", "10.0.1.2"} {
+		reply := h.serveDNS(testQuery(fmt.Sprintf("host%d.lb.local", i), mdns.TypeA))
+		if len(reply.Answer) != 2 || reply.Answer[0].(*mdns.A).A.String() != want {
+			t.Fatalf("round robin over a pattern: %v, want %s first", reply.Answer, want)
+		}
+	}
+	n := 0
+	h.systemHostsSnapshot().positions.Range(func(any, any) bool { n++; return true })
+	if n != 2 {
+		t.Fatalf("expected a position per entry, got %d", n)
+	}
+
+	// A reload starts over
+	h.systemHosts.Store(newSystemHosts(entries))
+	if got := first(); got != "10.0.0.1" {
+		t.Fatalf("round robin after a reload: first answer %s", got)
+	}
+}
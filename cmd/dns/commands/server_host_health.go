@@ -0,0 +1,212 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/logger"
+)
+
+// hostHealthChecker probes the addresses of config hosts entries that declare a health
+// check. Addresses failing FailThreshold probes in a row are left out of answers; a
+// successful probe brings them back. A nil *hostHealthChecker does nothing.
+type hostHealthChecker struct {
+	addresses map[hostHealthKey]*hostAddressHealth // of the entries checked, read-only
+	client    *http.Client
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+// hostHealthKey identifies an address of the health-checked hosts entries of a name.
+type hostHealthKey struct {
+	domain string
+	ip     string
+}
+
+// hostAddressHealth is the health of an address.
+type hostAddressHealth struct {
+	down  atomic.Bool
+	fails atomic.Int32 // consecutive failed probes
+}
+
+// hostHealthState holds the health of the health-checked addresses. The checkers of
+// successive configs share it, so that a reload keeps the addresses that are down out
+// of answers.
+type hostHealthState struct {
+	mu        sync.Mutex
+	addresses map[hostHealthKey]*hostAddressHealth
+}
+
+func newHostHealthState() *hostHealthState {
+	return &hostHealthState{addresses: make(map[hostHealthKey]*hostAddressHealth)}
+}
+
+// get returns the health of key, healthy if it was never checked.
+func (s *hostHealthState) get(key hostHealthKey) *hostAddressHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.addresses[key]
+	if a == nil {
+		a = new(hostAddressHealth)
+		s.addresses[key] = a
+	}
+	return a
+}
+
+// retain forgets the health of the addresses c does not check, once c replaced the
+// checker of the previous config. A nil c checks none.
+func (s *hostHealthState) retain(c *hostHealthChecker) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.addresses {
+		if c == nil || c.addresses[key] == nil {
+			delete(s.addresses, key)
+		}
+	}
+}
+
+// startHostHealthChecker starts probing the health-checked hosts entries of cfgs, or
+// returns nil when there are none. Their addresses start with the health recorded in
+// state.
+func startHostHealthChecker(state *hostHealthState, cfgs ...*config.Config) (*hostHealthChecker, error) {
+	var mappings []*config.HostMapping
+	for _, cfg := range cfgs {
+		if cfg == nil {
+			continue
+		}
+		idx, err := cfg.HostIndex()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range idx.Entries() {
+			if m.HealthCheck != nil && len(m.HostAddresses()) > 0 {
+				mappings = append(mappings, m)
+			}
+		}
+	}
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+
+	c := &hostHealthChecker{
+		addresses: make(map[hostHealthKey]*hostAddressHealth),
+		client: &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+			// A redirect is an answer; don't follow it to another host
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		done: make(chan struct{}),
+	}
+	for _, m := range mappings {
+		for _, ip := range m.HostAddresses() {
+			key := hostHealthKey{m.Domain, ip}
+			c.addresses[key] = state.get(key)
+		}
+		m.SetHealth(c)
+	}
+	for _, m := range mappings {
+		go c.run(m)
+	}
+	return c, nil
+}
+
+// Healthy implements config.HostHealth.
+func (c *hostHealthChecker) Healthy(m *config.HostMapping, ip string) bool {
+	a := c.addresses[hostHealthKey{m.Domain, ip}]
+	return a == nil || !a.down.Load()
+}
+
+// run probes the addresses of m every interval until the checker stops.
+func (c *hostHealthChecker) run(m *config.HostMapping) {
+	ticker := time.NewTicker(m.HealthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll(m)
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll probes every address of m concurrently and updates their health.
+func (c *hostHealthChecker) checkAll(m *config.HostMapping) {
+	ips := m.HostAddresses()
+	errs := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.probe(m, ip)
+		}()
+	}
+	wg.Wait()
+
+	for i, ip := range ips {
+		a := c.addresses[hostHealthKey{m.Domain, ip}]
+		if errs[i] == nil {
+			a.fails.Store(0)
+			if a.down.Swap(false) {
+				logger.Info("Host %s address %s is healthy again, back in answers", m.Domain, ip)
+			}
+			continue
+		}
+		fails := a.fails.Add(1)
+		if int(fails) >= m.HealthCheck.FailThreshold && !a.down.Swap(true) {
+			logger.Warn("Host %s address %s failed %d health checks (%v), leaving it out of answers", m.Domain, ip, fails, errs[i])
+		}
+	}
+}
+
+// probe runs the health check of m against ip.
+func (c *hostHealthChecker) probe(m *config.HostMapping, ip string) error {
+	hc := m.HealthCheck
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	addr := net.JoinHostPort(ip, strconv.Itoa(hc.Port))
+
+	if hc.Type != config.HostHealthCheckHTTP {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	if !m.IsWildcard && !m.IsRegex {
+		req.Host = m.Domain
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if hc.Status != 0 && resp.StatusCode != hc.Status || hc.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// stop ends health checking.
+func (c *hostHealthChecker) stop() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() { close(c.done) })
+}
@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// answeredA returns the A addresses answered for name.
+func answeredA(h *queryHandler, name string) []string {
+	var ips []string
+	for _, rr := range h.serveDNS(testQuery(name, mdns.TypeA)).Answer {
+		if a, ok := rr.(*mdns.A); ok {
+			ips = append(ips, a.A.String())
+		}
+	}
+	return ips
+}
+
+func waitForAnswer(t *testing.T, h *queryHandler, name string, want ...string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = answeredA(h, name); slices.Equal(got, want) {
+			return
+		}
+	}
+	t.Fatalf("%s answered %v, want %v", name, got, want)
+}
+
+func TestHostHealthCheckerTCP(t *testing.T) {
+	t.Parallel()
+	// Only 127.0.0.1 listens; 127.0.0.2 refuses connections on the same port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	cfg := &config.Config{Hosts: config.HostsConfig{
+		"db.example.com": map[string]interface{}{
+			"a":            []interface{}{"127.0.0.1", "127.0.0.2"},
+			"health_check": map[string]interface{}{"port": port, "interval": "20ms", "fail_threshold": 1},
+		},
+	}}
+	h := newTestHandler(t, cfg, "127.0.0.1:1")
+	if answeredA(h, "db.example.com") == nil {
+		t.Fatal("addresses must be answered before the first probe")
+	}
+	if h.hostHealth, err = startHostHealthChecker(newHostHealthState(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer h.hostHealth.stop()
+
+	waitForAnswer(t, h, "db.example.com", "127.0.0.1")
+}
+
+func TestHostHealthCheckerHTTPFallback(t *testing.T) {
+	t.Parallel()
+	var healthy atomic.Bool
+	healthy.Store(true)
+	var host atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		if r.URL.Path != "/healthz" || !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	cfg := &config.Config{Hosts: config.HostsConfig{
+		"api.example.com": map[string]interface{}{
+			"a": "127.0.0.1",
+			"health_check": map[string]interface{}{
+				"type": "http", "port": portNum, "path": "/healthz", "interval": "20ms", "fail_threshold": 2,
+			},
+			"fallback": "10.9.0.1",
+		},
+	}}
+	h := newTestHandler(t, cfg, "127.0.0.1:1")
+	checker, err := startHostHealthChecker(newHostHealthState(), cfg)
+	if err != nil || checker == nil {
+		t.Fatalf("startHostHealthChecker = %v, %v", checker, err)
+	}
+	h.hostHealth = checker
+	defer checker.stop()
+
+	waitForAnswer(t, h, "api.example.com", "127.0.0.1")
+
+	healthy.Store(false)
+	waitForAnswer(t, h, "api.example.com", "10.9.0.1")
+	healthy.Store(true)
+	waitForAnswer(t, h, "api.example.com", "127.0.0.1")
+	if got, _ := host.Load().(string); got != "api.example.com" {
+		t.Errorf("probe sent Host %q, want the entry name", got)
+	}
+}
+
+func TestHostHealthCheckerKeepsHealthAcrossReloads(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	state := newHostHealthState()
+	load := func(interval string, failThreshold int) *config.Config {
+		return &config.Config{Hosts: config.HostsConfig{
+			"db.example.com": map[string]interface{}{
+				"a":            []interface{}{"127.0.0.1", "127.0.0.2"},
+				"health_check": map[string]interface{}{"port": port, "interval": interval, "fail_threshold": failThreshold},
+			},
+			"cache.example.com": map[string]interface{}{
+				"a":            "127.0.0.2",
+				"health_check": map[string]interface{}{"port": port, "interval": interval, "fail_threshold": failThreshold},
+			},
+		}}
+	}
+	cfg := load("20ms", 1)
+	h := newTestHandler(t, cfg, "127.0.0.1:1")
+	if h.hostHealth, err = startHostHealthChecker(state, cfg); err != nil {
+		t.Fatal(err)
+	}
+	waitForAnswer(t, h, "db.example.com", "127.0.0.1")
+	h.hostHealth.stop()
+
+	// The reloaded entry needs many failed probes to take an address down: the address
+	// down before the reload stays out of answers meanwhile
+	next := load("1h", 100)
+	delete(next.Hosts, "cache.example.com")
+	h2 := newTestHandler(t, next, "127.0.0.1:1")
+	if h2.hostHealth, err = startHostHealthChecker(state, next); err != nil {
+		t.Fatal(err)
+	}
+	defer h2.hostHealth.stop()
+	if got := answeredA(h2, "db.example.com"); !slices.Equal(got, []string{"127.0.0.1"}) {
+		t.Errorf("after the reload db.example.com answered %v", got)
+	}
+
+	// Addresses no longer checked are forgotten once the new checker is active
+	h2.hostHealthState = state
+	h2.activate()
+	if n := len(state.addresses); n != 2 {
+		t.Errorf("%d addresses kept, want 2", n)
+	}
+}
+
+func TestStartHostHealthCheckerWithoutChecks(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{Hosts: config.HostsConfig{"example.com": "10.0.0.1"}}
+	c, err := startHostHealthChecker(newHostHealthState(), cfg)
+	if err != nil || c != nil {
+		t.Fatalf("startHostHealthChecker = %v, %v; want nil", c, err)
+	}
+	c.stop() // nil-safe
+}
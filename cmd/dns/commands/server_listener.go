@@ -0,0 +1,518 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// dnsServerUDPSize is the EDNS0 UDP payload size advertised in responses (DNS flag day 2020).
+const dnsServerUDPSize = 1232
+
+// dnsRequest is a single DNS message received by dnsServer together with where it came from.
+type dnsRequest struct {
+	msg      *mdns.Msg
+	clientIP net.IP
+	protocol string // udp, tcp, dot, doh, doq
+}
+
+// dnsServerOptions configures the listeners started by dnsServer.
+type dnsServerOptions struct {
+	Host        string
+	Port        int
+	EnableDoT   bool
+	DoTPort     int
+	EnableDoH   bool
+	DoHPort     int
+	EnableDoQ   bool
+	DoQPort     int
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// dnsServer serves DNS over UDP/TCP and optionally DoT, DoH and DoQ.
+// Unlike go-zoox/dns's server, the handler receives the whole request message
+// (any query type) and returns the full reply, so records beyond A/AAAA can be served.
+type dnsServer struct {
+	opts      *dnsServerOptions
+	handler   func(req *dnsRequest) *mdns.Msg // a nil reply sends no response
+	tlsConfig *tls.Config
+
+	inflight atomic.Int64 // requests being handled
+
+	mu       sync.Mutex
+	closing  bool
+	stops    []func(context.Context) error // stop a listener from accepting
+	releases []func()                      // run once in-flight requests are drained
+}
+
+// newDNSServer creates a dnsServer, loading the TLS certificate when DoT/DoH/DoQ is enabled.
+func newDNSServer(opts *dnsServerOptions, handler func(req *dnsRequest) *mdns.Msg) (*dnsServer, error) {
+	s := &dnsServer{
+		opts:    opts,
+		handler: handler,
+	}
+
+	if opts.EnableDoT || opts.EnableDoH || opts.EnableDoQ {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	return s, nil
+}
+
+// Addr returns the address of the UDP/TCP listeners
+func (s *dnsServer) Addr() string {
+	return net.JoinHostPort(s.opts.Host, strconv.Itoa(s.opts.Port))
+}
+
+// DoTAddr returns the address of the DoT listener
+func (s *dnsServer) DoTAddr() string {
+	return net.JoinHostPort(s.opts.Host, strconv.Itoa(s.opts.DoTPort))
+}
+
+// DoHAddr returns the address of the DoH listener
+func (s *dnsServer) DoHAddr() string {
+	return net.JoinHostPort(s.opts.Host, strconv.Itoa(s.opts.DoHPort))
+}
+
+// DoQAddr returns the address of the DoQ listener
+func (s *dnsServer) DoQAddr() string {
+	return net.JoinHostPort(s.opts.Host, strconv.Itoa(s.opts.DoQPort))
+}
+
+// serve starts all enabled listeners and blocks until one of them fails or shutdown
+// stops them, in which case it returns nil.
+func (s *dnsServer) serve() error {
+	errCh := make(chan error, 5)
+	run := func(name, addr string, start func() error) {
+		go func() {
+			err := start()
+			switch {
+			case s.isClosing():
+				errCh <- nil
+			case err != nil:
+				errCh <- fmt.Errorf("%s listener on %s failed: %w", name, addr, err)
+			}
+		}()
+	}
+
+	run("udp", s.Addr(), func() error { return s.startPlain("udp") })
+	run("tcp", s.Addr(), func() error { return s.startPlain("tcp") })
+	if s.opts.EnableDoT {
+		run("DoT", s.DoTAddr(), s.startDoT)
+	}
+	if s.opts.EnableDoH {
+		run("DoH", s.DoHAddr(), s.startDoH)
+	}
+	if s.opts.EnableDoQ {
+		run("DoQ", s.DoQAddr(), s.startDoQ)
+	}
+
+	return <-errCh
+}
+
+// track registers how to stop a listener and what to release after draining. It
+// reports false when shutdown has already begun, in which case the caller must stop
+// the listener itself.
+func (s *dnsServer) track(stop func(context.Context) error, release func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.stops = append(s.stops, stop)
+	if release != nil {
+		s.releases = append(s.releases, release)
+	}
+	return true
+}
+
+func (s *dnsServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// shutdown stops every listener from accepting queries and waits for the queries being
+// handled to be answered, until ctx is done.
+func (s *dnsServer) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closing = true
+	stops, releases := s.stops, s.releases
+	s.mu.Unlock()
+
+	var errs []error
+	for _, stop := range stops {
+		if err := stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, s.drain(ctx))
+	for _, release := range releases {
+		release()
+	}
+	return errors.Join(errs...)
+}
+
+// drain waits until no request is being handled or ctx is done.
+func (s *dnsServer) drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := s.inflight.Load()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d queries still in flight: %w", n, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// handle runs the handler for a request and prepares the reply for the transport it
+// arrived on. A nil reply means no response is sent.
+func (s *dnsServer) handle(req *dnsRequest) *mdns.Msg {
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+
+	reply := s.handler(req)
+	if reply == nil {
+		return nil
+	}
+
+	// Echo EDNS0 support and keep UDP answers within the client's advertised buffer
+	udpSize := mdns.MinMsgSize
+	if opt := req.msg.IsEdns0(); opt != nil {
+		if reply.IsEdns0() == nil {
+			reply.SetEdns0(dnsServerUDPSize, opt.Do())
+		}
+		if int(opt.UDPSize()) > udpSize {
+			udpSize = int(opt.UDPSize())
+		}
+	}
+	if req.protocol == "udp" {
+		reply.Truncate(udpSize)
+	}
+
+	return reply
+}
+
+func (s *dnsServer) serveMsg(protocol string) mdns.HandlerFunc {
+	return func(w mdns.ResponseWriter, r *mdns.Msg) {
+		reply := s.handle(&dnsRequest{
+			msg:      r,
+			clientIP: addrIP(w.RemoteAddr()),
+			protocol: protocol,
+		})
+		if reply == nil {
+			// Dropped: UDP clients time out, stream clients see the connection close
+			if protocol != "udp" {
+				w.Close()
+			}
+			return
+		}
+		if err := w.WriteMsg(reply); err != nil {
+			logger.Debugf("Failed to write %s response to %s: %v", protocol, w.RemoteAddr(), err)
+		}
+	}
+}
+
+func (s *dnsServer) startPlain(network string) error {
+	server := &mdns.Server{
+		Addr:    s.Addr(),
+		Net:     network,
+		Handler: s.serveMsg(network),
+		UDPSize: 65535,
+	}
+	server.NotifyStartedFunc = s.trackMiekg(server)
+
+	logger.Info("Start %s listener on %s", network, s.Addr())
+	return server.ListenAndServe()
+}
+
+func (s *dnsServer) startDoT() error {
+	server := &mdns.Server{
+		Addr:      s.DoTAddr(),
+		Net:       "tcp-tls",
+		Handler:   s.serveMsg("dot"),
+		TLSConfig: s.tlsConfig,
+	}
+	server.NotifyStartedFunc = s.trackMiekg(server)
+
+	logger.Info("Start DoT listener on %s", s.DoTAddr())
+	return server.ListenAndServe()
+}
+
+// trackMiekg returns a NotifyStartedFunc registering server for shutdown once it runs;
+// a server that starts after shutdown began is stopped right away.
+func (s *dnsServer) trackMiekg(server *mdns.Server) func() {
+	return func() {
+		if !s.track(server.ShutdownContext, nil) {
+			go server.Shutdown()
+		}
+	}
+}
+
+// doH handles DNS over HTTPS requests (RFC 8484, GET and POST)
+func (s *dnsServer) doH(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		// GET: dns query in base64url format
+		dnsParam := r.URL.Query().Get("dns")
+		if dnsParam == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		data, err = base64.RawURLEncoding.DecodeString(dnsParam)
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		// POST: binary DNS message in body
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "invalid content type", http.StatusBadRequest)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(r.Body, mdns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msg := new(mdns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	if len(msg.Question) == 0 {
+		http.Error(w, "no question in dns message", http.StatusBadRequest)
+		return
+	}
+
+	var remote net.IP
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = net.ParseIP(host)
+	} else {
+		remote = net.ParseIP(r.RemoteAddr)
+	}
+
+	reply := s.handle(&dnsRequest{msg: msg, clientIP: remote, protocol: "doh"})
+	if reply == nil {
+		// Dropped: abort the response without writing anything
+		panic(http.ErrAbortHandler)
+	}
+	out, err := reply.Pack()
+	if err != nil {
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// Timeouts of the metrics and admin API listeners, so that slow clients cannot hold
+// their connections open
+const (
+	httpReadHeaderTimeout = 5 * time.Second
+	httpReadTimeout       = 30 * time.Second
+	httpWriteTimeout      = time.Minute // reloads through the admin API may take a while
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// newHTTPServer returns a server for handler on listen with the HTTP timeouts.
+func newHTTPServer(listen string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              listen,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
+
+// serveHTTP serves server until it is shut down, logging a failure of its listener.
+func serveHTTP(server *http.Server, name string) {
+	logger.Info("Start %s listener on %s", name, server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("The %s listener on %s failed: %v", name, server.Addr, err)
+	}
+}
+
+// shutdownHTTPServers stops servers and waits for their requests, until ctx is done.
+func shutdownHTTPServers(ctx context.Context, servers []*http.Server) error {
+	var errs []error
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *dnsServer) startDoH() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", s.doH)
+	mux.HandleFunc("/query", s.doH) // Alternative path
+
+	server := &http.Server{
+		Addr:      s.DoHAddr(),
+		Handler:   mux,
+		TLSConfig: s.tlsConfig,
+	}
+	if !s.track(server.Shutdown, nil) {
+		return nil
+	}
+
+	logger.Info("Start DoH listener on %s", s.DoHAddr())
+	if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// doQ handles one DNS over QUIC stream. Messages are framed with a 2-octet length
+// prefix (RFC 9250); unframed messages from older clients are accepted and answered unframed.
+func (s *dnsServer) doQ(stream *quic.Stream, conn *quic.Conn) error {
+	defer stream.Close()
+
+	data, err := io.ReadAll(io.LimitReader(stream, mdns.MaxMsgSize+2))
+	if err != nil {
+		return err
+	}
+
+	framed := len(data) >= 2 && int(binary.BigEndian.Uint16(data)) == len(data)-2
+	if framed {
+		data = data[2:]
+	}
+
+	msg := new(mdns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		return err
+	}
+	if len(msg.Question) == 0 {
+		return nil
+	}
+
+	reply := s.handle(&dnsRequest{msg: msg, clientIP: addrIP(conn.RemoteAddr()), protocol: "doq"})
+	if reply == nil {
+		return nil // dropped: close the stream without an answer
+	}
+	out, err := reply.Pack()
+	if err != nil {
+		return err
+	}
+	if framed {
+		out = append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...)
+	}
+
+	_, err = stream.Write(out)
+	return err
+}
+
+func (s *dnsServer) startDoQ() error {
+	addr, err := net.ResolveUDPAddr("udp", s.DoQAddr())
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	doqTLSConfig := s.tlsConfig.Clone()
+	doqTLSConfig.NextProtos = []string{"doq"}
+
+	listener, err := quic.Listen(conn, doqTLSConfig, &quic.Config{
+		Allow0RTT: true,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	// Established connections keep serving their streams until drained
+	stop := func(context.Context) error { return listener.Close() }
+	if !s.track(stop, func() { conn.Close() }) {
+		listener.Close()
+		conn.Close()
+		return nil
+	}
+
+	logger.Info("Start DoQ listener on %s", s.DoQAddr())
+	for {
+		c, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+
+		// Handle each connection and each of its streams in its own goroutine
+		go func(c *quic.Conn) {
+			for {
+				stream, err := c.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go func(st *quic.Stream) {
+					if err := s.doQ(st, c); err != nil {
+						logger.Debugf("DoQ stream error from %s: %v", c.RemoteAddr(), err)
+					}
+				}(stream)
+			}
+		}(c)
+	}
+}
+
+// addrIP extracts the IP address from a listener's remote address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+// freePort returns a port that is free for both UDP and TCP on localhost.
+func freePort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if pc, err := net.ListenPacket("udp", l.Addr().String()); err == nil {
+			pc.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+// startTestServer runs a dnsServer with handler on localhost and waits until it listens.
+func startTestServer(t *testing.T, handler func(*dnsRequest) *mdns.Msg) (*dnsServer, <-chan error) {
+	t.Helper()
+	s, err := newDNSServer(&dnsServerOptions{Host: "127.0.0.1", Port: freePort(t)}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve() }()
+
+	// UDP and TCP listeners register for shutdown once they are serving
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		s.mu.Lock()
+		started := len(s.stops)
+		s.mu.Unlock()
+		if started == 2 {
+			return s, served
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start, %d listeners running", started)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDNSServerShutdownDrainsInFlightQueries(t *testing.T) {
+	t.Parallel()
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s, served := startTestServer(t, func(req *dnsRequest) *mdns.Msg {
+		entered <- struct{}{}
+		<-release
+		m := new(mdns.Msg)
+		m.SetReply(req.msg)
+		return m
+	})
+
+	answered := make(chan error, 1)
+	go func() {
+		m := new(mdns.Msg)
+		m.SetQuestion("example.com.", mdns.TypeA)
+		_, _, err := (&mdns.Client{Timeout: 5 * time.Second}).Exchange(m, s.Addr())
+		answered <- err
+	}()
+	<-entered
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- s.shutdown(context.Background()) }()
+
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("shutdown returned before the in-flight query finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-answered; err != nil {
+		t.Fatalf("in-flight query was not answered: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve returned %v after shutdown", err)
+	}
+
+	m := new(mdns.Msg)
+	m.SetQuestion("example.com.", mdns.TypeA)
+	if _, _, err := (&mdns.Client{Net: "tcp", Timeout: 200 * time.Millisecond}).Exchange(m, s.Addr()); err == nil {
+		t.Fatal("server still answers after shutdown")
+	}
+}
+
+func TestDNSServerShutdownDeadline(t *testing.T) {
+	t.Parallel()
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	s, _ := startTestServer(t, func(req *dnsRequest) *mdns.Msg {
+		entered <- struct{}{}
+		<-release
+		return nil
+	})
+
+	go func() {
+		m := new(mdns.Msg)
+		m.SetQuestion("example.com.", mdns.TypeA)
+		(&mdns.Client{Timeout: 2 * time.Second}).Exchange(m, s.Addr())
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.shutdown(ctx); err == nil {
+		t.Fatal("expected an error when queries are still in flight at the deadline")
+	}
+}
+
+func TestHTTPServerShutdown(t *testing.T) {
+	t.Parallel()
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	server := newHTTPServer(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	if server.ReadHeaderTimeout == 0 || server.ReadTimeout == 0 || server.WriteTimeout == 0 || server.IdleTimeout == 0 {
+		t.Fatalf("HTTP server without timeouts: %+v", server)
+	}
+	done := make(chan struct{})
+	go func() {
+		serveHTTP(server, "test")
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		resp, err := http.Get("http://" + addr)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shutdownHTTPServers(ctx, []*http.Server{server}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serveHTTP did not return after shutdown")
+	}
+	if _, err := http.Get("http://" + addr); err == nil {
+		t.Fatal("server still answering after shutdown")
+	}
+}
@@ -0,0 +1,150 @@
+package commands
+
+import (
+	"net/http"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverMetrics holds the Prometheus metrics of the server. A nil *serverMetrics
+// records nothing, so callers do not need to check whether metrics are enabled.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	queries         *prometheus.CounterVec
+	responses       *prometheus.CounterVec
+	queryDuration   *prometheus.HistogramVec
+	upstreamLatency *prometheus.HistogramVec
+	upstreamErrors  *prometheus.CounterVec
+	reloads         *prometheus.CounterVec
+	coalesced       prometheus.Counter
+}
+
+// newServerMetrics registers the server metrics, reading cache counters from cache.
+func newServerMetrics(cache *dnsAnswerCache) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		queries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_queries_total",
+			Help: "DNS queries received, by query type and transport.",
+		}, []string{"qtype", "protocol"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_responses_total",
+			Help: "DNS responses sent, by resolution channel and response code.",
+		}, []string{"channel", "rcode"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dns_query_duration_seconds",
+			Help:    "Time to answer a query, by resolution channel.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"channel"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dns_upstream_request_duration_seconds",
+			Help:    "Latency of queries sent to upstream servers.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"server"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_upstream_errors_total",
+			Help: "Failed queries to upstream servers (network errors and SERVFAIL/REFUSED replies).",
+		}, []string{"server"}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_reloads_total",
+			Help: "Reloads of watched files, by source (config, system_hosts, filter) and result.",
+		}, []string{"source", "result"}),
+		coalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dns_upstream_coalesced_total",
+			Help: "Queries answered by sharing an identical upstream lookup already in flight.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.queries, m.responses, m.queryDuration,
+		m.upstreamLatency, m.upstreamErrors, m.reloads, m.coalesced,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dns_cache_hits_total",
+			Help: "Response cache hits.",
+		}, func() float64 { return float64(cache.hitCount()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dns_cache_misses_total",
+			Help: "Response cache misses.",
+		}, func() float64 { return float64(cache.missCount()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dns_cache_evictions_total",
+			Help: "Response cache entries evicted to stay within max_entries.",
+		}, func() float64 { return float64(cache.evictionCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "dns_cache_entries",
+			Help: "Entries currently held by the response cache.",
+		}, func() float64 { return float64(cache.len()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeQuery records a query and the response sent for it.
+func (m *serverMetrics) observeQuery(qtype uint16, protocol, channel string, rcode int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	typeName, ok := mdns.TypeToString[qtype]
+	if !ok {
+		typeName = "OTHER"
+	}
+	rcodeName, ok := mdns.RcodeToString[rcode]
+	if !ok {
+		rcodeName = "OTHER"
+	}
+	if channel == "" {
+		channel = "none"
+	}
+	m.queries.WithLabelValues(typeName, protocol).Inc()
+	m.responses.WithLabelValues(channel, rcodeName).Inc()
+	m.queryDuration.WithLabelValues(channel).Observe(elapsed.Seconds())
+}
+
+// observeUpstream records one query sent to an upstream server.
+func (m *serverMetrics) observeUpstream(server string, elapsed time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	m.upstreamLatency.WithLabelValues(server).Observe(elapsed.Seconds())
+	if failed {
+		m.upstreamErrors.WithLabelValues(server).Inc()
+	}
+}
+
+// observeCoalesced records a query that shared an upstream lookup in flight.
+func (m *serverMetrics) observeCoalesced() {
+	if m == nil {
+		return
+	}
+	m.coalesced.Inc()
+}
+
+// reloaded records a reload of a watched file.
+func (m *serverMetrics) reloaded(source string, ok bool) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	m.reloads.WithLabelValues(source, result).Inc()
+}
+
+// handler returns the HTTP handler serving the metrics in the Prometheus text format.
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// httpServer returns the HTTP server exposing the metrics on listen at path.
+func (m *serverMetrics) httpServer(listen, path string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(path, m.handler())
+	return newHTTPServer(listen, mux)
+}
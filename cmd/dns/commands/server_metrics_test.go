@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func TestServerMetrics(t *testing.T) {
+	t.Parallel()
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		if strings.HasPrefix(r.Question[0].Name, "missing.") {
+			m.SetRcode(r, mdns.RcodeNameError)
+		} else {
+			m.SetReply(r)
+			m.Answer = []mdns.RR{testA(r.Question[0].Name, "10.0.0.1")}
+		}
+		w.WriteMsg(m)
+	})
+
+	h := newTestHandler(t, &config.Config{Hosts: config.HostsConfig{"static.example": "10.0.0.9"}}, upstream)
+	metrics := newServerMetrics(h.cache)
+	h.metrics = metrics
+	h.upstream.fallback.metrics = metrics
+
+	h.serveDNS(testQuery("static.example", mdns.TypeA))
+	h.serveDNS(testQuery("www.example", mdns.TypeA))
+	h.serveDNS(testQuery("www.example", mdns.TypeA))
+	h.serveDNS(testQuery("missing.example", mdns.TypeAAAA))
+	metrics.reloaded("system_hosts", true)
+
+	rec := httptest.NewRecorder()
+	metrics.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	out := string(body)
+
+	for _, want := range []string{
+		`dns_queries_total{protocol="udp",qtype="A"} 3`,
+		`dns_queries_total{protocol="udp",qtype="AAAA"} 1`,
+		`dns_responses_total{channel="config.hosts",rcode="NOERROR"} 1`,
+		`dns_responses_total{channel="upstream",rcode="NOERROR"} 1`,
+		`dns_responses_total{channel="cache",rcode="NOERROR"} 1`,
+		`dns_responses_total{channel="upstream",rcode="NXDOMAIN"} 1`,
+		`dns_cache_hits_total 1`,
+		`dns_cache_misses_total 2`,
+		`dns_cache_entries 2`,
+		`dns_upstream_request_duration_seconds_count{server="` + upstream,
+		`dns_reloads_total{result="success",source="system_hosts"} 1`,
+		`dns_query_duration_seconds_count{channel="cache"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
+
+func TestServerMetricsNilSafe(t *testing.T) {
+	t.Parallel()
+	var m *serverMetrics
+	m.observeQuery(mdns.TypeA, "udp", "cache", mdns.RcodeSuccess, 0)
+	m.observeUpstream("127.0.0.1:53", 0, true)
+	m.reloaded("config", false)
+}
@@ -0,0 +1,281 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+// queryLogBuffer is how many entries may wait for the sink before new ones are dropped,
+// so a slow disk never stalls query handling.
+const queryLogBuffer = 4096
+
+// queryLogEntry is one line of the query log.
+type queryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Protocol  string    `json:"protocol"`
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	RCode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	View      string    `json:"view,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	CacheHit  bool      `json:"cache_hit"`
+}
+
+// queryLogSink receives encoded query log lines.
+type queryLogSink interface {
+	io.Writer
+	Close() error
+}
+
+// queryLogger writes query log entries as JSON lines to a sink from a background goroutine.
+// A nil *queryLogger logs nothing.
+type queryLogger struct {
+	sink    queryLogSink
+	entries chan *queryLogEntry
+	dropped atomic.Uint64
+	done    chan struct{}
+}
+
+// newQueryLogger creates the sink configured by cfg: stdout for "stdout" or "-",
+// otherwise a rotating file.
+func newQueryLogger(cfg config.QueryLogConfig) (*queryLogger, error) {
+	var sink queryLogSink
+	switch cfg.Output {
+	case "", "stdout", "-":
+		sink = nopCloser{os.Stdout}
+	default:
+		rotateInterval, err := parseOptionalDuration(cfg.RotateInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query_log.rotate_interval: %w", err)
+		}
+		f, err := openRotatingFile(cfg.Output, int64(cfg.MaxSizeMB)*1024*1024, rotateInterval, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink = f
+	}
+	return startQueryLogger(sink), nil
+}
+
+func startQueryLogger(sink queryLogSink) *queryLogger {
+	l := &queryLogger{
+		sink:    sink,
+		entries: make(chan *queryLogEntry, queryLogBuffer),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *queryLogger) run() {
+	defer close(l.done)
+	enc := json.NewEncoder(l.sink)
+	for e := range l.entries {
+		if err := enc.Encode(e); err != nil {
+			logger.Warn("Failed to write query log: %v", err)
+		}
+	}
+}
+
+// log queues an entry for req and its reply.
+func (l *queryLogger) log(req *dnsRequest, reply *mdns.Msg, channel, view string, startAt time.Time) {
+	if l == nil {
+		return
+	}
+	e := &queryLogEntry{
+		Time:      startAt,
+		Protocol:  req.protocol,
+		RCode:     mdns.RcodeToString[reply.Rcode],
+		Channel:   channel,
+		View:      view,
+		LatencyMs: float64(time.Since(startAt).Microseconds()) / 1000,
+		CacheHit:  channel == "cache" || channel == "stale",
+	}
+	e.Client = clientIPString(req.clientIP)
+	if len(req.msg.Question) > 0 {
+		q := req.msg.Question[0]
+		e.QName = strings.TrimSuffix(q.Name, ".")
+		e.QType = mdns.TypeToString[q.Qtype]
+		if e.QType == "" {
+			e.QType = fmt.Sprintf("TYPE%d", q.Qtype)
+		}
+	}
+	for _, rr := range reply.Answer {
+		e.Answers = append(e.Answers, rr.String())
+	}
+
+	select {
+	case l.entries <- e:
+	default:
+		if l.dropped.Add(1)%1000 == 1 {
+			logger.Warn("Query log is falling behind, dropped %d entries so far", l.dropped.Load())
+		}
+	}
+}
+
+// close flushes queued entries and closes the sink.
+func (l *queryLogger) close() {
+	if l == nil {
+		return
+	}
+	close(l.entries)
+	<-l.done
+	if err := l.sink.Close(); err != nil {
+		logger.Warn("Failed to close query log: %v", err)
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// rotatingFile is a log file rotated when it exceeds maxSize bytes or every interval.
+// Rotated files are renamed to <name>-<timestamp><ext>; only the newest maxBackups are kept.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64         // 0 = no size limit
+	interval   time.Duration // 0 = no time-based rotation
+	maxBackups int           // 0 = keep all
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+	retryAt    time.Time // rotation failed: keep writing to the current file until then
+	now        func() time.Time
+}
+
+// queryLogBackupTime is the time format of the backups of a rotated query log.
+const queryLogBackupTime = "20060102T150405.000"
+
+// queryLogRotateRetry is how long writes go to the current file after a failed rotation.
+const queryLogRotateRetry = time.Minute
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create query log directory: %w", err)
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open query log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open query log: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	if f.size > 0 && !now.Before(f.retryAt) && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.interval > 0 && now.Sub(f.openedAt) >= f.interval)) {
+		if err := f.rotate(now); err != nil {
+			// Entries are better kept in an oversized file than lost
+			logger.Warn("%v, retrying in %s", err, queryLogRotateRetry)
+			f.retryAt = now.Add(queryLogRotateRetry)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, opens a new one and removes old backups. On
+// failure the current file stays open at its path.
+func (f *rotatingFile) rotate(now time.Time) error {
+	ext := filepath.Ext(f.path)
+	base := strings.TrimSuffix(f.path, ext)
+	backup := fmt.Sprintf("%s-%s%s", base, now.UTC().Format(queryLogBackupTime), ext)
+	if err := os.Rename(f.path, backup); err != nil {
+		return fmt.Errorf("failed to rotate query log: %w", err)
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		// Put the current file back in place
+		if renameErr := os.Rename(backup, f.path); renameErr != nil {
+			logger.Warn("Failed to restore query log %s: %v", f.path, renameErr)
+		}
+		return fmt.Errorf("failed to rotate query log: %w", err)
+	}
+	if err := old.Close(); err != nil {
+		logger.Warn("Failed to close rotated query log %s: %v", backup, err)
+	}
+
+	if f.maxBackups > 0 {
+		backups := f.backups(base, ext)
+		for len(backups) > f.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// backups returns the backups of the log, oldest first. Only names made by rotate
+// match, so other files next to the log are never removed.
+func (f *rotatingFile) backups(base, ext string) []string {
+	matches, _ := filepath.Glob(base + "-*" + ext)
+	backups := matches[:0]
+	for _, path := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(path, base+"-"), ext)
+		if _, err := time.Parse(queryLogBackupTime, stamp); err == nil {
+			backups = append(backups, path)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// parseOptionalDuration parses a duration, treating an empty string as 0.
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// clientIPString formats a client address for logs.
+func clientIPString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
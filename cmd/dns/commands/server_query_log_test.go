@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func TestQueryLogEntries(t *testing.T) {
+	t.Parallel()
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		m.Answer = []mdns.RR{testA(r.Question[0].Name, "10.0.0.1")}
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(t, &config.Config{Hosts: config.HostsConfig{"static.example": "10.0.0.9"}}, upstream)
+	var buf bytes.Buffer
+	h.queryLog = startQueryLogger(nopCloser{&buf})
+
+	h.serveDNS(testQuery("static.example", mdns.TypeA))
+	h.serveDNS(testQuery("www.example", mdns.TypeA))
+	h.serveDNS(testQuery("www.example", mdns.TypeA))
+	h.queryLog.close()
+
+	var entries []queryLogEntry
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e queryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	first := entries[0]
+	if first.Client != "127.0.0.1" || first.Protocol != "udp" || first.QName != "static.example" || first.QType != "A" ||
+		first.RCode != "NOERROR" || first.Channel != "config.hosts" || first.CacheHit || len(first.Answers) != 1 ||
+		!strings.Contains(first.Answers[0], "10.0.0.9") || first.Time.IsZero() {
+		t.Errorf("unexpected first entry %+v", first)
+	}
+	if entries[1].Channel != "upstream" || entries[1].CacheHit {
+		t.Errorf("unexpected second entry %+v", entries[1])
+	}
+	if entries[2].Channel != "cache" || !entries[2].CacheHit {
+		t.Errorf("unexpected third entry %+v", entries[2])
+	}
+}
+
+func TestRotatingFileBySize(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "logs", "queries.log")
+	f, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not a backup: never pruned
+	other := filepath.Join(filepath.Dir(path), "queries-old.log")
+	if err := os.WriteFile(other, []byte("keep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { now = now.Add(time.Second); return now }
+
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	backups, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "queries-2*.log"))
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups to be kept, got %v", backups)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("pruning removed an unrelated file: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "12345678\n" {
+		t.Errorf("current file holds %q", data)
+	}
+}
+
+func TestRotatingFileByTime(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "queries.log")
+	f, err := openRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	f.openedAt = now
+
+	f.Write([]byte("first\n"))
+	now = now.Add(30 * time.Minute)
+	f.Write([]byte("second\n"))
+	now = now.Add(time.Hour)
+	f.Write([]byte("third\n"))
+	f.Close()
+
+	backups, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "queries-*.log"))
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 rotation, got %v", backups)
+	}
+	old, _ := os.ReadFile(backups[0])
+	cur, _ := os.ReadFile(path)
+	if string(old) != "first\nsecond\n" || string(cur) != "third\n" {
+		t.Errorf("unexpected contents %q / %q", old, cur)
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRotationFails(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "queries.log")
+	f, err := openRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+
+	// A directory in the way of the backup makes the rename fail
+	if err := os.Mkdir(filepath.Join(filepath.Dir(path), "queries-"+now.Format(queryLogBackupTime)+".log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"12345678\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("write after a failed rotation: %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "12345678\nsecond\nthird\n" {
+		t.Errorf("current file holds %q", data)
+	}
+
+	// Rotation is retried later
+	now = now.Add(queryLogRotateRetry)
+	if _, err := f.Write([]byte("fourth\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "fourth\n" {
+		t.Errorf("current file after the retry holds %q", data)
+	}
+}
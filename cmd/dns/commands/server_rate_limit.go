@@ -0,0 +1,246 @@
+package commands
+
+import (
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+const (
+	rateBucketShards     = 16
+	rateBucketShardLimit = 65536 // buckets per shard; clients beyond it share the overflow bucket
+	rateBucketSweep      = time.Minute
+	rateBucketFullSweep  = time.Second // how often a full shard is swept for new clients
+)
+
+// rateBuckets are token buckets refilled at rate tokens per second up to burst, keyed by
+// client network (and response, for RRL). With a negative floor, limited takes still
+// spend tokens down to floor, so a client that keeps sending stays limited until it
+// slows down; otherwise they spend nothing.
+type rateBuckets struct {
+	rate, burst, floor float64
+	seed               maphash.Seed
+	shards             [rateBucketShards]rateBucketShard
+}
+
+type rateBucketShard struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+	// overflow is shared by the keys that find the shard full, so that a flood from
+	// more addresses than the shard holds stays limited.
+	overflow *rateBucket
+}
+
+type rateBucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint64 // limited takes since the bucket was last refilled, for slip
+}
+
+func newRateBuckets(rate, burst, floor float64) *rateBuckets {
+	b := &rateBuckets{rate: rate, burst: burst, floor: floor, seed: maphash.MakeSeed()}
+	for i := range b.shards {
+		b.shards[i].buckets = make(map[string]*rateBucket)
+	}
+	return b
+}
+
+// take spends a token of key at now and reports whether one was available. When not,
+// limited counts the limited takes in a row.
+func (b *rateBuckets) take(key string, now time.Time) (ok bool, limited uint64) {
+	s := &b.shards[maphash.String(b.seed, key)%rateBucketShards]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) > rateBucketSweep {
+		b.sweepLocked(s, now)
+	}
+	bk := s.buckets[key]
+	if bk == nil && len(s.buckets) >= rateBucketShardLimit && now.Sub(s.swept) > rateBucketFullSweep {
+		b.sweepLocked(s, now)
+	}
+	switch {
+	case bk != nil:
+	case len(s.buckets) < rateBucketShardLimit:
+		bk = &rateBucket{tokens: b.burst, last: now}
+		s.buckets[key] = bk
+	default:
+		if s.overflow == nil {
+			s.overflow = &rateBucket{tokens: b.burst, last: now}
+		}
+		bk = s.overflow
+	}
+
+	bk.tokens = min(b.burst, bk.tokens+now.Sub(bk.last).Seconds()*b.rate)
+	bk.last = now
+	if bk.tokens >= 1 {
+		bk.tokens--
+		bk.limited = 0
+		return true, 0
+	}
+	if b.floor < 0 {
+		bk.tokens = max(b.floor, bk.tokens-1)
+	}
+	bk.limited++
+	return false, bk.limited
+}
+
+// sweepLocked forgets the buckets of s that are full again.
+func (b *rateBuckets) sweepLocked(s *rateBucketShard, now time.Time) {
+	s.swept = now
+	for key, bk := range s.buckets {
+		if bk.tokens+now.Sub(bk.last).Seconds()*b.rate >= b.burst {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// rateLimiter applies the query and response rate limits of a config. A nil
+// *rateLimiter limits nothing.
+type rateLimiter struct {
+	exempt []netip.Prefix
+
+	queries       *rateBuckets // nil = queries are not limited
+	queryAction   string
+	queryPrefixes [2]int // IPv4 and IPv6 prefix lengths
+
+	responses        *rateBuckets // nil = responses are not limited
+	responseAction   string
+	slip             uint64
+	responsePrefixes [2]int
+}
+
+// newRateLimiter builds the rate limiter of cfg, or returns nil when it limits nothing.
+func newRateLimiter(cfg config.RateLimitConfig) (*rateLimiter, error) {
+	if cfg.Queries.Rate <= 0 && cfg.Responses.Rate <= 0 {
+		return nil, nil
+	}
+	exempt, err := (&config.ClientMatch{Clients: cfg.Exempt}).ClientPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	l := &rateLimiter{exempt: exempt}
+
+	if q := cfg.Queries; q.Rate > 0 {
+		l.queries = newRateBuckets(q.Rate, float64(max(1, q.Burst)), 0)
+		l.queryAction = q.Action
+		l.queryPrefixes = [2]int{q.IPv4Prefix, q.IPv6Prefix}
+	}
+	if r := cfg.Responses; r.Rate > 0 {
+		window, err := time.ParseDuration(r.Window)
+		if err != nil {
+			return nil, err
+		}
+		// One second of responses in advance, up to window seconds of debt (like BIND)
+		l.responses = newRateBuckets(r.Rate, max(1, r.Rate), -r.Rate*window.Seconds())
+		l.responseAction = r.Action
+		if r.Slip != nil {
+			l.slip = uint64(*r.Slip)
+		}
+		l.responsePrefixes = [2]int{r.IPv4Prefix, r.IPv6Prefix}
+	}
+	return l, nil
+}
+
+// query returns the config.RateLimit* action for a query from client at now, or "" if
+// it is within the limit.
+func (l *rateLimiter) query(client net.IP, now time.Time) string {
+	if l == nil || l.queries == nil {
+		return ""
+	}
+	network, ok := l.network(client, l.queryPrefixes)
+	if !ok {
+		return ""
+	}
+	if ok, _ := l.queries.take(network, now); ok {
+		return ""
+	}
+	return l.queryAction
+}
+
+// response returns the config.RateLimit* action for sending reply to client at now,
+// or "" if it is within the limit. Every slip-th limited response is truncated.
+func (l *rateLimiter) response(client net.IP, reply *mdns.Msg, now time.Time) string {
+	if l == nil || l.responses == nil {
+		return ""
+	}
+	network, ok := l.network(client, l.responsePrefixes)
+	if !ok {
+		return ""
+	}
+	ok, limited := l.responses.take(network+"|"+responseKey(reply), now)
+	switch {
+	case ok:
+		return ""
+	case l.slip > 0 && limited%l.slip == 0:
+		return config.RateLimitTruncate
+	}
+	return l.responseAction
+}
+
+// network returns the network of client for prefixes (IPv4 and IPv6 lengths), or
+// false when client is exempt or unknown.
+func (l *rateLimiter) network(client net.IP, prefixes [2]int) (string, bool) {
+	addr, ok := netip.AddrFromSlice(client)
+	if !ok {
+		return "", false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l.exempt {
+		if prefix.Contains(addr) {
+			return "", false
+		}
+	}
+	bits := prefixes[0]
+	if addr.Is6() {
+		bits = prefixes[1]
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String(), true
+}
+
+// responseKey groups responses for RRL: answers and empty answers by name and type,
+// NXDOMAIN by the zone of its SOA and errors by rcode, so that random names cannot
+// spread a flood over many buckets.
+func responseKey(reply *mdns.Msg) string {
+	switch reply.Rcode {
+	case mdns.RcodeSuccess:
+		if len(reply.Question) > 0 {
+			q := reply.Question[0]
+			return strings.ToLower(q.Name) + "#" + strconv.Itoa(int(q.Qtype))
+		}
+	case mdns.RcodeNameError:
+		for _, rr := range reply.Ns {
+			if soa, ok := rr.(*mdns.SOA); ok {
+				return "nxdomain@" + strings.ToLower(soa.Hdr.Name)
+			}
+		}
+		return "nxdomain"
+	}
+	return "error#" + strconv.Itoa(reply.Rcode)
+}
+
+// limitReply turns reply into the response for a config.RateLimit* action, and reports
+// whether no response must be sent at all. Truncation only helps UDP clients; others
+// are refused.
+func limitReply(reply *mdns.Msg, action, protocol string) (drop bool) {
+	if action == config.RateLimitDrop {
+		return true
+	}
+	reply.Answer, reply.Ns, reply.Extra = nil, nil, nil
+	if action == config.RateLimitTruncate && protocol == "udp" {
+		reply.Rcode = mdns.RcodeSuccess
+		reply.Truncated = true
+		return false
+	}
+	reply.Rcode = mdns.RcodeRefused
+	return false
+}
@@ -0,0 +1,171 @@
+package commands
+
+import (
+	"fmt"
+	"hash/maphash"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func TestRateBuckets(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	b := newRateBuckets(2, 3, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take("10.0.0.1/32", now); !ok {
+			t.Fatalf("take %d within the burst was limited", i)
+		}
+	}
+	for want := uint64(1); want <= 2; want++ {
+		if ok, limited := b.take("10.0.0.1/32", now); ok || limited != want {
+			t.Fatalf("take past the burst = %v, %d; want limited %d", ok, limited, want)
+		}
+	}
+	if ok, _ := b.take("10.0.0.2/32", now); !ok {
+		t.Fatal("another client shares the bucket")
+	}
+	// 2 tokens per second: one refilled after half a second
+	if ok, _ := b.take("10.0.0.1/32", now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("bucket was not refilled")
+	}
+
+	// With a floor, limited takes keep spending
+	debt := newRateBuckets(1, 1, -2)
+	debt.take("k", now)
+	debt.take("k", now)
+	debt.take("k", now) // tokens at the floor of -2
+	if ok, _ := debt.take("k", now.Add(2*time.Second)); ok {
+		t.Fatal("a client in debt must wait for it to be paid off")
+	}
+	if ok, _ := debt.take("k", now.Add(6*time.Second)); !ok {
+		t.Fatal("debt was not paid off")
+	}
+
+	// Buckets are forgotten once full again
+	later := now.Add(2 * time.Second)
+	for i := range b.shards {
+		b.sweepLocked(&b.shards[i], later)
+		if n := len(b.shards[i].buckets); n != 0 {
+			t.Fatalf("shard %d kept %d full buckets", i, n)
+		}
+	}
+}
+
+func TestRateBucketsFullShard(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	b := newRateBuckets(1, 2, 0)
+	shard := func(key string) *rateBucketShard {
+		return &b.shards[maphash.String(b.seed, key)%rateBucketShards]
+	}
+	// Fill the shard of two new clients with busy buckets
+	first := "10.0.0.1/32"
+	s := shard(first)
+	for i := 0; len(s.buckets) < rateBucketShardLimit; i++ {
+		s.buckets[fmt.Sprintf("busy%d", i)] = &rateBucket{last: now}
+	}
+	s.swept = now
+	var second string
+	for i := 2; second == ""; i++ {
+		if key := fmt.Sprintf("10.0.%d.%d/32", i/256, i%256); shard(key) == s {
+			second = key
+		}
+	}
+
+	// They share the overflow bucket instead of going unlimited
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(first, now); !ok {
+			t.Fatalf("take %d within the overflow burst was limited", i)
+		}
+	}
+	if ok, _ := b.take(second, now); ok {
+		t.Fatal("a client beyond the shard limit was not limited")
+	}
+
+	// Once the busy buckets are full again, a sweep makes room
+	later := now.Add(5 * time.Second)
+	if ok, _ := b.take(second, later); !ok || s.buckets[second] == nil {
+		t.Fatal("a full shard was not swept for a new client")
+	}
+}
+
+func TestQueryHandlerRateLimit(t *testing.T) {
+	t.Parallel()
+	cfg := &config.Config{Hosts: config.HostsConfig{"app.example.com": "10.0.0.20"}}
+	cfg.RateLimit = config.RateLimitConfig{
+		Queries: config.QueryRateLimit{Rate: 0.001, Burst: 2, IPv4Prefix: 24, IPv6Prefix: 64, Action: config.RateLimitRefuse},
+		Exempt:  []string{"127.0.0.1"},
+	}
+	h := newTestHandler(t, cfg, "127.0.0.1:1")
+	var err error
+	if h.rateLimit, err = newRateLimiter(cfg.RateLimit); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeA, "192.0.2.1", "tcp")); len(reply.Answer) != 1 {
+			t.Fatalf("query %d within the burst = %v", i, reply)
+		}
+	}
+	// The client's /24 shares the bucket
+	if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeA, "192.0.2.2", "tcp")); reply.Rcode != mdns.RcodeRefused || len(reply.Answer) != 0 {
+		t.Fatalf("limited query = %v", reply)
+	}
+	for i := 0; i < 5; i++ {
+		if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeA, "127.0.0.1", "udp")); len(reply.Answer) != 1 {
+			t.Fatalf("exempt client was limited: %v", reply)
+		}
+	}
+}
+
+func TestQueryHandlerResponseRateLimit(t *testing.T) {
+	t.Parallel()
+	slip := 2
+	cfg := &config.Config{Hosts: config.HostsConfig{"app.example.com": "10.0.0.20"}}
+	cfg.RateLimit.Responses = config.ResponseRateLimit{Rate: 1, Window: "15s", Slip: &slip, IPv4Prefix: 24, IPv6Prefix: 56, Action: config.RateLimitDrop}
+	h := newTestHandler(t, cfg, "127.0.0.1:1")
+	var err error
+	if h.rateLimit, err = newRateLimiter(cfg.RateLimit); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeA, "192.0.2.1", "udp")); reply == nil || len(reply.Answer) != 1 {
+		t.Fatalf("first response = %v", reply)
+	}
+	// Limited responses alternate between dropped and truncated (slip 2)
+	if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeA, "192.0.2.7", "udp")); reply != nil {
+		t.Fatalf("expected a dropped response, got %v", reply)
+	}
+	if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeA, "192.0.2.1", "udp")); reply == nil || !reply.Truncated || len(reply.Answer) != 0 {
+		t.Fatalf("expected a truncated response, got %v", reply)
+	}
+	// Other responses and TCP are not affected
+	if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeAAAA, "192.0.2.1", "udp")); reply == nil {
+		t.Fatal("a different response was limited")
+	}
+	if reply := h.serveDNS(viewQuery("app.example.com", mdns.TypeA, "192.0.2.1", "tcp")); reply == nil || len(reply.Answer) != 1 {
+		t.Fatalf("TCP response was limited: %v", reply)
+	}
+}
+
+func TestResponseKey(t *testing.T) {
+	t.Parallel()
+	nx := func(name string) *mdns.Msg {
+		m := new(mdns.Msg)
+		m.SetQuestion(name, mdns.TypeA)
+		m.Rcode = mdns.RcodeNameError
+		m.Ns = []mdns.RR{&mdns.SOA{Hdr: mdns.RR_Header{Name: "Example.com.", Rrtype: mdns.TypeSOA, Class: mdns.ClassINET}}}
+		return m
+	}
+	if a, b := responseKey(nx("x1.example.com.")), responseKey(nx("x2.example.com.")); a != b || a != "nxdomain@example.com." {
+		t.Errorf("NXDOMAIN keys %q and %q, want the zone", a, b)
+	}
+	servfail := new(mdns.Msg)
+	servfail.SetRcode(nx("a.example.com."), mdns.RcodeServerFailure)
+	if got := responseKey(servfail); got != "error#2" {
+		t.Errorf("SERVFAIL key %q", got)
+	}
+}
@@ -0,0 +1,243 @@
+package commands
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/cli"
+	"github.com/go-zoox/logger"
+)
+
+// cacheSettings merges cache TTL bounds, serve-stale window and size from CLI flags and config.
+// Config overrides flag defaults unless the flag was set explicitly on the CLI.
+func cacheSettings(ctx *cli.Context, cfg *config.Config) (policy dnsCachePolicy, serveStale time.Duration, maxEntries int, err error) {
+	policy.maxTTL, err = time.ParseDuration(strings.TrimSpace(ctx.String("cache-ttl")))
+	if err != nil {
+		return policy, 0, 0, fmt.Errorf("invalid --cache-ttl: %w", err)
+	}
+	policy.maxNegTTL, err = time.ParseDuration(strings.TrimSpace(ctx.String("cache-negative-ttl")))
+	if err != nil {
+		return policy, 0, 0, fmt.Errorf("invalid --cache-negative-ttl: %w", err)
+	}
+	maxEntries = ctx.Int("cache-max-entries")
+	if maxEntries <= 0 {
+		maxEntries = config.DNSCacheMaxEntriesDefault
+	}
+	if cfg != nil && cfg.Cache.EffectiveCacheEnabled() {
+		if !ctx.IsSet("cache-ttl") {
+			if d, err := time.ParseDuration(cfg.Cache.PositiveTTL); err == nil {
+				policy.maxTTL = d
+			}
+		}
+		if !ctx.IsSet("cache-negative-ttl") {
+			if d, err := time.ParseDuration(cfg.Cache.NegativeTTL); err == nil {
+				policy.maxNegTTL = d
+			}
+		}
+		if d, err := parseOptionalDuration(cfg.Cache.MinTTL); err == nil {
+			policy.minTTL = d
+		}
+		if d, err := parseOptionalDuration(cfg.Cache.ServeStale); err == nil {
+			serveStale = d
+		}
+		if !ctx.IsSet("cache-max-entries") && cfg.Cache.MaxEntries > 0 {
+			maxEntries = cfg.Cache.MaxEntries
+		}
+	}
+	return policy, serveStale, maxEntries, nil
+}
+
+// shutdownTimeout returns how long shutdown waits for in-flight queries: the CLI flag
+// when set explicitly, else server.shutdown_timeout of the current config.
+func shutdownTimeout(ctx *cli.Context, cfg *config.Config) time.Duration {
+	value := ctx.String("shutdown-timeout")
+	if !ctx.IsSet("shutdown-timeout") && cfg != nil && cfg.Server.ShutdownTimeout != "" {
+		value = cfg.Server.ShutdownTimeout
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d <= 0 {
+		logger.Warn("Invalid shutdown timeout %q, using 10s", value)
+		return 10 * time.Second
+	}
+	return d
+}
+
+// watchConfigFile watches the YAML config file and hot-reloads it.
+func watchConfigFile(filePath string, build func(*config.Config) (*queryHandler, error), handlerAtomic *atomic.Value, done <-chan struct{}) {
+	watchFile(filePath, "config file", done, func() {
+		_ = reloadConfigFile(filePath, build, handlerAtomic)
+	}, func() {
+		logger.Warn("Keeping the current configuration until config file %s is restored", filePath)
+	})
+}
+
+// configReloadMu serializes config reloads, which the file watcher, SIGHUP and the admin
+// API start concurrently: a slower reload must neither swap in an older file nor
+// activate its handler after a newer one.
+var configReloadMu sync.Mutex
+
+// reloadConfigFile reloads the config file and swaps in a handler built from it.
+// A file that fails to load or validate keeps the previous configuration.
+func reloadConfigFile(filePath string, build func(*config.Config) (*queryHandler, error), handlerAtomic *atomic.Value) error {
+	// Small delay to ensure file write is complete
+	time.Sleep(200 * time.Millisecond)
+
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+
+	metrics := handlerAtomic.Load().(*queryHandler).metrics
+	cfg, err := config.LoadConfig(filePath)
+	if err != nil {
+		logger.Error("Failed to reload config file %s, keeping previous configuration: %v", filePath, err)
+		metrics.reloaded("config", false)
+		return fmt.Errorf("failed to reload config file %s: %w", filePath, err)
+	}
+	next, err := build(cfg)
+	if err != nil {
+		logger.Error("Failed to apply config file %s, keeping previous configuration: %v", filePath, err)
+		metrics.reloaded("config", false)
+		return fmt.Errorf("failed to apply config file %s: %w", filePath, err)
+	}
+	metrics.reloaded("config", true)
+
+	prev := handlerAtomic.Swap(next).(*queryHandler)
+	next.activate()
+	prev.retire()
+	if changed := configChangesFlushingCache(prev.cfg, cfg); len(changed) > 0 {
+		// Cached answers may come from aliases or upstreams that no longer apply
+		logger.Info("Config file %s changed %s; flushing the DNS cache", filePath, strings.Join(changed, ", "))
+		next.cache.flush()
+	}
+
+	if changed := configChangesRequiringRestart(prev.cfg, cfg); len(changed) > 0 {
+		logger.Warn("Config file %s changed %s; these settings take effect after a restart", filePath, strings.Join(changed, ", "))
+	}
+	logger.Info("Successfully reloaded config file: %s", filePath)
+	return nil
+}
+
+// configChangesFlushingCache lists the config sections that differ between old and new
+// and shape the answers cached from upstream: the upstreams and their routes, the hosts
+// aliases, views, DNSSEC validation and DNS64.
+func configChangesFlushingCache(old, new *config.Config) []string {
+	if old == nil || new == nil {
+		return []string{"config"}
+	}
+
+	var changed []string
+	if !slices.Equal(old.Upstream.Servers, new.Upstream.Servers) || !reflect.DeepEqual(old.Upstream.Routes, new.Upstream.Routes) {
+		changed = append(changed, "upstream")
+	}
+	oldAliases, oldErr := hostsAliases(old)
+	newAliases, newErr := hostsAliases(new)
+	if oldErr != nil || newErr != nil || !maps.Equal(oldAliases, newAliases) {
+		changed = append(changed, "hosts")
+	}
+	if !reflect.DeepEqual(old.Views, new.Views) {
+		changed = append(changed, "views")
+	}
+	if !reflect.DeepEqual(old.DNSSEC, new.DNSSEC) {
+		changed = append(changed, "dnssec")
+	}
+	if !reflect.DeepEqual(old.DNS64, new.DNS64) {
+		changed = append(changed, "dns64")
+	}
+	return changed
+}
+
+// hostsAliases returns the alias target of every hosts entry that has one, including
+// the fallback target answered while its addresses are down.
+func hostsAliases(cfg *config.Config) (map[string]string, error) {
+	idx, err := cfg.HostIndex()
+	if err != nil {
+		return nil, err
+	}
+	aliases := make(map[string]string)
+	for _, m := range idx.Entries() {
+		if m.AliasTarget != "" {
+			aliases[m.Domain] = m.AliasTarget
+		} else if m.Fallback != nil && m.Fallback.AliasTarget != "" {
+			aliases[m.Domain] = "fallback:" + m.Fallback.AliasTarget
+		}
+	}
+	return aliases, nil
+}
+
+// configChangesRequiringRestart lists the config sections that differ between old and
+// new but are only applied at startup (listeners, TLS, system hosts, cache on/off and
+// persistence).
+func configChangesRequiringRestart(old, new *config.Config) []string {
+	if old == nil || new == nil {
+		return nil
+	}
+
+	var changed []string
+	if old.Server.Host != new.Server.Host || old.Server.Port != new.Server.Port {
+		changed = append(changed, "server")
+	}
+	if !reflect.DeepEqual(old.DoT, new.DoT) {
+		changed = append(changed, "dot")
+	}
+	if !reflect.DeepEqual(old.DoH, new.DoH) {
+		changed = append(changed, "doh")
+	}
+	if !reflect.DeepEqual(old.DoQ, new.DoQ) {
+		changed = append(changed, "doq")
+	}
+	if !reflect.DeepEqual(old.Metrics, new.Metrics) {
+		changed = append(changed, "metrics")
+	}
+	if !reflect.DeepEqual(old.Admin, new.Admin) {
+		changed = append(changed, "admin")
+	}
+	if !reflect.DeepEqual(old.QueryLog, new.QueryLog) {
+		changed = append(changed, "query_log")
+	}
+	if old.SystemHosts.Disabled != new.SystemHosts.Disabled || old.SystemHosts.FilePath != new.SystemHosts.FilePath {
+		changed = append(changed, "system_hosts")
+	}
+	if old.Cache.EffectiveCacheEnabled() != new.Cache.EffectiveCacheEnabled() {
+		changed = append(changed, "cache.enabled")
+	}
+	if old.Cache.PersistFile != new.Cache.PersistFile || old.Cache.PersistInterval != new.Cache.PersistInterval {
+		changed = append(changed, "cache.persist_file")
+	}
+	return changed
+}
+
+// activate applies the settings of a handler that outlive it (the cache size and
+// serve-stale window, the watches of filter lists, the health of the hosts checked)
+// once it serves queries, so that a reload that fails to build leaves the running
+// server as it was.
+func (h *queryHandler) activate() {
+	h.cache.resize(h.cacheMaxEntries)
+	h.hostHealthState.retain(h.hostHealth)
+	h.cache.setServeStale(h.cacheServeStale)
+	if h.cfg != nil {
+		h.filterWatcher.watch(h.cfg.Filter)
+	}
+	for _, v := range h.views {
+		if v.ownFilter {
+			h.filterWatcher.watch(*v.cfg.Filter)
+		}
+	}
+}
+
+// retire releases a handler replaced by a reload once in-flight queries had time to finish.
+func (h *queryHandler) retire() {
+	h.hostHealth.stop()
+	if h.upstream == nil {
+		return
+	}
+	time.AfterFunc(2*h.upstream.timeout+time.Second, func() {
+		h.upstream.close()
+		h.views.close()
+	})
+}
@@ -0,0 +1,198 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func TestReloadConfigFileSwapsHandler(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("hosts:\n  \"app.internal\": \"10.0.0.1\"\nupstream:\n  servers: [\"127.0.0.1:1\"]\n")
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := newDNSAnswerCache(10)
+	build := func(cfg *config.Config) (*queryHandler, error) {
+		up, err := newUpstreamRouter(cfg.Upstream.Servers, cfg.Upstream.Routes, upstreamOptions{timeout: time.Second})
+		if err != nil {
+			return nil, err
+		}
+		serveStale, err := parseOptionalDuration(cfg.Cache.ServeStale)
+		if err != nil {
+			up.close()
+			return nil, err
+		}
+		return &queryHandler{cfg: cfg, cache: cache, upstream: up, ttl: 60, cacheMaxEntries: 10, cacheServeStale: serveStale}, nil
+	}
+	first, err := build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handlerAtomic atomic.Value
+	handlerAtomic.Store(first)
+
+	lookup := func() string {
+		reply := handlerAtomic.Load().(*queryHandler).serveDNS(testQuery("app.internal", mdns.TypeA))
+		if len(reply.Answer) != 1 {
+			return ""
+		}
+		return reply.Answer[0].(*mdns.A).A.String()
+	}
+	if got := lookup(); got != "10.0.0.1" {
+		t.Fatalf("initial answer %q", got)
+	}
+
+	cache.set(time.Now(), "stale#1", &dnsResult{answer: []mdns.RR{testA("stale", "1.1.1.1")}}, false, time.Minute)
+	write("hosts:\n  \"app.internal\": \"10.0.0.2\"\nupstream:\n  servers: [\"127.0.0.1:1\"]\ncache:\n  serve_stale: 1h\n")
+	reloadConfigFile(path, build, &handlerAtomic)
+	if got := lookup(); got != "10.0.0.2" {
+		t.Fatalf("answer after reload %q", got)
+	}
+	if got := time.Duration(cache.serveStale.Load()); got != time.Hour {
+		t.Fatalf("serve stale after reload %s, want the new handler's 1h", got)
+	}
+	// Only the hosts addresses changed: cached answers still apply
+	if _, hit := cache.get(time.Now(), "stale#1"); !hit {
+		t.Fatal("expected the cache to be kept on reload")
+	}
+
+	// Another upstream flushes the cache, including the answers of lookups in flight
+	gen := cache.currentGeneration()
+	write("hosts:\n  \"app.internal\": \"10.0.0.2\"\nupstream:\n  servers: [\"127.0.0.1:2\"]\ncache:\n  serve_stale: 1h\n")
+	reloadConfigFile(path, build, &handlerAtomic)
+	if _, hit := cache.get(time.Now(), "stale#1"); hit {
+		t.Fatal("expected the cache to be flushed when the upstreams change")
+	}
+	cache.setFrom(gen, time.Now(), "inflight#1", &dnsResult{answer: []mdns.RR{testA("inflight", "1.1.1.1")}}, false, time.Minute)
+	if _, hit := cache.get(time.Now(), "inflight#1"); hit {
+		t.Fatal("expected the answer of a lookup started before the flush not to be cached")
+	}
+
+	// A broken file keeps the previous configuration
+	write("hosts:\n  \"app.internal\":\n    mx: [\"bogus\"]\n")
+	reloadConfigFile(path, build, &handlerAtomic)
+	if got := lookup(); got != "10.0.0.2" {
+		t.Fatalf("answer after invalid reload %q", got)
+	}
+
+	// So does a config that fails to build, without touching the shared cache
+	write("hosts:\n  \"app.internal\": \"10.0.0.3\"\nupstream:\n  servers: [\"bogus://127.0.0.1\"]\ncache:\n  serve_stale: 2h\n")
+	reloadConfigFile(path, build, &handlerAtomic)
+	if got := lookup(); got != "10.0.0.2" {
+		t.Fatalf("answer after failed build %q", got)
+	}
+	if got := time.Duration(cache.serveStale.Load()); got != time.Hour {
+		t.Fatalf("serve stale after failed build %s", got)
+	}
+}
+
+func TestReloadConfigFileSerializesReloads(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(ip string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("hosts:\n  \"app.internal\": \""+ip+"\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The build of the first file version is slow
+	building, release := make(chan struct{}), make(chan struct{})
+	build := func(cfg *config.Config) (*queryHandler, error) {
+		if ips, _ := cfg.LookupHost("app.internal", 4); len(ips) == 1 && ips[0] == "10.0.0.1" {
+			close(building)
+			<-release
+		}
+		return &queryHandler{cfg: cfg, ttl: 60}, nil
+	}
+	var handlerAtomic atomic.Value
+	handlerAtomic.Store(&queryHandler{ttl: 60})
+
+	write("10.0.0.1")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reloadConfigFile(path, build, &handlerAtomic)
+	}()
+	<-building
+	write("10.0.0.2")
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		close(release)
+	}()
+	reloadConfigFile(path, build, &handlerAtomic)
+	<-done
+
+	reply := handlerAtomic.Load().(*queryHandler).serveDNS(testQuery("app.internal", mdns.TypeA))
+	if len(reply.Answer) != 1 || reply.Answer[0].(*mdns.A).A.String() != "10.0.0.2" {
+		t.Fatalf("answer after concurrent reloads %v, want the last file version", reply.Answer)
+	}
+}
+
+func TestConfigChangesFlushingCache(t *testing.T) {
+	t.Parallel()
+	old := &config.Config{
+		Hosts:    config.HostsConfig{"a.internal": "10.0.0.1", "b.internal": "b.example.com"},
+		Upstream: config.UpstreamConfig{Servers: []string{"1.1.1.1"}, Timeout: "2s"},
+	}
+	same := &config.Config{
+		Hosts:    config.HostsConfig{"a.internal": "10.0.0.2", "b.internal": "b.example.com"},
+		Upstream: config.UpstreamConfig{Servers: []string{"1.1.1.1"}, Timeout: "5s"},
+		Server:   config.ServerConfig{TTL: 60},
+	}
+	if got := configChangesFlushingCache(old, same); len(got) != 0 {
+		t.Errorf("unexpected changes %v", got)
+	}
+
+	updated := &config.Config{
+		Hosts:    config.HostsConfig{"a.internal": "10.0.0.1", "b.internal": "c.example.com"},
+		Upstream: config.UpstreamConfig{Servers: []string{"1.1.1.1"}, Routes: []config.UpstreamRoute{{Domains: []string{"corp"}, Servers: []string{"10.0.0.53"}}}},
+		DNS64:    config.DNS64Config{Enabled: true},
+	}
+	got := configChangesFlushingCache(old, updated)
+	if want := []string{"upstream", "hosts", "dns64"}; !slices.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestConfigChangesRequiringRestart(t *testing.T) {
+	t.Parallel()
+	disabled := false
+	old := &config.Config{Server: config.ServerConfig{Port: 53, TTL: 500}}
+	updated := &config.Config{
+		Server: config.ServerConfig{Port: 5353, TTL: 60},
+		DoH:    config.DoHConfig{Enabled: true},
+		Cache:  config.CacheConfig{Enabled: &disabled, PersistFile: "/var/lib/dns/cache.json"},
+		Admin:  config.AdminConfig{Enabled: true, Token: "secret"},
+		Hosts:  config.HostsConfig{"a.internal": "10.0.0.1"},
+	}
+
+	got := configChangesRequiringRestart(old, updated)
+	want := []string{"server", "doh", "admin", "cache.enabled", "cache.persist_file"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package commands
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+// upstreamUDPSize is the EDNS0 UDP payload size requested from upstream servers.
+const upstreamUDPSize = 4096
+
+// upstreamEWMAWeight is the weight of the newest sample in the latency average.
+const upstreamEWMAWeight = 0.3
+
+// upstreamOptions configures how upstream servers are queried.
+type upstreamOptions struct {
+	timeout  time.Duration
+	strategy string // config.UpstreamStrategy*, empty means failover
+	health   healthCheckOptions
+	metrics  *serverMetrics
+	dnssec   bool // request DNSSEC records and skip upstream validation (DO and CD flags)
+}
+
+// upstreamServer is one upstream with its health and latency state.
+type upstreamServer struct {
+	upstream.Upstream
+	unhealthy atomic.Bool
+	fails     atomic.Int32  // consecutive failures
+	ewma      atomic.Uint64 // float64 bits, latency average in nanoseconds, 0 = not measured yet
+}
+
+// latency returns the EWMA latency, 0 before the first sample.
+func (s *upstreamServer) latency() float64 {
+	return math.Float64frombits(s.ewma.Load())
+}
+
+// observe records the latency of an exchange; failures count as a full timeout.
+func (s *upstreamServer) observe(rtt time.Duration) {
+	for {
+		old := s.ewma.Load()
+		avg := math.Float64frombits(old)
+		if avg == 0 {
+			avg = float64(rtt)
+		} else {
+			avg = upstreamEWMAWeight*float64(rtt) + (1-upstreamEWMAWeight)*avg
+		}
+		if s.ewma.CompareAndSwap(old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+// upstreamResolver forwards queries of any type to a group of upstream servers and
+// returns the full reply (all sections and TTLs). The strategy decides the order in
+// which healthy servers are tried; the first NOERROR or NXDOMAIN reply wins.
+type upstreamResolver struct {
+	servers  []*upstreamServer
+	timeout  time.Duration
+	strategy string
+	next     atomic.Uint32 // round-robin position
+	// failThreshold takes a server out of rotation after that many consecutive failed
+	// queries; 0 disables it. Only set while a health checker can bring servers back.
+	failThreshold int32
+	metrics       *serverMetrics
+	dnssec        bool
+}
+
+// newUpstreamResolver creates upstream clients for servers. Addresses are parsed by
+// dnsproxy's upstream.AddressToUpstream (plain, tcp://, tls://, https://, quic://, sdns://).
+func newUpstreamResolver(servers []string, timeout time.Duration, strategy string) (*upstreamResolver, error) {
+	switch strategy {
+	case "":
+		strategy = config.UpstreamStrategyFailover
+	case config.UpstreamStrategyFailover, config.UpstreamStrategyRoundRobin, config.UpstreamStrategyRandom,
+		config.UpstreamStrategyFastest, config.UpstreamStrategyParallel:
+	default:
+		return nil, fmt.Errorf("unsupported upstream strategy %q", strategy)
+	}
+	r := &upstreamResolver{timeout: timeout, strategy: strategy}
+	for _, s := range servers {
+		u, err := upstream.AddressToUpstream(s, &upstream.Options{
+			Timeout: timeout,
+		})
+		if err != nil {
+			logger.Warn("Skipping invalid upstream %s: %v", s, err)
+			continue
+		}
+		r.servers = append(r.servers, &upstreamServer{Upstream: u})
+	}
+
+	if len(r.servers) == 0 {
+		return nil, fmt.Errorf("no valid upstream servers in %v", servers)
+	}
+	return r, nil
+}
+
+// candidates returns the healthy servers in the order the strategy tries them.
+// When every server is unhealthy all of them are tried rather than failing outright.
+func (r *upstreamResolver) candidates() []*upstreamServer {
+	out := make([]*upstreamServer, 0, len(r.servers))
+	for _, s := range r.servers {
+		if !s.unhealthy.Load() {
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, r.servers...)
+	}
+	if len(out) < 2 {
+		return out
+	}
+
+	switch r.strategy {
+	case config.UpstreamStrategyRoundRobin:
+		start := int(r.next.Add(1)-1) % len(out)
+		rotated := make([]*upstreamServer, 0, len(out))
+		out = append(append(rotated, out[start:]...), out[:start]...)
+	case config.UpstreamStrategyRandom:
+		rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	case config.UpstreamStrategyFastest:
+		// Servers without samples sort first so every server gets measured
+		sort.SliceStable(out, func(i, j int) bool { return out[i].latency() < out[j].latency() })
+	}
+	return out
+}
+
+// exchange queries the upstream servers for name/qtype.
+// NXDOMAIN is a valid reply, not an error; check reply.Rcode.
+func (r *upstreamResolver) exchange(name string, qtype uint16) (*mdns.Msg, error) {
+	servers := r.candidates()
+	if r.strategy == config.UpstreamStrategyParallel && len(servers) > 1 {
+		return r.exchangeParallel(servers, name, qtype)
+	}
+
+	var lastErr error
+	for _, s := range servers {
+		reply, err := r.exchangeWith(s, name, qtype)
+		if err == nil {
+			return reply, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// exchangeParallel queries every server at once and returns the first usable reply.
+func (r *upstreamResolver) exchangeParallel(servers []*upstreamServer, name string, qtype uint16) (*mdns.Msg, error) {
+	type result struct {
+		reply *mdns.Msg
+		err   error
+	}
+	results := make(chan result, len(servers))
+	for _, s := range servers {
+		go func(s *upstreamServer) {
+			reply, err := r.exchangeWith(s, name, qtype)
+			results <- result{reply, err}
+		}(s)
+	}
+
+	var lastErr error
+	for range servers {
+		res := <-results
+		if res.err == nil {
+			return res.reply, nil
+		}
+		lastErr = res.err
+	}
+	return nil, lastErr
+}
+
+// exchangeWith sends one query to s and records its latency and transport failures.
+func (r *upstreamResolver) exchangeWith(s *upstreamServer, name string, qtype uint16) (*mdns.Msg, error) {
+	req := new(mdns.Msg)
+	req.SetQuestion(mdns.Fqdn(name), qtype)
+	req.RecursionDesired = true
+	req.SetEdns0(upstreamUDPSize, r.dnssec)
+	req.CheckingDisabled = r.dnssec
+
+	startAt := time.Now()
+	reply, err := s.Exchange(req)
+	elapsed := time.Since(startAt)
+	if err != nil {
+		r.failed(s)
+		s.observe(r.timeout)
+		r.metrics.observeUpstream(s.Address(), elapsed, true)
+		return nil, fmt.Errorf("%s: %w", s.Address(), err)
+	}
+	s.observe(elapsed)
+	if reply.Rcode == mdns.RcodeSuccess || reply.Rcode == mdns.RcodeNameError {
+		s.fails.Store(0)
+		r.metrics.observeUpstream(s.Address(), elapsed, false)
+		return reply, nil
+	}
+	// SERVFAIL and REFUSED are usually caused by the queried name (lame delegation,
+	// broken DNSSEC) rather than the server: only the health probes count them
+	r.metrics.observeUpstream(s.Address(), elapsed, true)
+	return nil, fmt.Errorf("%s: failed to query with code: %d", s.Address(), reply.Rcode)
+}
+
+// failed counts a failed query and takes s out of rotation past the threshold.
+func (r *upstreamResolver) failed(s *upstreamServer) {
+	fails := s.fails.Add(1)
+	if r.failThreshold > 0 && fails >= r.failThreshold && s.unhealthy.CompareAndSwap(false, true) {
+		logger.Warn("Upstream %s failed %d queries in a row, taking it out of rotation", s.Address(), fails)
+	}
+}
+
+// close releases the upstream connections.
+func (r *upstreamResolver) close() {
+	for _, s := range r.servers {
+		if err := s.Close(); err != nil {
+			logger.Debugf("Failed to close upstream %s: %v", s.Address(), err)
+		}
+	}
+}
+
+// upstreamRouter picks the upstream servers for a query name (conditional forwarding).
+// Routes are matched by longest suffix; names without a route use the default servers.
+type upstreamRouter struct {
+	fallback   *upstreamResolver
+	domains    map[string]*upstreamResolver // the domain and its subdomains
+	subdomains map[string]*upstreamResolver // subdomains only ("*.domain")
+	timeout    time.Duration
+	checker    *healthChecker
+}
+
+// newUpstreamRouter creates the default resolver for servers and one resolver per route,
+// and starts health checking them when enabled.
+func newUpstreamRouter(servers []string, routes []config.UpstreamRoute, opts upstreamOptions) (*upstreamRouter, error) {
+	fallback, err := newUpstreamResolver(servers, opts.timeout, opts.strategy)
+	if err != nil {
+		return nil, err
+	}
+	r := &upstreamRouter{
+		fallback:   fallback,
+		domains:    make(map[string]*upstreamResolver),
+		subdomains: make(map[string]*upstreamResolver),
+		timeout:    opts.timeout,
+	}
+
+	for i, route := range routes {
+		// The domains routed elsewhere already are skipped: a route left without any is
+		// not built, so that it opens no connections
+		type routeDomain struct {
+			name   string
+			target map[string]*upstreamResolver
+		}
+		var domains []routeDomain
+		for _, domain := range route.Domains {
+			domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+			target := r.domains
+			if rest, ok := strings.CutPrefix(domain, "*."); ok {
+				domain, target = rest, r.subdomains
+			}
+			if domain == "" {
+				continue
+			}
+			if _, dup := target[domain]; dup {
+				logger.Warn("Upstream route for %s is declared more than once, using the first one", domain)
+				continue
+			}
+			target[domain] = nil
+			domains = append(domains, routeDomain{domain, target})
+		}
+		if len(domains) == 0 {
+			continue
+		}
+
+		strategy := route.Strategy
+		if strategy == "" {
+			strategy = opts.strategy
+		}
+		resolver, err := newUpstreamResolver(route.Servers, opts.timeout, strategy)
+		if err != nil {
+			for _, d := range domains {
+				delete(d.target, d.name)
+			}
+			r.close()
+			return nil, fmt.Errorf("upstream route %d: %w", i, err)
+		}
+		for _, d := range domains {
+			d.target[d.name] = resolver
+		}
+		logger.Info("Upstream route %v -> %v", route.Domains, route.Servers)
+	}
+
+	for _, resolver := range r.resolvers() {
+		resolver.metrics = opts.metrics
+		resolver.dnssec = opts.dnssec
+	}
+	if opts.health.interval > 0 {
+		for _, resolver := range r.resolvers() {
+			// Single servers are never probed (see startHealthChecker), so nothing
+			// would bring them back
+			if len(resolver.servers) > 1 {
+				resolver.failThreshold = int32(opts.health.failThreshold)
+			}
+		}
+		r.checker = startHealthChecker(r.resolvers(), opts.health)
+	}
+	return r, nil
+}
+
+// resolverFor returns the resolver of the longest route suffix matching name.
+func (r *upstreamRouter) resolverFor(name string) *upstreamResolver {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if resolver, ok := r.domains[name]; ok {
+		return resolver
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; {
+		parent := name[i+1:]
+		// "*.parent" is as specific as "parent" for names below it and takes precedence
+		if resolver, ok := r.subdomains[parent]; ok {
+			return resolver
+		}
+		if resolver, ok := r.domains[parent]; ok {
+			return resolver
+		}
+		next := strings.IndexByte(parent, '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return r.fallback
+}
+
+// exchange queries the upstream servers routed for name.
+func (r *upstreamRouter) exchange(name string, qtype uint16) (*mdns.Msg, error) {
+	return r.resolverFor(name).exchange(name, qtype)
+}
+
+// close stops health checking and releases the connections of every route.
+func (r *upstreamRouter) close() {
+	if r.checker != nil {
+		r.checker.stop()
+	}
+	for _, resolver := range r.resolvers() {
+		resolver.close()
+	}
+}
+
+// resolvers returns the default resolver and every distinct route resolver.
+func (r *upstreamRouter) resolvers() []*upstreamResolver {
+	seen := map[*upstreamResolver]bool{r.fallback: true}
+	out := []*upstreamResolver{r.fallback}
+	for _, m := range []map[string]*upstreamResolver{r.domains, r.subdomains} {
+		for _, resolver := range m {
+			if !seen[resolver] {
+				seen[resolver] = true
+				out = append(out, resolver)
+			}
+		}
+	}
+	return out
+}
+
+// upstreamGroupStatus describes one resolver of an upstreamRouter for the admin API.
+type upstreamGroupStatus struct {
+	Domains  []string               `json:"domains,omitempty"` // empty for the default servers
+	Strategy string                 `json:"strategy"`
+	Servers  []upstreamServerStatus `json:"servers"`
+}
+
+type upstreamServerStatus struct {
+	Address   string  `json:"address"`
+	Healthy   bool    `json:"healthy"`
+	Failures  int32   `json:"consecutive_failures"`
+	LatencyMs float64 `json:"latency_ms"` // moving average, 0 before the first query
+}
+
+// status returns the health and latency of every server, default servers first and
+// routes sorted by their first domain.
+func (r *upstreamRouter) status() []upstreamGroupStatus {
+	domains := make(map[*upstreamResolver][]string)
+	for domain, resolver := range r.domains {
+		domains[resolver] = append(domains[resolver], domain)
+	}
+	for domain, resolver := range r.subdomains {
+		domains[resolver] = append(domains[resolver], "*."+domain)
+	}
+
+	var out []upstreamGroupStatus
+	for _, resolver := range r.resolvers() {
+		group := upstreamGroupStatus{Strategy: resolver.strategy}
+		if resolver != r.fallback {
+			group.Domains = domains[resolver]
+			sort.Strings(group.Domains)
+		}
+		for _, s := range resolver.servers {
+			group.Servers = append(group.Servers, upstreamServerStatus{
+				Address:   s.Address(),
+				Healthy:   !s.unhealthy.Load(),
+				Failures:  s.fails.Load(),
+				LatencyMs: s.latency() / float64(time.Millisecond),
+			})
+		}
+		out = append(out, group)
+	}
+	sort.SliceStable(out[1:], func(i, j int) bool { return out[1+i].Domains[0] < out[1+j].Domains[0] })
+	return out
+}
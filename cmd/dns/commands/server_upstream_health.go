@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+// healthCheckOptions configures active upstream probing.
+type healthCheckOptions struct {
+	interval      time.Duration // 0 disables health checking
+	domain        string        // probe query name (NS)
+	failThreshold int           // consecutive failed probes before a server leaves rotation
+}
+
+// healthChecker periodically probes upstream servers. Servers failing failThreshold probes
+// in a row are taken out of rotation; a successful probe brings them back.
+type healthChecker struct {
+	servers  []*upstreamServer
+	opts     healthCheckOptions
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startHealthChecker probes the servers of resolvers with more than one server; a single
+// server is always used anyway, so probing it would only add traffic.
+func startHealthChecker(resolvers []*upstreamResolver, opts healthCheckOptions) *healthChecker {
+	if opts.domain == "" {
+		opts.domain = "."
+	}
+	if opts.failThreshold <= 0 {
+		opts.failThreshold = 2
+	}
+
+	c := &healthChecker{opts: opts, done: make(chan struct{})}
+	for _, r := range resolvers {
+		if len(r.servers) > 1 {
+			c.servers = append(c.servers, r.servers...)
+		}
+	}
+	if len(c.servers) == 0 {
+		return c
+	}
+
+	go c.run()
+	return c
+}
+
+func (c *healthChecker) run() {
+	ticker := time.NewTicker(c.opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.checkAll()
+		}
+	}
+}
+
+// checkAll probes every server concurrently and waits for the probes to finish.
+func (c *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, s := range c.servers {
+		wg.Add(1)
+		go func(s *upstreamServer) {
+			defer wg.Done()
+			c.check(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// check sends one probe to s and updates its health. Any reply other than SERVFAIL
+// or REFUSED shows the server is answering.
+func (c *healthChecker) check(s *upstreamServer) {
+	req := new(mdns.Msg)
+	req.SetQuestion(mdns.Fqdn(c.opts.domain), mdns.TypeNS)
+	req.RecursionDesired = true
+
+	reply, err := s.Exchange(req)
+	if err == nil && reply.Rcode != mdns.RcodeServerFailure && reply.Rcode != mdns.RcodeRefused {
+		s.fails.Store(0)
+		if s.unhealthy.CompareAndSwap(true, false) {
+			logger.Info("Upstream %s is healthy again, back in rotation", s.Address())
+		}
+		return
+	}
+
+	fails := s.fails.Add(1)
+	if int(fails) >= c.opts.failThreshold && s.unhealthy.CompareAndSwap(false, true) {
+		if err == nil {
+			logger.Warn("Upstream %s failed %d health checks (rcode: %s), taking it out of rotation", s.Address(), fails, mdns.RcodeToString[reply.Rcode])
+		} else {
+			logger.Warn("Upstream %s failed %d health checks (%v), taking it out of rotation", s.Address(), fails, err)
+		}
+	}
+}
+
+// stop ends health checking.
+func (c *healthChecker) stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
@@ -0,0 +1,299 @@
+package commands
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+// startAnsweringUpstream runs a test upstream answering every A query with ip.
+func startAnsweringUpstream(t *testing.T, ip string) string {
+	t.Helper()
+	return startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		m.Answer = []mdns.RR{testA(r.Question[0].Name, ip)}
+		w.WriteMsg(m)
+	})
+}
+
+func TestUpstreamRouterLongestSuffix(t *testing.T) {
+	t.Parallel()
+	public := startAnsweringUpstream(t, "1.1.1.1")
+	corp := startAnsweringUpstream(t, "10.0.0.2")
+	lab := startAnsweringUpstream(t, "10.0.1.2")
+	cluster := startAnsweringUpstream(t, "10.96.0.10")
+
+	router, err := newUpstreamRouter([]string{public}, []config.UpstreamRoute{
+		{Domains: []string{"corp.internal"}, Servers: []string{corp}},
+		{Domains: []string{"lab.corp.internal."}, Servers: []string{lab}},
+		{Domains: []string{"*.svc.cluster.local"}, Servers: []string{cluster}},
+	}, upstreamOptions{timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+
+	for name, want := range map[string]string{
+		"corp.internal":            "10.0.0.2",
+		"www.corp.internal.":       "10.0.0.2",
+		"lab.corp.internal":        "10.0.1.2",
+		"db.LAB.corp.internal":     "10.0.1.2",
+		"api.ns.svc.cluster.local": "10.96.0.10",
+		"svc.cluster.local":        "1.1.1.1", // subdomains only
+		"example.com":              "1.1.1.1",
+		"notcorp.internal":         "1.1.1.1",
+	} {
+		reply, err := router.exchange(name, mdns.TypeA)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := reply.Answer[0].(*mdns.A).A.String(); got != want {
+			t.Errorf("%s routed to answer %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestUpstreamRouterSkipsDuplicateRoutes(t *testing.T) {
+	t.Parallel()
+	public := startAnsweringUpstream(t, "1.1.1.1")
+	corp := startAnsweringUpstream(t, "10.0.0.2")
+	other := startAnsweringUpstream(t, "10.0.0.3")
+
+	router, err := newUpstreamRouter([]string{public}, []config.UpstreamRoute{
+		{Domains: []string{"corp.internal", "*.lab.internal"}, Servers: []string{corp}},
+		{Domains: []string{"Corp.Internal.", "*.lab.internal"}, Servers: []string{other}},
+	}, upstreamOptions{timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+
+	// The second route only repeats domains of the first one: it is not built
+	if n := len(router.resolvers()); n != 2 {
+		t.Errorf("%d resolvers, want 2", n)
+	}
+	reply, err := router.exchange("www.corp.internal", mdns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reply.Answer[0].(*mdns.A).A.String(); got != "10.0.0.2" {
+		t.Errorf("www.corp.internal routed to answer %s, want 10.0.0.2", got)
+	}
+}
+
+func TestQueryHandlerRoutesAliasTarget(t *testing.T) {
+	t.Parallel()
+	public := startAnsweringUpstream(t, "1.1.1.1")
+	corp := startAnsweringUpstream(t, "10.0.0.2")
+
+	cfg := &config.Config{Hosts: config.HostsConfig{"app.example.com": "app.corp.internal"}}
+	h := newTestHandler(t, cfg, public)
+	router, err := newUpstreamRouter([]string{public}, []config.UpstreamRoute{
+		{Domains: []string{"corp.internal"}, Servers: []string{corp}},
+	}, upstreamOptions{timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(router.close)
+	h.upstream = router
+
+	reply := h.serveDNS(testQuery("app.example.com", mdns.TypeA))
+	if len(reply.Answer) != 1 || reply.Answer[0].(*mdns.A).A.String() != "10.0.0.2" {
+		t.Fatalf("expected alias target to be resolved by the corp route, got %v", reply.Answer)
+	}
+}
+
+// startBlackholeUpstream returns the address of a UDP socket that never answers.
+func startBlackholeUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func answerIP(t *testing.T, r *upstreamRouter, name string) string {
+	t.Helper()
+	reply, err := r.exchange(name, mdns.TypeA)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return reply.Answer[0].(*mdns.A).A.String()
+}
+
+func TestUpstreamStrategyRoundRobin(t *testing.T) {
+	t.Parallel()
+	a := startAnsweringUpstream(t, "10.0.0.1")
+	b := startAnsweringUpstream(t, "10.0.0.2")
+	router, err := newUpstreamRouter([]string{a, b}, nil, upstreamOptions{timeout: time.Second, strategy: "round_robin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+
+	first, second, third := answerIP(t, router, "a.example"), answerIP(t, router, "b.example"), answerIP(t, router, "c.example")
+	if first == second || first != third {
+		t.Fatalf("expected alternating upstreams, got %s %s %s", first, second, third)
+	}
+}
+
+func TestUpstreamStrategyFastest(t *testing.T) {
+	t.Parallel()
+	slow := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		m := new(mdns.Msg)
+		m.SetReply(r)
+		m.Answer = []mdns.RR{testA(r.Question[0].Name, "10.0.0.1")}
+		w.WriteMsg(m)
+	})
+	fast := startAnsweringUpstream(t, "10.0.0.2")
+	router, err := newUpstreamRouter([]string{slow, fast}, nil, upstreamOptions{timeout: time.Second, strategy: "fastest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+
+	// Both servers are measured first, then the fast one is preferred
+	answerIP(t, router, "a.example")
+	answerIP(t, router, "b.example")
+	for i := 0; i < 3; i++ {
+		if got := answerIP(t, router, "c.example"); got != "10.0.0.2" {
+			t.Fatalf("expected the fastest upstream, got %s", got)
+		}
+	}
+}
+
+func TestUpstreamStrategyParallel(t *testing.T) {
+	t.Parallel()
+	dead := startBlackholeUpstream(t)
+	good := startAnsweringUpstream(t, "10.0.0.2")
+	router, err := newUpstreamRouter([]string{dead, good}, nil, upstreamOptions{timeout: 2 * time.Second, strategy: "parallel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+
+	startAt := time.Now()
+	if got := answerIP(t, router, "a.example"); got != "10.0.0.2" {
+		t.Fatalf("got %s", got)
+	}
+	if elapsed := time.Since(startAt); elapsed > time.Second {
+		t.Fatalf("parallel query waited for the dead upstream (%v)", elapsed)
+	}
+}
+
+func TestUpstreamStrategyUnknown(t *testing.T) {
+	t.Parallel()
+	if _, err := newUpstreamRouter([]string{"127.0.0.1:53"}, nil, upstreamOptions{timeout: time.Second, strategy: "fastest-ever"}); err == nil {
+		t.Fatal("expected error for unknown strategy")
+	}
+}
+
+func TestUpstreamHealthCheckTakesFailingServerOutOfRotation(t *testing.T) {
+	t.Parallel()
+	var down atomic.Bool
+	down.Store(true)
+	flaky := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		if down.Load() {
+			m.SetRcode(r, mdns.RcodeServerFailure)
+		} else {
+			m.SetReply(r)
+			m.Answer = []mdns.RR{testA(r.Question[0].Name, "10.0.0.1")}
+		}
+		w.WriteMsg(m)
+	})
+	good := startAnsweringUpstream(t, "10.0.0.2")
+
+	router, err := newUpstreamRouter([]string{flaky, good}, nil, upstreamOptions{
+		timeout: time.Second,
+		health:  healthCheckOptions{interval: 20 * time.Millisecond, failThreshold: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+	flakyServer := router.fallback.servers[0]
+
+	waitFor := func(cond func() bool, what string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor(flakyServer.unhealthy.Load, "the failing upstream to leave rotation")
+	if got := answerIP(t, router, "a.example"); got != "10.0.0.2" {
+		t.Fatalf("got %s from an unhealthy upstream", got)
+	}
+
+	down.Store(false)
+	waitFor(func() bool { return !flakyServer.unhealthy.Load() }, "the upstream to recover")
+	if got := answerIP(t, router, "b.example"); got != "10.0.0.1" {
+		t.Fatalf("expected the recovered upstream to be tried first again, got %s", got)
+	}
+}
+
+func TestUpstreamServfailKeepsServerInRotation(t *testing.T) {
+	t.Parallel()
+	servfail := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		m := new(mdns.Msg)
+		m.SetRcode(r, mdns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+	good := startAnsweringUpstream(t, "10.0.0.2")
+
+	router, err := newUpstreamRouter([]string{servfail, good}, []config.UpstreamRoute{
+		{Domains: []string{"corp.internal"}, Servers: []string{good}},
+	}, upstreamOptions{
+		timeout: time.Second,
+		health:  healthCheckOptions{interval: time.Hour, failThreshold: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+
+	// SERVFAIL of a broken name says nothing about the server: only probes count it
+	for i := 0; i < 3; i++ {
+		if got := answerIP(t, router, "broken.example"); got != "10.0.0.2" {
+			t.Fatalf("got %s", got)
+		}
+	}
+	if s := router.fallback.servers[0]; s.unhealthy.Load() || s.fails.Load() != 0 {
+		t.Errorf("SERVFAIL replies took the upstream out of rotation (%d failures)", s.fails.Load())
+	}
+	// Single servers are not probed, so they never leave rotation either
+	if threshold := router.resolverFor("corp.internal").failThreshold; threshold != 0 {
+		t.Errorf("single server fail threshold %d, want 0", threshold)
+	}
+}
+
+func TestUpstreamAllUnhealthyStillTried(t *testing.T) {
+	t.Parallel()
+	a := startAnsweringUpstream(t, "10.0.0.1")
+	b := startAnsweringUpstream(t, "10.0.0.2")
+	router, err := newUpstreamRouter([]string{a, b}, nil, upstreamOptions{timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.close()
+	for _, s := range router.fallback.servers {
+		s.unhealthy.Store(true)
+	}
+
+	if got := answerIP(t, router, "a.example"); got != "10.0.0.1" {
+		t.Fatalf("got %s", got)
+	}
+}
@@ -0,0 +1,175 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+)
+
+// dnsView answers the clients of a config view (split-horizon DNS) with its own hosts,
+// upstreams, filter and DNS64.
+type dnsView struct {
+	cfg      config.ViewConfig
+	clients  []netip.Prefix
+	hosts    *config.Config  // the view's hosts, checked before the top-level ones; nil when none
+	upstream *upstreamRouter // nil = the top-level upstreams
+	// filter replaces the top-level filter when ownFilter is set; nil blocks nothing.
+	filter    *dnsFilter
+	ownFilter bool
+	// dns64 replaces the top-level DNS64 when ownDNS64 is set; nil synthesizes nothing.
+	dns64    *dns64
+	ownDNS64 bool
+}
+
+// dnsViews are the views of a config in match order. A nil or empty dnsViews matches
+// no query.
+type dnsViews []*dnsView
+
+// loadViews builds the views of cfg, creating their upstreams with opts for the timeout
+// and health check settings not given by the view (LoadConfig fills them from the
+// top-level upstream section).
+func loadViews(cfg *config.Config, opts upstreamOptions) (views dnsViews, err error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	defer func() {
+		if err != nil {
+			views.close()
+		}
+	}()
+	for _, vc := range cfg.Views {
+		v := &dnsView{cfg: vc}
+		views = append(views, v)
+		if v.clients, err = vc.ClientPrefixes(); err != nil {
+			return views, fmt.Errorf("view %s: %w", vc.Name, err)
+		}
+		if len(vc.Hosts) > 0 {
+			v.hosts = &config.Config{Hosts: vc.Hosts}
+			if _, err = v.hosts.HostIndex(); err != nil {
+				return views, fmt.Errorf("view %s: invalid hosts config: %w", vc.Name, err)
+			}
+		}
+		if vc.Filter != nil {
+			v.ownFilter = true
+			if v.filter, err = loadDNSFilter(*vc.Filter); err != nil {
+				return views, fmt.Errorf("view %s: failed to load filter: %w", vc.Name, err)
+			}
+		}
+		if vc.DNS64 != nil {
+			v.ownDNS64 = true
+			if v.dns64, err = newDNS64(*vc.DNS64); err != nil {
+				return views, fmt.Errorf("view %s: invalid dns64: %w", vc.Name, err)
+			}
+		}
+		if u := vc.Upstream; u != nil {
+			viewOpts := opts
+			viewOpts.strategy = u.Strategy
+			if u.Timeout != "" {
+				if viewOpts.timeout, err = time.ParseDuration(u.Timeout); err != nil {
+					return views, fmt.Errorf("view %s: invalid upstream.timeout: %w", vc.Name, err)
+				}
+			}
+			if hc := u.HealthCheck; hc != (config.UpstreamHealthCheck{}) {
+				viewOpts.health = healthCheckOptions{domain: hc.Domain, failThreshold: hc.FailThreshold}
+				if hc.EffectiveEnabled() {
+					if viewOpts.health.interval, err = time.ParseDuration(hc.Interval); err != nil {
+						return views, fmt.Errorf("view %s: invalid upstream.health_check.interval: %w", vc.Name, err)
+					}
+				}
+			}
+			if v.upstream, err = newUpstreamRouter(u.Servers, u.Routes, viewOpts); err != nil {
+				return views, fmt.Errorf("view %s: failed to create upstream resolver: %w", vc.Name, err)
+			}
+		}
+	}
+	return views, nil
+}
+
+// match returns the first view matching a query from client over protocol, or nil.
+func (vs dnsViews) match(client net.IP, protocol string) *dnsView {
+	for _, v := range vs {
+		if v.cfg.Matches(v.clients, client, protocol) {
+			return v
+		}
+	}
+	return nil
+}
+
+// hostsConfigs returns the hosts of every view that has some.
+func (vs dnsViews) hostsConfigs() []*config.Config {
+	var cfgs []*config.Config
+	for _, v := range vs {
+		if v.hosts != nil {
+			cfgs = append(cfgs, v.hosts)
+		}
+	}
+	return cfgs
+}
+
+// reloadFilters returns a copy of the views with the filters they replace rebuilt from
+// their lists.
+func (vs dnsViews) reloadFilters() (dnsViews, error) {
+	out := make(dnsViews, len(vs))
+	var errs []error
+	for i, v := range vs {
+		next := *v
+		if v.ownFilter && v.cfg.Filter.Enabled() {
+			f, err := loadDNSFilter(*v.cfg.Filter)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("view %s: %w", v.cfg.Name, err))
+			} else {
+				next.filter = f
+			}
+		}
+		out[i] = &next
+	}
+	return out, errors.Join(errs...)
+}
+
+// hasFilterLists reports whether any view replaces the filter with list files.
+func (vs dnsViews) hasFilterLists() bool {
+	for _, v := range vs {
+		if v.ownFilter && v.cfg.Filter.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// close closes the upstreams of the views.
+func (vs dnsViews) close() {
+	for _, v := range vs {
+		if v.upstream != nil {
+			v.upstream.close()
+		}
+	}
+}
+
+// name returns the view name, or "" for the top-level settings.
+func (v *dnsView) name() string {
+	if v == nil {
+		return ""
+	}
+	return v.cfg.Name
+}
+
+// hostsConfig returns the view's hosts, or nil when it has none.
+func (v *dnsView) hostsConfig() *config.Config {
+	if v == nil {
+		return nil
+	}
+	return v.hosts
+}
+
+// cacheKey returns the cache key of a question asked in the view: views have their own
+// hosts aliases and upstreams, so their answers are cached apart.
+func (v *dnsView) cacheKey(hostname string, qtype uint16) string {
+	if v == nil {
+		return dnsCacheKey(hostname, qtype)
+	}
+	return dnsCacheKey(hostname, qtype) + "@" + v.cfg.Name
+}
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+func viewQuery(name string, qtype uint16, client, protocol string) *dnsRequest {
+	req := testQuery(name, qtype)
+	req.clientIP = net.ParseIP(client)
+	req.protocol = protocol
+	return req
+}
+
+func firstA(t *testing.T, reply *mdns.Msg) string {
+	t.Helper()
+	if len(reply.Answer) == 0 {
+		t.Fatalf("expected an answer, got %v", reply)
+	}
+	return reply.Answer[0].(*mdns.A).A.String()
+}
+
+func TestQueryHandlerViews(t *testing.T) {
+	t.Parallel()
+	public := startAnsweringUpstream(t, "203.0.113.1")
+	internal := startAnsweringUpstream(t, "10.0.0.1")
+	block := writeFilterList(t, t.TempDir(), "block.txt", "ads.example.com\n")
+
+	cfg := &config.Config{
+		Hosts:  config.HostsConfig{"git.example.com": "203.0.113.20"},
+		Filter: config.FilterConfig{Blocklists: []string{block}, BlockResponse: config.BlockResponseNXDomain},
+		Views: []config.ViewConfig{
+			{
+				Name:        "office",
+				ClientMatch: config.ClientMatch{Clients: []string{"10.0.0.0/8"}},
+				Hosts:       config.HostsConfig{"git.example.com": "10.0.0.20", "wiki.example.com": "docs.example.com"},
+				Upstream:    &config.UpstreamConfig{Servers: []string{internal}},
+				Filter:      &config.FilterConfig{},
+			},
+			{Name: "vpn", ClientMatch: config.ClientMatch{Protocols: []string{"doq"}}},
+		},
+	}
+	h := newTestHandler(t, cfg, public)
+	var err error
+	if h.filter, err = loadDNSFilter(cfg.Filter); err != nil {
+		t.Fatal(err)
+	}
+	if h.views, err = loadViews(cfg, upstreamOptions{timeout: h.upstream.timeout}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.views.close)
+
+	const office, outside = "10.1.2.3", "198.51.100.7"
+
+	// View hosts come first, other clients get the top-level hosts
+	if got := firstA(t, h.serveDNS(viewQuery("git.example.com", mdns.TypeA, office, "udp"))); got != "10.0.0.20" {
+		t.Errorf("office git.example.com = %s", got)
+	}
+	if got := firstA(t, h.serveDNS(viewQuery("git.example.com", mdns.TypeA, outside, "udp"))); got != "203.0.113.20" {
+		t.Errorf("outside git.example.com = %s", got)
+	}
+
+	// Each view forwards to its own upstreams and caches apart
+	for i := 0; i < 2; i++ {
+		if got := firstA(t, h.serveDNS(viewQuery("app.example.com", mdns.TypeA, office, "tcp"))); got != "10.0.0.1" {
+			t.Errorf("office app.example.com = %s", got)
+		}
+		if got := firstA(t, h.serveDNS(viewQuery("app.example.com", mdns.TypeA, outside, "udp"))); got != "203.0.113.1" {
+			t.Errorf("outside app.example.com = %s", got)
+		}
+	}
+	if got := firstA(t, h.serveDNS(viewQuery("wiki.example.com", mdns.TypeA, office, "udp"))); got != "10.0.0.1" {
+		t.Errorf("office alias resolved with %s, want the view's upstream", got)
+	}
+
+	// The office view blocks nothing; the vpn view keeps the top-level filter
+	if reply := h.serveDNS(viewQuery("ads.example.com", mdns.TypeA, office, "udp")); reply.Rcode != mdns.RcodeSuccess {
+		t.Errorf("office ads.example.com rcode %s", mdns.RcodeToString[reply.Rcode])
+	}
+	if reply := h.serveDNS(viewQuery("ads.example.com", mdns.TypeA, outside, "doq")); reply.Rcode != mdns.RcodeNameError {
+		t.Errorf("vpn ads.example.com rcode %s", mdns.RcodeToString[reply.Rcode])
+	}
+
+	if n := h.cache.delete("app.example.com", mdns.TypeA); n != 2 {
+		t.Errorf("deleted %d cache entries of app.example.com, want one per view", n)
+	}
+}
+
+func TestFilterListWatcherReloadsViewFilters(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFilterList(t, dir, "block.txt", "ads.example.com\n")
+	cfg := &config.Config{Views: []config.ViewConfig{{
+		Name:        "kids",
+		ClientMatch: config.ClientMatch{Clients: []string{"192.168.2.0/24"}},
+		Filter:      &config.FilterConfig{Blocklists: []string{filepath.Join(dir, "block.txt")}, BlockResponse: config.BlockResponseNXDomain},
+	}}}
+	views, err := loadViews(cfg, upstreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handlerAtomic atomic.Value
+	handlerAtomic.Store(&queryHandler{cfg: cfg, views: views})
+	w := newFilterListWatcher(&handlerAtomic, nil)
+
+	writeFilterList(t, dir, "block.txt", "games.example.com\n")
+	if err := w.reload(); err != nil {
+		t.Fatal(err)
+	}
+	f := handlerAtomic.Load().(*queryHandler).views[0].filter
+	if f.blocked("ads.example.com") || !f.blocked("games.example.com") {
+		t.Fatal("expected the view's list to be reloaded")
+	}
+	if views[0].filter.blocked("games.example.com") {
+		t.Fatal("reload modified the previous handler's view")
+	}
+}
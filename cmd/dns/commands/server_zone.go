@@ -0,0 +1,281 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	"github.com/go-zoox/logger"
+	mdns "github.com/miekg/dns"
+)
+
+// authZone is an authoritative zone loaded from an RFC 1035 master file.
+type authZone struct {
+	origin  string // lowercased FQDN
+	soa     *mdns.SOA
+	records map[string]map[uint16][]mdns.RR // owner -> type -> RRset
+	names   map[string]bool                 // owners plus empty non-terminals
+}
+
+// zoneSet holds the configured zones, most specific origin first.
+type zoneSet struct {
+	zones []*authZone
+}
+
+// loadZones parses every configured zone file.
+func loadZones(zones []config.ZoneConfig) (*zoneSet, error) {
+	set := &zoneSet{}
+	for _, zc := range zones {
+		z, err := parseZoneFile(zc.File, zc.Origin)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range set.zones {
+			if other.origin == z.origin {
+				return nil, fmt.Errorf("zone %s is declared more than once", z.origin)
+			}
+		}
+		set.zones = append(set.zones, z)
+		logger.Info("Loaded zone %s from %s (%d names)", z.origin, zc.File, len(z.records))
+	}
+
+	// Longest origin first so the most specific zone wins
+	sort.Slice(set.zones, func(i, j int) bool {
+		return mdns.CountLabel(set.zones[i].origin) > mdns.CountLabel(set.zones[j].origin)
+	})
+	return set, nil
+}
+
+// parseZoneFile reads a master file. If origin is empty it is taken from $ORIGIN / the SOA owner.
+func parseZoneFile(filePath, origin string) (*authZone, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zone file: %w", err)
+	}
+	defer f.Close()
+
+	if origin != "" {
+		origin = mdns.Fqdn(strings.ToLower(strings.TrimSpace(origin)))
+	}
+
+	z := &authZone{
+		origin:  origin,
+		records: make(map[string]map[uint16][]mdns.RR),
+		names:   make(map[string]bool),
+	}
+
+	zp := mdns.NewZoneParser(f, origin, filePath)
+	zp.SetIncludeAllowed(true)
+	var rrs []mdns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if soa, isSOA := rr.(*mdns.SOA); isSOA {
+			if z.soa != nil {
+				return nil, fmt.Errorf("zone file %s: more than one SOA record", filePath)
+			}
+			z.soa = soa
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file %s: %w", filePath, err)
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("zone file %s: missing SOA record", filePath)
+	}
+	if z.origin == "" {
+		z.origin = z.soa.Hdr.Name
+	}
+	if z.soa.Hdr.Name != z.origin {
+		return nil, fmt.Errorf("zone file %s: SOA owner %s does not match origin %s", filePath, z.soa.Hdr.Name, z.origin)
+	}
+
+	for _, rr := range rrs {
+		name := rr.Header().Name
+		if !mdns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("zone file %s: record %s is outside of zone %s", filePath, name, z.origin)
+		}
+		byType := z.records[name]
+		if byType == nil {
+			byType = make(map[uint16][]mdns.RR)
+			z.records[name] = byType
+		}
+		byType[rr.Header().Rrtype] = append(byType[rr.Header().Rrtype], rr)
+
+		// Mark the owner and every ancestor up to the origin as existing (empty non-terminals)
+		for n := name; ; {
+			z.names[n] = true
+			if n == z.origin {
+				break
+			}
+			i, end := mdns.NextLabel(n, 0)
+			if end {
+				break
+			}
+			n = n[i:]
+		}
+	}
+
+	return z, nil
+}
+
+// find returns the most specific zone containing name, or nil.
+func (s *zoneSet) find(name string) *authZone {
+	if s == nil {
+		return nil
+	}
+	for _, z := range s.zones {
+		if mdns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// negativeSOA returns the SOA for the authority section of negative answers,
+// with its TTL capped by the SOA minimum (RFC 2308).
+func (z *authZone) negativeSOA() []mdns.RR {
+	soa := mdns.Copy(z.soa).(*mdns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return []mdns.RR{soa}
+}
+
+// delegation returns the NS RRset of the closest zone cut strictly below the origin
+// at or above name, if any.
+func (z *authZone) delegation(name string, qtype uint16) []mdns.RR {
+	labels := mdns.SplitDomainName(name)
+	originLabels := mdns.CountLabel(z.origin)
+	// Walk from just below the origin down to name
+	for i := len(labels) - originLabels - 1; i >= 0; i-- {
+		cut := mdns.Fqdn(strings.Join(labels[i:], "."))
+		ns := z.records[cut][mdns.TypeNS]
+		if len(ns) == 0 {
+			continue
+		}
+		// DS records live in the parent side of the cut
+		if cut == name && qtype == mdns.TypeDS {
+			return nil
+		}
+		return ns
+	}
+	return nil
+}
+
+// glue returns address records held by the zone for the NS targets.
+func (z *authZone) glue(ns []mdns.RR) []mdns.RR {
+	var extra []mdns.RR
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*mdns.NS).Ns)
+		extra = append(extra, copyRRs(z.records[target][mdns.TypeA])...)
+		extra = append(extra, copyRRs(z.records[target][mdns.TypeAAAA])...)
+	}
+	return extra
+}
+
+// owner returns the name whose records answer for name: name itself when it exists,
+// possibly as an empty non-terminal, or else the wildcard at its closest encloser
+// (RFC 4592), if any.
+func (z *authZone) owner(name string) (string, bool) {
+	if _, exists := z.records[name]; exists || z.names[name] {
+		return name, true
+	}
+	encloser := name
+	for encloser != z.origin && !z.names[encloser] {
+		i, _ := mdns.NextLabel(encloser, 0)
+		encloser = encloser[i:]
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	_, exists := z.records[wildcard]
+	return wildcard, exists
+}
+
+// types returns the types of the records answering for name, sorted, and whether name
+// exists in the zone.
+func (z *authZone) types(name string) ([]uint16, bool) {
+	owner, exists := z.owner(name)
+	types := make([]uint16, 0, len(z.records[owner]))
+	for t := range z.records[owner] {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	return types, exists
+}
+
+// maxZoneCNAMEChain bounds CNAME chasing inside a zone.
+const maxZoneCNAMEChain = 8
+
+// lookup answers name/qtype from the zone (RFC 1034 section 4.3.2, without
+// following aliases out of the zone).
+func (z *authZone) lookup(name string, qtype uint16) *dnsResult {
+	return z.lookupChain(name, qtype, 0)
+}
+
+func (z *authZone) lookupChain(name string, qtype uint16, depth int) *dnsResult {
+	res := &dnsResult{authoritative: true, channel: "zone"}
+
+	if ns := z.delegation(name, qtype); ns != nil {
+		// Referral: not authoritative for data below a zone cut
+		res.authoritative = false
+		res.ns = copyRRs(ns)
+		res.extra = z.glue(ns)
+		return res
+	}
+
+	owner, exists := z.owner(name)
+	if !exists {
+		res.rcode = mdns.RcodeNameError
+		res.ns = z.negativeSOA()
+		return res
+	}
+	byType := z.records[owner]
+
+	answer := func(rrs []mdns.RR) {
+		for _, rr := range rrs {
+			cp := mdns.Copy(rr)
+			cp.Header().Name = name
+			res.answer = append(res.answer, cp)
+		}
+	}
+
+	switch {
+	case qtype == mdns.TypeANY:
+		types := make([]int, 0, len(byType))
+		for t := range byType {
+			types = append(types, int(t))
+		}
+		sort.Ints(types)
+		for _, t := range types {
+			answer(byType[uint16(t)])
+		}
+	case len(byType[qtype]) > 0:
+		answer(byType[qtype])
+	case len(byType[mdns.TypeCNAME]) > 0:
+		answer(byType[mdns.TypeCNAME])
+		// Chase the alias while it stays inside this zone
+		target := strings.ToLower(byType[mdns.TypeCNAME][0].(*mdns.CNAME).Target)
+		if target != owner && depth < maxZoneCNAMEChain && mdns.IsSubDomain(z.origin, target) {
+			chased := z.lookupChain(target, qtype, depth+1)
+			if chased.authoritative {
+				// The last name of the chain sets the rcode, and the SOA of a negative
+				// answer (RFC 6604, RFC 2308 section 2.1)
+				res.rcode = chased.rcode
+				res.answer = append(res.answer, chased.answer...)
+				res.ns = chased.ns
+			}
+		}
+	}
+
+	if len(res.answer) == 0 {
+		// NODATA
+		res.ns = z.negativeSOA()
+	}
+	return res
+}
@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-idp/dns/cmd/dns/config"
+	mdns "github.com/miekg/dns"
+)
+
+const testZoneFile = `$ORIGIN corp.internal.
+$TTL 3600
+@       IN SOA ns1 hostmaster 2024010101 7200 900 1209600 300
+@       IN NS  ns1
+ns1     IN A   10.0.0.53
+www     IN A   10.0.0.10
+        IN AAAA fd00::10
+@       IN MX  10 mail
+mail    IN A   10.0.0.25
+web     IN CNAME www
+old     IN CNAME gone
+*.apps  IN A   10.0.1.1
+a.b.c   IN TXT "deep"
+sub     IN NS  ns.sub
+ns.sub  IN A   10.0.2.53
+`
+
+func writeTestZone(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "corp.internal.zone")
+	if err := os.WriteFile(path, []byte(testZoneFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadZonesFromMasterFile(t *testing.T) {
+	t.Parallel()
+	zones, err := loadZones([]config.ZoneConfig{{File: writeTestZone(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zones.find("www.corp.internal.")
+	if z == nil || z.origin != "corp.internal." {
+		t.Fatalf("expected zone corp.internal., got %v", z)
+	}
+	if zones.find("www.example.com.") != nil {
+		t.Fatal("unexpected zone for example.com")
+	}
+
+	if _, err := loadZones([]config.ZoneConfig{{File: writeTestZone(t), Origin: "other.internal"}}); err == nil {
+		t.Fatal("expected origin mismatch error")
+	}
+}
+
+func TestAuthZoneLookup(t *testing.T) {
+	t.Parallel()
+	zones, err := loadZones([]config.ZoneConfig{{File: writeTestZone(t), Origin: "corp.internal"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zones.find("corp.internal.")
+
+	res := z.lookup("www.corp.internal.", mdns.TypeA)
+	if !res.authoritative || res.rcode != mdns.RcodeSuccess || len(res.answer) != 1 || res.answer[0].(*mdns.A).A.String() != "10.0.0.10" {
+		t.Fatalf("www A: %+v", res)
+	}
+
+	res = z.lookup("nope.corp.internal.", mdns.TypeA)
+	if res.rcode != mdns.RcodeNameError || len(res.ns) != 1 || res.ns[0].Header().Ttl != 300 {
+		t.Fatalf("NXDOMAIN: %+v", res)
+	}
+
+	res = z.lookup("mail.corp.internal.", mdns.TypeMX)
+	if res.rcode != mdns.RcodeSuccess || len(res.answer) != 0 || len(res.ns) != 1 {
+		t.Fatalf("NODATA: %+v", res)
+	}
+
+	// Empty non-terminal exists but has no data
+	res = z.lookup("b.c.corp.internal.", mdns.TypeA)
+	if res.rcode != mdns.RcodeSuccess || len(res.answer) != 0 {
+		t.Fatalf("empty non-terminal: %+v", res)
+	}
+
+	res = z.lookup("x.apps.corp.internal.", mdns.TypeA)
+	if len(res.answer) != 1 || res.answer[0].Header().Name != "x.apps.corp.internal." {
+		t.Fatalf("wildcard: %+v", res)
+	}
+
+	res = z.lookup("web.corp.internal.", mdns.TypeAAAA)
+	if len(res.answer) != 2 || res.answer[0].Header().Rrtype != mdns.TypeCNAME || res.answer[1].Header().Rrtype != mdns.TypeAAAA {
+		t.Fatalf("CNAME chase: %+v", res.answer)
+	}
+
+	// The chase ends in NODATA or NXDOMAIN: the last name sets the rcode, with the SOA
+	res = z.lookup("web.corp.internal.", mdns.TypeMX)
+	if res.rcode != mdns.RcodeSuccess || len(res.answer) != 1 || len(res.ns) != 1 || res.ns[0].Header().Rrtype != mdns.TypeSOA {
+		t.Fatalf("CNAME to NODATA: %+v", res)
+	}
+	res = z.lookup("old.corp.internal.", mdns.TypeA)
+	if res.rcode != mdns.RcodeNameError || len(res.answer) != 1 || len(res.ns) != 1 || res.ns[0].Header().Rrtype != mdns.TypeSOA {
+		t.Fatalf("CNAME to NXDOMAIN: %+v", res)
+	}
+
+	res = z.lookup("host.sub.corp.internal.", mdns.TypeA)
+	if res.authoritative || len(res.ns) != 1 || len(res.extra) != 1 || len(res.answer) != 0 {
+		t.Fatalf("referral: %+v", res)
+	}
+}
+
+func TestQueryHandlerZoneIsAuthoritative(t *testing.T) {
+	t.Parallel()
+	zones, err := loadZones([]config.ZoneConfig{{File: writeTestZone(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := startTestUpstream(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		t.Errorf("unexpected upstream query %v", r.Question[0])
+		m := new(mdns.Msg)
+		w.WriteMsg(m.SetRcode(r, mdns.RcodeServerFailure))
+	})
+	// Config hosts for a name inside the zone must not be consulted
+	cfg := &config.Config{Hosts: config.HostsConfig{"missing.corp.internal": "1.2.3.4"}}
+	h := newTestHandler(t, cfg, upstream)
+	h.zones = zones
+
+	reply := h.serveDNS(testQuery("missing.corp.internal", mdns.TypeA))
+	if !reply.Authoritative || reply.Rcode != mdns.RcodeNameError {
+		t.Fatalf("expected authoritative NXDOMAIN, got %v", reply)
+	}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ACLConfig restricts who may query the server and who may get answers that need
+// upstreams (recursion), so the server can listen on a public interface without
+// becoming an open resolver:
+//
+//	acl:
+//	  query:                              # who may query at all
+//	    rules:
+//	      - clients: ["198.51.100.0/24"]
+//	        action: drop
+//	  recursion:                          # who may get upstream answers
+//	    default: refuse
+//	    rules:
+//	      - clients: ["10.0.0.0/8", "127.0.0.1", "::1"]
+//	        action: allow
+//
+// Clients denied recursion are still answered from host overrides, zones, hosts and
+// blocklists.
+type ACLConfig struct {
+	Query     ACLList `yaml:"query"`
+	Recursion ACLList `yaml:"recursion"`
+}
+
+// ACLList applies the action of the first rule matching a query, or Default.
+type ACLList struct {
+	Default string    `yaml:"default"` // ACL* action when no rule matches, default allow
+	Rules   []ACLRule `yaml:"rules"`
+}
+
+// ACLRule applies Action to the queries it matches.
+type ACLRule struct {
+	ClientMatch `yaml:",inline"`
+	Action      string `yaml:"action"` // ACL*
+}
+
+// Actions of ACL rules
+const (
+	ACLAllow  = "allow"  // answer
+	ACLRefuse = "refuse" // answer REFUSED
+	ACLDrop   = "drop"   // send no response
+)
+
+func validACLAction(action string) bool {
+	switch action {
+	case ACLAllow, ACLRefuse, ACLDrop:
+		return true
+	}
+	return false
+}
+
+// applyDefaults validates the list and fills its default action. Errors name the
+// invalid key under name.
+func (l *ACLList) applyDefaults(name string) error {
+	l.Default = strings.ToLower(strings.TrimSpace(l.Default))
+	if l.Default == "" {
+		l.Default = ACLAllow
+	}
+	if !validACLAction(l.Default) {
+		return fmt.Errorf("%s.default: unsupported action %q", name, l.Default)
+	}
+	for i := range l.Rules {
+		rule := &l.Rules[i]
+		if err := rule.ClientMatch.validate(); err != nil {
+			return fmt.Errorf("%s.rules[%d].%w", name, i, err)
+		}
+		rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+		if !validACLAction(rule.Action) {
+			return fmt.Errorf("%s.rules[%d].action: unsupported action %q", name, i, rule.Action)
+		}
+	}
+	return nil
+}
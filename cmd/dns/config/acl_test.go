@@ -0,0 +1,50 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig_ACL(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "acl.yaml")
+	content := `
+acl:
+  query:
+    rules:
+      - clients: ["198.51.100.0/24"]
+        action: DROP
+  recursion:
+    default: refuse
+    rules:
+      - clients: ["10.0.0.0/8", "127.0.0.1"]
+        action: allow
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.ACL.Query.Default != ACLAllow || cfg.ACL.Query.Rules[0].Action != ACLDrop {
+		t.Errorf("acl.query = %+v", cfg.ACL.Query)
+	}
+	if cfg.ACL.Recursion.Default != ACLRefuse || len(cfg.ACL.Recursion.Rules[0].Clients) != 2 {
+		t.Errorf("acl.recursion = %+v", cfg.ACL.Recursion)
+	}
+
+	for name, acl := range map[string]string{
+		"default": `{query: {default: deny}}`,
+		"action":  `{query: {rules: [{clients: ["10.0.0.0/8"], action: reject}]}}`,
+		"client":  `{recursion: {rules: [{clients: ["office"], action: allow}]}}`,
+		"match":   `{recursion: {rules: [{action: allow}]}}`,
+	} {
+		if err := os.WriteFile(configFile, []byte("acl: "+acl+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
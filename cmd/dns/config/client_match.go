@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ClientMatch selects queries by client address and by the protocol they arrived on,
+// for views and ACL rules. At least one of Clients and Protocols is required.
+type ClientMatch struct {
+	Clients   []string `yaml:"clients"`   // CIDRs or addresses, empty = every client
+	Protocols []string `yaml:"protocols"` // Protocol*, empty = every protocol
+}
+
+// Protocols a query can arrive on, for ClientMatch.Protocols
+const (
+	ProtocolUDP = "udp"
+	ProtocolTCP = "tcp"
+	ProtocolDoT = "dot"
+	ProtocolDoH = "doh"
+	ProtocolDoQ = "doq"
+)
+
+func validProtocol(protocol string) bool {
+	switch protocol {
+	case ProtocolUDP, ProtocolTCP, ProtocolDoT, ProtocolDoH, ProtocolDoQ:
+		return true
+	}
+	return false
+}
+
+// validate checks the clients and normalizes the protocols. Errors name the invalid key.
+func (m *ClientMatch) validate() error {
+	if _, err := m.ClientPrefixes(); err != nil {
+		return fmt.Errorf("clients: %w", err)
+	}
+	for i, protocol := range m.Protocols {
+		m.Protocols[i] = strings.ToLower(strings.TrimSpace(protocol))
+		if !validProtocol(m.Protocols[i]) {
+			return fmt.Errorf("protocols: unsupported value %q", protocol)
+		}
+	}
+	if len(m.Clients) == 0 && len(m.Protocols) == 0 {
+		return fmt.Errorf("clients: clients or protocols are required")
+	}
+	return nil
+}
+
+// ClientPrefixes parses Clients; a plain address matches only itself.
+func (m *ClientMatch) ClientPrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(m.Clients))
+	for _, client := range m.Clients {
+		client = strings.TrimSpace(client)
+		if prefix, err := netip.ParsePrefix(client); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client %q: expected a CIDR or an address", client)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Matches reports whether a query from client over protocol (Protocol*) is selected.
+// prefixes are the ClientPrefixes of m.
+func (m *ClientMatch) Matches(prefixes []netip.Prefix, client net.IP, protocol string) bool {
+	if len(m.Protocols) > 0 && !slices.Contains(m.Protocols, protocol) {
+		return false
+	}
+	if len(prefixes) == 0 {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(client)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
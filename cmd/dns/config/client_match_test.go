@@ -0,0 +1,35 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientMatch_Matches(t *testing.T) {
+	v := ClientMatch{Clients: []string{"10.0.0.0/8", "fd00::/8", "192.168.1.7"}, Protocols: []string{"udp", "tcp"}}
+	prefixes, err := v.ClientPrefixes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		client   string
+		protocol string
+		want     bool
+	}{
+		{"10.1.2.3", "udp", true},
+		{"::ffff:10.1.2.3", "tcp", true},
+		{"fd00::1", "udp", true},
+		{"192.168.1.7", "udp", true},
+		{"192.168.1.8", "udp", false},
+		{"10.1.2.3", "doh", false},
+	} {
+		if got := v.Matches(prefixes, net.ParseIP(tc.client), tc.protocol); got != tc.want {
+			t.Errorf("Matches(%s, %s) = %v, want %v", tc.client, tc.protocol, got, tc.want)
+		}
+	}
+
+	anyClient := ClientMatch{Protocols: []string{"doh"}}
+	if !anyClient.Matches(nil, net.ParseIP("203.0.113.1"), "doh") {
+		t.Error("a match without clients must match every client")
+	}
+}
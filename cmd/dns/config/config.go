@@ -5,8 +5,13 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,9 +22,23 @@ type Config struct {
 	DoH         DoHConfig         `yaml:"doh"`
 	DoQ         DoQConfig         `yaml:"doq"`
 	Hosts       HostsConfig       `yaml:"hosts"`
+	Zones       []ZoneConfig      `yaml:"zones"`
 	SystemHosts SystemHostsConfig `yaml:"system_hosts"`
 	Upstream    UpstreamConfig    `yaml:"upstream"`
 	Cache       CacheConfig       `yaml:"cache"`
+	Filter      FilterConfig      `yaml:"filter"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	QueryLog    QueryLogConfig    `yaml:"query_log"`
+	Admin       AdminConfig       `yaml:"admin"`
+	Views       []ViewConfig      `yaml:"views"`
+	ACL         ACLConfig         `yaml:"acl"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	DNSSEC      DNSSECConfig      `yaml:"dnssec"`
+	DNS64       DNS64Config       `yaml:"dns64"`
+
+	// hostIndex is the precompiled index over Hosts, built by LoadConfig or on first lookup.
+	// Hosts must not be modified afterwards.
+	hostIndex atomic.Pointer[HostIndex[*HostMapping]]
 }
 
 // CacheConfig enables in-memory caching of answers that required upstream resolution.
@@ -27,9 +46,28 @@ type Config struct {
 type CacheConfig struct {
 	// Enabled, when nil after YAML load, means "on" (default). Explicit false disables.
 	Enabled     *bool  `yaml:"enabled"`
-	PositiveTTL string `yaml:"positive_ttl"` // TTL for answers with at least one IP
-	NegativeTTL string `yaml:"negative_ttl"` // TTL for empty / NXDOMAIN-style answers
-	MaxEntries  int    `yaml:"max_entries"`  // 0 = use DNSCacheMaxEntriesDefault
+	PositiveTTL string `yaml:"positive_ttl"` // maximum TTL for answers with at least one record
+	NegativeTTL string `yaml:"negative_ttl"` // maximum TTL for empty / NXDOMAIN-style answers
+	MinTTL      string `yaml:"min_ttl"`      // minimum TTL for any cached answer, default 0
+	// ServeStale is how long expired answers are kept to be served when every upstream
+	// fails (RFC 8767); empty or 0 disables serve-stale.
+	ServeStale string              `yaml:"serve_stale"`
+	MaxEntries int                 `yaml:"max_entries"` // 0 = use DNSCacheMaxEntriesDefault
+	Prefetch   CachePrefetchConfig `yaml:"prefetch"`
+	// PersistFile, when set, is where the cache is saved on shutdown and every
+	// PersistInterval (default 5m, 0 = only on shutdown), and loaded from on startup.
+	PersistFile     string `yaml:"persist_file"`
+	PersistInterval string `yaml:"persist_interval"`
+}
+
+// CachePrefetchConfig refreshes popular cached answers from upstream in the background
+// shortly before they expire, so frequently queried names never miss.
+type CachePrefetchConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Threshold is the percentage of the TTL left below which a hit triggers a refresh.
+	Threshold int `yaml:"threshold"`
+	// MinHits is how many times an answer must have been served from the cache.
+	MinHits int `yaml:"min_hits"`
 }
 
 // EffectiveCacheEnabled reports whether caching should be used. Omitted "enabled" defaults to true.
@@ -50,6 +88,11 @@ const (
 	DNSCachePositiveTTLDefault = "300s" // 5 minutes
 	DNSCacheNegativeTTLDefault = "60s"
 	DNSCacheMaxEntriesDefault  = 10000
+
+	DNSCachePrefetchThresholdDefault = 10 // percent of the TTL left
+	DNSCachePrefetchMinHitsDefault   = 3
+
+	DNSCachePersistIntervalDefault = "5m"
 )
 
 // applyDNSCacheDefaults fills omitted cache fields when cache is effectively enabled.
@@ -66,6 +109,71 @@ func applyDNSCacheDefaults(c *CacheConfig) {
 	if c.MaxEntries == 0 {
 		c.MaxEntries = DNSCacheMaxEntriesDefault
 	}
+	if c.Prefetch.Threshold == 0 {
+		c.Prefetch.Threshold = DNSCachePrefetchThresholdDefault
+	}
+	if c.Prefetch.MinHits == 0 {
+		c.Prefetch.MinHits = DNSCachePrefetchMinHitsDefault
+	}
+	if c.PersistFile != "" && c.PersistInterval == "" {
+		c.PersistInterval = DNSCachePersistIntervalDefault
+	}
+}
+
+// FilterConfig configures domain blocklists.
+// List files may be in hosts format ("0.0.0.0 ads.example.com"), plain domain lists
+// ("ads.example.com", "*.ads.example.com") or Adblock-style rules ("||ads.example.com^",
+// "@@||ok.example.com^" for exceptions).
+type FilterConfig struct {
+	Blocklists    []string `yaml:"blocklists"`
+	Allowlists    []string `yaml:"allowlists"`     // every rule in these files is an exception
+	Allow         []string `yaml:"allow"`          // inline exceptions, same syntax as list lines
+	BlockResponse string   `yaml:"block_response"` // nxdomain (default), null_ip or refused
+	TTL           uint32   `yaml:"ttl"`            // TTL of null_ip answers, default 10
+}
+
+// Block responses supported by FilterConfig.BlockResponse
+const (
+	BlockResponseNXDomain = "nxdomain"
+	BlockResponseNullIP   = "null_ip"
+	BlockResponseRefused  = "refused"
+)
+
+// Enabled reports whether any blocklist is configured.
+func (f *FilterConfig) Enabled() bool {
+	return len(f.Blocklists) > 0
+}
+
+func validUpstreamStrategy(strategy string) bool {
+	switch strategy {
+	case UpstreamStrategyFailover, UpstreamStrategyRoundRobin, UpstreamStrategyRandom, UpstreamStrategyFastest, UpstreamStrategyParallel:
+		return true
+	}
+	return false
+}
+
+// MetricsConfig exposes Prometheus metrics over HTTP
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"` // default 127.0.0.1:9153
+	Path    string `yaml:"path"`   // default /metrics
+}
+
+// AdminConfig enables the admin HTTP API for runtime inspection and control.
+// Every request must carry "Authorization: Bearer <token>".
+type AdminConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"` // default 127.0.0.1:9154
+	Token   string `yaml:"token"`  // required when enabled
+}
+
+// QueryLogConfig records every query as a JSON line
+type QueryLogConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	Output         string `yaml:"output"`          // "stdout" (default) or a file path
+	MaxSizeMB      int    `yaml:"max_size_mb"`     // rotate files larger than this, default 100, -1 = never
+	RotateInterval string `yaml:"rotate_interval"` // also rotate files older than this, e.g. "24h"
+	MaxBackups     int    `yaml:"max_backups"`     // rotated files to keep, default 10, -1 = all
 }
 
 // ServerConfig represents basic server settings
@@ -73,6 +181,8 @@ type ServerConfig struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
 	TTL  uint32 `yaml:"ttl"`
+	// ShutdownTimeout is how long shutdown waits for in-flight queries, default 10s.
+	ShutdownTimeout string `yaml:"shutdown_timeout"`
 }
 
 // DoTConfig represents DNS-over-TLS configuration
@@ -107,6 +217,7 @@ type TLSConfig struct {
 //   - Simple: "example.com": "1.2.3.4"
 //   - Multiple IPs: "example.com": ["1.2.3.4", "1.2.3.5"]
 //   - With type: "example.com": {"a": ["1.2.3.4"], "aaaa": ["2001:db8::1"]}
+//   - Other record types: "example.com": {"mx": ["10 mail.example.com"], "txt": ["v=spf1 -all"], "ttl": 60}
 type HostsConfig map[string]interface{}
 
 // HostMapping represents a parsed host mapping
@@ -115,21 +226,95 @@ type HostMapping struct {
 	IPv4        []string
 	IPv6        []string
 	AliasTarget string
+	// Records holds non-address records (MX, TXT, SRV, ...) keyed by RR type.
+	// Owner names are "." and a zero TTL means "inherit" (see LookupRecords).
+	Records map[uint16][]dns.RR
+	TTL     uint32      // mapping-wide TTL from the structured format, 0 = server default
+	Policy  *HostPolicy // which addresses are answered and in which order, nil = all in order
+	// HealthCheck probes the addresses; failing ones are left out of answers in favor of
+	// the others, then of Fallback (addresses or an alias target).
+	HealthCheck *HostHealthCheck
+	Fallback    *HostMapping
+	health      HostHealth     // the health of the addresses, set by SetHealth
 	IsWildcard  bool           // true if domain contains wildcard (*)
 	IsRegex     bool           // true if domain is a regex pattern (starts with ^)
 	Regex       *regexp.Regexp // compiled regex pattern if IsRegex is true
 }
 
+// ZoneConfig declares an authoritative zone loaded from an RFC 1035 master file
+type ZoneConfig struct {
+	Origin string `yaml:"origin"` // optional, defaults to the file's $ORIGIN / SOA owner
+	File   string `yaml:"file"`
+}
+
 // SystemHostsConfig represents system hosts file configuration
 type SystemHostsConfig struct {
 	Disabled bool   `yaml:"disabled"`
 	FilePath string `yaml:"file_path"`
+	// Order of the addresses answered for a name with several IPs: fixed (default),
+	// shuffle or round_robin.
+	Order string `yaml:"order"`
+}
+
+// Orders of the addresses answered for a hosts name with several IPs
+const (
+	HostsOrderFixed      = "fixed"       // the order they are listed in
+	HostsOrderShuffle    = "shuffle"     // a random order per response
+	HostsOrderRoundRobin = "round_robin" // rotate the first address per response
+	HostsOrderWeighted   = "weighted"    // a random order favoring heavier addresses (config hosts only)
+)
+
+func validHostsOrder(order string) bool {
+	switch order {
+	case HostsOrderFixed, HostsOrderShuffle, HostsOrderRoundRobin:
+		return true
+	}
+	return false
 }
 
 // UpstreamConfig represents upstream DNS servers configuration
 type UpstreamConfig struct {
-	Servers []string `yaml:"servers"`
-	Timeout string   `yaml:"timeout"`
+	Servers     []string            `yaml:"servers"`
+	Timeout     string              `yaml:"timeout"`
+	Strategy    string              `yaml:"strategy"` // failover (default), round_robin, random, fastest, parallel
+	HealthCheck UpstreamHealthCheck `yaml:"health_check"`
+	Routes      []UpstreamRoute     `yaml:"routes"`
+}
+
+// Upstream selection strategies supported by UpstreamConfig.Strategy
+const (
+	UpstreamStrategyFailover   = "failover"    // try servers in order
+	UpstreamStrategyRoundRobin = "round_robin" // rotate the first server tried
+	UpstreamStrategyRandom     = "random"      // start with a random server
+	UpstreamStrategyFastest    = "fastest"     // lowest EWMA latency first
+	UpstreamStrategyParallel   = "parallel"    // query all, first answer wins
+)
+
+// UpstreamHealthCheck configures active probing of upstream servers. Servers failing
+// FailThreshold probes in a row are taken out of rotation until a probe succeeds.
+type UpstreamHealthCheck struct {
+	// Enabled, when nil after YAML load, means "on" (default). Explicit false disables.
+	Enabled       *bool  `yaml:"enabled"`
+	Interval      string `yaml:"interval"`       // default 10s
+	Domain        string `yaml:"domain"`         // probe query name (NS), default "."
+	FailThreshold int    `yaml:"fail_threshold"` // default 2
+}
+
+// EffectiveEnabled reports whether health checking should be used. Omitted "enabled" defaults to true.
+func (h *UpstreamHealthCheck) EffectiveEnabled() bool {
+	if h == nil || h.Enabled == nil {
+		return true
+	}
+	return *h.Enabled
+}
+
+// UpstreamRoute forwards queries for some domains to dedicated servers (conditional forwarding).
+// "corp.internal" matches the domain and its subdomains, "*.corp.internal" only its subdomains.
+// When several routes match, the longest suffix wins.
+type UpstreamRoute struct {
+	Domains  []string `yaml:"domains"`
+	Servers  []string `yaml:"servers"`
+	Strategy string   `yaml:"strategy"` // defaults to upstream.strategy
 }
 
 // LoadConfig loads configuration from a YAML file
@@ -171,15 +356,158 @@ func LoadConfig(filePath string) (*Config, error) {
 	}
 
 	applyDNSCacheDefaults(&config.Cache)
+	if config.Server.ShutdownTimeout == "" {
+		config.Server.ShutdownTimeout = "10s"
+	}
+	if _, err := time.ParseDuration(config.Server.ShutdownTimeout); err != nil {
+		return nil, fmt.Errorf("server.shutdown_timeout: %w", err)
+	}
+	if config.Cache.MinTTL != "" {
+		if _, err := time.ParseDuration(config.Cache.MinTTL); err != nil {
+			return nil, fmt.Errorf("cache.min_ttl: %w", err)
+		}
+	}
+	if config.Cache.Prefetch.Threshold < 0 || config.Cache.Prefetch.Threshold >= 100 {
+		return nil, fmt.Errorf("cache.prefetch.threshold: must be a percentage between 1 and 99, got %d", config.Cache.Prefetch.Threshold)
+	}
+	if config.Cache.PersistInterval != "" {
+		if _, err := time.ParseDuration(config.Cache.PersistInterval); err != nil {
+			return nil, fmt.Errorf("cache.persist_interval: %w", err)
+		}
+	}
+	if config.Cache.ServeStale != "" {
+		if _, err := time.ParseDuration(config.Cache.ServeStale); err != nil {
+			return nil, fmt.Errorf("cache.serve_stale: %w", err)
+		}
+	}
 
 	// Set default system hosts file path if not disabled and not specified
 	if !config.SystemHosts.Disabled && config.SystemHosts.FilePath == "" {
 		config.SystemHosts.FilePath = "/etc/hosts"
 	}
+	if config.SystemHosts.Order == "" {
+		config.SystemHosts.Order = HostsOrderFixed
+	}
+	if !validHostsOrder(config.SystemHosts.Order) {
+		return nil, fmt.Errorf("system_hosts.order: unsupported value %q", config.SystemHosts.Order)
+	}
+
+	if config.Metrics.Listen == "" {
+		config.Metrics.Listen = "127.0.0.1:9153"
+	}
+	if config.Metrics.Path == "" {
+		config.Metrics.Path = "/metrics"
+	}
+
+	if config.Admin.Listen == "" {
+		config.Admin.Listen = "127.0.0.1:9154"
+	}
+	if config.Admin.Enabled && config.Admin.Token == "" {
+		return nil, fmt.Errorf("admin.token: required when the admin API is enabled")
+	}
+
+	if config.QueryLog.Output == "" {
+		config.QueryLog.Output = "stdout"
+	}
+	if config.QueryLog.MaxSizeMB == 0 {
+		config.QueryLog.MaxSizeMB = 100
+	}
+	if config.QueryLog.MaxBackups == 0 {
+		config.QueryLog.MaxBackups = 10
+	}
+	if config.QueryLog.RotateInterval != "" {
+		if _, err := time.ParseDuration(config.QueryLog.RotateInterval); err != nil {
+			return nil, fmt.Errorf("query_log.rotate_interval: %w", err)
+		}
+	}
+
+	if config.Filter.BlockResponse == "" {
+		config.Filter.BlockResponse = BlockResponseNXDomain
+	}
+	switch config.Filter.BlockResponse {
+	case BlockResponseNXDomain, BlockResponseNullIP, BlockResponseRefused:
+	default:
+		return nil, fmt.Errorf("filter.block_response: unsupported value %q (use %s, %s or %s)",
+			config.Filter.BlockResponse, BlockResponseNXDomain, BlockResponseNullIP, BlockResponseRefused)
+	}
+	if config.Filter.TTL == 0 {
+		config.Filter.TTL = 10
+	}
+
+	if config.Upstream.Strategy == "" {
+		config.Upstream.Strategy = UpstreamStrategyFailover
+	}
+	if !validUpstreamStrategy(config.Upstream.Strategy) {
+		return nil, fmt.Errorf("upstream.strategy: unsupported value %q", config.Upstream.Strategy)
+	}
+	if config.Upstream.HealthCheck.Interval == "" {
+		config.Upstream.HealthCheck.Interval = "10s"
+	}
+	if _, err := time.ParseDuration(config.Upstream.HealthCheck.Interval); err != nil {
+		return nil, fmt.Errorf("upstream.health_check.interval: %w", err)
+	}
+	if config.Upstream.HealthCheck.Domain == "" {
+		config.Upstream.HealthCheck.Domain = "."
+	}
+	if config.Upstream.HealthCheck.FailThreshold <= 0 {
+		config.Upstream.HealthCheck.FailThreshold = 2
+	}
+
+	for i, route := range config.Upstream.Routes {
+		if len(route.Domains) == 0 || len(route.Servers) == 0 {
+			return nil, fmt.Errorf("upstream.routes[%d]: domains and servers are required", i)
+		}
+		if route.Strategy != "" && !validUpstreamStrategy(route.Strategy) {
+			return nil, fmt.Errorf("upstream.routes[%d].strategy: unsupported value %q", i, route.Strategy)
+		}
+	}
+
+	for i, zone := range config.Zones {
+		if strings.TrimSpace(zone.File) == "" {
+			return nil, fmt.Errorf("zones[%d]: file is required", i)
+		}
+	}
+
+	// Reject hosts entries whose records cannot be parsed instead of failing every query later
+	if _, err := config.HostIndex(); err != nil {
+		return nil, fmt.Errorf("invalid hosts config: %w", err)
+	}
+
+	if err := config.applyViewDefaults(); err != nil {
+		return nil, err
+	}
+	if err := config.ACL.Query.applyDefaults("acl.query"); err != nil {
+		return nil, err
+	}
+	if err := config.ACL.Recursion.applyDefaults("acl.recursion"); err != nil {
+		return nil, err
+	}
+	if err := config.RateLimit.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if err := config.DNSSEC.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if err := config.DNS64.applyDefaults("dns64"); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
+// Clone returns a deep copy of the config.
+func (c *Config) Clone() (*Config, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var clone Config
+	if err := yaml.Unmarshal(data, &clone); err != nil {
+		return nil, err
+	}
+	return &clone, nil
+}
+
 // ParseHosts parses the hosts configuration into a map of domain to IP mappings
 func (c *Config) ParseHosts() (map[string]*HostMapping, error) {
 	hosts := make(map[string]*HostMapping)
@@ -220,6 +548,12 @@ func (c *Config) ParseHosts() (map[string]*HostMapping, error) {
 			Regex:      compiledRegex,
 		}
 
+		// yaml.v3 decodes nested mappings with the enclosing map type, so structured
+		// entries loaded from a file arrive as HostsConfig rather than map[string]interface{}
+		if nested, ok := value.(HostsConfig); ok {
+			value = map[string]interface{}(nested)
+		}
+
 		switch v := value.(type) {
 		case string:
 			// Compatible format:
@@ -251,33 +585,32 @@ func (c *Config) ParseHosts() (map[string]*HostMapping, error) {
 
 		case map[string]interface{}:
 			// Structured format: "example.com": {"a": [...], "aaaa": [...], "cname": "..."}
-			if aList, ok := v["a"].([]interface{}); ok {
-				for _, item := range aList {
-					ip := strings.TrimSpace(fmt.Sprintf("%v", item))
-					if parsedIP := net.ParseIP(ip); parsedIP != nil && parsedIP.To4() != nil {
-						mapping.IPv4 = append(mapping.IPv4, ip)
-					}
-				}
+			// Addresses are plain strings or {"value": "1.2.3.4", "weight": 5}.
+			policy := &HostPolicy{Weights: make(map[string]int)}
+			var err error
+			if mapping.IPv4, err = parseHostAddresses(v["a"], false, policy.Weights); err == nil {
+				mapping.IPv6, err = parseHostAddresses(v["aaaa"], true, policy.Weights)
 			}
-			if aaaaList, ok := v["aaaa"].([]interface{}); ok {
-				for _, item := range aaaaList {
-					ip := strings.TrimSpace(fmt.Sprintf("%v", item))
-					if parsedIP := net.ParseIP(ip); parsedIP != nil && parsedIP.To4() == nil {
-						mapping.IPv6 = append(mapping.IPv6, ip)
-					}
-				}
+			if err == nil {
+				err = policy.parse(v["order"], v["limit"])
 			}
-			// Also support single string values
-			if aStr, ok := v["a"].(string); ok {
-				ip := strings.TrimSpace(aStr)
-				if parsedIP := net.ParseIP(ip); parsedIP != nil && parsedIP.To4() != nil {
-					mapping.IPv4 = append(mapping.IPv4, ip)
+			if err != nil {
+				return nil, fmt.Errorf("host %s: %w", domain, err)
+			}
+			if policy.Order != HostsOrderFixed || policy.Limit > 0 {
+				mapping.Policy = policy
+			}
+			if raw, ok := v["health_check"]; ok {
+				if mapping.HealthCheck, err = parseHostHealthCheck(raw); err != nil {
+					return nil, fmt.Errorf("host %s: %w", domain, err)
 				}
 			}
-			if aaaaStr, ok := v["aaaa"].(string); ok {
-				ip := strings.TrimSpace(aaaaStr)
-				if parsedIP := net.ParseIP(ip); parsedIP != nil && parsedIP.To4() == nil {
-					mapping.IPv6 = append(mapping.IPv6, ip)
+			if raw, ok := v["fallback"]; ok {
+				if mapping.HealthCheck == nil {
+					return nil, fmt.Errorf("host %s: fallback requires a health_check", domain)
+				}
+				if mapping.Fallback, err = parseHostFallback(raw); err != nil {
+					return nil, fmt.Errorf("host %s: %w", domain, err)
 				}
 			}
 			if cnameStr, ok := v["cname"].(string); ok {
@@ -286,9 +619,30 @@ func (c *Config) ParseHosts() (map[string]*HostMapping, error) {
 					mapping.AliasTarget = alias
 				}
 			}
+			if ttl, ok := parseHostTTL(v["ttl"]); ok {
+				mapping.TTL = ttl
+			}
+			// Any other key naming an RR type (mx, txt, srv, ptr, ns, soa, caa, ...) carries
+			// records in presentation format, e.g. mx: ["10 mail.example.com"].
+			for key, raw := range v {
+				rrtype, ok := hostRecordType(key)
+				if !ok {
+					continue
+				}
+				records, err := parseHostRecords(rrtype, raw)
+				if err != nil {
+					return nil, fmt.Errorf("host %s: %w", domain, err)
+				}
+				if len(records) > 0 {
+					if mapping.Records == nil {
+						mapping.Records = make(map[uint16][]dns.RR)
+					}
+					mapping.Records[rrtype] = records
+				}
+			}
 		}
 
-		if len(mapping.IPv4) > 0 || len(mapping.IPv6) > 0 || mapping.AliasTarget != "" {
+		if len(mapping.IPv4) > 0 || len(mapping.IPv6) > 0 || mapping.AliasTarget != "" || len(mapping.Records) > 0 {
 			hosts[domainLower] = mapping
 		}
 	}
@@ -296,15 +650,41 @@ func (c *Config) ParseHosts() (map[string]*HostMapping, error) {
 	return hosts, nil
 }
 
-// MatchWildcard checks if a domain matches a wildcard pattern
-// This is exported so it can be used by the server command
+// HostPattern implements HostPattern for HostIndex.
+func (m *HostMapping) HostPattern() (string, bool, *regexp.Regexp) {
+	return m.Domain, m.IsWildcard, m.Regex
+}
+
+// HostAddresses implements HostAddresser for HostIndex.
+func (m *HostMapping) HostAddresses() []string {
+	return append(append([]string(nil), m.IPv4...), m.IPv6...)
+}
+
+// HostIndex returns the precompiled lookup index over the hosts configuration,
+// parsing Hosts the first time it is needed.
+func (c *Config) HostIndex() (*HostIndex[*HostMapping], error) {
+	if idx := c.hostIndex.Load(); idx != nil {
+		return idx, nil
+	}
+
+	hosts, err := c.ParseHosts()
+	if err != nil {
+		return nil, err
+	}
+	mappings := make([]*HostMapping, 0, len(hosts))
+	for _, mapping := range hosts {
+		mappings = append(mappings, mapping)
+	}
+
+	idx := NewHostIndex(mappings)
+	c.hostIndex.Store(idx)
+	return idx, nil
+}
+
+// MatchWildcard checks if a domain matches a wildcard pattern.
+// The pattern is compiled on every call; lookups on the query path go through HostIndex.
 func MatchWildcard(domain, pattern string) bool {
-	// Convert wildcard pattern to regex
-	// *.example.com -> ^.*\.example\.com$
-	// *.*.example.com -> ^.*\..*\.example\.com$
-	regexPattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), "\\*", ".*") + "$"
-	matched, _ := regexp.MatchString(regexPattern, domain)
-	return matched
+	return wildcardRegexp(pattern).MatchString(domain)
 }
 
 // IsIPv6 checks if an IP address is IPv6
@@ -313,109 +693,313 @@ func IsIPv6(ip string) bool {
 	return strings.Contains(ip, ":")
 }
 
-// LookupHost looks up a domain in the hosts configuration
-func (c *Config) LookupHost(domain string, queryType int) ([]string, error) {
-	hosts, err := c.ParseHosts()
+// findHostMapping returns the first mapping for domain accepted by want, trying exact
+// matches before wildcard and regex patterns.
+func (c *Config) findHostMapping(domain string, want func(*HostMapping) bool) (*HostMapping, error) {
+	idx, err := c.HostIndex()
 	if err != nil {
 		return nil, err
 	}
+	if mapping, ok := idx.Find(domain, want); ok {
+		return mapping, nil
+	}
+	return nil, fmt.Errorf("not found in hosts")
+}
 
-	domain = strings.ToLower(strings.TrimSpace(domain))
-	domainNoDot := strings.TrimSuffix(domain, ".")
-
-	// Try exact match first
-	if mapping, ok := hosts[domain]; ok && !mapping.IsWildcard && !mapping.IsRegex {
+// LookupHost looks up a domain in the hosts configuration
+func (c *Config) LookupHost(domain string, queryType int) ([]string, error) {
+	ipsOf := func(mapping *HostMapping) []string {
 		if queryType == 4 { // A record
-			if len(mapping.IPv4) > 0 {
-				return mapping.IPv4, nil
-			}
+			return mapping.addresses(false)
 		} else if queryType == 6 { // AAAA record
-			if len(mapping.IPv6) > 0 {
-				return mapping.IPv6, nil
-			}
+			return mapping.addresses(true)
 		}
+		return nil
 	}
 
-	// Try with trailing dot removed
-	if mapping, ok := hosts[domainNoDot]; ok && !mapping.IsWildcard && !mapping.IsRegex {
-		if queryType == 4 { // A record
-			if len(mapping.IPv4) > 0 {
-				return mapping.IPv4, nil
+	mapping, err := c.findHostMapping(domain, func(m *HostMapping) bool { return len(ipsOf(m)) > 0 })
+	if err != nil {
+		return nil, err
+	}
+	return mapping.Policy.Apply(ipsOf(mapping), queryType == 6), nil
+}
+
+// LookupRecords looks up records of any RR type for a domain in the hosts configuration.
+// A/AAAA records are built from the mapping's IPs, other types come from the structured format.
+// Owner names are set to domain, and records without an explicit TTL get the mapping TTL or defaultTTL.
+func (c *Config) LookupRecords(domain string, qtype uint16, defaultTTL uint32) ([]dns.RR, error) {
+	mapping, err := c.findHostMapping(domain, func(m *HostMapping) bool { return m.hasRecords(qtype) })
+	if err != nil {
+		return nil, err
+	}
+
+	return mapping.recordsFor(domain, qtype, defaultTTL), nil
+}
+
+// LookupTypes returns the RR types, sorted, that the hosts configuration has records of
+// for domain: those LookupRecords answers. Aliases are not included.
+func (c *Config) LookupTypes(domain string) []uint16 {
+	seen := make(map[uint16]bool)
+	c.findHostMapping(domain, func(m *HostMapping) bool {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if m.hasRecords(qtype) {
+				seen[qtype] = true
 			}
-		} else if queryType == 6 { // AAAA record
-			if len(mapping.IPv6) > 0 {
-				return mapping.IPv6, nil
+		}
+		for qtype, rrs := range m.Records {
+			if len(rrs) > 0 {
+				seen[qtype] = true
 			}
 		}
+		// Visit every matching mapping
+		return false
+	})
+	types := make([]uint16, 0, len(seen))
+	for qtype := range seen {
+		types = append(types, qtype)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// HasSubdomains reports whether hosts entries define names below domain.
+func (c *Config) HasSubdomains(domain string) bool {
+	idx, err := c.HostIndex()
+	if err != nil {
+		return false
 	}
+	return idx.HasSubdomains(domain)
+}
 
-	// Try wildcard and regex patterns
-	for pattern, mapping := range hosts {
-		var matched bool
+// LookupAddr returns PTR records naming the exact hosts entries that map to ip, owned
+// by the reverse name of ip. Records get the mapping TTL or defaultTTL.
+func (c *Config) LookupAddr(ip net.IP, defaultTTL uint32) ([]dns.RR, error) {
+	idx, err := c.HostIndex()
+	if err != nil {
+		return nil, err
+	}
+	mappings := idx.Reverse(ip)
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("not found in hosts")
+	}
 
-		if mapping.IsRegex && mapping.Regex != nil {
-			// Match against regex pattern
-			matched = mapping.Regex.MatchString(domain) || mapping.Regex.MatchString(domainNoDot)
-		} else if mapping.IsWildcard {
-			// Match against wildcard pattern
-			matched = MatchWildcard(domain, pattern) || MatchWildcard(domainNoDot, pattern)
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]dns.RR, 0, len(mappings))
+	for _, m := range mappings {
+		ttl := defaultTTL
+		if m.TTL > 0 {
+			ttl = m.TTL
 		}
+		out = append(out, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: dns.Fqdn(m.Domain),
+		})
+	}
+	return out, nil
+}
 
-		if matched {
-			if queryType == 4 { // A record
-				if len(mapping.IPv4) > 0 {
-					return mapping.IPv4, nil
-				}
-			} else if queryType == 6 { // AAAA record
-				if len(mapping.IPv6) > 0 {
-					return mapping.IPv6, nil
-				}
+func (m *HostMapping) hasRecords(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA:
+		return len(m.addresses(false)) > 0
+	case dns.TypeAAAA:
+		return len(m.addresses(true)) > 0
+	default:
+		return len(m.Records[qtype]) > 0
+	}
+}
+
+// recordsFor returns copies of the mapping's qtype records owned by name.
+func (m *HostMapping) recordsFor(name string, qtype uint16, defaultTTL uint32) []dns.RR {
+	ttl := defaultTTL
+	if m.TTL > 0 {
+		ttl = m.TTL
+	}
+	hdr := dns.RR_Header{Name: dns.Fqdn(strings.ToLower(strings.TrimSpace(name))), Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+
+	var out []dns.RR
+	switch qtype {
+	case dns.TypeA:
+		for _, ip := range m.Policy.Apply(m.addresses(false), false) {
+			out = append(out, &dns.A{Hdr: hdr, A: net.ParseIP(ip).To4()})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range m.Policy.Apply(m.addresses(true), true) {
+			out = append(out, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(ip).To16()})
+		}
+	default:
+		for _, rr := range m.Records[qtype] {
+			cp := dns.Copy(rr)
+			cp.Header().Name = hdr.Name
+			if cp.Header().Ttl == 0 {
+				cp.Header().Ttl = ttl
 			}
+			out = append(out, cp)
 		}
 	}
+	return out
+}
 
-	return nil, fmt.Errorf("not found in hosts")
+// hostRecordType maps a structured hosts key (mx, txt, srv, ...) to its RR type.
+// a, aaaa and cname have dedicated handling and are not reported here.
+func hostRecordType(key string) (uint16, bool) {
+	rrtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(key))]
+	if !ok {
+		return 0, false
+	}
+	switch rrtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
+		return 0, false
+	}
+	return rrtype, true
 }
 
-// LookupAlias looks up a domain alias target in the hosts configuration.
-// It supports exact, wildcard, and regex matching similar to LookupHost.
-func (c *Config) LookupAlias(domain string) (string, error) {
-	hosts, err := c.ParseHosts()
-	if err != nil {
-		return "", err
+// parseHostTTL reads a TTL in seconds from a YAML value.
+func parseHostTTL(value interface{}) (uint32, bool) {
+	switch v := value.(type) {
+	case int:
+		if v > 0 {
+			return uint32(v), true
+		}
+	case uint64:
+		if v > 0 {
+			return uint32(v), true
+		}
+	case float64:
+		if v > 0 {
+			return uint32(v), true
+		}
+	case string:
+		if n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32); err == nil && n > 0 {
+			return uint32(n), true
+		}
 	}
+	return 0, false
+}
 
-	domain = strings.ToLower(strings.TrimSpace(domain))
-	domainNoDot := strings.TrimSuffix(domain, ".")
+// parseHostAddresses parses the addresses listed under "a" (ipv6 false) or "aaaa" and
+// records the weight of those given as {"value": "...", "weight": 5}. Values that are
+// not addresses of the family are skipped.
+func parseHostAddresses(raw interface{}, ipv6 bool, weights map[string]int) ([]string, error) {
+	var items []interface{}
+	switch v := raw.(type) {
+	case []interface{}:
+		items = v
+	case nil:
+		return []string{}, nil
+	default:
+		items = []interface{}{v}
+	}
 
-	// Try exact match first
-	if mapping, ok := hosts[domain]; ok && !mapping.IsWildcard && !mapping.IsRegex {
-		if mapping.AliasTarget != "" {
-			return mapping.AliasTarget, nil
+	ips := []string{}
+	for _, item := range items {
+		weight := 0
+		if nested, ok := item.(HostsConfig); ok {
+			item = map[string]interface{}(nested)
+		}
+		if m, ok := item.(map[string]interface{}); ok {
+			item = m["value"]
+			if m["weight"] != nil {
+				w, ok := parseHostTTL(m["weight"]) // same positive integer forms as TTLs
+				if !ok {
+					return nil, fmt.Errorf("invalid weight %v for %v", m["weight"], item)
+				}
+				weight = int(w)
+			}
+		}
+		ip := strings.TrimSpace(fmt.Sprintf("%v", item))
+		if parsedIP := net.ParseIP(ip); parsedIP != nil && (parsedIP.To4() == nil) == ipv6 {
+			ips = append(ips, ip)
+			if weight > 0 && weights != nil {
+				weights[ip] = weight
+			}
 		}
 	}
+	return ips, nil
+}
 
-	// Try with trailing dot removed
-	if mapping, ok := hosts[domainNoDot]; ok && !mapping.IsWildcard && !mapping.IsRegex {
-		if mapping.AliasTarget != "" {
-			return mapping.AliasTarget, nil
-		}
+// parseHostRecords parses the records listed under an RR type key. Each item is either
+// the record data in presentation format or {"value": "...", "ttl": 60}.
+func parseHostRecords(rrtype uint16, raw interface{}) ([]dns.RR, error) {
+	var items []interface{}
+	switch v := raw.(type) {
+	case []interface{}:
+		items = v
+	case nil:
+		return nil, nil
+	default:
+		items = []interface{}{v}
 	}
 
-	// Try wildcard and regex patterns
-	for pattern, mapping := range hosts {
-		var matched bool
+	records := make([]dns.RR, 0, len(items))
+	for _, item := range items {
+		var value string
+		var ttl uint32
+		if nested, ok := item.(HostsConfig); ok {
+			item = map[string]interface{}(nested)
+		}
+		switch v := item.(type) {
+		case map[string]interface{}:
+			value = strings.TrimSpace(fmt.Sprintf("%v", v["value"]))
+			ttl, _ = parseHostTTL(v["ttl"])
+		default:
+			value = strings.TrimSpace(fmt.Sprintf("%v", v))
+		}
+		if value == "" {
+			continue
+		}
 
-		if mapping.IsRegex && mapping.Regex != nil {
-			matched = mapping.Regex.MatchString(domain) || mapping.Regex.MatchString(domainNoDot)
-		} else if mapping.IsWildcard {
-			matched = MatchWildcard(domain, pattern) || MatchWildcard(domainNoDot, pattern)
+		rr, err := newHostRecord(rrtype, value, ttl)
+		if err != nil {
+			return nil, err
 		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
 
-		if matched && mapping.AliasTarget != "" {
-			return mapping.AliasTarget, nil
+// newHostRecord builds an RR owned by "." from record data in presentation format.
+func newHostRecord(rrtype uint16, value string, ttl uint32) (dns.RR, error) {
+	typeName := dns.TypeToString[rrtype]
+	if rrtype == dns.TypeTXT && !strings.HasPrefix(value, `"`) {
+		value = quoteTXT(value)
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf(". %d IN %s %s", ttl, typeName, value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s record %q: %w", typeName, value, err)
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("invalid %s record %q", typeName, value)
+	}
+	return rr, nil
+}
+
+// quoteTXT quotes free-form text as TXT character-strings, splitting it into 255-byte chunks.
+func quoteTXT(text string) string {
+	var parts []string
+	for len(text) > 0 {
+		n := len(text)
+		if n > 255 {
+			n = 255
 		}
+		chunk := strings.ReplaceAll(text[:n], `\`, `\\`)
+		chunk = strings.ReplaceAll(chunk, `"`, `\"`)
+		parts = append(parts, `"`+chunk+`"`)
+		text = text[n:]
 	}
+	return strings.Join(parts, " ")
+}
 
-	return "", fmt.Errorf("not found in hosts")
+// LookupAlias looks up a domain alias target in the hosts configuration.
+// It supports exact, wildcard, and regex matching similar to LookupHost.
+func (c *Config) LookupAlias(domain string) (string, error) {
+	mapping, err := c.findHostMapping(domain, func(m *HostMapping) bool { return m.aliasTarget() != "" })
+	if err != nil {
+		return "", err
+	}
+	return mapping.aliasTarget(), nil
 }
@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -711,6 +713,36 @@ system_hosts:
 	}
 }
 
+func TestLoadConfig_SystemHosts_Order(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "test.yaml")
+
+	if err := os.WriteFile(configFile, []byte("server:\n  port: 53\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.SystemHosts.Order != HostsOrderFixed {
+		t.Errorf("Expected default order %s, got %s", HostsOrderFixed, cfg.SystemHosts.Order)
+	}
+
+	if err := os.WriteFile(configFile, []byte("system_hosts:\n  order: round_robin\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if cfg, err = LoadConfig(configFile); err != nil || cfg.SystemHosts.Order != HostsOrderRoundRobin {
+		t.Errorf("Expected round_robin order, got %v (err: %v)", cfg, err)
+	}
+
+	if err := os.WriteFile(configFile, []byte("system_hosts:\n  order: weighted\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for unsupported system_hosts.order")
+	}
+}
+
 func TestLoadConfig_SystemHosts_NotSpecified(t *testing.T) {
 	tmpDir := t.TempDir()
 	configFile := filepath.Join(tmpDir, "test.yaml")
@@ -995,3 +1027,397 @@ upstream:
 		t.Fatal("expected cache disabled")
 	}
 }
+
+func TestParseHosts_StructuredRecordTypes(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"example.com": map[string]interface{}{
+				"mx":  []interface{}{"10 mail.example.com", "20 mail2.example.com."},
+				"txt": "hello \"world\"",
+				"srv": []interface{}{map[string]interface{}{"value": "10 5 5060 sip.example.com", "ttl": 30}},
+				"caa": "0 issue \"letsencrypt.org\"",
+				"ttl": 120,
+			},
+		},
+	}
+
+	hosts, err := cfg.ParseHosts()
+	if err != nil {
+		t.Fatalf("Failed to parse hosts: %v", err)
+	}
+	mapping := hosts["example.com"]
+	if mapping == nil {
+		t.Fatal("expected example.com mapping")
+	}
+	if mapping.TTL != 120 {
+		t.Errorf("expected mapping TTL 120, got %d", mapping.TTL)
+	}
+	if len(mapping.Records[dns.TypeMX]) != 2 || len(mapping.Records[dns.TypeSRV]) != 1 || len(mapping.Records[dns.TypeCAA]) != 1 {
+		t.Fatalf("unexpected records: %v", mapping.Records)
+	}
+
+	rrs, err := cfg.LookupRecords("EXAMPLE.com.", dns.TypeMX, 500)
+	if err != nil {
+		t.Fatalf("Failed to lookup MX: %v", err)
+	}
+	if mx := rrs[1].(*dns.MX); mx.Hdr.Name != "example.com." || mx.Mx != "mail2.example.com." || mx.Hdr.Ttl != 120 {
+		t.Errorf("unexpected MX record %v", mx)
+	}
+
+	rrs, err = cfg.LookupRecords("example.com", dns.TypeSRV, 500)
+	if err != nil || rrs[0].Header().Ttl != 30 {
+		t.Errorf("expected per-record TTL 30, got %v (err %v)", rrs, err)
+	}
+
+	rrs, err = cfg.LookupRecords("example.com", dns.TypeTXT, 500)
+	// miekg/dns keeps TXT strings in escaped presentation form
+	if err != nil || rrs[0].(*dns.TXT).Txt[0] != `hello \"world\"` {
+		t.Errorf("unexpected TXT %v (err %v)", rrs, err)
+	}
+
+	if _, err := cfg.LookupRecords("example.com", dns.TypeNS, 500); err == nil {
+		t.Error("expected not found for NS")
+	}
+}
+
+func TestLookupRecords_WildcardAndDefaultTTL(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"*.svc.internal": map[string]interface{}{
+				"a":   "10.0.0.1",
+				"txt": "managed",
+			},
+		},
+	}
+
+	rrs, err := cfg.LookupRecords("api.svc.internal", dns.TypeA, 500)
+	if err != nil {
+		t.Fatalf("Failed to lookup A: %v", err)
+	}
+	if a := rrs[0].(*dns.A); a.Hdr.Name != "api.svc.internal." || a.Hdr.Ttl != 500 || a.A.String() != "10.0.0.1" {
+		t.Errorf("unexpected A record %v", a)
+	}
+
+	rrs, err = cfg.LookupRecords("api.svc.internal", dns.TypeTXT, 500)
+	if err != nil || rrs[0].Header().Name != "api.svc.internal." {
+		t.Errorf("unexpected TXT %v (err %v)", rrs, err)
+	}
+}
+
+func TestLoadConfig_InvalidHostRecord(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "bad-record.yaml")
+
+	configContent := `
+hosts:
+  "example.com":
+    mx: ["not-a-preference mail.example.com"]
+`
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for invalid MX record")
+	}
+}
+
+func TestLoadConfig_StructuredHostsFromYAML(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "structured.yaml")
+
+	configContent := `
+hosts:
+  "dual.example.com":
+    a: ["1.2.3.4"]
+    aaaa: ["2001:db8::1"]
+    mx:
+      - value: "10 mail.example.com"
+        ttl: 60
+`
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ips, err := cfg.LookupHost("dual.example.com", 6)
+	if err != nil || len(ips) != 1 || ips[0] != "2001:db8::1" {
+		t.Errorf("expected AAAA 2001:db8::1, got %v (err %v)", ips, err)
+	}
+	rrs, err := cfg.LookupRecords("dual.example.com", dns.TypeMX, 500)
+	if err != nil || len(rrs) != 1 || rrs[0].Header().Ttl != 60 {
+		t.Errorf("expected one MX with TTL 60, got %v (err %v)", rrs, err)
+	}
+}
+
+func TestLoadConfig_Zones(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "zones.yaml")
+
+	configContent := `
+zones:
+  - origin: "corp.internal"
+    file: "/etc/dns/corp.internal.zone"
+  - file: "/etc/dns/lab.internal.zone"
+`
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.Zones) != 2 || cfg.Zones[0].Origin != "corp.internal" || cfg.Zones[1].File != "/etc/dns/lab.internal.zone" {
+		t.Errorf("unexpected zones %+v", cfg.Zones)
+	}
+
+	if err := os.WriteFile(configFile, []byte("zones:\n  - origin: \"corp.internal\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for zone without file")
+	}
+}
+
+func TestLoadConfig_Filter(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "filter.yaml")
+
+	configContent := `
+filter:
+  blocklists: ["/etc/dns/ads.txt"]
+  allow: ["||ok.example.com^"]
+`
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.Filter.Enabled() || cfg.Filter.BlockResponse != BlockResponseNXDomain || cfg.Filter.TTL != 10 {
+		t.Errorf("unexpected filter defaults %+v", cfg.Filter)
+	}
+
+	if err := os.WriteFile(configFile, []byte("filter:\n  block_response: \"blackhole\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for unsupported block_response")
+	}
+}
+
+func TestLoadConfig_UpstreamRoutes(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "routes.yaml")
+
+	configContent := `
+upstream:
+  servers: ["https://dns.adguard.com/dns-query"]
+  routes:
+    - domains: ["corp.internal"]
+      servers: ["10.0.0.2:53"]
+    - domains: ["*.svc.cluster.local"]
+      servers: ["10.96.0.10:53"]
+`
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.Upstream.Routes) != 2 || cfg.Upstream.Routes[1].Domains[0] != "*.svc.cluster.local" || cfg.Upstream.Routes[1].Servers[0] != "10.96.0.10:53" {
+		t.Errorf("unexpected routes %+v", cfg.Upstream.Routes)
+	}
+
+	if err := os.WriteFile(configFile, []byte("upstream:\n  routes:\n    - domains: [\"corp.internal\"]\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for route without servers")
+	}
+}
+
+func TestLoadConfig_UpstreamStrategyAndHealthCheck(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "strategy.yaml")
+
+	if err := os.WriteFile(configFile, []byte("upstream:\n  servers: [\"10.0.0.1:53\", \"10.0.0.2:53\"]\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	hc := cfg.Upstream.HealthCheck
+	if cfg.Upstream.Strategy != UpstreamStrategyFailover || !hc.EffectiveEnabled() || hc.Interval != "10s" || hc.Domain != "." || hc.FailThreshold != 2 {
+		t.Errorf("unexpected upstream defaults %+v", cfg.Upstream)
+	}
+
+	configContent := `
+upstream:
+  strategy: "fastest"
+  health_check:
+    enabled: false
+  routes:
+    - domains: ["corp.internal"]
+      servers: ["10.0.0.2:53", "10.0.0.3:53"]
+      strategy: "parallel"
+`
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err = LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Upstream.Strategy != UpstreamStrategyFastest || cfg.Upstream.HealthCheck.EffectiveEnabled() || cfg.Upstream.Routes[0].Strategy != UpstreamStrategyParallel {
+		t.Errorf("unexpected upstream config %+v", cfg.Upstream)
+	}
+
+	for _, bad := range []string{
+		"upstream:\n  strategy: \"fastest-ever\"\n",
+		"upstream:\n  health_check:\n    interval: \"soon\"\n",
+		"upstream:\n  routes:\n    - domains: [\"a\"]\n      servers: [\"10.0.0.1:53\"]\n      strategy: \"nope\"\n",
+	} {
+		if err := os.WriteFile(configFile, []byte(bad), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil {
+			t.Errorf("Expected error for config %q", bad)
+		}
+	}
+}
+
+func TestLoadConfig_QueryLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "querylog.yaml")
+
+	if err := os.WriteFile(configFile, []byte("query_log:\n  enabled: true\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.QueryLog.Enabled || cfg.QueryLog.Output != "stdout" || cfg.QueryLog.MaxSizeMB != 100 || cfg.QueryLog.MaxBackups != 10 {
+		t.Errorf("unexpected query log defaults %+v", cfg.QueryLog)
+	}
+
+	if err := os.WriteFile(configFile, []byte("query_log:\n  output: \"/var/log/dns/queries.log\"\n  rotate_interval: \"daily\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for invalid rotate_interval")
+	}
+}
+
+func TestLoadConfig_CacheTTLBounds(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "cache.yaml")
+
+	if err := os.WriteFile(configFile, []byte("cache:\n  min_ttl: \"5s\"\n  serve_stale: \"24h\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Cache.MinTTL != "5s" || cfg.Cache.ServeStale != "24h" || cfg.Cache.PositiveTTL != DNSCachePositiveTTLDefault {
+		t.Errorf("unexpected cache config %+v", cfg.Cache)
+	}
+	if cfg.Cache.Prefetch.Enabled || cfg.Cache.Prefetch.Threshold != DNSCachePrefetchThresholdDefault || cfg.Cache.Prefetch.MinHits != DNSCachePrefetchMinHitsDefault {
+		t.Errorf("unexpected prefetch defaults %+v", cfg.Cache.Prefetch)
+	}
+
+	if cfg.Cache.PersistInterval != "" {
+		t.Errorf("persist_interval defaulted without persist_file: %q", cfg.Cache.PersistInterval)
+	}
+
+	if err := os.WriteFile(configFile, []byte("cache:\n  persist_file: \"/var/lib/dns/cache.json\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if cfg, err = LoadConfig(configFile); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Cache.PersistInterval != DNSCachePersistIntervalDefault {
+		t.Errorf("persist_interval = %q, want %q", cfg.Cache.PersistInterval, DNSCachePersistIntervalDefault)
+	}
+
+	for _, body := range []string{
+		"cache:\n  min_ttl: \"5\"\n",
+		"cache:\n  persist_file: \"c.json\"\n  persist_interval: \"often\"\n",
+		"cache:\n  serve_stale: \"1 day\"\n",
+		"cache:\n  prefetch:\n    enabled: true\n    threshold: 100\n",
+	} {
+		if err := os.WriteFile(configFile, []byte(body), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil {
+			t.Errorf("Expected error for %q", body)
+		}
+	}
+}
+
+func TestLoadConfig_ShutdownTimeout(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "shutdown.yaml")
+
+	if err := os.WriteFile(configFile, []byte("server:\n  port: 53\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Server.ShutdownTimeout != "10s" {
+		t.Errorf("shutdown_timeout = %q, want 10s", cfg.Server.ShutdownTimeout)
+	}
+
+	if err := os.WriteFile(configFile, []byte("server:\n  shutdown_timeout: \"soon\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for invalid shutdown_timeout")
+	}
+}
+
+func TestLoadConfig_Admin(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "admin.yaml")
+
+	if err := os.WriteFile(configFile, []byte("admin:\n  enabled: true\n  token: \"secret\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Admin.Listen != "127.0.0.1:9154" {
+		t.Errorf("admin.listen = %q, want 127.0.0.1:9154", cfg.Admin.Listen)
+	}
+
+	clone, err := cfg.Clone()
+	if err != nil {
+		t.Fatalf("Failed to clone config: %v", err)
+	}
+	clone.Admin.Token = "changed"
+	if cfg.Admin.Token != "secret" {
+		t.Error("Modifying the clone changed the original config")
+	}
+
+	if err := os.WriteFile(configFile, []byte("admin:\n  enabled: true\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("Expected error for admin API without a token")
+	}
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// DNS64Config synthesizes AAAA records from A records (RFC 6147) so that IPv6-only
+// clients behind a NAT64 gateway reach IPv4-only services:
+//
+//	dns64:
+//	  enabled: true
+//	  prefix: "64:ff9b::/96"          # the NAT64 prefix: /32, /40, /48, /56, /64 or /96
+//	  exclude: ["10.0.0.0/8"]         # IPv4 addresses never synthesized
+//
+// AAAA questions answered with no AAAA record (other than IPv4-mapped ones) are answered
+// with the A records of the name embedded in the prefix (RFC 6052), and PTR questions
+// for addresses of the prefix with the PTR records of the embedded IPv4 address.
+type DNS64Config struct {
+	Enabled bool     `yaml:"enabled"`
+	Prefix  string   `yaml:"prefix"`  // default DNS64PrefixDefault, the well-known prefix
+	Exclude []string `yaml:"exclude"` // IPv4 CIDRs or addresses
+}
+
+// DNS64PrefixDefault is the well-known NAT64 prefix (RFC 6052).
+const DNS64PrefixDefault = "64:ff9b::/96"
+
+// applyDefaults validates the prefix and the excluded networks of the section at key.
+func (c *DNS64Config) applyDefaults(key string) error {
+	c.Prefix = strings.TrimSpace(c.Prefix)
+	if c.Prefix == "" {
+		c.Prefix = DNS64PrefixDefault
+	}
+	if _, err := c.ParsePrefix(); err != nil {
+		return fmt.Errorf("%s.%w", key, err)
+	}
+	if _, err := c.ParseExclude(); err != nil {
+		return fmt.Errorf("%s.%w", key, err)
+	}
+	return nil
+}
+
+// ParsePrefix returns the NAT64 prefix, DNS64PrefixDefault when none is configured.
+func (c *DNS64Config) ParsePrefix() (netip.Prefix, error) {
+	s := c.Prefix
+	if s == "" {
+		s = DNS64PrefixDefault
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("prefix: invalid IPv6 prefix %q", s)
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return netip.Prefix{}, fmt.Errorf("prefix: length of %s must be 32, 40, 48, 56, 64 or 96", s)
+	}
+	// Bits 64 to 71 of the address are reserved (RFC 6052 section 2.2)
+	if prefix.Bits() == 96 && prefix.Addr().As16()[8] != 0 {
+		return netip.Prefix{}, fmt.Errorf("prefix: bits 64 to 71 of %s must be zero", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// ParseExclude returns the IPv4 networks whose addresses are not synthesized.
+func (c *DNS64Config) ParseExclude() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(c.Exclude))
+	for i, s := range c.Exclude {
+		s = strings.TrimSpace(s)
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(s); err == nil {
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil || !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("exclude[%d]: invalid IPv4 network %q", i, s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
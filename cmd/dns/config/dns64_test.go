@@ -0,0 +1,56 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig_DNS64(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "dns64.yaml")
+	content := `
+dns64:
+  enabled: true
+  exclude: ["10.0.0.0/8", " 192.0.2.1 "]
+views:
+  - name: lab
+    clients: ["2001:db8::/32"]
+    dns64:
+      enabled: true
+      prefix: "2001:db8:64::/48"
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.DNS64.Enabled || cfg.DNS64.Prefix != DNS64PrefixDefault {
+		t.Errorf("dns64 = %+v", cfg.DNS64)
+	}
+	exclude, err := cfg.DNS64.ParseExclude()
+	if err != nil || len(exclude) != 2 || exclude[1] != netip.MustParsePrefix("192.0.2.1/32") {
+		t.Errorf("exclude = %v, %v", exclude, err)
+	}
+	if prefix, err := cfg.Views[0].DNS64.ParsePrefix(); err != nil || prefix != netip.MustParsePrefix("2001:db8:64::/48") {
+		t.Errorf("view prefix = %v, %v", prefix, err)
+	}
+
+	for content, want := range map[string]string{
+		"dns64:\n  prefix: 192.0.2.0/24\n":                                         "dns64.prefix: invalid IPv6 prefix",
+		"dns64:\n  prefix: 64:ff9b::/80\n":                                         "dns64.prefix: length",
+		"dns64:\n  prefix: 64:ff9b:0:0:ff00::/96\n":                                "dns64.prefix: bits 64 to 71",
+		"dns64:\n  exclude: [2001:db8::/32]\n":                                     "dns64.exclude[0]: invalid IPv4 network",
+		"views:\n  - name: a\n    clients: [10.0.0.0/8]\n    dns64: {prefix: x}\n": "views[0].dns64.prefix",
+	} {
+		if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected %q, got %v", content, want, err)
+		}
+	}
+}
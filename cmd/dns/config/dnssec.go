@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECConfig enables DNSSEC validation of upstream answers:
+//
+//	dnssec:
+//	  validate: true
+//	  trust_anchors:                          # default: the root zone KSKs
+//	    - ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+//	  negative_trust_anchors: ["corp.example.com"]   # validated as unsigned
+//
+// Secure answers get the AD flag, bogus ones SERVFAIL unless the client sets CD.
+type DNSSECConfig struct {
+	Validate bool `yaml:"validate"`
+	// TrustAnchors are DS or DNSKEY records in master file format; the chain of trust of
+	// a name starts at the anchor of its closest enclosing zone.
+	TrustAnchors []string `yaml:"trust_anchors"`
+	// NegativeTrustAnchors are domains (and their subdomains) treated as unsigned, for
+	// private zones or broken signatures (RFC 7646).
+	NegativeTrustAnchors []string `yaml:"negative_trust_anchors"`
+	// Sign lists the zones whose local answers are signed.
+	Sign []DNSSECSignConfig `yaml:"sign"`
+}
+
+// DNSSECSignConfig signs the answers for a zone from the hosts, zones and overrides on
+// the fly, for clients setting DO:
+//
+//	sign:
+//	  - zone: corp.example.com
+//	    keys: [/etc/dns/Kcorp.example.com.+013+31407]   # BIND .key and .private files
+//	    nsec3: true
+//
+// Names in the zone are then only answered from local data, with proofs that the
+// others do not exist. Publish the DS of the key signing key in the parent zone, or
+// configure it as a trust anchor on the validating clients.
+type DNSSECSignConfig struct {
+	Zone string `yaml:"zone"`
+	// Keys are BIND key file pairs, by path with or without the .key or .private
+	// extension. Keys with the SEP flag (257) sign the DNSKEY RRset and the others every
+	// other RRset; a single kind of key signs both.
+	Keys []string `yaml:"keys"`
+	// NSEC3 denies existence with hashed names (RFC 5155) instead of NSEC records.
+	NSEC3 bool `yaml:"nsec3"`
+}
+
+// RootTrustAnchors are the DS records of the root zone key signing keys (KSK-2017 and
+// KSK-2024), used when no trust anchor is configured.
+var RootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// applyDefaults validates the trust anchors and normalizes the negative trust anchors
+// and the signed zones.
+func (c *DNSSECConfig) applyDefaults() error {
+	if _, err := c.ParseTrustAnchors(); err != nil {
+		return err
+	}
+	for i, domain := range c.NegativeTrustAnchors {
+		domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+		if domain == "" {
+			return fmt.Errorf("dnssec.negative_trust_anchors[%d]: empty domain", i)
+		}
+		c.NegativeTrustAnchors[i] = domain
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Sign {
+		sign := &c.Sign[i]
+		sign.Zone = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(sign.Zone), "."))
+		if sign.Zone == "" {
+			return fmt.Errorf("dnssec.sign[%d]: zone is required", i)
+		}
+		if seen[sign.Zone] {
+			return fmt.Errorf("dnssec.sign[%d]: zone %s is signed more than once", i, sign.Zone)
+		}
+		seen[sign.Zone] = true
+		if len(sign.Keys) == 0 {
+			return fmt.Errorf("dnssec.sign[%d]: keys are required", i)
+		}
+		for j, key := range sign.Keys {
+			sign.Keys[j] = strings.TrimSpace(key)
+		}
+	}
+	return nil
+}
+
+// ParseTrustAnchors returns the DS and DNSKEY records of TrustAnchors, or of
+// RootTrustAnchors when none is configured.
+func (c *DNSSECConfig) ParseTrustAnchors() ([]dns.RR, error) {
+	anchors := c.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = RootTrustAnchors
+	}
+	rrs := make([]dns.RR, 0, len(anchors))
+	for i, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("dnssec.trust_anchors[%d]: %w", i, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("dnssec.trust_anchors[%d]: want a DS or DNSKEY record, got %s", i, dns.TypeToString[rr.Header().Rrtype])
+		}
+		rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoadConfig_DNSSEC(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "dnssec.yaml")
+	content := `
+dnssec:
+  validate: true
+  negative_trust_anchors: ["Corp.Example.COM."]
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.DNSSEC.Validate || len(cfg.DNSSEC.NegativeTrustAnchors) != 1 || cfg.DNSSEC.NegativeTrustAnchors[0] != "corp.example.com" {
+		t.Errorf("dnssec = %+v", cfg.DNSSEC)
+	}
+
+	// The root KSKs are the default anchors
+	anchors, err := cfg.DNSSEC.ParseTrustAnchors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != len(RootTrustAnchors) {
+		t.Fatalf("anchors = %v", anchors)
+	}
+	for _, rr := range anchors {
+		if ds, ok := rr.(*dns.DS); !ok || ds.Hdr.Name != "." || ds.Algorithm != dns.RSASHA256 {
+			t.Errorf("unexpected root anchor %v", rr)
+		}
+	}
+}
+
+func TestLoadConfig_DNSSECInvalidTrustAnchor(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "dnssec.yaml")
+	for _, anchor := range []string{
+		"example.com. IN A 192.0.2.1",
+		"example.com. IN DS not-a-record",
+	} {
+		content := "dnssec:\n  validate: true\n  trust_anchors: [\"" + anchor + "\"]\n"
+		if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil || !strings.Contains(err.Error(), "dnssec.trust_anchors[0]") {
+			t.Errorf("%s: expected a trust anchor error, got %v", anchor, err)
+		}
+	}
+}
+
+func TestLoadConfig_DNSSECSign(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "dnssec.yaml")
+	content := `
+dnssec:
+  sign:
+    - zone: " Corp.Example.COM. "
+      keys: [" /etc/dns/Kcorp.example.com.+013+31407 "]
+      nsec3: true
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.DNSSEC.Sign) != 1 {
+		t.Fatalf("sign = %+v", cfg.DNSSEC.Sign)
+	}
+	if sign := cfg.DNSSEC.Sign[0]; sign.Zone != "corp.example.com" || sign.Keys[0] != "/etc/dns/Kcorp.example.com.+013+31407" || !sign.NSEC3 {
+		t.Errorf("sign = %+v", sign)
+	}
+
+	for content, want := range map[string]string{
+		"dnssec:\n  sign:\n    - keys: [k]\n":                                                         "zone is required",
+		"dnssec:\n  sign:\n    - zone: corp.example.com\n":                                            "keys are required",
+		"dnssec:\n  sign:\n    - {zone: a.example, keys: [k]}\n    - {zone: A.example., keys: [k]}\n": "signed more than once",
+	} {
+		if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected %q, got %v", content, want, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Probes supported by HostHealthCheck.Type
+const (
+	HostHealthCheckTCP  = "tcp"  // connect to the port
+	HostHealthCheckHTTP = "http" // GET the path and check the status
+)
+
+// HostHealthCheck probes the addresses of a structured hosts entry; addresses failing
+// it are left out of answers:
+//
+//	"db.example.com":
+//	  a: ["10.0.0.1", "10.0.0.2"]
+//	  health_check:
+//	    type: http          # tcp (default) or http
+//	    port: 8080          # required
+//	    path: /healthz      # http only, default /
+//	    status: 200         # http only, default any 2xx
+//	    interval: 10s       # default 10s
+//	    timeout: 2s         # default 2s
+//	    fail_threshold: 2   # consecutive failures before an address is down, default 2
+//	  fallback: ["10.1.0.1"]   # or an alias target, e.g. "db.standby.example.com"
+type HostHealthCheck struct {
+	Type          string
+	Port          int
+	Path          string
+	Status        int // 0 = any 2xx
+	Interval      time.Duration
+	Timeout       time.Duration
+	FailThreshold int
+}
+
+// parseHostHealthCheck reads the health_check key of a structured hosts entry.
+func parseHostHealthCheck(raw interface{}) (*HostHealthCheck, error) {
+	if nested, ok := raw.(HostsConfig); ok {
+		raw = map[string]interface{}(nested)
+	}
+	v, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("health_check: expected a mapping")
+	}
+
+	hc := &HostHealthCheck{
+		Type:          HostHealthCheckTCP,
+		Path:          "/",
+		Interval:      10 * time.Second,
+		Timeout:       2 * time.Second,
+		FailThreshold: 2,
+	}
+	if t, ok := v["type"]; ok {
+		hc.Type = strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", t)))
+	}
+	if hc.Type != HostHealthCheckTCP && hc.Type != HostHealthCheckHTTP {
+		return nil, fmt.Errorf("health_check.type: unsupported value %q", hc.Type)
+	}
+	port, ok := parseHostTTL(v["port"]) // same positive integer forms as TTLs
+	if !ok || port > 65535 {
+		return nil, fmt.Errorf("health_check.port: expected a port number, got %v", v["port"])
+	}
+	hc.Port = int(port)
+	if p, ok := v["path"]; ok {
+		hc.Path = strings.TrimSpace(fmt.Sprintf("%v", p))
+		if !strings.HasPrefix(hc.Path, "/") {
+			hc.Path = "/" + hc.Path
+		}
+	}
+	if s, ok := v["status"]; ok {
+		status, ok := parseHostTTL(s)
+		if !ok || status < 100 || status > 599 {
+			return nil, fmt.Errorf("health_check.status: expected an HTTP status, got %v", s)
+		}
+		hc.Status = int(status)
+	}
+	for key, d := range map[string]*time.Duration{"interval": &hc.Interval, "timeout": &hc.Timeout} {
+		s, ok := v[key]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(strings.TrimSpace(fmt.Sprintf("%v", s)))
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("health_check.%s: expected a positive duration, got %v", key, s)
+		}
+		*d = parsed
+	}
+	if f, ok := v["fail_threshold"]; ok {
+		n, ok := parseHostTTL(f)
+		if !ok {
+			return nil, fmt.Errorf("health_check.fail_threshold: expected a positive integer, got %v", f)
+		}
+		hc.FailThreshold = int(n)
+	}
+	return hc, nil
+}
+
+// parseHostFallback reads the fallback key of a structured hosts entry: addresses, an
+// alias target, or {"a": [...], "aaaa": [...], "cname": "..."}.
+func parseHostFallback(raw interface{}) (*HostMapping, error) {
+	if nested, ok := raw.(HostsConfig); ok {
+		raw = map[string]interface{}(nested)
+	}
+	if s, ok := raw.(string); ok && net.ParseIP(strings.TrimSpace(s)) != nil {
+		raw = []interface{}{s}
+	}
+
+	fallback := &HostMapping{}
+	var err error
+	switch v := raw.(type) {
+	case string:
+		fallback.AliasTarget = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(v, ".")))
+	case []interface{}:
+		if fallback.IPv4, err = parseHostAddresses(raw, false, nil); err == nil {
+			fallback.IPv6, err = parseHostAddresses(raw, true, nil)
+		}
+	case map[string]interface{}:
+		if fallback.IPv4, err = parseHostAddresses(v["a"], false, nil); err == nil {
+			fallback.IPv6, err = parseHostAddresses(v["aaaa"], true, nil)
+		}
+		if cname, ok := v["cname"].(string); ok {
+			fallback.AliasTarget = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(cname, ".")))
+		}
+	default:
+		return nil, fmt.Errorf("fallback: expected addresses or an alias target")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fallback: %w", err)
+	}
+	if len(fallback.IPv4) == 0 && len(fallback.IPv6) == 0 && fallback.AliasTarget == "" {
+		return nil, fmt.Errorf("fallback: expected addresses or an alias target")
+	}
+	return fallback, nil
+}
+
+// HostHealth tells whether the addresses of health-checked hosts entries pass their
+// check. It is kept by the health checker rather than by the config, so that it
+// outlives config reloads.
+type HostHealth interface {
+	Healthy(m *HostMapping, ip string) bool
+}
+
+// SetHealth makes h the source of the health of the entry's addresses. It must be set
+// before the entry is looked up concurrently.
+func (m *HostMapping) SetHealth(h HostHealth) {
+	m.health = h
+}
+
+// Healthy reports whether ip passes the entry's health check. Addresses are healthy
+// until a HostHealth says otherwise.
+func (m *HostMapping) Healthy(ip string) bool {
+	return m.health == nil || m.health.Healthy(m, ip)
+}
+
+// addresses returns the addresses answered for an A (ipv6 false) or AAAA query. With a
+// health check these are the healthy ones; when none is left, the fallback addresses,
+// nothing if the fallback is an alias target (see aliasTarget), else all of them
+// since a possibly down address beats no answer.
+func (m *HostMapping) addresses(ipv6 bool) []string {
+	ips := m.IPv4
+	if ipv6 {
+		ips = m.IPv6
+	}
+	if m.HealthCheck == nil || len(ips) == 0 {
+		return ips
+	}
+
+	healthy := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if m.Healthy(ip) {
+			healthy = append(healthy, ip)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	if m.Fallback != nil {
+		if fallback := m.Fallback.addresses(ipv6); len(fallback) > 0 {
+			return fallback
+		}
+		if m.Fallback.AliasTarget != "" {
+			return nil
+		}
+	}
+	return ips
+}
+
+// aliasTarget returns the alias target of the entry, or its fallback alias target
+// while every address of one family is down.
+func (m *HostMapping) aliasTarget() string {
+	if m.AliasTarget != "" || m.HealthCheck == nil || m.Fallback == nil || m.Fallback.AliasTarget == "" {
+		return m.AliasTarget
+	}
+	if len(m.IPv4) > 0 && len(m.addresses(false)) == 0 || len(m.IPv6) > 0 && len(m.addresses(true)) == 0 {
+		return m.Fallback.AliasTarget
+	}
+	return ""
+}
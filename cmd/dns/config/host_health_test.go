@@ -0,0 +1,146 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostHealthCheck_Parse(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"db.example.com": map[string]interface{}{
+				"a": []interface{}{"10.0.0.1", "10.0.0.2"},
+				"health_check": map[string]interface{}{
+					"type":     "HTTP",
+					"port":     8080,
+					"path":     "healthz",
+					"status":   204,
+					"interval": "5s",
+				},
+				"fallback": map[string]interface{}{"a": "10.1.0.1", "aaaa": []interface{}{"fd01::1"}},
+			},
+		},
+	}
+	idx, err := cfg.HostIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := idx.Find("db.example.com", func(*HostMapping) bool { return true })
+	want := HostHealthCheck{Type: HostHealthCheckHTTP, Port: 8080, Path: "/healthz", Status: 204, Interval: 5 * time.Second, Timeout: 2 * time.Second, FailThreshold: 2}
+	if m == nil || m.HealthCheck == nil || *m.HealthCheck != want {
+		t.Fatalf("health check = %+v, want %+v", m, want)
+	}
+	if m.Fallback == nil || !slices.Equal(m.Fallback.IPv4, []string{"10.1.0.1"}) || !slices.Equal(m.Fallback.IPv6, []string{"fd01::1"}) {
+		t.Fatalf("fallback = %+v", m.Fallback)
+	}
+}
+
+func TestHostHealthCheck_Invalid(t *testing.T) {
+	for name, entry := range map[string]map[string]interface{}{
+		"type":     {"a": "10.0.0.1", "health_check": map[string]interface{}{"type": "icmp", "port": 80}},
+		"port":     {"a": "10.0.0.1", "health_check": map[string]interface{}{}},
+		"status":   {"a": "10.0.0.1", "health_check": map[string]interface{}{"type": "http", "port": 80, "status": 42}},
+		"interval": {"a": "10.0.0.1", "health_check": map[string]interface{}{"port": 80, "interval": "soon"}},
+		"fallback": {"a": "10.0.0.1", "fallback": "10.1.0.1"},
+		"empty":    {"a": "10.0.0.1", "health_check": map[string]interface{}{"port": 80}, "fallback": []interface{}{}},
+	} {
+		cfg := &Config{Hosts: HostsConfig{"db.example.com": entry}}
+		if _, err := cfg.ParseHosts(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// testHostHealth is a HostHealth with the addresses marked down.
+type testHostHealth map[string]bool
+
+func (h testHostHealth) Healthy(_ *HostMapping, ip string) bool { return !h[ip] }
+
+func TestHostHealthCheck_FallbackAddresses(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"db.example.com": map[string]interface{}{
+				"a":            []interface{}{"10.0.0.1", "10.0.0.2"},
+				"health_check": map[string]interface{}{"port": 5432},
+				"fallback":     []interface{}{"10.1.0.1"},
+			},
+		},
+	}
+	idx, err := cfg.HostIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := idx.Find("db.example.com", func(*HostMapping) bool { return true })
+	lookup := func() []string {
+		t.Helper()
+		ips, err := cfg.LookupHost("db.example.com", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ips
+	}
+
+	if got := lookup(); !slices.Equal(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("all healthy: %v", got)
+	}
+	down := testHostHealth{}
+	m.SetHealth(down)
+	down["10.0.0.1"] = true
+	if got := lookup(); !slices.Equal(got, []string{"10.0.0.2"}) {
+		t.Fatalf("one down: %v", got)
+	}
+	down["10.0.0.2"] = true
+	if got := lookup(); !slices.Equal(got, []string{"10.1.0.1"}) {
+		t.Fatalf("all down: %v, want the fallback", got)
+	}
+	// The fallback has no IPv6 addresses and the entry none either
+	if ips, _ := cfg.LookupHost("db.example.com", 6); len(ips) != 0 {
+		t.Fatalf("AAAA = %v", ips)
+	}
+	delete(down, "10.0.0.1")
+	if got := lookup(); !slices.Equal(got, []string{"10.0.0.1"}) {
+		t.Fatalf("recovered: %v", got)
+	}
+}
+
+func TestHostHealthCheck_FallbackAlias(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"db.example.com": map[string]interface{}{
+				"a":            "10.0.0.1",
+				"health_check": map[string]interface{}{"port": 5432},
+				"fallback":     "db.standby.example.com.",
+			},
+			"api.example.com": map[string]interface{}{
+				"a":            "10.0.0.5",
+				"health_check": map[string]interface{}{"port": 443},
+			},
+		},
+	}
+	idx, err := cfg.HostIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := idx.Find("db.example.com", func(*HostMapping) bool { return true })
+	if target, _ := cfg.LookupAlias("db.example.com"); target != "" {
+		t.Fatalf("healthy entry aliased to %q", target)
+	}
+
+	db.SetHealth(testHostHealth{"10.0.0.1": true})
+	if target, _ := cfg.LookupAlias("db.example.com"); target != "db.standby.example.com" {
+		t.Fatalf("LookupAlias = %q, want the fallback target", target)
+	}
+	if rrs, _ := cfg.LookupRecords("db.example.com", 1, 60); len(rrs) != 0 {
+		t.Fatalf("down entry still answered %v", rrs)
+	}
+
+	// Without a fallback a down entry keeps answering its addresses
+	api, _ := idx.Find("api.example.com", func(*HostMapping) bool { return true })
+	api.SetHealth(testHostHealth{"10.0.0.5": true})
+	rrs, err := cfg.LookupRecords("api.example.com", 1, 60)
+	if err != nil || len(rrs) != 1 || !strings.HasSuffix(rrs[0].String(), "10.0.0.5") {
+		t.Fatalf("LookupRecords = %v, %v", rrs, err)
+	}
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HostPattern is implemented by host entries that can be placed in a HostIndex.
+type HostPattern interface {
+	// HostPattern returns the entry's lowercased domain or pattern, whether it is a
+	// wildcard pattern, and its compiled regex if it is a regex pattern.
+	HostPattern() (domain string, isWildcard bool, regex *regexp.Regexp)
+}
+
+// HostAddresser is implemented by host entries that map their domain to IP addresses.
+// Exact entries implementing it are also indexed by address for reverse lookups.
+type HostAddresser interface {
+	HostAddresses() []string
+}
+
+// HostIndex is an immutable lookup index over host entries, built once at load time:
+//   - exact domains in a map
+//   - "*.suffix" wildcards in a reversed-label suffix trie (most specific suffix wins)
+//   - regexes and other wildcard shapes (e.g. "api-*.example.com") as precompiled regexes
+//   - exact domains by IP address, for entries implementing HostAddresser
+type HostIndex[T HostPattern] struct {
+	exact    map[string][]T
+	suffixes *hostSuffixNode[T]
+	patterns []hostRegexEntry[T]
+	reverse  map[string][]T
+	parents  map[string]bool // ancestors of exact domains and "*.suffix" wildcards
+	entries  []T
+}
+
+type hostSuffixNode[T HostPattern] struct {
+	children  map[string]*hostSuffixNode[T]
+	wildcards []T // entries for "*.<labels down to this node>"
+}
+
+type hostRegexEntry[T HostPattern] struct {
+	regex *regexp.Regexp
+	entry T
+}
+
+// NewHostIndex builds an index over entries. Patterns that are tried after exact
+// matches are ordered deterministically: suffix wildcards by specificity, then the
+// remaining patterns sorted by their text.
+func NewHostIndex[T HostPattern](entries []T) *HostIndex[T] {
+	idx := &HostIndex[T]{
+		exact:    make(map[string][]T),
+		suffixes: &hostSuffixNode[T]{},
+		reverse:  make(map[string][]T),
+		parents:  make(map[string]bool),
+		entries:  entries,
+	}
+
+	var patterns []string
+	byPattern := make(map[string][]hostRegexEntry[T])
+	for _, entry := range entries {
+		domain, isWildcard, regex := entry.HostPattern()
+		switch {
+		case isWildcard:
+			if suffix, ok := wildcardSuffix(domain); ok {
+				idx.suffixes.insert(suffix, entry)
+				idx.addParents(suffix)
+				continue
+			}
+			regex = wildcardRegexp(domain)
+		case regex == nil:
+			idx.exact[domain] = append(idx.exact[domain], entry)
+			idx.addReverse(entry)
+			if labels := strings.Split(strings.TrimSuffix(domain, "."), "."); len(labels) > 1 {
+				idx.addParents(labels[1:])
+			}
+			continue
+		}
+		if regex == nil {
+			continue
+		}
+		if _, seen := byPattern[domain]; !seen {
+			patterns = append(patterns, domain)
+		}
+		byPattern[domain] = append(byPattern[domain], hostRegexEntry[T]{regex: regex, entry: entry})
+	}
+
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		idx.patterns = append(idx.patterns, byPattern[p]...)
+	}
+	for _, entries := range idx.reverse {
+		sort.SliceStable(entries, func(i, j int) bool {
+			di, _, _ := entries[i].HostPattern()
+			dj, _, _ := entries[j].HostPattern()
+			return di < dj
+		})
+	}
+	return idx
+}
+
+func (x *HostIndex[T]) addReverse(entry T) {
+	a, ok := any(entry).(HostAddresser)
+	if !ok {
+		return
+	}
+	for _, addr := range a.HostAddresses() {
+		if ip := net.ParseIP(strings.TrimSpace(addr)); ip != nil {
+			x.reverse[ip.String()] = append(x.reverse[ip.String()], entry)
+		}
+	}
+}
+
+// addParents marks the domain of labels and its ancestors as having subdomains.
+func (x *HostIndex[T]) addParents(labels []string) {
+	for i := range labels {
+		x.parents[strings.Join(labels[i:], ".")] = true
+	}
+}
+
+// HasSubdomains reports whether exact or "*.suffix" entries define names below domain.
+// Regex entries are not considered.
+func (x *HostIndex[T]) HasSubdomains(domain string) bool {
+	if x == nil {
+		return false
+	}
+	return x.parents[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")]
+}
+
+// Len returns the number of indexed entries.
+func (x *HostIndex[T]) Len() int {
+	if x == nil {
+		return 0
+	}
+	n := len(x.patterns) + x.suffixes.count()
+	for _, entries := range x.exact {
+		n += len(entries)
+	}
+	return n
+}
+
+// Entries returns the indexed entries.
+func (x *HostIndex[T]) Entries() []T {
+	if x == nil {
+		return nil
+	}
+	return x.entries
+}
+
+// Reverse returns the exact entries mapping a domain to ip, sorted by domain.
+func (x *HostIndex[T]) Reverse(ip net.IP) []T {
+	if x == nil || ip == nil {
+		return nil
+	}
+	return x.reverse[ip.String()]
+}
+
+// Find returns the first entry matching domain that want accepts, trying exact matches
+// before wildcard and regex patterns.
+func (x *HostIndex[T]) Find(domain string, want func(T) bool) (T, bool) {
+	var zero T
+	if x == nil {
+		return zero, false
+	}
+
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domainNoDot := strings.TrimSuffix(domain, ".")
+
+	// Try exact match first, then with trailing dot removed
+	for _, name := range []string{domain, domainNoDot} {
+		for _, entry := range x.exact[name] {
+			if want(entry) {
+				return entry, true
+			}
+		}
+	}
+
+	if entry, ok := x.suffixes.find(domainNoDot, want); ok {
+		return entry, true
+	}
+
+	for _, p := range x.patterns {
+		if (p.regex.MatchString(domain) || p.regex.MatchString(domainNoDot)) && want(p.entry) {
+			return p.entry, true
+		}
+	}
+
+	return zero, false
+}
+
+func (n *hostSuffixNode[T]) insert(suffix []string, entry T) {
+	node := n
+	for i := len(suffix) - 1; i >= 0; i-- {
+		child := node.children[suffix[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*hostSuffixNode[T])
+			}
+			child = &hostSuffixNode[T]{}
+			node.children[suffix[i]] = child
+		}
+		node = child
+	}
+	node.wildcards = append(node.wildcards, entry)
+}
+
+// find walks the labels of domain from the root and returns the entry of the deepest
+// wildcard accepted by want that still leaves at least one label for the "*".
+func (n *hostSuffixNode[T]) find(domain string, want func(T) bool) (T, bool) {
+	var zero T
+	if domain == "" {
+		return zero, false
+	}
+	labels := strings.Split(domain, ".")
+
+	var matches [][]T
+	node := n
+	for i := len(labels) - 1; i > 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			break
+		}
+		if len(node.wildcards) > 0 {
+			matches = append(matches, node.wildcards)
+		}
+	}
+
+	for i := len(matches) - 1; i >= 0; i-- {
+		for _, entry := range matches[i] {
+			if want(entry) {
+				return entry, true
+			}
+		}
+	}
+	return zero, false
+}
+
+func (n *hostSuffixNode[T]) count() int {
+	c := len(n.wildcards)
+	for _, child := range n.children {
+		c += child.count()
+	}
+	return c
+}
+
+// wildcardSuffix returns the labels after a leading "*." when that is the pattern's only
+// wildcard, e.g. "*.example.com" -> ["example", "com"].
+func wildcardSuffix(pattern string) ([]string, bool) {
+	pattern = strings.TrimSuffix(pattern, ".")
+	rest, ok := strings.CutPrefix(pattern, "*.")
+	if !ok || rest == "" || strings.Contains(rest, "*") {
+		return nil, false
+	}
+	labels := strings.Split(rest, ".")
+	for _, l := range labels {
+		if l == "" {
+			return nil, false
+		}
+	}
+	return labels, true
+}
+
+// wildcardRegexp compiles a wildcard pattern where "*" matches any characters.
+// *.example.com -> ^.*\.example\.com$
+// *.*.example.com -> ^.*\..*\.example\.com$
+func wildcardRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), "\\*", ".*") + "$")
+}
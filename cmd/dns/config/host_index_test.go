@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHostIndex_MostSpecificWildcardWins(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"*.example.com":             "1.1.1.1",
+			"*.svc.example.com":         "2.2.2.2",
+			"api-*.example.com":         "3.3.3.3",
+			"^db-\\d+\\.example\\.com$": "4.4.4.4",
+			"exact.svc.example.com":     "5.5.5.5",
+		},
+	}
+
+	cases := map[string]string{
+		"www.example.com":         "1.1.1.1",
+		"a.b.example.com":         "1.1.1.1",
+		"web.svc.example.com":     "2.2.2.2",
+		"x.y.svc.example.com.":    "2.2.2.2",
+		"exact.svc.example.com":   "5.5.5.5",
+		"db-12.example.com":       "1.1.1.1", // suffix wildcards are tried before regexes
+		"api-v1.example.com":      "1.1.1.1",
+		"api-v1.other.com":        "",
+		"example.com":             "",
+		"svc.example.com":         "1.1.1.1",
+		"WWW.EXAMPLE.COM":         "1.1.1.1",
+		"nothing.example.org":     "",
+		"api-v1.svc.example.com.": "2.2.2.2",
+	}
+	for name, want := range cases {
+		ips, err := cfg.LookupHost(name, 4)
+		got := ""
+		if err == nil {
+			got = ips[0]
+		}
+		if got != want {
+			t.Errorf("LookupHost(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHostIndex_PatternsWithoutSuffixWildcard(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"api-*.example.com":         "3.3.3.3",
+			"^db-\\d+\\.example\\.com$": "4.4.4.4",
+		},
+	}
+
+	for name, want := range map[string]string{
+		"api-v1.example.com": "3.3.3.3",
+		"db-12.example.com":  "4.4.4.4",
+		"db-x.example.com":   "",
+	} {
+		ips, err := cfg.LookupHost(name, 4)
+		got := ""
+		if err == nil {
+			got = ips[0]
+		}
+		if got != want {
+			t.Errorf("LookupHost(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHostIndex_FallsBackToLessSpecificWildcard(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"*.example.com":     HostsConfig{"aaaa": []interface{}{"2001:db8::1"}},
+			"*.svc.example.com": "2.2.2.2",
+		},
+	}
+
+	// The deeper wildcard has no AAAA record, so the shallower one answers
+	ips, err := cfg.LookupHost("web.svc.example.com", 6)
+	if err != nil || len(ips) != 1 || ips[0] != "2001:db8::1" {
+		t.Fatalf("got %v, %v", ips, err)
+	}
+}
+
+func TestHostIndex_Len(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"a.example.com":     "1.1.1.1",
+			"*.example.com":     "1.1.1.2",
+			"api-*.example.com": "1.1.1.3",
+			"^x\\.example$":     "1.1.1.4",
+		},
+	}
+	idx, err := cfg.HostIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", idx.Len())
+	}
+}
+
+func TestHostIndex_Reverse(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"b.example.com": []interface{}{"10.0.0.1", "fd00::1"},
+			"a.example.com": "10.0.0.1",
+			"*.example.com": "10.0.0.2",
+			"alias.example": "target.example.com",
+		},
+	}
+	idx, err := cfg.HostIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := idx.Reverse(net.ParseIP("10.0.0.1"))
+	if len(got) != 2 || got[0].Domain != "a.example.com" || got[1].Domain != "b.example.com" {
+		t.Errorf("Reverse(10.0.0.1) = %v", got)
+	}
+	if got := idx.Reverse(net.ParseIP("fd00:0::1")); len(got) != 1 || got[0].Domain != "b.example.com" {
+		t.Errorf("Reverse(fd00::1) = %v", got)
+	}
+	if got := idx.Reverse(net.ParseIP("10.0.0.2")); len(got) != 0 {
+		t.Errorf("wildcard entries must not be reversed, got %v", got)
+	}
+
+	rrs, err := cfg.LookupAddr(net.ParseIP("fd00::1"), 300)
+	if err != nil || len(rrs) != 1 {
+		t.Fatalf("LookupAddr(fd00::1) = %v, %v", rrs, err)
+	}
+	if ptr := rrs[0].(*dns.PTR); ptr.Ptr != "b.example.com." || ptr.Hdr.Name != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa." || ptr.Hdr.Ttl != 300 {
+		t.Errorf("unexpected PTR %v", ptr)
+	}
+	if _, err := cfg.LookupAddr(net.ParseIP("192.0.2.1"), 300); err == nil {
+		t.Error("expected unknown address to miss")
+	}
+}
+
+func BenchmarkLookupHost(b *testing.B) {
+	hosts := HostsConfig{}
+	for i := 0; i < 5000; i++ {
+		hosts[fmt.Sprintf("host-%d.example.com", i)] = "10.0.0.1"
+		hosts[fmt.Sprintf("*.zone-%d.example.com", i)] = "10.0.0.2"
+	}
+	cfg := &Config{Hosts: hosts}
+	if _, err := cfg.HostIndex(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cfg.LookupHost("www.zone-4999.example.com", 4); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHostIndex_SubdomainsAndTypes(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"a.b.example.com":  "10.0.0.1",
+			"*.svc.example.io": "10.0.0.2",
+			"mail.example.com": map[string]interface{}{"aaaa": "fd00::25", "mx": []interface{}{"10 mail.example.com"}},
+			"*.example.com":    map[string]interface{}{"txt": []interface{}{"wildcard"}},
+			"^db-\\d+\\.x$":    "10.0.0.3",
+		},
+	}
+	for name, want := range map[string]bool{
+		"b.example.com":   true,
+		"example.com.":    true,
+		"com":             true,
+		"svc.example.io":  true,
+		"a.b.example.com": false,
+		"x":               false,
+		"other.com":       false,
+	} {
+		if got := cfg.HasSubdomains(name); got != want {
+			t.Errorf("HasSubdomains(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	for name, want := range map[string][]uint16{
+		"mail.example.com": {dns.TypeMX, dns.TypeTXT, dns.TypeAAAA},
+		"a.b.example.com":  {dns.TypeA, dns.TypeTXT},
+		"db-1.x":           {dns.TypeA},
+		"missing.org":      {},
+	} {
+		if got := cfg.LookupTypes(name); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("LookupTypes(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// HostPolicy decides which addresses of a structured hosts entry are answered and in
+// which order:
+//
+//	"web.example.com":
+//	  a: ["10.0.0.1", {value: "10.0.0.2", weight: 3}]
+//	  order: weighted   # fixed (default), shuffle, round_robin or weighted
+//	  limit: 1          # answer at most 1 address, 0 = all
+//
+// Giving weights without an order selects weighted. A nil *HostPolicy answers every
+// address in the listed order.
+type HostPolicy struct {
+	Order   string         // HostsOrder*
+	Limit   int            // maximum number of addresses per answer, 0 = all
+	Weights map[string]int // per-address weights for HostsOrderWeighted, default 1
+
+	next [2]atomic.Uint32 // round-robin positions of the IPv4 and IPv6 addresses
+}
+
+// parse reads the "order" and "limit" keys of a structured hosts entry.
+func (p *HostPolicy) parse(order, limit interface{}) error {
+	switch {
+	case order != nil:
+		p.Order = strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", order)))
+	case len(p.Weights) > 0:
+		p.Order = HostsOrderWeighted
+	default:
+		p.Order = HostsOrderFixed
+	}
+	if p.Order != HostsOrderWeighted && !validHostsOrder(p.Order) {
+		return fmt.Errorf("unsupported order %q", p.Order)
+	}
+	if limit != nil {
+		n, ok := parseHostTTL(limit) // same positive integer forms as TTLs
+		if !ok {
+			return fmt.Errorf("invalid limit %v", limit)
+		}
+		p.Limit = int(n)
+	}
+	return nil
+}
+
+// Apply returns the addresses to answer from ips, all of one family, without
+// modifying ips.
+func (p *HostPolicy) Apply(ips []string, ipv6 bool) []string {
+	if p == nil {
+		return ips
+	}
+	next := &p.next[0]
+	if ipv6 {
+		next = &p.next[1]
+	}
+	out := OrderAddresses(ips, p.Order, next, p.weight)
+	if p.Limit > 0 && len(out) > p.Limit {
+		out = out[:p.Limit]
+	}
+	return out
+}
+
+func (p *HostPolicy) weight(ip string) int {
+	if w, ok := p.Weights[ip]; ok {
+		return w
+	}
+	return 1
+}
+
+// OrderAddresses returns ips in a HostsOrder* order without modifying ips. next holds
+// the round-robin position; weight gives the weight of an address for
+// HostsOrderWeighted and may be nil when every address weighs the same.
+func OrderAddresses(ips []string, order string, next *atomic.Uint32, weight func(ip string) int) []string {
+	if len(ips) < 2 {
+		return ips
+	}
+	out := make([]string, 0, len(ips))
+	switch order {
+	case HostsOrderRoundRobin:
+		start := int(next.Add(1)-1) % len(ips)
+		out = append(append(out, ips[start:]...), ips[:start]...)
+	case HostsOrderShuffle:
+		out = append(out, ips...)
+		rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	case HostsOrderWeighted:
+		// Weighted random order (Efraimidis-Spirakis): an address comes first with a
+		// probability proportional to its weight.
+		keys := make(map[string]float64, len(ips))
+		for _, ip := range ips {
+			w := 1
+			if weight != nil {
+				w = weight(ip)
+			}
+			keys[ip] = math.Pow(rand.Float64(), 1/float64(w))
+		}
+		out = append(out, ips...)
+		sort.SliceStable(out, func(i, j int) bool { return keys[out[i]] > keys[out[j]] })
+	default:
+		return ips
+	}
+	return out
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHostPolicy_RoundRobin(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"web.example.com": map[string]interface{}{
+				"a":     []interface{}{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+				"aaaa":  []interface{}{"fd00::1", "fd00::2"},
+				"order": "round_robin",
+			},
+		},
+	}
+
+	for _, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		ips, err := cfg.LookupHost("web.example.com", 4)
+		if err != nil || len(ips) != 3 || ips[0] != want {
+			t.Fatalf("LookupHost = %v, %v; want %s first", ips, err, want)
+		}
+		// IPv6 lookups rotate independently
+		if _, err := cfg.LookupHost("web.example.com", 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rrs, err := cfg.LookupRecords("web.example.com", 28, 60)
+	if err != nil || len(rrs) != 2 || !strings.HasSuffix(rrs[0].String(), "fd00::1") {
+		t.Fatalf("LookupRecords(AAAA) = %v, %v", rrs, err)
+	}
+}
+
+func TestHostPolicy_ShuffleLimit(t *testing.T) {
+	all := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"web.example.com": map[string]interface{}{
+				"a":     []interface{}{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				"order": "shuffle",
+				"limit": 2,
+			},
+		},
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		ips, err := cfg.LookupHost("web.example.com", 4)
+		if err != nil || len(ips) != 2 || ips[0] == ips[1] {
+			t.Fatalf("LookupHost = %v, %v; want 2 distinct addresses", ips, err)
+		}
+		for _, ip := range ips {
+			if !slices.Contains(all, ip) {
+				t.Fatalf("unexpected address %s", ip)
+			}
+			seen[ip] = true
+		}
+	}
+	if len(seen) != len(all) {
+		t.Errorf("random subsets only used %v", seen)
+	}
+}
+
+func TestHostPolicy_Weighted(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"web.example.com": map[string]interface{}{
+				"a": []interface{}{
+					map[string]interface{}{"value": "10.0.0.1", "weight": 9},
+					"10.0.0.2",
+				},
+				"limit": 1,
+			},
+		},
+	}
+
+	first := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		ips, err := cfg.LookupHost("web.example.com", 4)
+		if err != nil || len(ips) != 1 {
+			t.Fatalf("LookupHost = %v, %v", ips, err)
+		}
+		first[ips[0]]++
+	}
+	// 10.0.0.1 is expected first 90% of the time
+	if first["10.0.0.1"] < 1600 || first["10.0.0.2"] < 100 {
+		t.Errorf("weighted selection off: %v", first)
+	}
+}
+
+func TestHostPolicy_FixedByDefault(t *testing.T) {
+	cfg := &Config{
+		Hosts: HostsConfig{
+			"web.example.com": map[string]interface{}{"a": []interface{}{"10.0.0.1", "10.0.0.2"}},
+		},
+	}
+	idx, err := cfg.HostIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := idx.Find("web.example.com", func(*HostMapping) bool { return true }); m.Policy != nil {
+		t.Errorf("expected no policy, got %+v", m.Policy)
+	}
+	for i := 0; i < 3; i++ {
+		if ips, _ := cfg.LookupHost("web.example.com", 4); !slices.Equal(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+			t.Fatalf("LookupHost = %v", ips)
+		}
+	}
+}
+
+func TestHostPolicy_Invalid(t *testing.T) {
+	for name, entry := range map[string]map[string]interface{}{
+		"order":  {"a": "10.0.0.1", "order": "sticky"},
+		"limit":  {"a": "10.0.0.1", "limit": -1},
+		"weight": {"a": []interface{}{map[string]interface{}{"value": "10.0.0.1", "weight": 0}}},
+	} {
+		cfg := &Config{Hosts: HostsConfig{"web.example.com": entry}}
+		if _, err := cfg.ParseHosts(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
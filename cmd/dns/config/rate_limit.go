@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RateLimitConfig limits how fast clients may query and how often the same response
+// is sent to the same network:
+//
+//	rate_limit:
+//	  queries:                  # per client network token bucket, every protocol
+//	    rate: 50                # queries per second
+//	    burst: 100              # default rate
+//	    action: refuse          # drop (default), refuse or truncate
+//	  responses:                # response rate limiting (RRL), UDP only
+//	    rate: 5                 # identical responses per second per network
+//	    window: 15s             # how long excess responses are remembered
+//	    slip: 2                 # every 2nd limited response is sent truncated
+//	  exempt: ["127.0.0.1", "10.0.0.0/8"]
+type RateLimitConfig struct {
+	Queries   QueryRateLimit    `yaml:"queries"`
+	Responses ResponseRateLimit `yaml:"responses"`
+	Exempt    []string          `yaml:"exempt"` // CIDRs or addresses never limited
+}
+
+// QueryRateLimit is a token bucket per client network.
+type QueryRateLimit struct {
+	Rate       float64 `yaml:"rate"`        // queries per second, 0 = unlimited
+	Burst      int     `yaml:"burst"`       // bucket size, default Rate (at least 1)
+	IPv4Prefix int     `yaml:"ipv4_prefix"` // clients sharing this prefix share a bucket, default 32
+	IPv6Prefix int     `yaml:"ipv6_prefix"` // default 64
+	Action     string  `yaml:"action"`      // RateLimit*, default drop
+}
+
+// ResponseRateLimit is BIND-style response rate limiting: identical responses to one
+// network beyond Rate per second are dropped, except every Slip-th which is sent
+// truncated so that real clients retry over TCP. Responses are identical when they
+// answer the same name and type with the same rcode; NXDOMAIN responses of a zone and
+// error responses are grouped.
+type ResponseRateLimit struct {
+	Rate       float64 `yaml:"rate"`        // responses per second, 0 = unlimited
+	Window     string  `yaml:"window"`      // default 15s
+	Slip       *int    `yaml:"slip"`        // default 2, 0 = never, 1 = every limited response
+	IPv4Prefix int     `yaml:"ipv4_prefix"` // default 24
+	IPv6Prefix int     `yaml:"ipv6_prefix"` // default 56
+	Action     string  `yaml:"action"`      // RateLimit* for responses not slipped, default drop
+}
+
+// Actions taken on rate-limited queries and responses
+const (
+	RateLimitDrop     = "drop"     // send no response
+	RateLimitRefuse   = "refuse"   // answer REFUSED
+	RateLimitTruncate = "truncate" // answer empty with the TC flag (REFUSED over TCP, DoT, DoH and DoQ)
+)
+
+func validRateLimitAction(action string) bool {
+	switch action {
+	case RateLimitDrop, RateLimitRefuse, RateLimitTruncate:
+		return true
+	}
+	return false
+}
+
+// applyDefaults validates the rate limits and fills their omitted fields.
+func (r *RateLimitConfig) applyDefaults() error {
+	if _, err := (&ClientMatch{Clients: r.Exempt}).ClientPrefixes(); err != nil {
+		return fmt.Errorf("rate_limit.exempt: %w", err)
+	}
+
+	q := &r.Queries
+	if q.Rate < 0 || q.Burst < 0 {
+		return fmt.Errorf("rate_limit.queries: rate and burst must not be negative")
+	}
+	if q.Burst == 0 {
+		q.Burst = max(1, int(q.Rate))
+	}
+	if err := applyPrefixDefaults("rate_limit.queries", &q.IPv4Prefix, &q.IPv6Prefix, 32, 64); err != nil {
+		return err
+	}
+	if err := applyActionDefault("rate_limit.queries.action", &q.Action); err != nil {
+		return err
+	}
+
+	p := &r.Responses
+	if p.Rate < 0 {
+		return fmt.Errorf("rate_limit.responses.rate: must not be negative")
+	}
+	if p.Window == "" {
+		p.Window = "15s"
+	}
+	if d, err := time.ParseDuration(p.Window); err != nil || d <= 0 {
+		return fmt.Errorf("rate_limit.responses.window: expected a positive duration, got %q", p.Window)
+	}
+	if p.Slip == nil {
+		slip := 2
+		p.Slip = &slip
+	}
+	if *p.Slip < 0 {
+		return fmt.Errorf("rate_limit.responses.slip: must not be negative")
+	}
+	if err := applyPrefixDefaults("rate_limit.responses", &p.IPv4Prefix, &p.IPv6Prefix, 24, 56); err != nil {
+		return err
+	}
+	return applyActionDefault("rate_limit.responses.action", &p.Action)
+}
+
+// applyPrefixDefaults fills omitted client prefix lengths and checks them.
+func applyPrefixDefaults(name string, ipv4, ipv6 *int, def4, def6 int) error {
+	if *ipv4 == 0 {
+		*ipv4 = def4
+	}
+	if *ipv6 == 0 {
+		*ipv6 = def6
+	}
+	if *ipv4 < 0 || *ipv4 > 32 || *ipv6 < 0 || *ipv6 > 128 {
+		return fmt.Errorf("%s: prefix lengths must be within 1-32 (ipv4_prefix) and 1-128 (ipv6_prefix)", name)
+	}
+	return nil
+}
+
+// applyActionDefault normalizes a RateLimit* action, drop when omitted.
+func applyActionDefault(name string, action *string) error {
+	*action = strings.ToLower(strings.TrimSpace(*action))
+	if *action == "" {
+		*action = RateLimitDrop
+	}
+	if !validRateLimitAction(*action) {
+		return fmt.Errorf("%s: unsupported value %q", name, *action)
+	}
+	return nil
+}
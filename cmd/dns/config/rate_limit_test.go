@@ -0,0 +1,63 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig_RateLimit(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "rate_limit.yaml")
+	content := `
+rate_limit:
+  queries:
+    rate: 20
+    action: Refuse
+  responses:
+    rate: 5
+    slip: 0
+  exempt: ["127.0.0.1", "10.0.0.0/8"]
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	q := cfg.RateLimit.Queries
+	if q.Burst != 20 || q.IPv4Prefix != 32 || q.IPv6Prefix != 64 || q.Action != RateLimitRefuse {
+		t.Errorf("rate_limit.queries = %+v", q)
+	}
+	r := cfg.RateLimit.Responses
+	if r.Window != "15s" || r.Slip == nil || *r.Slip != 0 || r.IPv4Prefix != 24 || r.IPv6Prefix != 56 || r.Action != RateLimitDrop {
+		t.Errorf("rate_limit.responses = %+v", r)
+	}
+
+	// Omitted sections limit nothing but still get their defaults
+	if err := os.WriteFile(configFile, []byte("server:\n  port: 5353\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if cfg, err = LoadConfig(configFile); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.RateLimit.Queries.Rate != 0 || cfg.RateLimit.Responses.Slip == nil || *cfg.RateLimit.Responses.Slip != 2 {
+		t.Errorf("rate_limit defaults = %+v", cfg.RateLimit)
+	}
+
+	for name, rateLimit := range map[string]string{
+		"rate":   `{queries: {rate: -1}}`,
+		"action": `{queries: {rate: 10, action: delay}}`,
+		"prefix": `{responses: {rate: 5, ipv4_prefix: 33}}`,
+		"window": `{responses: {rate: 5, window: 0s}}`,
+		"slip":   `{responses: {rate: 5, slip: -1}}`,
+		"exempt": `{exempt: ["localhost"]}`,
+	} {
+		if err := os.WriteFile(configFile, []byte("rate_limit: "+rateLimit+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ViewConfig is a split-horizon view: queries from the clients it matches are answered
+// with its own hosts, upstreams and blocklists, so the same name can resolve to internal
+// addresses for internal networks only.
+//
+//	views:
+//	  - name: office
+//	    clients: ["10.0.0.0/8", "192.168.1.0/24"]
+//	    protocols: ["udp", "tcp"]        # optional, default every protocol
+//	    hosts:                           # checked before the top-level hosts
+//	      "git.corp.example.com": "10.0.0.20"
+//	    upstream:                        # replaces the top-level upstream
+//	      servers: ["10.0.0.53:53"]
+//	    filter: {}                       # replaces the top-level filter; {} blocks nothing
+//	    dns64: {enabled: true}           # replaces the top-level dns64
+//
+// Views are tried in order and the first match wins; queries matching no view use the
+// top-level settings. Zones, system hosts and admin overrides apply to every view.
+type ViewConfig struct {
+	Name        string           `yaml:"name"`
+	ClientMatch `yaml:",inline"` // the clients and protocols of the view
+	Hosts       HostsConfig      `yaml:"hosts"`
+	// Upstream, Filter and DNS64, when set, replace the top-level sections; omitted
+	// fields of Upstream default to the top-level ones.
+	Upstream *UpstreamConfig `yaml:"upstream"`
+	Filter   *FilterConfig   `yaml:"filter"`
+	DNS64    *DNS64Config    `yaml:"dns64"`
+}
+
+// applyViewDefaults validates the views and fills their omitted upstream and filter
+// fields from the top-level sections.
+func (c *Config) applyViewDefaults() error {
+	names := make(map[string]bool, len(c.Views))
+	for i := range c.Views {
+		v := &c.Views[i]
+		v.Name = strings.TrimSpace(v.Name)
+		if v.Name == "" {
+			return fmt.Errorf("views[%d]: name is required", i)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("views[%d]: duplicate name %q", i, v.Name)
+		}
+		names[v.Name] = true
+
+		if err := v.ClientMatch.validate(); err != nil {
+			return fmt.Errorf("views[%d].%w", i, err)
+		}
+
+		if _, err := (&Config{Hosts: v.Hosts}).HostIndex(); err != nil {
+			return fmt.Errorf("views[%d]: invalid hosts config: %w", i, err)
+		}
+
+		if u := v.Upstream; u != nil {
+			if len(u.Servers) == 0 {
+				return fmt.Errorf("views[%d].upstream.servers: required when upstream is set", i)
+			}
+			if u.Timeout == "" {
+				u.Timeout = c.Upstream.Timeout
+			}
+			if u.Strategy == "" {
+				u.Strategy = c.Upstream.Strategy
+			}
+			if !validUpstreamStrategy(u.Strategy) {
+				return fmt.Errorf("views[%d].upstream.strategy: unsupported value %q", i, u.Strategy)
+			}
+			hc := &u.HealthCheck
+			if hc.Enabled == nil {
+				hc.Enabled = c.Upstream.HealthCheck.Enabled
+			}
+			if hc.Interval == "" {
+				hc.Interval = c.Upstream.HealthCheck.Interval
+			}
+			if _, err := time.ParseDuration(hc.Interval); err != nil {
+				return fmt.Errorf("views[%d].upstream.health_check.interval: %w", i, err)
+			}
+			if hc.Domain == "" {
+				hc.Domain = c.Upstream.HealthCheck.Domain
+			}
+			if hc.FailThreshold <= 0 {
+				hc.FailThreshold = c.Upstream.HealthCheck.FailThreshold
+			}
+			for j, route := range u.Routes {
+				if len(route.Domains) == 0 || len(route.Servers) == 0 {
+					return fmt.Errorf("views[%d].upstream.routes[%d]: domains and servers are required", i, j)
+				}
+				if route.Strategy != "" && !validUpstreamStrategy(route.Strategy) {
+					return fmt.Errorf("views[%d].upstream.routes[%d].strategy: unsupported value %q", i, j, route.Strategy)
+				}
+			}
+		}
+
+		if f := v.Filter; f != nil {
+			if f.BlockResponse == "" {
+				f.BlockResponse = c.Filter.BlockResponse
+			}
+			switch f.BlockResponse {
+			case BlockResponseNXDomain, BlockResponseNullIP, BlockResponseRefused:
+			default:
+				return fmt.Errorf("views[%d].filter.block_response: unsupported value %q", i, f.BlockResponse)
+			}
+			if f.TTL == 0 {
+				f.TTL = c.Filter.TTL
+			}
+		}
+
+		if d := v.DNS64; d != nil {
+			if err := d.applyDefaults(fmt.Sprintf("views[%d].dns64", i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig_Views(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "views.yaml")
+	content := `
+upstream:
+  servers: ["1.1.1.1:53"]
+  strategy: fastest
+  timeout: 3s
+filter:
+  block_response: refused
+views:
+  - name: office
+    clients: ["10.0.0.0/8", "192.168.1.7"]
+    hosts:
+      "git.corp.example.com": "10.0.0.20"
+    upstream:
+      servers: ["10.0.0.53:53"]
+    filter: {}
+  - name: doh
+    protocols: ["DoH"]
+`
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.Views) != 2 {
+		t.Fatalf("expected 2 views, got %d", len(cfg.Views))
+	}
+
+	office := cfg.Views[0]
+	if u := office.Upstream; u == nil || u.Strategy != UpstreamStrategyFastest || u.Timeout != "3s" || u.HealthCheck.Interval != "10s" {
+		t.Errorf("view upstream defaults not applied: %+v", u)
+	}
+	if f := office.Filter; f == nil || f.Enabled() || f.BlockResponse != BlockResponseRefused {
+		t.Errorf("view filter = %+v, want an empty filter with the top-level block response", f)
+	}
+	if cfg.Views[1].Upstream != nil || cfg.Views[1].Filter != nil || cfg.Views[1].Protocols[0] != ProtocolDoH {
+		t.Errorf("doh view = %+v", cfg.Views[1])
+	}
+
+	clone, err := cfg.Clone()
+	if err != nil || len(clone.Views) != 2 || clone.Views[0].Hosts["git.corp.example.com"] != "10.0.0.20" {
+		t.Fatalf("Clone lost views: %+v, %v", clone, err)
+	}
+}
+
+func TestLoadConfig_ViewsInvalid(t *testing.T) {
+	for name, views := range map[string]string{
+		"name":      `[{clients: ["10.0.0.0/8"]}]`,
+		"duplicate": `[{name: a, clients: ["10.0.0.0/8"]}, {name: a, clients: ["10.1.0.0/16"]}]`,
+		"client":    `[{name: a, clients: ["office"]}]`,
+		"protocol":  `[{name: a, protocols: ["http"]}]`,
+		"match":     `[{name: a}]`,
+		"hosts":     `[{name: a, clients: ["10.0.0.0/8"], hosts: {"a.example.com": {mx: "bad"}}}]`,
+		"servers":   `[{name: a, clients: ["10.0.0.0/8"], upstream: {strategy: random}}]`,
+		"strategy":  `[{name: a, clients: ["10.0.0.0/8"], upstream: {servers: ["10.0.0.53"], strategy: best}}]`,
+		"response":  `[{name: a, clients: ["10.0.0.0/8"], filter: {block_response: drop}}]`,
+	} {
+		configFile := filepath.Join(t.TempDir(), "views.yaml")
+		if err := os.WriteFile(configFile, []byte("views: "+views+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if _, err := LoadConfig(configFile); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}